@@ -1,34 +1,165 @@
 package api
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
+	"strconv"
 	"time"
 
+	"bitbucket.org/jayflux/mypodcasts_injest/config"
+	"bitbucket.org/jayflux/mypodcasts_injest/leader"
+	"bitbucket.org/jayflux/mypodcasts_injest/logger"
+	"bitbucket.org/jayflux/mypodcasts_injest/metrics"
 	"bitbucket.org/jayflux/mypodcasts_injest/models"
+	"bitbucket.org/jayflux/mypodcasts_injest/store"
+	"bitbucket.org/jayflux/mypodcasts_injest/tracing"
+	"bitbucket.org/jayflux/mypodcasts_injest/validator"
 
 	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
 	// Needed for database/sql
 	_ "github.com/lib/pq"
 )
 
-// API Entrypoint to the API
-func API() {
+var log = logger.Log
+
+// Serve serves the API on listener until ctx is done, then waits up to api.shutdownGraceSeconds for requests to finish
+// Podcasts and episodes are read from stores
+func Serve(ctx context.Context, listener net.Listener, stores store.Stores) error {
+	server := &http.Server{Handler: Router(stores), ReadHeaderTimeout: 10 * time.Second}
+	// Serve returns as soon as Shutdown is called, drained is closed once requests have actually finished
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-ctx.Done()
+		log.Println("API: Shutting down, waiting for requests to finish")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Get().API.ShutdownGraceSeconds)*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Error(err)
+		}
+	}()
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+	<-drained
+	return nil
+}
+
+// Router has every API route on it, podcasts and episodes are read from stores
+func Router(stores store.Stores) *mux.Router {
 	router := mux.NewRouter()
+	router.Use(traceRequest, requestID, instrument, requestTimeout)
 	router.HandleFunc("/test", Test).Methods("GET")
+	// Submit a feed to be injested, then poll the job it returns, the job is run by a -worker
+	router.HandleFunc("/podcasts", submitPodcastHandler).Methods("POST")
+	router.HandleFunc("/jobs/{id}", jobHandler).Methods("GET")
 	// Get metadata about recently added podcasts
-	router.HandleFunc("/podcasts/new", newPodcastsHandler)
+	router.HandleFunc("/podcasts/new", newPodcastsHandler(stores.Podcasts))
 	// Get metadata about latest podcasts
-	router.HandleFunc("/podcasts/latest", latestPodcastsHandler)
+	router.HandleFunc("/podcasts/latest", latestPodcastsHandler(stores.Podcasts))
 	// Get metadata about podcast
-	router.HandleFunc("/podcasts/{podcast}", podcastHandler)
+	router.HandleFunc("/podcasts/{podcast}", podcastHandler(stores.Podcasts))
 	// Get metadata about individual episode
-	router.HandleFunc("/episodes/{podcast}", podcastEpisodeHandler)
+	router.HandleFunc("/episodes/{podcast}", podcastEpisodeHandler(stores.Episodes))
 	// Get multiple episodes from a podcast
-	router.HandleFunc("/podcasts/{podcast}/episodes", podcastEpisodesHandler)
-	log.Fatal(http.ListenAndServe("0.0.0.0:8060", router))
+	router.HandleFunc("/podcasts/{podcast}/episodes", podcastEpisodesHandler(stores.Episodes))
+	// Browse podcasts by the network directories file them under, e.g BBC Radio 4
+	router.HandleFunc("/networks", networksHandler).Methods("GET")
+	router.HandleFunc("/networks/{network}/podcasts", networkPodcastsHandler).Methods("GET")
+	// Get the change history of a podcast and its episodes
+	router.HandleFunc("/podcasts/{podcast}/history", podcastHistoryHandler).Methods("GET")
+	// Check a feed for problems, e.g /validate?url=https://example.com/feed.xml
+	router.HandleFunc("/validate", validateHandler).Methods("GET")
+	// Admin endpoints, these need api.adminToken as a bearer token and aren't served without it
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.Use(adminAuth)
+	// Where podcasts came from, per source and per podcast
+	admin.HandleFunc("/sources", sourcesHandler).Methods("GET")
+	admin.HandleFunc("/sources/{source}/uninjested", uninjestedSourcesHandler).Methods("GET")
+	admin.HandleFunc("/podcasts/{podcast}/sources", podcastSourcesHandler).Methods("GET")
+	// Which instance leads each scheduled job
+	admin.HandleFunc("/leaders", leadersHandler).Methods("GET")
+	// Export the catalog as OPML, e.g /opml?category=Comedy&language=en&active=true
+	router.HandleFunc("/opml", opmlHandler).Methods("GET")
+	return router
+}
+
+// requestTimeout cancels a request's context after api.requestTimeoutSeconds, so slow queries and fetches give up
+func requestTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(config.Get().API.RequestTimeoutSeconds)*time.Second)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestID gives each request an ID, or keeps the X-Request-ID it came with, and attaches it to the request's logger
+// It's sent back in X-Request-ID so a response can be matched to its log lines
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 64 {
+			id = uuid.NewV4().String()
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := logger.WithFields(r.Context(), logger.Fields{"request_id": id, "method": r.Method, "path": r.URL.Path})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// statusRecorder remembers the status a handler wrote so instrument can label with it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// instrument records how long each request took in metrics.APIRequestDuration, by route template rather than path
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		metrics.APIRequestDuration.WithLabelValues(routeTemplate(r), r.Method, strconv.Itoa(recorder.status)).Observe(time.Since(start).Seconds())
+	})
+}
+
+// traceRequest starts a span for each request, continuing the trace the caller sent in traceparent if there is one
+func traceRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracing.Span(ctx, r.Method+" "+routeTemplate(r), attribute.String("http.method", r.Method), attribute.String("http.target", r.URL.RequestURI()))
+		defer span.End()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.status_code", recorder.status))
+		if recorder.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
+
+// routeTemplate is the route r matched, e.g. /podcasts/{podcast}, so IDs don't end up in metric labels or span names
+func routeTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return "unknown"
 }
 
 // Test is a testing function
@@ -37,47 +168,200 @@ func Test(w http.ResponseWriter, r *http.Request) {
 }
 
 // Handle New Podcasts
-func newPodcastsHandler(w http.ResponseWriter, r *http.Request) {
-	podcasts := models.GetNewPodcasts()
-	podcastsJSON, _ := json.Marshal(podcasts)
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprint(w, string(podcastsJSON))
+func newPodcastsHandler(podcasts store.PodcastStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		newPodcasts, err := podcasts.NewPodcasts(r.Context())
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+		podcastsJSON, _ := json.Marshal(newPodcasts)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, string(podcastsJSON))
+	}
 }
 
 // Handle latest podcasts
-func latestPodcastsHandler(w http.ResponseWriter, r *http.Request) {
-	podcasts := models.GetUpdatedPodcasts()
+func latestPodcastsHandler(podcasts store.PodcastStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		updatedPodcasts, err := podcasts.UpdatedPodcasts(r.Context())
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+		podcastsJSON, _ := json.Marshal(updatedPodcasts)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, string(podcastsJSON))
+	}
+}
+
+// Handle the podcast homepage
+func podcastHandler(podcasts store.PodcastStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		podcast, err := podcasts.Podcast(r.Context(), vars["podcast"])
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+		podcastJSON, _ := json.Marshal(podcast)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, string(podcastJSON))
+	}
+}
+
+// Handle the podcast homepage
+func podcastEpisodeHandler(episodes store.EpisodeStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		podcast, err := episodes.Episode(r.Context(), vars["podcast"])
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+		podcastJSON, _ := json.Marshal(podcast)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, string(podcastJSON))
+	}
+}
+
+// Handle fetching episodes for a podcast
+func podcastEpisodesHandler(episodes store.EpisodeStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		q := r.URL.Query()
+		dateTime, _ := time.Parse(time.RFC3339, q.Get("datetime"))
+		podcast, err := episodes.Episodes(r.Context(), vars["podcast"], dateTime)
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+		podcastJSON, _ := json.Marshal(podcast)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, string(podcastJSON))
+	}
+}
+
+// storeError logs an error reading from a store and tells the client it failed
+func storeError(w http.ResponseWriter, r *http.Request, err error) {
+	logger.From(r.Context()).Error(err)
+	http.Error(w, "Could not read from the store", http.StatusInternalServerError)
+}
+
+// Handle listing networks
+func networksHandler(w http.ResponseWriter, r *http.Request) {
+	networks := models.GetNetworks(r.Context())
+	networksJSON, _ := json.Marshal(networks)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(networksJSON))
+}
+
+// Handle listing the podcasts in a network
+func networkPodcastsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	podcasts := models.GetNetworkPodcasts(r.Context(), vars["network"])
 	podcastsJSON, _ := json.Marshal(podcasts)
 	w.Header().Set("Content-Type", "application/json")
 	fmt.Fprint(w, string(podcastsJSON))
 }
 
-// Handle the podcast homepage
-func podcastHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	podcast := models.GetPodcast(vars["podcast"])
-	podcastJSON, _ := json.Marshal(podcast)
+// adminAuth checks the bearer token on admin endpoints
+// Without api.adminToken set they're turned off, rather than open to anyone
+func adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := config.Get().API.AdminToken
+		if token == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorised", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Handle summarising where podcasts came from
+func sourcesHandler(w http.ResponseWriter, r *http.Request) {
+	summaries := models.GetSourceSummaries(r.Context())
+	summariesJSON, _ := json.Marshal(summaries)
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprint(w, string(podcastJSON))
+	fmt.Fprint(w, string(summariesJSON))
 }
 
-// Handle the podcast homepage
-func podcastEpisodeHandler(w http.ResponseWriter, r *http.Request) {
+// Handle listing who holds each scheduled job's lease
+func leadersHandler(w http.ResponseWriter, r *http.Request) {
+	leases, err := leader.Leases()
+	if err != nil {
+		logger.From(r.Context()).Error(err)
+		http.Error(w, "Could not read leases", http.StatusInternalServerError)
+		return
+	}
+	leasesJSON, _ := json.Marshal(leases)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(leasesJSON))
+}
+
+// Handle listing feeds a source listed which never became podcasts
+func uninjestedSourcesHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	podcast := models.GetPodcastEpisode(vars["podcast"])
-	podcastJSON, _ := json.Marshal(podcast)
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	sources := models.GetUninjestedSources(r.Context(), vars["source"], limit)
+	sourcesJSON, _ := json.Marshal(sources)
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprint(w, string(podcastJSON))
+	fmt.Fprint(w, string(sourcesJSON))
+}
 
+// Handle listing where a podcast came from
+func podcastSourcesHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sources := models.GetPodcastSources(r.Context(), vars["podcast"])
+	sourcesJSON, _ := json.Marshal(sources)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(sourcesJSON))
 }
 
-// Handle fetching episodes for a podcast
-func podcastEpisodesHandler(w http.ResponseWriter, r *http.Request) {
+// Handle fetching the change history for a podcast
+func podcastHistoryHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	q := r.URL.Query()
-	dateTime, _ := time.Parse(time.RFC3339, q.Get("datetime"))
-	podcast := models.GetPodcastEpisodes(vars["podcast"], dateTime)
-	podcastJSON, _ := json.Marshal(podcast)
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	history := models.GetPodcastHistory(r.Context(), vars["podcast"], limit)
+	historyJSON, _ := json.Marshal(history)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(historyJSON))
+}
+
+// Handle validating a feed
+func validateHandler(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.Query().Get("url")
+	if url == "" {
+		http.Error(w, "url is required", http.StatusBadRequest)
+		return
+	}
+	report, err := validator.Validate(r.Context(), url)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	reportJSON, _ := json.Marshal(report)
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprint(w, string(podcastJSON))
+	fmt.Fprint(w, string(reportJSON))
+}
+
+// Handle exporting podcasts as OPML
+func opmlHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	active, _ := strconv.ParseBool(q.Get("active"))
+	doc := models.GetPodcastsOPML(r.Context(), models.PodcastFilter{Category: q.Get("category"), Language: q.Get("language"), Active: active})
+	w.Header().Set("Content-Type", "text/x-opml; charset=utf-8")
+	if err := doc.Write(w); err != nil {
+		logger.From(r.Context()).Error(err)
+	}
 }
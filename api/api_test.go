@@ -0,0 +1,88 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/config"
+	"bitbucket.org/jayflux/mypodcasts_injest/models"
+	"bitbucket.org/jayflux/mypodcasts_injest/store"
+)
+
+func TestAdminAuth(t *testing.T) {
+	handler := adminAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	api := &config.Get().API
+	defer func(token string) { api.AdminToken = token }(api.AdminToken)
+
+	tests := []struct {
+		token         string
+		authorization string
+		want          int
+	}{
+		// Without a token admin endpoints are off, whatever the request sends
+		{"", "", http.StatusNotFound},
+		{"", "Bearer ", http.StatusNotFound},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "Bearer secret", http.StatusOK},
+	}
+	for _, test := range tests {
+		api.AdminToken = test.token
+		r := httptest.NewRequest("GET", "/admin/sources", nil)
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("token %q with Authorization %q got %d, want %d", test.token, test.authorization, w.Code, test.want)
+		}
+	}
+}
+
+// downStores is the memory store with the reads the API makes failing, like a database that's gone away
+type downStores struct {
+	store.PodcastStore
+	store.EpisodeStore
+}
+
+var errDown = errors.New("connection refused")
+
+func (downStores) Podcast(ctx context.Context, id string) (models.Podcast, error) {
+	return models.Podcast{}, errDown
+}
+
+func (downStores) NewPodcasts(ctx context.Context) ([]models.Podcast, error) {
+	return nil, errDown
+}
+
+func (downStores) UpdatedPodcasts(ctx context.Context) ([]models.Podcast, error) {
+	return nil, errDown
+}
+
+func (downStores) Episode(ctx context.Context, id string) (models.PodcastEpisode, error) {
+	return models.PodcastEpisode{}, errDown
+}
+
+func (downStores) Episodes(ctx context.Context, podcastID string, since time.Time) ([]models.PodcastEpisode, error) {
+	return nil, errDown
+}
+
+func TestStoreErrors(t *testing.T) {
+	memory := store.NewMemory().Stores()
+	down := downStores{memory.Podcasts, memory.Episodes}
+	router := Router(store.Stores{Podcasts: down, Episodes: down, FetchState: memory.FetchState})
+	for _, path := range []string{"/podcasts/new", "/podcasts/latest", "/podcasts/abc", "/episodes/abc", "/podcasts/abc/episodes"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("%s got %d, want 500", path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/config"
+	"bitbucket.org/jayflux/mypodcasts_injest/injest"
+	"bitbucket.org/jayflux/mypodcasts_injest/logger"
+	"bitbucket.org/jayflux/mypodcasts_injest/queue"
+	"github.com/gorilla/mux"
+)
+
+// Job is a submitted feed waiting to be, or that has been, injested
+type Job struct {
+	ID      string `json:"id"`
+	FeedURL string `json:"feedUrl"`
+	// Status is queued, running, done or dead, a job that failed is queued again until it runs out of attempts
+	Status    string    `json:"status"`
+	Attempts  int       `json:"attempts"`
+	PodcastID string    `json:"podcastId,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// getJob returns a submission job from the queue, other types of job aren't visible through the API
+func getJob(id string) (*Job, error) {
+	queued, err := queue.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if queued.Type != queue.TypeInjestFeed {
+		return nil, sql.ErrNoRows
+	}
+	var payload injest.InjestFeedJob
+	var result injest.InjestFeedResult
+	json.Unmarshal(queued.Payload, &payload)
+	json.Unmarshal(queued.Result, &result)
+	return &Job{
+		ID:        queued.ID,
+		FeedURL:   payload.URL,
+		Status:    queued.Status,
+		Attempts:  queued.Attempts,
+		PodcastID: result.PodcastID,
+		Error:     queued.LastError,
+		CreatedAt: queued.CreatedAt,
+		UpdatedAt: queued.UpdatedAt,
+	}, nil
+}
+
+// rateLimiter allows each client a number of submissions per hour
+type rateLimiter struct {
+	sync.Mutex
+	windows map[string]*rateWindow
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+var submissionLimiter = &rateLimiter{windows: make(map[string]*rateWindow)}
+
+// allow records a submission from client, returning how long until it can submit again if it's over the limit
+func (l *rateLimiter) allow(client string, perHour int) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	for c, w := range l.windows {
+		if now.Sub(w.start) > time.Hour {
+			delete(l.windows, c)
+		}
+	}
+	w, ok := l.windows[client]
+	if !ok {
+		w = &rateWindow{start: now}
+		l.windows[client] = w
+	}
+	if w.count >= perHour {
+		return false, w.start.Add(time.Hour).Sub(now)
+	}
+	w.count++
+	return true, 0
+}
+
+// clientIP is who to rate limit, X-Forwarded-For is only trusted if api.trustProxy is set
+func clientIP(r *http.Request) string {
+	if config.Get().API.TrustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Handle a feed being submitted, e.g POST /podcasts {"url": "https://example.com/feed.xml"}
+func submitPodcastHandler(w http.ResponseWriter, r *http.Request) {
+	var submission struct {
+		URL string `json:"url"`
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&submission); err != nil {
+			http.Error(w, "body must be JSON with a url", http.StatusBadRequest)
+			return
+		}
+	} else {
+		submission.URL = r.FormValue("url")
+	}
+	url := strings.TrimSpace(submission.URL)
+	if url == "" || len(url) > 2048 {
+		http.Error(w, "url is required", http.StatusBadRequest)
+		return
+	}
+
+	if ok, retry := submissionLimiter.allow(clientIP(r), config.Get().API.Submissions.PerHour); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+		http.Error(w, "too many submissions, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	if err := injest.CheckPublicURL(url); err != nil {
+		http.Error(w, fmt.Sprintf("url can't be fetched: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if injest.KnownFeedURL(url) {
+		knownJSON, _ := json.Marshal(map[string]string{"status": "known", "podcastId": injest.PodcastIDForURL(url)})
+		fmt.Fprint(w, string(knownJSON))
+		return
+	}
+
+	if err := injest.RecordSources([]injest.SourceRecord{{FeedURL: url, Source: injest.SourceSubmission}}); err != nil {
+		logger.From(r.Context()).Error(err)
+		http.Error(w, "the feed couldn't be queued, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	id, err := injest.EnqueueInjest(url, queue.PriorityHigh)
+	if err != nil {
+		logger.From(r.Context()).Error(err)
+		http.Error(w, "the feed couldn't be queued, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	job, err := getJob(id)
+	if err != nil {
+		logger.From(r.Context()).Error(err)
+		http.Error(w, "the feed couldn't be queued, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	jobJSON, _ := json.Marshal(job)
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprint(w, string(jobJSON))
+}
+
+// Handle polling a submission job
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !injest.UUIDRegex.MatchString(vars["id"]) {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	job, err := getJob(vars["id"])
+	if err == sql.ErrNoRows {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.From(r.Context()).Error(err)
+		http.Error(w, "couldn't fetch the job", http.StatusInternalServerError)
+		return
+	}
+	jobJSON, _ := json.Marshal(job)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(jobJSON))
+}
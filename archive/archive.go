@@ -0,0 +1,129 @@
+// Package archive stores the raw feed bodies we download so they can be replayed later
+// Snapshots are gzipped and kept either on the local filesystem or in an S3 compatible bucket (DigitalOcean Spaces)
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/config"
+	"github.com/minio/minio-go"
+)
+
+// Store is somewhere we can keep snapshots
+type Store interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+}
+
+// FileStore keeps snapshots under a directory on the local filesystem
+type FileStore struct {
+	Dir string
+}
+
+// Put writes data to key, creating any directories needed
+func (s FileStore) Put(key string, data []byte) error {
+	path := filepath.Join(s.Dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// Get reads the data stored at key
+func (s FileStore) Get(key string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(s.Dir, filepath.FromSlash(key)))
+}
+
+// Delete removes key, it isn't an error if it has already gone
+func (s FileStore) Delete(key string) error {
+	err := os.Remove(filepath.Join(s.Dir, filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// BucketStore keeps snapshots in an S3 compatible bucket
+type BucketStore struct {
+	Client *minio.Client
+	Bucket string
+}
+
+// Put uploads data to key
+func (s BucketStore) Put(key string, data []byte) error {
+	_, err := s.Client.PutObject(s.Bucket, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{ContentType: "application/gzip"})
+	return err
+}
+
+// Get downloads the object at key
+func (s BucketStore) Get(key string) ([]byte, error) {
+	object, err := s.Client.GetObject(s.Bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+	return ioutil.ReadAll(object)
+}
+
+// Delete removes the object at key
+func (s BucketStore) Delete(key string) error {
+	return s.Client.RemoveObject(s.Bucket, key)
+}
+
+// NewStoreFromConfig returns the store configured under "archive" in config.json, the bucket backend uses the one under "spaces"
+// It returns nil if archiving is turned off
+func NewStoreFromConfig() (Store, error) {
+	settings := config.Get().Archive
+	if !settings.Enabled {
+		return nil, nil
+	}
+
+	switch settings.Backend {
+	case "bucket":
+		spaces := config.Get().Spaces
+		client, err := minio.New(spaces.Endpoint, spaces.Key, spaces.SecretKey, spaces.UseSSL)
+		if err != nil {
+			return nil, err
+		}
+		return BucketStore{Client: client, Bucket: spaces.Bucket}, nil
+	case "filesystem", "":
+		return FileStore{Dir: settings.Path}, nil
+	default:
+		return nil, fmt.Errorf("archive: unknown backend %q", settings.Backend)
+	}
+}
+
+// Key generates the key a snapshot of a podcast fetched at a time is stored under
+func Key(podcastID string, fetchedAt time.Time) string {
+	return fmt.Sprintf("feed-snapshots/%s/%s.xml.gz", podcastID, fetchedAt.UTC().Format("2006-01-02T15-04-05.000"))
+}
+
+// Compress gzips a feed body ready for storing
+func Compress(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress returns the feed body from a stored snapshot
+func Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
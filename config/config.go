@@ -0,0 +1,82 @@
+// Package config loads config.json, the environment and -set flags into viper, once, for every package that needs it
+// Most settings are read into a typed Config, see Get, with their defaults set here
+// The rest, e.g logging.*, are read with viper by the package using them, which sets their defaults with viper.SetDefault, before or after Load
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// EnvPrefix is prepended to a key to override it from the environment, e.g FANCAST_DATABASE_HOST for database.host
+const EnvPrefix = "FANCAST"
+
+var loadOnce sync.Once
+
+// Load reads config.json from the working directory, or the file -config names, panicking if it can't
+// Without config.json the defaults and the environment are used, so packages can be imported, e.g by tests, without one
+// Then -set key=value flags override what was read, calling it again does nothing
+// Packages load config as they're initialised, before main parses flags, so the flags are read from os.Args here
+func Load() {
+	loadOnce.Do(func() {
+		viper.SetConfigType("json")
+		files := flagValues(os.Args[1:], "config")
+		if len(files) > 0 {
+			viper.SetConfigFile(files[len(files)-1])
+		} else {
+			viper.SetConfigName("config") // name of config file (without extension)
+			viper.AddConfigPath(".")
+		}
+		viper.SetEnvPrefix(EnvPrefix)
+		viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+		viper.AutomaticEnv()
+		// The names the deployment already sets
+		viper.BindEnv("database.user", "DB_USER")
+		viper.BindEnv("database.database", "DB_NAME")
+		viper.BindEnv("database.password", "DB_PASS")
+		viper.BindEnv("database.host", "DB_HOST")
+		viper.BindEnv("database.port", "DB_PORT")
+		viper.BindEnv("database.sslMode", "DB_SSLMODE")
+		viper.BindEnv("spaces.key", "SPACES_KEY")
+		viper.BindEnv("spaces.secretKey", "SPACES_SECRET_KEY")
+		err := viper.ReadInConfig() // Find and read the config file
+		if _, notFound := err.(viper.ConfigFileNotFoundError); notFound && len(files) == 0 {
+			err = nil
+		}
+		if err != nil { // Handle errors reading the config file
+			panic(fmt.Errorf("Fatal error config file: %s \n", err))
+		}
+		for _, setting := range flagValues(os.Args[1:], "set") {
+			kv := strings.SplitN(setting, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				panic(fmt.Errorf("config: -set %s should be key=value", setting))
+			}
+			viper.Set(kv[0], kv[1])
+		}
+	})
+}
+
+// flagValues returns every value given to the flag called name in args, as -name value, -name=value or with --
+func flagValues(args []string, name string) []string {
+	values := make([]string, 0)
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--" {
+			break
+		}
+		arg := strings.TrimPrefix(strings.TrimPrefix(args[i], "-"), "-")
+		if arg == args[i] {
+			continue
+		}
+		if arg == name && i+1 < len(args) {
+			values = append(values, args[i+1])
+			i++
+		} else if strings.HasPrefix(arg, name+"=") {
+			values = append(values, strings.TrimPrefix(arg, name+"="))
+		}
+	}
+	return values
+}
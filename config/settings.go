@@ -0,0 +1,465 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	neturl "net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/sanitise"
+	"github.com/spf13/viper"
+)
+
+// Config is the typed view of the settings most of the application shares
+// Each field is read from its key in config.json, e.g database.host, which the environment and -set can override
+// Keys without a field here, e.g logging.* and tracing.*, are still read with viper by the package using them
+type Config struct {
+	Database  Database  `mapstructure:"database" json:"database"`
+	Spaces    Spaces    `mapstructure:"spaces" json:"spaces"`
+	Fetch     Fetch     `mapstructure:"fetch" json:"fetch"`
+	Limits    Limits    `mapstructure:"limits" json:"limits"`
+	Archive   Archive   `mapstructure:"archive" json:"archive"`
+	Injest    Injest    `mapstructure:"injest" json:"injest"`
+	ParseLog  ParseLog  `mapstructure:"parseLog" json:"parseLog"`
+	Discover  Discover  `mapstructure:"discover" json:"discover"`
+	Queue     Queue     `mapstructure:"queue" json:"queue"`
+	Scheduler Scheduler `mapstructure:"scheduler" json:"scheduler"`
+	Leader    Leader    `mapstructure:"leader" json:"leader"`
+	Cron      Cron      `mapstructure:"cron" json:"cron"`
+	API       API       `mapstructure:"api" json:"api"`
+	Serve     Serve     `mapstructure:"serve" json:"serve"`
+	Sanitise  Sanitise  `mapstructure:"sanitise" json:"sanitise"`
+}
+
+// Database is the Postgres server and how the pool uses it
+type Database struct {
+	// Host is empty to connect over the local socket
+	Host     string `mapstructure:"host" json:"host"`
+	Port     int    `mapstructure:"port" json:"port"`
+	SSLMode  string `mapstructure:"sslMode" json:"sslMode"`
+	User     string `mapstructure:"user" json:"user"`
+	Database string `mapstructure:"database" json:"database"`
+	Password string `mapstructure:"password" json:"password"`
+	// 0 is unlimited, some loops hold rows open while writing so a low limit can leave them waiting on each other
+	MaxOpenConns           int `mapstructure:"maxOpenConns" json:"maxOpenConns"`
+	MaxIdleConns           int `mapstructure:"maxIdleConns" json:"maxIdleConns"`
+	ConnMaxLifetimeSeconds int `mapstructure:"connMaxLifetimeSeconds" json:"connMaxLifetimeSeconds"`
+}
+
+// Spaces is the S3 compatible object storage database backups, and archived feeds if archive.backend is bucket, go to
+type Spaces struct {
+	Endpoint  string `mapstructure:"endpoint" json:"endpoint"`
+	Bucket    string `mapstructure:"bucket" json:"bucket"`
+	Key       string `mapstructure:"key" json:"key"`
+	SecretKey string `mapstructure:"secretKey" json:"secretKey"`
+	UseSSL    bool   `mapstructure:"useSSL" json:"useSSL"`
+	// BackupPrefix is where in the bucket database backups are kept
+	BackupPrefix string `mapstructure:"backupPrefix" json:"backupPrefix"`
+}
+
+// Fetch is how feeds, and anything else they link to, are requested
+type Fetch struct {
+	UserAgent             string `mapstructure:"userAgent" json:"userAgent"`
+	TimeoutSeconds        int    `mapstructure:"timeoutSeconds" json:"timeoutSeconds"`
+	ConnectTimeoutSeconds int    `mapstructure:"connectTimeoutSeconds" json:"connectTimeoutSeconds"`
+	TLSTimeoutSeconds     int    `mapstructure:"tlsTimeoutSeconds" json:"tlsTimeoutSeconds"`
+	// Proxy is a URL every request goes through, empty uses HTTP_PROXY and HTTPS_PROXY from the environment
+	Proxy string `mapstructure:"proxy" json:"proxy"`
+	// AllowPrivateAddresses lets feeds on a local network be fetched, e.g in development
+	AllowPrivateAddresses bool `mapstructure:"allowPrivateAddresses" json:"allowPrivateAddresses"`
+}
+
+// Limits cap what a feed can cost us, feeds are untrusted input and a huge or malicious one can exhaust the injester
+type Limits struct {
+	// ResponseBytes is the most of a response read, DecompressedBytes the most it can inflate to, larger feeds are truncated
+	ResponseBytes       int64 `mapstructure:"responseBytes" json:"responseBytes"`
+	DecompressedBytes   int64 `mapstructure:"decompressedBytes" json:"decompressedBytes"`
+	Items               int   `mapstructure:"items" json:"items"`
+	ParseTimeoutSeconds int   `mapstructure:"parseTimeoutSeconds" json:"parseTimeoutSeconds"`
+}
+
+// Archive is whether, and where, a snapshot of each feed fetched is kept
+type Archive struct {
+	Enabled bool `mapstructure:"enabled" json:"enabled"`
+	// Backend is filesystem, which writes under Path, or bucket, which uses the one under spaces
+	Backend   string           `mapstructure:"backend" json:"backend"`
+	Path      string           `mapstructure:"path" json:"path"`
+	Retention ArchiveRetention `mapstructure:"retention" json:"retention"`
+}
+
+// ArchiveRetention is how many of a podcast's snapshots are kept, the latest is kept whatever these say
+type ArchiveRetention struct {
+	MaxSnapshots int `mapstructure:"maxSnapshots" json:"maxSnapshots"`
+	MaxAgeDays   int `mapstructure:"maxAgeDays" json:"maxAgeDays"`
+}
+
+// Injest is how feeds are injested in bulk
+type Injest struct {
+	// Workers is how many feeds InjestAll fetches at once
+	Workers int `mapstructure:"workers" json:"workers"`
+}
+
+// ParseLog is how long parse results are kept, the parse report only looks back as far as this
+type ParseLog struct {
+	KeepDays int `mapstructure:"keepDays" json:"keepDays"`
+}
+
+// Discover is where new podcasts are found
+type Discover struct {
+	// BatchSize is how many candidates a streaming source is read in at a time
+	BatchSize int `mapstructure:"batchSize" json:"batchSize"`
+	// Sources are keyed by name, which is what -discover takes
+	Sources map[string]DiscoverSource `mapstructure:"sources" json:"sources"`
+}
+
+// DiscoverSource is how a source is set up, not every type uses every field
+type DiscoverSource struct {
+	Type string `mapstructure:"type" json:"type"`
+	// URL is where bbc sources fetch from
+	URL string `mapstructure:"url" json:"url,omitempty"`
+	// Path is the file dataset, podcastindex, opml and urls sources read, opml and urls also accept an http(s) URL
+	Path string `mapstructure:"path" json:"path,omitempty"`
+	// Format is tsv, csv or jsonl for datasets, if it's empty it's taken from the file extension
+	Format    string `mapstructure:"format" json:"format,omitempty"`
+	Delimiter string `mapstructure:"delimiter" json:"delimiter,omitempty"`
+	// Header is set if the first row of a tsv or csv dataset names the columns
+	Header  bool            `mapstructure:"header" json:"header,omitempty"`
+	Columns DiscoverColumns `mapstructure:"columns" json:"columns"`
+}
+
+// DiscoverColumns is where a dataset has each field, either a zero based index or a header name (or key for jsonl)
+type DiscoverColumns struct {
+	FeedURL  string `mapstructure:"feedUrl" json:"feedUrl,omitempty"`
+	Title    string `mapstructure:"title" json:"title,omitempty"`
+	ITunesID string `mapstructure:"itunesId" json:"itunesId,omitempty"`
+}
+
+// discoverTypes are the types of source discover can build
+var discoverTypes = []string{"bbc", "dataset", "podcastindex", "opml", "urls"}
+
+// Queue is how background jobs are claimed, retried and cleaned up
+type Queue struct {
+	Workers     int `mapstructure:"workers" json:"workers"`
+	MaxAttempts int `mapstructure:"maxAttempts" json:"maxAttempts"`
+	// A running job whose lease is older than this is assumed to have died with its worker, workers renew it at half this
+	VisibilityTimeoutSeconds int `mapstructure:"visibilityTimeoutSeconds" json:"visibilityTimeoutSeconds"`
+	PollIntervalSeconds      int `mapstructure:"pollIntervalSeconds" json:"pollIntervalSeconds"`
+	// A failed job waits BackoffSeconds, doubling with each attempt up to MaxBackoffSeconds, before it's retried
+	BackoffSeconds       int `mapstructure:"backoffSeconds" json:"backoffSeconds"`
+	MaxBackoffSeconds    int `mapstructure:"maxBackoffSeconds" json:"maxBackoffSeconds"`
+	KeepDoneDays         int `mapstructure:"keepDoneDays" json:"keepDoneDays"`
+	ShutdownGraceSeconds int `mapstructure:"shutdownGraceSeconds" json:"shutdownGraceSeconds"`
+}
+
+// Scheduler is how scheduled runs are looked after, each job's schedule is under schedules.<name>
+type Scheduler struct {
+	// A run whose heartbeat is older than this is assumed to have died with its process
+	StaleRunMinutes      int `mapstructure:"staleRunMinutes" json:"staleRunMinutes"`
+	ShutdownGraceSeconds int `mapstructure:"shutdownGraceSeconds" json:"shutdownGraceSeconds"`
+}
+
+// Leader is how instances agree which of them runs each scheduled job
+type Leader struct {
+	// LeaseSeconds is how long a lease lasts without being renewed, it's renewed at a third of this
+	LeaseSeconds int `mapstructure:"leaseSeconds" json:"leaseSeconds"`
+}
+
+// Cron is what the legacy -cron process runs
+type Cron struct {
+	// Cron only queues work, unless there are dedicated -worker processes RunWorkers runs it there too
+	RunWorkers bool `mapstructure:"runWorkers" json:"runWorkers"`
+}
+
+// API is where the API listens and the limits it puts on requests
+type API struct {
+	Addr                  string `mapstructure:"addr" json:"addr"`
+	RequestTimeoutSeconds int    `mapstructure:"requestTimeoutSeconds" json:"requestTimeoutSeconds"`
+	ShutdownGraceSeconds  int    `mapstructure:"shutdownGraceSeconds" json:"shutdownGraceSeconds"`
+	// TrustProxy takes the client's address from X-Forwarded-For, only set it behind a proxy which sets that header
+	TrustProxy bool `mapstructure:"trustProxy" json:"trustProxy"`
+	// AdminToken is the bearer token admin endpoints need, they're turned off if it's empty
+	AdminToken  string      `mapstructure:"adminToken" json:"adminToken"`
+	Submissions Submissions `mapstructure:"submissions" json:"submissions"`
+}
+
+// Submissions limits how many feeds each client can submit
+type Submissions struct {
+	PerHour int `mapstructure:"perHour" json:"perHour"`
+}
+
+// Serve is what -serve runs
+type Serve struct {
+	Roles []string `mapstructure:"roles" json:"roles"`
+	// HealthAddr is where /healthz, /readyz and /metrics are served, empty turns them off
+	HealthAddr string `mapstructure:"healthAddr" json:"healthAddr"`
+	// Image processing shells out to node and is heavy, so it gets its own, smaller, pool of workers
+	ImageWorkers int `mapstructure:"imageWorkers" json:"imageWorkers"`
+}
+
+// Sanitise is how titles and descriptions are cleaned up
+type Sanitise struct {
+	// SummaryLength is the most characters a plain-text summary can have
+	SummaryLength int `mapstructure:"summaryLength" json:"summaryLength"`
+	// ImageProxy is a URL prefix remote images in descriptions are rewritten through, empty leaves them as they are
+	ImageProxy string `mapstructure:"imageProxy" json:"imageProxy"`
+}
+
+// redacted replaces secrets when config is printed
+const redacted = "[redacted]"
+
+var (
+	current   *Config
+	currentMu sync.Mutex
+)
+
+func init() {
+	viper.SetDefault("database.host", "")
+	viper.SetDefault("database.port", 5432)
+	viper.SetDefault("database.sslMode", "require")
+	viper.SetDefault("database.user", "")
+	viper.SetDefault("database.database", "")
+	viper.SetDefault("database.password", "")
+	viper.SetDefault("database.maxOpenConns", 0)
+	viper.SetDefault("database.maxIdleConns", 5)
+	viper.SetDefault("database.connMaxLifetimeSeconds", 30*60)
+
+	viper.SetDefault("spaces.endpoint", "ams3.digitaloceanspaces.com")
+	viper.SetDefault("spaces.bucket", "fancast")
+	viper.SetDefault("spaces.key", "")
+	viper.SetDefault("spaces.secretKey", "")
+	viper.SetDefault("spaces.useSSL", true)
+	viper.SetDefault("spaces.backupPrefix", "database-backups/")
+
+	viper.SetDefault("fetch.userAgent", "Fancast (+https://fancast.uk)")
+	viper.SetDefault("fetch.timeoutSeconds", 10)
+	viper.SetDefault("fetch.connectTimeoutSeconds", 10)
+	viper.SetDefault("fetch.tlsTimeoutSeconds", 10)
+	viper.SetDefault("fetch.proxy", "")
+	viper.SetDefault("fetch.allowPrivateAddresses", false)
+
+	viper.SetDefault("limits.responseBytes", 20*1024*1024)
+	viper.SetDefault("limits.decompressedBytes", 50*1024*1024)
+	viper.SetDefault("limits.items", 3000)
+	viper.SetDefault("limits.parseTimeoutSeconds", 30)
+
+	// Archiving is off unless turned on in config.json
+	viper.SetDefault("archive.enabled", false)
+	viper.SetDefault("archive.backend", "filesystem")
+	viper.SetDefault("archive.path", "./feed-snapshots")
+	viper.SetDefault("archive.retention.maxSnapshots", 10)
+	viper.SetDefault("archive.retention.maxAgeDays", 365)
+
+	viper.SetDefault("injest.workers", 4)
+	viper.SetDefault("parseLog.keepDays", 90)
+
+	// The sources we had before there was a registry, these can be overridden or added to in config.json
+	viper.SetDefault("discover.sources.bbc.type", "bbc")
+	viper.SetDefault("discover.sources.bbc.url", "https://www.bbc.co.uk/podcasts.json")
+	viper.SetDefault("discover.sources.dataset.type", "dataset")
+	viper.SetDefault("discover.sources.dataset.path", "/var/local/all-podcasts-dataset/a.tsv")
+	viper.SetDefault("discover.sources.dataset.columns.feedUrl", "3")
+	viper.SetDefault("discover.sources.podcastindex.type", "podcastindex")
+	viper.SetDefault("discover.sources.podcastindex.path", "/var/local/podcastindex/podcastindex_feeds.db")
+	viper.SetDefault("discover.batchSize", 500)
+
+	viper.SetDefault("queue.workers", 4)
+	viper.SetDefault("queue.maxAttempts", 5)
+	viper.SetDefault("queue.visibilityTimeoutSeconds", 600)
+	viper.SetDefault("queue.pollIntervalSeconds", 2)
+	viper.SetDefault("queue.backoffSeconds", 30)
+	viper.SetDefault("queue.maxBackoffSeconds", 6*60*60)
+	viper.SetDefault("queue.keepDoneDays", 7)
+	viper.SetDefault("queue.shutdownGraceSeconds", 30)
+
+	viper.SetDefault("scheduler.staleRunMinutes", 5)
+	viper.SetDefault("scheduler.shutdownGraceSeconds", 60)
+
+	viper.SetDefault("leader.leaseSeconds", 60)
+	viper.SetDefault("cron.runWorkers", true)
+
+	viper.SetDefault("api.addr", "0.0.0.0:8060")
+	viper.SetDefault("api.requestTimeoutSeconds", 30)
+	viper.SetDefault("api.shutdownGraceSeconds", 15)
+	viper.SetDefault("api.trustProxy", false)
+	viper.SetDefault("api.adminToken", "")
+	viper.SetDefault("api.submissions.perHour", 10)
+
+	viper.SetDefault("serve.roles", []string{"api", "scheduler", "worker", "image-processor"})
+	viper.SetDefault("serve.healthAddr", "0.0.0.0:8061")
+	viper.SetDefault("serve.imageWorkers", 1)
+
+	viper.SetDefault("sanitise.summaryLength", sanitise.DefaultSummaryLength)
+	viper.SetDefault("sanitise.imageProxy", "")
+}
+
+// Get returns the typed config, reading it the first time it's called
+// It exits if a value can't be read as its type, e.g a port that isn't a number, Validate reports the rest
+func Get() *Config {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	if current == nil {
+		c, err := read()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		current = c
+	}
+	return current
+}
+
+// Validate reads the config and checks it, returning every problem found in one error
+func Validate() error {
+	c, err := read()
+	if err != nil {
+		return err
+	}
+	return c.Validate()
+}
+
+func read() (*Config, error) {
+	Load()
+	c := &Config{}
+	if err := viper.Unmarshal(c); err != nil {
+		return nil, fmt.Errorf("config: %s", err)
+	}
+	return c, nil
+}
+
+// Validate checks each value is one that can be used
+func (c *Config) Validate() error {
+	problems := make([]string, 0)
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Database.Port > 0 && c.Database.Port < 65536, "database.port must be between 1 and 65535, not %d", c.Database.Port)
+	sslModes := []string{"disable", "require", "verify-ca", "verify-full"}
+	check(contains(sslModes, c.Database.SSLMode), "database.sslMode must be one of %s, not %q", strings.Join(sslModes, ", "), c.Database.SSLMode)
+	check(c.Database.MaxOpenConns >= 0, "database.maxOpenConns can't be negative")
+	check(c.Database.MaxIdleConns >= 0, "database.maxIdleConns can't be negative")
+	check(c.Database.ConnMaxLifetimeSeconds >= 0, "database.connMaxLifetimeSeconds can't be negative")
+
+	check(c.Spaces.Endpoint != "", "spaces.endpoint is required")
+	check(!strings.Contains(c.Spaces.Endpoint, "://"), "spaces.endpoint is a host, not a URL, e.g ams3.digitaloceanspaces.com")
+	check(c.Spaces.Bucket != "", "spaces.bucket is required")
+	check((c.Spaces.Key == "") == (c.Spaces.SecretKey == ""), "spaces.key and spaces.secretKey must be set together")
+
+	check(c.Fetch.UserAgent != "", "fetch.userAgent is required")
+	check(c.Fetch.TimeoutSeconds > 0, "fetch.timeoutSeconds must be more than 0")
+	check(c.Fetch.ConnectTimeoutSeconds > 0, "fetch.connectTimeoutSeconds must be more than 0")
+	check(c.Fetch.TLSTimeoutSeconds > 0, "fetch.tlsTimeoutSeconds must be more than 0")
+	if c.Fetch.Proxy != "" {
+		proxy, err := neturl.Parse(c.Fetch.Proxy)
+		check(err == nil && proxy.Scheme != "" && proxy.Host != "", "fetch.proxy must be a URL, e.g http://proxy:3128, not %q", c.Fetch.Proxy)
+	}
+
+	check(c.Limits.ResponseBytes > 0, "limits.responseBytes must be more than 0")
+	check(c.Limits.DecompressedBytes > 0, "limits.decompressedBytes must be more than 0")
+	check(c.Limits.Items > 0, "limits.items must be more than 0")
+	check(c.Limits.ParseTimeoutSeconds > 0, "limits.parseTimeoutSeconds must be more than 0")
+
+	backends := []string{"filesystem", "bucket"}
+	check(contains(backends, c.Archive.Backend), "archive.backend must be one of %s, not %q", strings.Join(backends, ", "), c.Archive.Backend)
+	check(!c.Archive.Enabled || c.Archive.Backend != "filesystem" || c.Archive.Path != "", "archive.path is required to archive to the filesystem")
+	check(c.Archive.Retention.MaxSnapshots >= 0, "archive.retention.maxSnapshots can't be negative")
+	check(c.Archive.Retention.MaxAgeDays >= 0, "archive.retention.maxAgeDays can't be negative")
+
+	check(c.Injest.Workers > 0, "injest.workers must be more than 0")
+	check(c.ParseLog.KeepDays > 0, "parseLog.keepDays must be more than 0")
+
+	check(c.Discover.BatchSize > 0, "discover.batchSize must be more than 0")
+	for _, name := range sortedKeys(c.Discover.Sources) {
+		source := c.Discover.Sources[name]
+		check(contains(discoverTypes, source.Type), "discover.sources.%s.type must be one of %s, not %q", name, strings.Join(discoverTypes, ", "), source.Type)
+		if source.Type == "bbc" {
+			check(source.URL != "", "discover.sources.%s.url is required", name)
+		} else if source.Type != "" {
+			check(source.Path != "", "discover.sources.%s.path is required", name)
+		}
+	}
+
+	check(c.Queue.Workers > 0, "queue.workers must be more than 0")
+	check(c.Queue.MaxAttempts > 0, "queue.maxAttempts must be more than 0")
+	check(c.Queue.VisibilityTimeoutSeconds > 0, "queue.visibilityTimeoutSeconds must be more than 0")
+	check(c.Queue.PollIntervalSeconds > 0, "queue.pollIntervalSeconds must be more than 0")
+	check(c.Queue.BackoffSeconds > 0, "queue.backoffSeconds must be more than 0")
+	check(c.Queue.MaxBackoffSeconds >= c.Queue.BackoffSeconds, "queue.maxBackoffSeconds can't be less than queue.backoffSeconds")
+	check(c.Queue.KeepDoneDays >= 0, "queue.keepDoneDays can't be negative")
+	check(c.Queue.ShutdownGraceSeconds >= 0, "queue.shutdownGraceSeconds can't be negative")
+
+	check(c.Scheduler.StaleRunMinutes > 0, "scheduler.staleRunMinutes must be more than 0")
+	check(c.Scheduler.ShutdownGraceSeconds >= 0, "scheduler.shutdownGraceSeconds can't be negative")
+
+	check(c.Leader.LeaseSeconds > 0, "leader.leaseSeconds must be more than 0")
+
+	check(validAddr(c.API.Addr), "api.addr must be host:port, not %q", c.API.Addr)
+	check(c.API.RequestTimeoutSeconds > 0, "api.requestTimeoutSeconds must be more than 0")
+	check(c.API.ShutdownGraceSeconds >= 0, "api.shutdownGraceSeconds can't be negative")
+	check(c.API.Submissions.PerHour >= 0, "api.submissions.perHour can't be negative")
+
+	check(c.Serve.HealthAddr == "" || validAddr(c.Serve.HealthAddr), "serve.healthAddr must be host:port or empty, not %q", c.Serve.HealthAddr)
+	check(c.Serve.ImageWorkers > 0, "serve.imageWorkers must be more than 0")
+
+	check(c.Sanitise.SummaryLength > 0, "sanitise.summaryLength must be more than 0")
+	if c.Sanitise.ImageProxy != "" {
+		proxy, err := neturl.Parse(c.Sanitise.ImageProxy)
+		check(err == nil && proxy.Scheme != "" && proxy.Host != "", "sanitise.imageProxy must be a URL prefix, e.g https://images.fancast.uk/proxy?url=, not %q", c.Sanitise.ImageProxy)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("config is invalid:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// Redacted returns a copy of c with its secrets hidden, to be printed
+func (c Config) Redacted() Config {
+	hide := func(secret *string) {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+	hide(&c.Database.Password)
+	hide(&c.Spaces.Key)
+	hide(&c.Spaces.SecretKey)
+	hide(&c.API.AdminToken)
+	if c.Fetch.Proxy != "" {
+		// The proxy's URL can have a password in it
+		if proxy, err := neturl.Parse(c.Fetch.Proxy); err == nil && proxy.User != nil {
+			proxy.User = neturl.User(proxy.User.Username())
+			c.Fetch.Proxy = proxy.String()
+		}
+	}
+	c.Serve.Roles = append([]string(nil), c.Serve.Roles...)
+	return c
+}
+
+func validAddr(addr string) bool {
+	_, port, err := net.SplitHostPort(addr)
+	return err == nil && port != ""
+}
+
+// sortedKeys returns the names of sources in order, so problems are reported the same way each time
+func sortedKeys(sources map[string]DiscoverSource) []string {
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDefaultsAreValid(t *testing.T) {
+	c, err := read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Error(err)
+	}
+	if source := c.Discover.Sources["dataset"]; source.Type != "dataset" || source.Columns.FeedURL != "3" {
+		t.Errorf("got dataset source %+v", source)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		change func(c *Config)
+		want   string
+	}{
+		{func(c *Config) { c.Limits.ResponseBytes = 0 }, "limits.responseBytes must be more than 0"},
+		{func(c *Config) { c.Leader.LeaseSeconds = 0 }, "leader.leaseSeconds must be more than 0"},
+		{func(c *Config) { c.Queue.VisibilityTimeoutSeconds = 0 }, "queue.visibilityTimeoutSeconds must be more than 0"},
+		{func(c *Config) { c.Queue.MaxBackoffSeconds = 10 }, "queue.maxBackoffSeconds can't be less than queue.backoffSeconds"},
+		{func(c *Config) { c.Archive.Backend = "ftp" }, `archive.backend must be one of filesystem, bucket, not "ftp"`},
+		{func(c *Config) { c.Archive.Enabled, c.Archive.Path = true, "" }, "archive.path is required"},
+		{func(c *Config) { c.Discover.Sources["mine"] = DiscoverSource{Type: "opml"} }, "discover.sources.mine.path is required"},
+		{func(c *Config) { c.Discover.Sources["mine"] = DiscoverSource{Type: "rss"} }, `discover.sources.mine.type must be one of`},
+		{func(c *Config) { c.Sanitise.ImageProxy = "images.fancast.uk" }, "sanitise.imageProxy must be a URL prefix"},
+	}
+	for _, test := range tests {
+		c, err := read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.change(c)
+		if err := c.Validate(); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("got %v, want %q", err, test.want)
+		}
+	}
+}
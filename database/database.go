@@ -0,0 +1,56 @@
+// Package database holds the one Postgres connection pool every package shares
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/config"
+	"bitbucket.org/jayflux/mypodcasts_injest/logger"
+	// Needed for database/sql
+	_ "github.com/lib/pq"
+)
+
+var (
+	db     *sql.DB
+	dbOnce sync.Once
+)
+
+// DB returns the pool, opening it (and loading config) the first time it's called
+func DB() *sql.DB {
+	dbOnce.Do(func() {
+		settings := config.Get().Database
+		var err error
+		db, err = sql.Open("postgres", connString(settings))
+		if err != nil {
+			logger.Log.Fatal(err)
+		}
+		db.SetMaxOpenConns(settings.MaxOpenConns)
+		db.SetMaxIdleConns(settings.MaxIdleConns)
+		db.SetConnMaxLifetime(time.Duration(settings.ConnMaxLifetimeSeconds) * time.Second)
+	})
+	return db
+}
+
+// connString builds a key=value connection string, values are quoted so a password can have spaces or quotes in it
+func connString(settings config.Database) string {
+	values := [][2]string{
+		{"host", settings.Host},
+		{"port", fmt.Sprint(settings.Port)},
+		{"sslmode", settings.SSLMode},
+		{"user", settings.User},
+		{"dbname", settings.Database},
+		{"password", settings.Password},
+	}
+	quote := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	parts := make([]string, 0, len(values))
+	for _, kv := range values {
+		if kv[1] != "" {
+			parts = append(parts, fmt.Sprintf("%s='%s'", kv[0], quote.Replace(kv[1])))
+		}
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,86 @@
+package discover
+
+import (
+	"encoding/json"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/injest"
+)
+
+// BBCSource lists the podcasts in the BBC's podcasts.json
+type BBCSource struct {
+	name string
+	URL  string
+}
+
+// Taken from https://www.bbc.co.uk/podcasts.json
+// Used https://mholt.github.io/json-to-go/
+type bbcPodcasts struct {
+	Podcasts []struct {
+		Title           string   `json:"title"`
+		ShortTitle      string   `json:"shortTitle"`
+		Description     string   `json:"description"`
+		NetworkID       string   `json:"networkId"`
+		IonServiceID    string   `json:"ionServiceId"`
+		LaunchDate      string   `json:"launchDate"`
+		LastPublishDate string   `json:"lastPublishDate"`
+		Frequency       string   `json:"frequency"`
+		LiveItems       int      `json:"liveItems"`
+		ImageURL        string   `json:"imageUrl"`
+		HomepageURL     string   `json:"homepageUrl"`
+		FeedURL         string   `json:"feedUrl"`
+		BrandPids       []string `json:"brandPids"`
+		Genres          []string `json:"genres"`
+	} `json:"podcasts"`
+}
+
+// Name of the source
+func (s *BBCSource) Name() string {
+	return s.name
+}
+
+// List returns podcasts published since cursor, the newest lastPublishDate we've seen
+// The dates are ISO 8601 so comparing them as strings is enough
+func (s *BBCSource) List(cursor string) ([]Candidate, string, error) {
+	body, err := open(s.URL)
+	if err != nil {
+		return nil, cursor, err
+	}
+	defer body.Close()
+
+	var result bbcPodcasts
+	if err := json.NewDecoder(body).Decode(&result); err != nil {
+		return nil, cursor, err
+	}
+
+	candidates := make([]Candidate, 0)
+	next := cursor
+	for _, podcast := range result.Podcasts {
+		if podcast.LastPublishDate > next {
+			next = podcast.LastPublishDate
+		}
+		if cursor != "" && podcast.LastPublishDate != "" && podcast.LastPublishDate <= cursor {
+			continue
+		}
+		// The brand PID is the BBC's ID for the programme the podcast belongs to
+		sourceID := ""
+		if len(podcast.BrandPids) > 0 {
+			sourceID = podcast.BrandPids[0]
+		}
+		candidates = append(candidates, Candidate{
+			FeedURL:  podcast.FeedURL,
+			SourceID: sourceID,
+			Title:    podcast.Title,
+			Metadata: map[string]interface{}{"ionServiceId": podcast.IonServiceID, "lastPublishDate": podcast.LastPublishDate},
+			Directory: &injest.DirectoryMetadata{
+				Directory:   "bbc",
+				Network:     podcast.NetworkID,
+				Genres:      podcast.Genres,
+				Frequency:   podcast.Frequency,
+				BrandIDs:    podcast.BrandPids,
+				HomepageURL: podcast.HomepageURL,
+				LaunchDate:  podcast.LaunchDate,
+			},
+		})
+	}
+	return candidates, next, nil
+}
@@ -0,0 +1,326 @@
+package discover
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The fields a dataset can map columns to
+const (
+	ColumnFeedURL  = "feedUrl"
+	ColumnTitle    = "title"
+	ColumnITunesID = "itunesId"
+)
+
+// DatasetSource streams feeds from a TSV, CSV or JSONL file (optionally gzipped), one feed per row
+// The cursor is the rows read and the byte offset reached, local files are resumed by seeking straight to the offset
+type DatasetSource struct {
+	name    string
+	Path    string
+	Format  string
+	Comma   rune
+	Header  bool
+	Columns map[string]string
+}
+
+// NewDatasetSource checks a dataset's config and works out its format
+func NewDatasetSource(name string, config SourceConfig) (*DatasetSource, error) {
+	s := &DatasetSource{name: name, Path: config.Path, Format: strings.ToLower(config.Format), Header: config.Header, Columns: config.Columns}
+	if s.Format == "" {
+		s.Format = strings.TrimPrefix(strings.ToLower(filepath.Ext(strings.TrimSuffix(s.Path, ".gz"))), ".")
+	}
+	switch s.Format {
+	case "tsv", "txt":
+		s.Format = "tsv"
+		s.Comma = '\t'
+	case "csv":
+		s.Comma = ','
+	case "jsonl", "ndjson":
+		s.Format = "jsonl"
+	default:
+		return nil, fmt.Errorf("discover: %s has unknown dataset format %q, use tsv, csv or jsonl", name, s.Format)
+	}
+	if config.Delimiter != "" {
+		s.Comma = []rune(config.Delimiter)[0]
+	}
+	if s.Columns == nil || s.Columns[ColumnFeedURL] == "" {
+		return nil, fmt.Errorf("discover: %s has no column set for %s", name, ColumnFeedURL)
+	}
+	return s, nil
+}
+
+// Name of the source
+func (s *DatasetSource) Name() string {
+	return s.name
+}
+
+// List reads the whole dataset after cursor into memory, Run uses Stream instead
+func (s *DatasetSource) List(cursor string) ([]Candidate, string, error) {
+	candidates := make([]Candidate, 0)
+	next := cursor
+	err := s.Stream(cursor, 1000, func(batch []Candidate, n string) error {
+		candidates = append(candidates, batch...)
+		next = n
+		return nil
+	})
+	return candidates, next, err
+}
+
+// Stream reads the dataset after cursor, calling fn with every batchSize candidates
+func (s *DatasetSource) Stream(cursor string, batchSize int, fn func(batch []Candidate, next string) error) error {
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+	rows, offset := parseDatasetCursor(cursor)
+
+	file, err := open(s.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if strings.HasSuffix(s.Path, ".gz") {
+		// Compressed datasets can't be seeked, resuming them skips rows instead
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		file = gz
+	}
+
+	reader := &datasetReader{source: s, file: file, rows: rows}
+	if err := reader.start(offset); err != nil {
+		return err
+	}
+
+	batch := make([]Candidate, 0, batchSize)
+	for {
+		candidate, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if _, ok := err.(*rowError); ok {
+			log.Warnf("discover: %s row %d: %s", s.name, reader.rows, err)
+			continue
+		}
+		if err != nil {
+			// Reading the file failed, it'd fail again on every row so the run stops here and resumes from the last batch
+			return err
+		}
+		if candidate == nil {
+			continue
+		}
+		batch = append(batch, *candidate)
+		if len(batch) == batchSize {
+			if err := fn(batch, reader.cursor()); err != nil {
+				return err
+			}
+			batch = make([]Candidate, 0, batchSize)
+		}
+	}
+	// Always call fn at the end, even with nothing in it, so the cursor covers any trailing rows we skipped
+	return fn(batch, reader.cursor())
+}
+
+// parseDatasetCursor splits a cursor into rows read and byte offset, older cursors are just the rows
+func parseDatasetCursor(cursor string) (int, int64) {
+	parts := strings.SplitN(cursor, ":", 2)
+	rows, _ := strconv.Atoi(parts[0])
+	var offset int64
+	if len(parts) == 2 {
+		offset, _ = strconv.ParseInt(parts[1], 10, 64)
+	}
+	return rows, offset
+}
+
+// datasetReader reads rows from one format of dataset and keeps track of where it is
+type datasetReader struct {
+	source *DatasetSource
+	file   io.Reader
+	// rows is how many rows have been read, including any header
+	rows int
+	// offset is the byte offset of the end of the last row read, base is where in the file the reader started
+	offset int64
+	base   int64
+	csv    *csv.Reader
+	lines  *bufio.Reader
+	// columns maps the fields we want to a column index, tsv and csv only
+	columns map[string]int
+}
+
+// start reads the header, then gets to offset, seeking if the file allows it and skipping rows if it doesn't
+func (r *datasetReader) start(offset int64) error {
+	skip := r.rows
+	r.rows = 0
+	if r.source.Format == "jsonl" {
+		r.lines = bufio.NewReader(r.file)
+	} else {
+		r.csv = r.newCSV(r.file)
+		if err := r.readHeader(); err != nil {
+			return err
+		}
+	}
+
+	seeker, canSeek := r.file.(*os.File)
+	if offset > 0 && canSeek && offset >= r.offset {
+		if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		r.base, r.offset, r.rows = offset, offset, skip
+		if r.source.Format == "jsonl" {
+			r.lines = bufio.NewReader(r.file)
+		} else {
+			r.csv = r.newCSV(r.file)
+		}
+		return nil
+	}
+
+	for r.rows < skip {
+		_, err := r.next()
+		if err == io.EOF {
+			return nil
+		}
+		if _, ok := err.(*rowError); err != nil && !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *datasetReader) newCSV(file io.Reader) *csv.Reader {
+	c := csv.NewReader(file)
+	c.Comma = r.source.Comma
+	c.FieldsPerRecord = -1
+	c.LazyQuotes = true
+	c.ReuseRecord = true
+	return c
+}
+
+// readHeader resolves Columns to indexes, reading the header row if there is one
+func (r *datasetReader) readHeader() error {
+	header := map[string]int{}
+	if r.source.Header {
+		record, err := r.csv.Read()
+		if err != nil && err != io.EOF {
+			return err
+		}
+		r.rows++
+		r.offset = r.base + r.csv.InputOffset()
+		for i, name := range record {
+			header[strings.TrimSpace(name)] = i
+		}
+	}
+
+	r.columns = make(map[string]int)
+	for field, column := range r.source.Columns {
+		if column == "" {
+			continue
+		}
+		if i, err := strconv.Atoi(column); err == nil {
+			r.columns[field] = i
+		} else if i, ok := header[column]; ok {
+			r.columns[field] = i
+		} else {
+			return fmt.Errorf("discover: %s has no column %q for %s", r.source.name, column, field)
+		}
+	}
+	return nil
+}
+
+// rowError is a row that couldn't be parsed, the rows after it can still be read
+type rowError struct {
+	err error
+}
+
+func (e *rowError) Error() string {
+	return e.err.Error()
+}
+
+// next reads the next row, returning nil without an error for rows with no feed URL
+// A row that can't be parsed is a *rowError, any other error is from reading the file
+func (r *datasetReader) next() (*Candidate, error) {
+	if r.lines != nil {
+		return r.nextJSON()
+	}
+
+	record, err := r.csv.Read()
+	if err == io.EOF {
+		return nil, err
+	}
+	r.rows++
+	r.offset = r.base + r.csv.InputOffset()
+	if _, ok := err.(*csv.ParseError); ok {
+		return nil, &rowError{err}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	value := func(field string) string {
+		i, ok := r.columns[field]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+	return r.candidate(value(ColumnFeedURL), value(ColumnTitle), value(ColumnITunesID)), nil
+}
+
+func (r *datasetReader) nextJSON() (*Candidate, error) {
+	line, err := r.lines.ReadBytes('\n')
+	if err == io.EOF && len(line) == 0 {
+		return nil, err
+	}
+	r.rows++
+	r.offset += int64(len(line))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return nil, nil
+	}
+
+	var row map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	// Keep IDs as they were written rather than turning them into floats
+	decoder.UseNumber()
+	if err := decoder.Decode(&row); err != nil {
+		// The line's already been read, so this is always the row rather than the file
+		return nil, &rowError{err}
+	}
+	value := func(field string) string {
+		v, ok := row[r.source.Columns[field]]
+		if !ok || v == nil {
+			return ""
+		}
+		return strings.TrimSpace(fmt.Sprint(v))
+	}
+	return r.candidate(value(ColumnFeedURL), value(ColumnTitle), value(ColumnITunesID)), nil
+}
+
+func (r *datasetReader) candidate(feedURL, title, itunesID string) *Candidate {
+	if feedURL == "" {
+		return nil
+	}
+	candidate := &Candidate{FeedURL: feedURL, Title: title, SourceID: strconv.Itoa(r.rows), Metadata: map[string]interface{}{"row": r.rows}}
+	if itunesID != "" {
+		candidate.SourceID = itunesID
+		candidate.ExternalIDs = map[string]string{IDITunes: itunesID}
+	}
+	return candidate
+}
+
+// cursor is where to resume from, rows read and the byte offset they ended at
+func (r *datasetReader) cursor() string {
+	return fmt.Sprintf("%d:%d", r.rows, r.offset)
+}
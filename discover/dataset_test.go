@@ -0,0 +1,117 @@
+package discover
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func writeDataset(t *testing.T, name string, body []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, body, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func feedURLs(candidates []Candidate) []string {
+	urls := make([]string, len(candidates))
+	for i, c := range candidates {
+		urls[i] = c.FeedURL
+	}
+	return urls
+}
+
+func TestDatasetTSVWithHeader(t *testing.T) {
+	path := writeDataset(t, "feeds.tsv", []byte("id\tname\turl\n1\tOne\thttps://example.com/1.xml\n2\tTwo\t\n3\tThree\thttps://example.com/3.xml\n"))
+	source, err := NewDatasetSource("test", SourceConfig{Path: path, Header: true, Columns: map[string]string{ColumnFeedURL: "url", ColumnTitle: "name", ColumnITunesID: "0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	candidates, cursor, err := source.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The row without a URL is skipped
+	if urls := feedURLs(candidates); len(urls) != 2 || urls[0] != "https://example.com/1.xml" || urls[1] != "https://example.com/3.xml" {
+		t.Fatalf("got %v", urls)
+	}
+	if candidates[1].Title != "Three" || candidates[1].ExternalIDs[IDITunes] != "3" {
+		t.Errorf("got %+v", candidates[1])
+	}
+
+	// Everything has been read, so resuming from the cursor lists nothing
+	candidates, _, err = source.List(cursor)
+	if err != nil || len(candidates) != 0 {
+		t.Errorf("resuming got %d candidates, %v", len(candidates), err)
+	}
+}
+
+func TestDatasetResume(t *testing.T) {
+	path := writeDataset(t, "feeds.csv", []byte("https://example.com/1.xml\nhttps://example.com/2.xml\nhttps://example.com/3.xml\n"))
+	source, err := NewDatasetSource("test", SourceConfig{Path: path, Columns: map[string]string{ColumnFeedURL: "0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cursor string
+	err = source.Stream("", 1, func(batch []Candidate, next string) error {
+		if cursor == "" {
+			cursor = next
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidates, _, err := source.List(cursor)
+	if urls := feedURLs(candidates); err != nil || len(urls) != 2 || urls[0] != "https://example.com/2.xml" {
+		t.Errorf("resuming from %q got %v, %v", cursor, urls, err)
+	}
+}
+
+func TestDatasetSkipsBadRows(t *testing.T) {
+	path := writeDataset(t, "feeds.jsonl", []byte(`{"url": "https://example.com/1.xml"}
+{"url":
+["not", "an", "object"]
+
+{"url": "https://example.com/2.xml", "itunes": 12345}
+`))
+	source, err := NewDatasetSource("test", SourceConfig{Path: path, Columns: map[string]string{ColumnFeedURL: "url", ColumnITunesID: "itunes"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidates, _, err := source.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if urls := feedURLs(candidates); len(urls) != 2 || urls[1] != "https://example.com/2.xml" {
+		t.Fatalf("got %v", urls)
+	}
+	if candidates[1].ExternalIDs[IDITunes] != "12345" {
+		t.Errorf("got iTunes ID %q", candidates[1].ExternalIDs[IDITunes])
+	}
+}
+
+func TestDatasetStopsOnReadErrors(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	for i := 0; i < 1000; i++ {
+		gz.Write([]byte("https://example.com/feed.xml\n"))
+	}
+	gz.Close()
+	// A download cut short, every read after the break fails the same way
+	truncated := compressed.Bytes()[:compressed.Len()/2]
+	path := writeDataset(t, "feeds.tsv.gz", truncated)
+	source, err := NewDatasetSource("test", SourceConfig{Path: path, Columns: map[string]string{ColumnFeedURL: "0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := source.List(""); err == nil {
+		t.Error("got no error reading a truncated file")
+	}
+}
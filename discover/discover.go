@@ -0,0 +1,327 @@
+// Package discover finds new feeds to injest from directories and lists
+// Each directory is a Source, adding a new one is a new type plus a case in New
+package discover
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/config"
+	"bitbucket.org/jayflux/mypodcasts_injest/injest"
+	"bitbucket.org/jayflux/mypodcasts_injest/logger"
+)
+
+var log = logger.Log
+
+// Candidate is a feed a source thinks we might want, with whatever the source told us about it
+type Candidate struct {
+	FeedURL string
+	Title   string
+	// Metadata is anything else the source knows, e.g genres from the BBC or the row a dataset feed came from
+	Metadata map[string]interface{}
+	// ExternalIDs are IDs other directories use for the feed, keyed by IDPodcastIndex, IDITunes or IDPodcastGUID
+	ExternalIDs map[string]string
+	// SourceID is what the source calls the feed, if it has a name for it
+	SourceID string
+	// Directory is set by sources that are directories (e.g the BBC), it's stored against the podcast
+	Directory *injest.DirectoryMetadata
+	// Priority is the queue priority the feed is injested with when it's queued, 0 is queue.PriorityLow
+	// Sources that know which feeds are popular raise it for them
+	Priority int
+}
+
+// The external IDs we record, so feeds can be cross referenced with other directories
+const (
+	IDPodcastIndex = "podcastindex"
+	IDITunes       = "itunes"
+	IDPodcastGUID  = "podcastguid"
+)
+
+// Source is a directory or list of feeds
+type Source interface {
+	// Name identifies the source, its cursor is saved under this name
+	Name() string
+	// List returns the candidates added since cursor, and the cursor to pass next time
+	// An empty cursor means list everything, sources which can't list incrementally ignore it and return ""
+	List(cursor string) ([]Candidate, string, error)
+}
+
+// Stats is what happened to the candidates from a run of a source
+type Stats struct {
+	Source     string `json:"source"`
+	Candidates int    `json:"candidates"`
+	Duplicates int    `json:"duplicates"`
+	Known      int    `json:"known"`
+	New        int    `json:"new"`
+	Queued     int    `json:"queued"`
+	Failed     int    `json:"failed"`
+}
+
+// Names lists the sources configured under discover.sources
+func Names() []string {
+	names := make([]string, 0)
+	for name := range config.Get().Discover.Sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// StreamingSource is a source too big to list in one go
+// Run reads it in batches and saves the cursor after each one, so a crash resumes where it stopped
+type StreamingSource interface {
+	Source
+	// Stream calls fn with each batch of candidates after cursor, and the cursor to resume from once the batch is done
+	Stream(cursor string, batchSize int, fn func(batch []Candidate, next string) error) error
+}
+
+// SourceConfig is how a source is set up in config.json, not every type uses every field
+type SourceConfig struct {
+	Type string
+	// URL is where bbc sources fetch from
+	URL string
+	// Path is the file dataset, podcastindex, opml and urls sources read, opml and urls also accept an http(s) URL
+	Path string
+	// Format is tsv, csv or jsonl for datasets, if it's empty it's taken from the file extension
+	Format    string
+	Delimiter string
+	// Header is set if the first row of a tsv or csv dataset names the columns
+	Header bool
+	// Columns maps feedUrl, title and itunesId to a column, either a zero based index or a header name (or key for jsonl)
+	Columns map[string]string
+}
+
+// Get builds a source from its config under discover.sources.<name>
+func Get(name string) (Source, error) {
+	sourceConfig := LoadConfig(name)
+	if sourceConfig.Type == "" {
+		return nil, fmt.Errorf("discover: no source called %q, configured sources are %s", name, strings.Join(Names(), ", "))
+	}
+	return New(name, sourceConfig)
+}
+
+// LoadConfig reads the config of a source, Type is empty if there isn't one called name
+func LoadConfig(name string) SourceConfig {
+	// Viper keeps keys in lower case
+	source := config.Get().Discover.Sources[strings.ToLower(name)]
+	return SourceConfig{
+		Type:      source.Type,
+		URL:       source.URL,
+		Path:      source.Path,
+		Format:    source.Format,
+		Delimiter: source.Delimiter,
+		Header:    source.Header,
+		Columns: map[string]string{
+			ColumnFeedURL:  source.Columns.FeedURL,
+			ColumnTitle:    source.Columns.Title,
+			ColumnITunesID: source.Columns.ITunesID,
+		},
+	}
+}
+
+// New builds a source from its config
+func New(name string, config SourceConfig) (Source, error) {
+	switch config.Type {
+	case "bbc":
+		return &BBCSource{name: name, URL: config.URL}, nil
+	case "dataset":
+		return NewDatasetSource(name, config)
+	case "podcastindex":
+		return &PodcastIndexSource{name: name, Path: config.Path}, nil
+	case "opml":
+		return &OPMLSource{name: name, Path: config.Path}, nil
+	case "urls":
+		return &URLListSource{name: name, Path: config.Path}, nil
+	}
+	return nil, fmt.Errorf("discover: unknown source type %q", config.Type)
+}
+
+// Options change how Run works through a source
+type Options struct {
+	// Workers is how many feeds are injested at once, 0 uses injest.workers from config
+	Workers int
+	// Full ignores the saved cursor and lists everything
+	Full bool
+	// Progress is written a line after each batch of a streaming source, nil to stay quiet
+	Progress io.Writer
+	// Enqueue queues new feeds for the workers rather than injesting them here, they're counted in Queued
+	Enqueue bool
+}
+
+// Run lists a source, injests the candidates we don't already have and saves the source's cursor
+// The cursor moves on even if some feeds fail, they're counted in Failed and a full run will try them again
+// If ctx is done part way through a batch the cursor stays where it was, so the next run picks that batch up again
+// The same goes for a batch, or a cursor, we couldn't record, Run stops there and returns the error
+func Run(ctx context.Context, src Source, options Options) (Stats, error) {
+	stats := Stats{Source: src.Name()}
+	cursor := ""
+	if !options.Full {
+		cursor = injest.GetDiscoveryCursor(src.Name())
+	}
+
+	if streaming, ok := src.(StreamingSource); ok {
+		started := time.Now()
+		err := streaming.Stream(cursor, config.Get().Discover.BatchSize, func(batch []Candidate, next string) error {
+			// Duplicates are only spotted within a batch, remembering every URL in a large dataset costs too much
+			// and a repeat of a feed we've injested is caught as known anyway
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := runBatch(ctx, src.Name(), batch, make(map[string]bool), options, &stats); err != nil {
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if next != "" {
+				if err := injest.SetDiscoveryCursor(src.Name(), next); err != nil {
+					return err
+				}
+			}
+			if options.Progress != nil {
+				rate := float64(stats.Candidates) / time.Since(started).Seconds()
+				fmt.Fprintf(options.Progress, "%s: %d read, %d new, %d queued, %d known, %d failed (%.1f/s, at %s)\n", stats.Source, stats.Candidates, stats.New, stats.Queued, stats.Known, stats.Failed, rate, next)
+			}
+			return nil
+		})
+		log.Printf("discover: %s listed %d, %d duplicates, %d known, %d new, %d queued, %d failed", stats.Source, stats.Candidates, stats.Duplicates, stats.Known, stats.New, stats.Queued, stats.Failed)
+		return stats, err
+	}
+
+	candidates, next, err := src.List(cursor)
+	if err != nil {
+		return stats, err
+	}
+	if err := runBatch(ctx, src.Name(), candidates, make(map[string]bool), options, &stats); err != nil {
+		return stats, err
+	}
+	if err := ctx.Err(); err != nil {
+		return stats, err
+	}
+
+	if next != "" && next != cursor {
+		if err := injest.SetDiscoveryCursor(src.Name(), next); err != nil {
+			return stats, err
+		}
+	}
+	log.Printf("discover: %s listed %d, %d duplicates, %d known, %d new, %d queued, %d failed", stats.Source, stats.Candidates, stats.Duplicates, stats.Known, stats.New, stats.Queued, stats.Failed)
+	return stats, nil
+}
+
+// runBatch injests the candidates we haven't seen and don't already have, adding to stats
+// A candidate sharing an external ID with a feed we already have is counted as known, it's the same podcast at another URL
+// If what sources said, the IDs they gave or their directory metadata can't be recorded the new feeds aren't injested, they're counted as failed and the error returned
+func runBatch(ctx context.Context, name string, candidates []Candidate, seen map[string]bool, options Options, stats *Stats) error {
+	stats.Candidates += len(candidates)
+	valid := make([]Candidate, 0, len(candidates))
+	urls := make([]string, 0, len(candidates))
+	ids := make([]injest.ExternalID, 0)
+	directory := make([]injest.DirectoryMetadata, 0)
+	sources := make([]injest.SourceRecord, 0, len(candidates))
+	for _, candidate := range candidates {
+		candidate.FeedURL = strings.TrimSpace(candidate.FeedURL)
+		if seen[candidate.FeedURL] || seenExternalID(candidate, seen) {
+			stats.Duplicates++
+			continue
+		}
+		seen[candidate.FeedURL] = true
+		if !validURL(candidate.FeedURL) {
+			log.Warnf("discover: %s listed an invalid feed URL %q", name, candidate.FeedURL)
+			stats.Failed++
+			continue
+		}
+		for source, id := range candidate.ExternalIDs {
+			externalID := injest.ExternalID{FeedURL: candidate.FeedURL, Source: source, ID: id}
+			seen[externalID.Key()] = true
+			ids = append(ids, externalID)
+		}
+		if candidate.Directory != nil {
+			candidate.Directory.FeedURL = candidate.FeedURL
+			directory = append(directory, *candidate.Directory)
+		}
+		sources = append(sources, injest.SourceRecord{FeedURL: candidate.FeedURL, Source: name, SourceID: candidate.SourceID, Metadata: candidate.Metadata})
+		valid = append(valid, candidate)
+		urls = append(urls, candidate.FeedURL)
+	}
+
+	// One query for the whole batch, checking each URL on its own was most of the time spent on big datasets
+	known := injest.KnownFeedURLs(urls)
+	knownIDs := injest.KnownExternalIDs(ids)
+	unknown := make([]string, 0, len(urls))
+	priorities := make(map[string]int)
+	for _, candidate := range valid {
+		if known[candidate.FeedURL] || hasExternalID(candidate, knownIDs) {
+			stats.Known++
+			continue
+		}
+		unknown = append(unknown, candidate.FeedURL)
+		priorities[candidate.FeedURL] = candidate.Priority
+	}
+
+	// Sources and IDs are recorded for known feeds too, so we can cross reference podcasts we found some other way
+	// Directory metadata goes in before injesting so new podcasts can be seeded from it
+	if err := injest.RecordSources(sources); err != nil {
+		stats.Failed += len(unknown)
+		return err
+	}
+	if err := injest.RecordExternalIDs(ids); err != nil {
+		stats.Failed += len(unknown)
+		return err
+	}
+	if err := injest.RecordDirectoryMetadata(directory); err != nil {
+		stats.Failed += len(unknown)
+		return err
+	}
+	if options.Enqueue {
+		for _, feedURL := range unknown {
+			if _, err := injest.EnqueueInjest(feedURL, priorities[feedURL]); err != nil {
+				log.Errorf("discover: Could not queue %s", feedURL)
+				log.Error(err)
+				stats.Failed++
+				continue
+			}
+			stats.Queued++
+		}
+		return nil
+	}
+
+	failed := injest.InjestAll(ctx, unknown, options.Workers)
+	injest.LinkDiscovered(unknown)
+	stats.Failed += len(failed)
+	stats.New += len(unknown) - len(failed)
+	return nil
+}
+
+func seenExternalID(candidate Candidate, seen map[string]bool) bool {
+	for source, id := range candidate.ExternalIDs {
+		if seen[injest.ExternalID{Source: source, ID: id}.Key()] {
+			return true
+		}
+	}
+	return false
+}
+
+func hasExternalID(candidate Candidate, keys map[string]bool) bool {
+	for source, id := range candidate.ExternalIDs {
+		if keys[injest.ExternalID{Source: source, ID: id}.Key()] {
+			return true
+		}
+	}
+	return false
+}
+
+func validURL(feedURL string) bool {
+	u, err := url.Parse(feedURL)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// Print writes the stats in a human readable form
+func (s Stats) Print(w io.Writer) {
+	fmt.Fprintf(w, "Source: %s\n", s.Source)
+	fmt.Fprintf(w, "Listed: %d\nDuplicates: %d\nAlready known: %d\nNew: %d\nQueued: %d\nFailed: %d\n", s.Candidates, s.Duplicates, s.Known, s.New, s.Queued, s.Failed)
+}
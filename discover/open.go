@@ -0,0 +1,27 @@
+package discover
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// open reads a path, or fetches it if it's an http(s) URL
+func open(path string) (io.ReadCloser, error) {
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		client := &http.Client{Timeout: 60 * time.Second}
+		resp, err := client.Get(path)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 400 {
+			resp.Body.Close()
+			return nil, fmt.Errorf("discover: %s returned %s", path, resp.Status)
+		}
+		return resp.Body, nil
+	}
+	return os.Open(path)
+}
@@ -0,0 +1,46 @@
+package discover
+
+import (
+	"bitbucket.org/jayflux/mypodcasts_injest/opml"
+)
+
+// OPMLSource lists the feeds in an OPML file
+// OPML files are small and get edited in place, so they're always listed in full and rely on dedupe
+type OPMLSource struct {
+	name string
+	Path string
+}
+
+// NewOPMLSource returns a source for a one off OPML file, it's named after the path
+func NewOPMLSource(path string) *OPMLSource {
+	return &OPMLSource{name: "opml:" + path, Path: path}
+}
+
+// Name of the source
+func (s *OPMLSource) Name() string {
+	return s.name
+}
+
+// List returns every feed in the file, cursor is ignored
+func (s *OPMLSource) List(cursor string) ([]Candidate, string, error) {
+	file, err := open(s.Path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+
+	doc, err := opml.Parse(file)
+	if err != nil {
+		return nil, "", err
+	}
+
+	candidates := make([]Candidate, 0)
+	for _, feed := range doc.Feeds() {
+		candidates = append(candidates, Candidate{
+			FeedURL:  feed.URL,
+			Title:    feed.Title,
+			Metadata: map[string]interface{}{"categories": feed.Categories, "htmlUrl": feed.HTMLURL},
+		})
+	}
+	return candidates, "", nil
+}
@@ -0,0 +1,153 @@
+package discover
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/injest"
+	"bitbucket.org/jayflux/mypodcasts_injest/queue"
+	// SQLite driver for reading the Podcast Index dump
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// PodcastIndexSource reads a local copy of the Podcast Index SQLite dump
+// https://public.podcastindex.org/podcastindex_feeds.db.tgz
+// Feeds are listed most popular first, then most recently updated, so the ones people want are injested first
+type PodcastIndexSource struct {
+	name string
+	Path string
+}
+
+// podcastIndexOrder is the sort key, the cursor is the last row's values of it
+const podcastIndexOrder = "COALESCE(popularityScore, 0), COALESCE(newestItemPubdate, 0), id"
+
+// Name of the source
+func (s *PodcastIndexSource) Name() string {
+	return s.name
+}
+
+// List reads the whole dump after cursor into memory, Run uses Stream instead
+func (s *PodcastIndexSource) List(cursor string) ([]Candidate, string, error) {
+	candidates := make([]Candidate, 0)
+	next := cursor
+	err := s.Stream(cursor, 1000, func(batch []Candidate, n string) error {
+		candidates = append(candidates, batch...)
+		next = n
+		return nil
+	})
+	return candidates, next, err
+}
+
+// Stream reads feeds that aren't marked dead, after cursor, in batches
+// The cursor is popularity:newest item:id of the last feed in the batch
+func (s *PodcastIndexSource) Stream(cursor string, batchSize int, fn func(batch []Candidate, next string) error) error {
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+	index, err := sql.Open("sqlite3", "file:"+s.Path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+
+	where := "dead = 0 AND COALESCE(url, '') != ''"
+	args := []interface{}{}
+	if after := strings.Split(cursor, ":"); len(after) == 3 {
+		where += " AND (" + podcastIndexOrder + ") < (?, ?, ?)"
+		for _, v := range after {
+			n, _ := strconv.ParseInt(v, 10, 64)
+			args = append(args, n)
+		}
+	}
+
+	// One query for the whole run, the dump has no index on the sort key so sorting it per batch would take hours
+	rows, err := index.Query(`SELECT id, url, COALESCE(title, ''), COALESCE(link, ''), COALESCE(language, ''), COALESCE(itunesId, 0), COALESCE(podcastGuid, ''),
+		COALESCE(popularityScore, 0), COALESCE(newestItemPubdate, 0), COALESCE(episodeCount, 0),
+		COALESCE(category1, ''), COALESCE(category2, ''), COALESCE(category3, ''), COALESCE(category4, ''), COALESCE(category5, ''),
+		COALESCE(category6, ''), COALESCE(category7, ''), COALESCE(category8, ''), COALESCE(category9, ''), COALESCE(category10, '')
+		FROM podcasts WHERE `+where+` ORDER BY COALESCE(popularityScore, 0) DESC, COALESCE(newestItemPubdate, 0) DESC, id DESC`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	batch := make([]Candidate, 0, batchSize)
+	next := cursor
+	for rows.Next() {
+		var id, itunesID, popularity, newest, episodes int64
+		var feedURL, title, link, language, guid string
+		categories := make([]string, 10)
+		dest := []interface{}{&id, &feedURL, &title, &link, &language, &itunesID, &guid, &popularity, &newest, &episodes}
+		for i := range categories {
+			dest = append(dest, &categories[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+
+		candidate := Candidate{
+			FeedURL:  feedURL,
+			Title:    title,
+			SourceID: strconv.FormatInt(id, 10),
+			Metadata: map[string]interface{}{
+				"link":              link,
+				"language":          language,
+				"categories":        nonEmpty(categories),
+				"popularityScore":   popularity,
+				"newestItemPubdate": newest,
+				"episodeCount":      episodes,
+			},
+			ExternalIDs: map[string]string{IDPodcastIndex: strconv.FormatInt(id, 10)},
+			// Categories and language fill in for feeds that don't have their own
+			Directory: &injest.DirectoryMetadata{
+				Directory:   "podcastindex",
+				Genres:      nonEmpty(categories),
+				HomepageURL: link,
+				Language:    language,
+			},
+			Priority: popularityPriority(popularity),
+		}
+		if itunesID > 0 {
+			candidate.ExternalIDs[IDITunes] = strconv.FormatInt(itunesID, 10)
+		}
+		if guid != "" {
+			candidate.ExternalIDs[IDPodcastGUID] = guid
+		}
+		batch = append(batch, candidate)
+		next = fmt.Sprintf("%d:%d:%d", popularity, newest, id)
+
+		if len(batch) == batchSize {
+			if err := fn(batch, next); err != nil {
+				return err
+			}
+			batch = make([]Candidate, 0, batchSize)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return fn(batch, next)
+}
+
+// popularityPriority queues more popular feeds first, still behind the feeds we already have
+func popularityPriority(popularity int64) int {
+	if popularity >= queue.PriorityNormal {
+		return queue.PriorityNormal - 1
+	}
+	if popularity < 0 {
+		return queue.PriorityLow
+	}
+	return queue.PriorityLow + int(popularity)
+}
+
+func nonEmpty(values []string) []string {
+	result := make([]string, 0, len(values))
+	for _, v := range values {
+		if v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
@@ -0,0 +1,78 @@
+package discover
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/queue"
+)
+
+func writePodcastIndex(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "podcastindex_feeds.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec(`CREATE TABLE podcasts (id integer, url text, title text, link text, language text, itunesId integer, podcastGuid text,
+		popularityScore integer, newestItemPubdate integer, episodeCount integer, dead integer,
+		category1 text, category2 text, category3 text, category4 text, category5 text, category6 text, category7 text, category8 text, category9 text, category10 text)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := [][]interface{}{
+		{1, "https://example.com/quiet.xml", "Quiet", "", "en", nil, "", 0, 100, 3, 0, "", "", "", "", "", "", "", "", "", ""},
+		{2, "https://example.com/popular.xml", "Popular", "https://example.com", "en-gb", 12345, "guid-2", 9, 200, 50, 0, "Comedy", "", "News", "", "", "", "", "", "", ""},
+		{3, "https://example.com/dead.xml", "Dead", "", "en", nil, "", 20, 300, 1, 1, "", "", "", "", "", "", "", "", "", ""},
+		{4, "", "No URL", "", "en", nil, "", 20, 300, 1, 0, "", "", "", "", "", "", "", "", "", ""},
+	}
+	for _, row := range rows {
+		if _, err := db.Exec("INSERT INTO podcasts VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", row...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestPodcastIndexSource(t *testing.T) {
+	source := &PodcastIndexSource{name: "podcastindex", Path: writePodcastIndex(t)}
+	candidates, cursor, err := source.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Dead feeds and feeds without a URL are skipped, the most popular comes first
+	if urls := feedURLs(candidates); !reflect.DeepEqual(urls, []string{"https://example.com/popular.xml", "https://example.com/quiet.xml"}) {
+		t.Fatalf("got %v", urls)
+	}
+
+	popular := candidates[0]
+	wantIDs := map[string]string{IDPodcastIndex: "2", IDITunes: "12345", IDPodcastGUID: "guid-2"}
+	if !reflect.DeepEqual(popular.ExternalIDs, wantIDs) {
+		t.Errorf("got external IDs %v, want %v", popular.ExternalIDs, wantIDs)
+	}
+	if popular.Directory == nil || !reflect.DeepEqual(popular.Directory.Genres, []string{"Comedy", "News"}) || popular.Directory.Language != "en-gb" || popular.Directory.HomepageURL != "https://example.com" {
+		t.Errorf("got directory metadata %+v", popular.Directory)
+	}
+	if popular.Metadata["popularityScore"] != int64(9) {
+		t.Errorf("got metadata %v", popular.Metadata)
+	}
+	if popular.Priority <= candidates[1].Priority {
+		t.Errorf("got priority %d for the popular feed and %d for the quiet one", popular.Priority, candidates[1].Priority)
+	}
+
+	// Nothing comes after the last feed
+	if candidates, _, err = source.List(cursor); err != nil || len(candidates) != 0 {
+		t.Errorf("resuming from %q got %d candidates, %v", cursor, len(candidates), err)
+	}
+}
+
+func TestPopularityPriority(t *testing.T) {
+	tests := map[int64]int{-1: queue.PriorityLow, 0: queue.PriorityLow, 10: queue.PriorityLow + 10, 1000: queue.PriorityNormal - 1}
+	for popularity, want := range tests {
+		if got := popularityPriority(popularity); got != want {
+			t.Errorf("popularityPriority(%d) = %d, want %d", popularity, got, want)
+		}
+	}
+}
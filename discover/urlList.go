@@ -0,0 +1,46 @@
+package discover
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+)
+
+// URLListSource lists feeds from a plain text file, one URL per line
+// Blank lines and lines starting with # are skipped
+type URLListSource struct {
+	name string
+	Path string
+}
+
+// Name of the source
+func (s *URLListSource) Name() string {
+	return s.name
+}
+
+// List returns the URLs after cursor, which is the number of lines read last time
+// Lists are expected to be appended to, if lines are removed run it with full
+func (s *URLListSource) List(cursor string) ([]Candidate, string, error) {
+	skip, _ := strconv.Atoi(cursor)
+	file, err := open(s.Path)
+	if err != nil {
+		return nil, cursor, err
+	}
+	defer file.Close()
+
+	candidates := make([]Candidate, 0)
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if line <= skip || text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		candidates = append(candidates, Candidate{FeedURL: text, Metadata: map[string]interface{}{"line": line}})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, cursor, err
+	}
+	return candidates, strconv.Itoa(line), nil
+}
@@ -0,0 +1,147 @@
+// Package health tracks what each role in a process is doing, and serves it for the container platform to probe
+// /healthz says whether the process is alive, /readyz whether every role is up and its checks pass
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Role statuses
+const (
+	StatusStarting = "starting"
+	StatusReady    = "ready"
+	StatusStopping = "stopping"
+	StatusStopped  = "stopped"
+	StatusFailed   = "failed"
+)
+
+// Check is something a role depends on, e.g. the database, it returns an error if it isn't usable
+type Check func(ctx context.Context) error
+
+// RoleStatus is how a role is doing
+type RoleStatus struct {
+	Status string    `json:"status"`
+	Error  string    `json:"error,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// Report is what /healthz and /readyz return
+type Report struct {
+	Ready  bool                  `json:"ready"`
+	Roles  map[string]RoleStatus `json:"roles"`
+	Checks map[string]string     `json:"checks,omitempty"`
+}
+
+// Registry holds the status of each role and the checks readiness depends on
+type Registry struct {
+	mu     sync.RWMutex
+	roles  map[string]RoleStatus
+	checks map[string]Check
+}
+
+// New creates an empty registry
+func New() *Registry {
+	return &Registry{roles: make(map[string]RoleStatus), checks: make(map[string]Check)}
+}
+
+// Set records a role's status, err is kept for failed roles
+func (r *Registry) Set(role, status string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := RoleStatus{Status: status, Since: time.Now()}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	r.roles[role] = s
+}
+
+// Stopping marks a role as stopping, unless it has already stopped or failed
+func (r *Registry) Stopping(role string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, ok := r.roles[role]; ok && (s.Status == StatusStopped || s.Status == StatusFailed) {
+		return
+	}
+	r.roles[role] = RoleStatus{Status: StatusStopping, Since: time.Now()}
+}
+
+// AddCheck adds a check that has to pass for the process to be ready
+func (r *Registry) AddCheck(name string, check Check) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checks[name] = check
+}
+
+// Report works out whether we're ready, running the checks if runChecks is true
+// Checks get a couple of seconds each, a probe that hangs is as bad as one that fails
+func (r *Registry) Report(ctx context.Context, runChecks bool) Report {
+	r.mu.RLock()
+	report := Report{Ready: len(r.roles) > 0, Roles: make(map[string]RoleStatus, len(r.roles))}
+	for role, s := range r.roles {
+		report.Roles[role] = s
+		if s.Status != StatusReady {
+			report.Ready = false
+		}
+	}
+	names := make([]string, 0, len(r.checks))
+	for name := range r.checks {
+		names = append(names, name)
+	}
+	checks := r.checks
+	r.mu.RUnlock()
+
+	if !runChecks {
+		return report
+	}
+	sort.Strings(names)
+	report.Checks = make(map[string]string, len(names))
+	for _, name := range names {
+		checkCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		err := checks[name](checkCtx)
+		cancel()
+		if err != nil {
+			report.Checks[name] = err.Error()
+			report.Ready = false
+			continue
+		}
+		report.Checks[name] = "ok"
+	}
+	return report
+}
+
+// Handler serves /healthz and /readyz
+// /healthz is 200 unless a role has failed, /readyz is 200 only once every role is ready and the checks pass
+func (r *Registry) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		report := r.Report(req.Context(), false)
+		status := http.StatusOK
+		for _, s := range report.Roles {
+			if s.Status == StatusFailed {
+				status = http.StatusServiceUnavailable
+			}
+		}
+		writeReport(w, status, report)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		report := r.Report(req.Context(), true)
+		status := http.StatusOK
+		if !report.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeReport(w, status, report)
+	})
+	return mux
+}
+
+func writeReport(w http.ResponseWriter, status int, report Report) {
+	reportJSON, _ := json.Marshal(report)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(reportJSON)
+}
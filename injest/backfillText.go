@@ -0,0 +1,52 @@
+package injest
+
+// BackfillText generates the sanitised HTML and plain text columns for podcasts and episodes injested before we stored them
+// Without this older rows won't show up in search until their feed changes
+func BackfillText() {
+	backfillTextForTable("podcasts")
+	backfillTextForTable("podcast_episodes")
+}
+
+func backfillTextForTable(table string) {
+	var (
+		id          string
+		title       string
+		description string
+	)
+
+	rows, err := getDB().Query("SELECT id, COALESCE(title, ''), COALESCE(description, '') FROM " + table + " WHERE description_text IS NULL")
+	if err != nil {
+		log.Error(err)
+		log.Fatal("BackfillText: error in query")
+	}
+	defer rows.Close()
+
+	tx, err := getDB().Begin()
+	if err != nil {
+		log.Error("BackfillText: Couldn't begin database transaction")
+		log.Fatal(err)
+	}
+
+	count := 0
+	for rows.Next() {
+		if err := rows.Scan(&id, &title, &description); err != nil {
+			log.Error(err)
+			continue
+		}
+		m := make(map[string][]byte)
+		prepareTextForDB(m, title, description)
+		_, writeErr := tx.Exec("UPDATE "+table+" SET (title_text, description_html, description_text, summary) = ($2, $3, $4, $5) WHERE id = $1", id, m["title_text"], m["description_html"], m["description_text"], m["summary"])
+		if writeErr != nil {
+			log.Error("BackfillText: Could not write to DB")
+			log.Fatal(writeErr)
+		}
+		count++
+	}
+
+	commitErr := tx.Commit()
+	if commitErr != nil {
+		log.Error("BackfillText: Commit failed")
+		log.Fatal(commitErr)
+	}
+	log.Printf("BackfillText: updated %d rows in %s", count, table)
+}
@@ -0,0 +1,125 @@
+package injest
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"unicode"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/store"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// DirectoryMetadata is what a directory (e.g the BBC or Podcast Index) says about a podcast it lists
+type DirectoryMetadata = store.DirectoryMetadata
+
+// RecordDirectoryMetadata stores what directories say about feeds, replacing what they said last time
+// It's recorded before the feed is injested so a new podcast can be seeded from it, LinkDiscovered links it afterwards
+// Nothing is recorded if it fails
+func RecordDirectoryMetadata(metadata []DirectoryMetadata) error {
+	if len(metadata) == 0 {
+		return nil
+	}
+	tx, err := getDB().Begin()
+	if err != nil {
+		log.Error("RecordDirectoryMetadata: Couldn't begin database transaction")
+		return err
+	}
+	defer tx.Rollback()
+	for _, m := range metadata {
+		genres, _ := json.Marshal(m.Genres)
+		brandIDs, _ := json.Marshal(m.BrandIDs)
+		_, writeErr := tx.Exec(`INSERT INTO podcast_directory_metadata (directory, feed_url, podcast_id, network, genres, frequency, brand_ids, homepage_url, launch_date, language, updated_at)
+			VALUES ($1, $2, `+podcastIDForURL("$2")+`, NULLIF($3, ''), $4, NULLIF($5, ''), $6, NULLIF($7, ''), NULLIF($8, ''), NULLIF($9, ''), now())
+			ON CONFLICT (directory, feed_url) DO UPDATE SET podcast_id = COALESCE(EXCLUDED.podcast_id, podcast_directory_metadata.podcast_id), network = EXCLUDED.network, genres = EXCLUDED.genres,
+			frequency = EXCLUDED.frequency, brand_ids = EXCLUDED.brand_ids, homepage_url = EXCLUDED.homepage_url, launch_date = EXCLUDED.launch_date, language = EXCLUDED.language, updated_at = EXCLUDED.updated_at`,
+			m.Directory, m.FeedURL, m.Network, genres, m.Frequency, brandIDs, m.HomepageURL, m.LaunchDate, m.Language)
+		if writeErr != nil {
+			log.Error("RecordDirectoryMetadata: Could not write to DB")
+			return writeErr
+		}
+	}
+	commitErr := tx.Commit()
+	if commitErr != nil {
+		log.Error("RecordDirectoryMetadata: Commit failed")
+		return commitErr
+	}
+	return nil
+}
+
+// getDirectoryMetadata returns what directories say about the podcast at url
+// The podcast may have moved since the directory listed it, so it's matched on the podcast as well as the URL
+func getDirectoryMetadata(ctx context.Context, url string) []DirectoryMetadata {
+	metadata, err := getStores().Podcasts.DirectoryMetadata(ctx, url)
+	if err != nil {
+		log.Error(err)
+	}
+	return metadata
+}
+
+// applyDirectoryMetadata fills in categories from directory genres, and the language, when the feed doesn't have them
+// It's applied on every injest so the digest stays stable
+func applyDirectoryMetadata(ctx context.Context, feed *gofeed.Feed, url string) {
+	if len(feed.Categories) > 0 && feed.Language != "" {
+		return
+	}
+	for _, m := range getDirectoryMetadata(ctx, url) {
+		if len(feed.Categories) == 0 && len(m.Genres) > 0 {
+			feed.Categories = m.Genres
+		}
+		if feed.Language == "" && m.Language != "" {
+			feed.Language = m.Language
+		}
+	}
+}
+
+// declaredPollFrequency is the poll frequency (in hours) matching how often a directory says the podcast publishes
+// ok is false if no directory says, or it's something we don't understand like "irregular"
+func declaredPollFrequency(ctx context.Context, url string) (freq int8, ok bool) {
+	for _, m := range getDirectoryMetadata(ctx, url) {
+		if freq, ok := frequencyHours(m.Frequency); ok {
+			return freq, true
+		}
+	}
+	return 0, false
+}
+
+// weekdays name a day a weekly podcast comes out on, e.g "every Tuesday"
+var weekdays = []string{"monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday"}
+
+// frequencyHours is the poll frequency (in hours) for a frequency as a directory describes it, e.g "daily" or "weekly on Monday"
+// It's matched on whole words, so the day in "weekly on Monday" isn't taken to mean daily
+func frequencyHours(frequency string) (int8, bool) {
+	words := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(strings.ToLower(frequency), func(r rune) bool { return !unicode.IsLetter(r) }) {
+		// Plurals mean the same, "weekdays", "mondays"
+		words[strings.TrimSuffix(word, "s")] = true
+	}
+	has := func(any ...string) bool {
+		for _, word := range any {
+			if words[word] {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case has("fortnightly", "fortnight", "monthly", "month"):
+		return 48, true
+	case has("weekly", "week") || has(weekdays...):
+		return 24, true
+	case has("daily", "day", "weekday", "nightly"):
+		return 4, true
+	}
+	return 0, false
+}
+
+// seedPollFrequency is the poll frequency for a podcast we know nothing about yet
+func seedPollFrequency(ctx context.Context, url string) int8 {
+	if freq, ok := declaredPollFrequency(ctx, url); ok {
+		return freq
+	}
+	return 8
+}
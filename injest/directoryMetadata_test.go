@@ -0,0 +1,63 @@
+package injest
+
+import (
+	"context"
+	"testing"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/store"
+	"github.com/mmcdole/gofeed"
+)
+
+func TestFrequencyHours(t *testing.T) {
+	tests := []struct {
+		frequency string
+		want      int8
+		ok        bool
+	}{
+		{"daily", 4, true},
+		{"Every day", 4, true},
+		{"weekdays", 4, true},
+		{"weekly", 24, true},
+		{"Weekly on Monday", 24, true},
+		{"every Tuesday", 24, true},
+		{"Sundays", 24, true},
+		{"fortnightly", 48, true},
+		{"Monthly", 48, true},
+		{"irregular", 0, false},
+		{"", 0, false},
+	}
+	for _, test := range tests {
+		got, ok := frequencyHours(test.frequency)
+		if got != test.want || ok != test.ok {
+			t.Errorf("frequencyHours(%q) = %d, %v, want %d, %v", test.frequency, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestApplyDirectoryMetadata(t *testing.T) {
+	memory := store.NewMemory()
+	SetStores(memory.Stores())
+	ctx := context.Background()
+	url := "https://example.com/feed.xml"
+	memory.AddDirectoryMetadata(store.DirectoryMetadata{Directory: "bbc", FeedURL: url, Genres: []string{"Comedy"}, Frequency: "weekly on Friday", Language: "en-gb"})
+
+	feed := &gofeed.Feed{}
+	applyDirectoryMetadata(ctx, feed, url)
+	if len(feed.Categories) != 1 || feed.Categories[0] != "Comedy" || feed.Language != "en-gb" {
+		t.Errorf("got categories %v and language %q", feed.Categories, feed.Language)
+	}
+
+	// What the feed says wins
+	feed = &gofeed.Feed{Categories: []string{"News"}, Language: "cy"}
+	applyDirectoryMetadata(ctx, feed, url)
+	if feed.Categories[0] != "News" || feed.Language != "cy" {
+		t.Errorf("got categories %v and language %q", feed.Categories, feed.Language)
+	}
+
+	if freq := seedPollFrequency(ctx, url); freq != 24 {
+		t.Errorf("got poll frequency %d, want 24", freq)
+	}
+	if freq := seedPollFrequency(ctx, "https://example.com/unlisted.xml"); freq != 8 {
+		t.Errorf("got poll frequency %d for a podcast no directory lists, want 8", freq)
+	}
+}
@@ -0,0 +1,76 @@
+package injest
+
+import (
+	"github.com/lib/pq"
+)
+
+// ExternalID is the ID another directory gives a feed, e.g its Podcast Index or iTunes ID
+type ExternalID struct {
+	FeedURL string
+	Source  string
+	ID      string
+}
+
+// Key identifies the ID regardless of which feed it's for
+func (e ExternalID) Key() string {
+	return e.Source + ":" + e.ID
+}
+
+// KnownExternalIDs returns the Keys of ids we've already recorded against a podcast, whichever feed it was listed at
+// A known ID on a different URL usually means the same podcast listed twice
+// IDs recorded for feeds that haven't been injested, e.g they failed or the run stopped, aren't known so they're tried again
+func KnownExternalIDs(ids []ExternalID) map[string]bool {
+	known := make(map[string]bool)
+	if len(ids) == 0 {
+		return known
+	}
+	sources := make([]string, len(ids))
+	values := make([]string, len(ids))
+	for i, id := range ids {
+		sources[i], values[i] = id.Source, id.ID
+	}
+
+	rows, err := getDB().Query("SELECT e.source, e.external_id FROM podcast_external_ids e JOIN unnest($1::text[], $2::text[]) AS c(source, external_id) USING (source, external_id) WHERE e.podcast_id IS NOT NULL", pq.Array(sources), pq.Array(values))
+	if err != nil {
+		log.Error(err)
+		return known
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id ExternalID
+		if err := rows.Scan(&id.Source, &id.ID); err != nil {
+			log.Error(err)
+			continue
+		}
+		known[id.Key()] = true
+	}
+	return known
+}
+
+// RecordExternalIDs stores external IDs against their feed, IDs we already have are left pointing where they were
+// The podcast is linked now if we have it, otherwise LinkDiscovered does it after injesting
+// Nothing is recorded if it fails
+func RecordExternalIDs(ids []ExternalID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	tx, err := getDB().Begin()
+	if err != nil {
+		log.Error("RecordExternalIDs: Couldn't begin database transaction")
+		return err
+	}
+	defer tx.Rollback()
+	for _, id := range ids {
+		_, writeErr := tx.Exec("INSERT INTO podcast_external_ids (feed_url, source, external_id, podcast_id, added_at) VALUES ($1, $2, $3, "+podcastIDForURL("$1")+", now()) ON CONFLICT (source, external_id) DO NOTHING", id.FeedURL, id.Source, id.ID)
+		if writeErr != nil {
+			log.Error("RecordExternalIDs: Could not write to DB")
+			return writeErr
+		}
+	}
+	commitErr := tx.Commit()
+	if commitErr != nil {
+		log.Error("RecordExternalIDs: Commit failed")
+		return commitErr
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package injest
+
+import (
+	"context"
+	"net/http"
+	neturl "net/url"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// maxRedirects is how many redirects Fetch will follow before giving up
+const maxRedirects = 5
+
+// FetchResult is a feed fetched and parsed through the normal injest path, without anything being written
+type FetchResult struct {
+	// URL is where the feed was finally fetched from, after any redirects
+	URL        string
+	Redirects  []Redirect
+	StatusCode int
+	Header     http.Header
+	Feed       *gofeed.Feed
+	Repairs    []string
+	Truncated  bool
+	// ParseError is set if the body couldn't be parsed, Feed will be nil
+	ParseError error
+}
+
+// Redirect is a single hop we were sent on when fetching a feed
+type Redirect struct {
+	From       string `json:"from"`
+	To         string `json:"to"`
+	StatusCode int    `json:"statusCode"`
+}
+
+// Fetch downloads and parses a feed the same way Injest does, but doesn't touch the database
+// Caching headers aren't sent so we always get the full feed back
+// An error is only returned if the feed couldn't be downloaded, parse errors are reported in the result
+func Fetch(ctx context.Context, url string) (*FetchResult, error) {
+	result := &FetchResult{URL: url, Redirects: []Redirect{}, Repairs: []string{}}
+
+	var response *http.Response
+	for {
+		isRedirect, newEndpoint, resp, err := fetchConanicalUrlWithHeaders(ctx, result.URL, RequestHeaders{})
+		if err != nil {
+			return nil, &feedError{FailureFetch, err}
+		}
+		if !isRedirect {
+			response = resp
+			break
+		}
+
+		redirect := Redirect{From: result.URL, To: resolveURL(result.URL, newEndpoint)}
+		if resp != nil {
+			redirect.StatusCode = resp.StatusCode
+			if resp.Body != nil {
+				resp.Body.Close()
+			}
+		}
+		result.Redirects = append(result.Redirects, redirect)
+		result.URL = redirect.To
+
+		// Let readFeedBody follow any further redirects itself
+		if len(result.Redirects) >= maxRedirects {
+			break
+		}
+	}
+
+	fetched, err := readFeedBody(ctx, result.URL, response)
+	if err != nil {
+		return nil, err
+	}
+	result.StatusCode = http.StatusOK
+	result.Header = fetched.Header
+	result.Truncated = fetched.Truncated
+
+	feed, repairs, err := parseFeed(fetched.Body, fetched.ContentType)
+	if fetched.Truncated {
+		repairs = append([]string{RepairTruncated}, repairs...)
+	}
+	result.Feed = feed
+	result.Repairs = repairs
+	result.ParseError = err
+
+	return result, nil
+}
+
+// resolveURL resolves a Location header against the URL that sent it, some servers send relative redirects
+func resolveURL(base, location string) string {
+	b, err := neturl.Parse(base)
+	if err != nil {
+		return location
+	}
+	l, err := neturl.Parse(location)
+	if err != nil {
+		return location
+	}
+	return b.ResolveReference(l).String()
+}
@@ -0,0 +1,291 @@
+package injest
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/config"
+	"bitbucket.org/jayflux/mypodcasts_injest/logger"
+	"bitbucket.org/jayflux/mypodcasts_injest/metrics"
+	"bitbucket.org/jayflux/mypodcasts_injest/tracing"
+	"github.com/andybalholm/brotli"
+	"github.com/mmcdole/gofeed"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Failure classifications recorded against a podcast when we can't injest it
+const (
+	FailureFetch        = "fetch-error"
+	FailureHTTP         = "http-error"
+	FailureTooLarge     = "feed-too-large"
+	FailureParse        = "parse-error"
+	FailureParseTimeout = "parse-timeout"
+)
+
+// Repairs recorded when a feed hits a limit, RepairTruncated when it was over the size limit and we cut it down to the items we could read,
+// RepairLimitedItems (suffixed with the limit) when it had more items than we keep
+const (
+	RepairTruncated    = "truncated-to-size-limit"
+	RepairLimitedItems = "limited-items"
+)
+
+// acceptEncoding is sent on every feed request, setting this ourselves turns off Go's transparent gzip so we decode (and limit) it
+const acceptEncoding = "gzip, deflate, br"
+
+var (
+	errFeedTooLarge = errors.New("feed too large")
+	errParseTimeout = errors.New("feed took too long to parse")
+)
+
+// feedError carries a failure classification alongside the underlying error
+type feedError struct {
+	class string
+	err   error
+}
+
+func (e *feedError) Error() string {
+	return e.class + ": " + e.err.Error()
+}
+
+// fetchedFeed is the body of a feed after it has been downloaded, decompressed and limited
+type fetchedFeed struct {
+	Body        []byte
+	ContentType string
+	Header      http.Header
+	// Truncated is true if the body hit a size limit and has been cut down to the last complete item
+	Truncated bool
+}
+
+// feedLimits are how much we're prepared to download and process for a single feed
+// Feeds are untrusted input, without these a huge or malicious feed can exhaust the injester
+type feedLimits struct {
+	ResponseBytes     int64
+	DecompressedBytes int64
+	Items             int
+	ParseTimeout      time.Duration
+}
+
+func getFeedLimits() feedLimits {
+	limits := config.Get().Limits
+	return feedLimits{
+		ResponseBytes:     limits.ResponseBytes,
+		DecompressedBytes: limits.DecompressedBytes,
+		Items:             limits.Items,
+		ParseTimeout:      time.Duration(limits.ParseTimeoutSeconds) * time.Second,
+	}
+}
+
+// readFeedBody reads the body from the response we already have, if there isn't one (after a redirect) it fetches the URL again
+// The body is decompressed and capped according to the configured limits
+func readFeedBody(ctx context.Context, url string, response *http.Response) (fetched *fetchedFeed, err error) {
+	ctx, span := tracing.Span(ctx, "injest.read", attribute.String("url", url))
+	defer func() { tracing.End(span, err) }()
+	log := logger.From(ctx)
+	if response == nil || response.Body == nil {
+		client := HTTPClient(FetchTimeout(), false)
+		request, err := http.NewRequestWithContext(tracing.WithHTTPEvents(ctx), "GET", url, nil)
+		if err != nil {
+			return nil, &feedError{FailureFetch, err}
+		}
+		request.Header.Set("Accept-Encoding", acceptEncoding)
+		start := time.Now()
+		response, err = client.Do(request)
+		metrics.FeedFetchDuration.Observe(time.Since(start).Seconds())
+		if err != nil {
+			metrics.FeedFetches.WithLabelValues(metrics.OutcomeError).Inc()
+			return nil, &feedError{FailureFetch, err}
+		}
+		metrics.FeedFetches.WithLabelValues(fetchOutcome(response.StatusCode)).Inc()
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 400 {
+		return nil, &feedError{FailureHTTP, fmt.Errorf("%s returned %s", url, response.Status)}
+	}
+
+	limits := getFeedLimits()
+	body, truncated, err := readLimited(response, limits)
+	if err != nil {
+		return nil, &feedError{FailureFetch, err}
+	}
+	metrics.FeedFetchBytes.Observe(float64(len(body)))
+	span.SetAttributes(attribute.Int("bytes", len(body)), attribute.Bool("truncated", truncated))
+
+	if truncated {
+		log.Warnf("readFeedBody: %s is over the size limit, truncating", url)
+		body, err = truncateFeed(body)
+		if err != nil {
+			return nil, &feedError{FailureTooLarge, err}
+		}
+	}
+
+	return &fetchedFeed{
+		Body:        body,
+		ContentType: response.Header.Get("Content-Type"),
+		Header:      response.Header,
+		Truncated:   truncated,
+	}, nil
+}
+
+// readLimited reads at most limits.ResponseBytes off the wire, and at most limits.DecompressedBytes once decoded
+// It returns true if either limit was reached
+func readLimited(response *http.Response, limits feedLimits) ([]byte, bool, error) {
+	wire := &countingReader{r: io.LimitReader(response.Body, limits.ResponseBytes+1)}
+
+	var decoded io.Reader
+	switch strings.ToLower(strings.TrimSpace(response.Header.Get("Content-Encoding"))) {
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(wire)
+		if err != nil {
+			return nil, false, err
+		}
+		defer gz.Close()
+		decoded = gz
+	case "deflate":
+		fl := flate.NewReader(wire)
+		defer fl.Close()
+		decoded = fl
+	case "br":
+		decoded = brotli.NewReader(wire)
+	default:
+		decoded = wire
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(decoded, limits.DecompressedBytes+1))
+	truncated := wire.n > limits.ResponseBytes || int64(len(body)) > limits.DecompressedBytes
+	// A compressed stream we cut short will error, that's expected when truncating
+	if err != nil && !truncated {
+		return nil, false, err
+	}
+	if int64(len(body)) > limits.DecompressedBytes {
+		body = body[:limits.DecompressedBytes]
+	}
+
+	return body, truncated, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// truncateFeed cuts a partial feed back to the last complete item and closes off the document
+// Most feeds list newest first, so this means we still injest the latest episodes
+func truncateFeed(body []byte) ([]byte, error) {
+	if end := bytes.LastIndex(body, []byte("</item>")); end != -1 {
+		body = append(body[:end+len("</item>")], "</channel></rss>"...)
+		return body, nil
+	}
+	if end := bytes.LastIndex(body, []byte("</entry>")); end != -1 {
+		body = append(body[:end+len("</entry>")], "</feed>"...)
+		return body, nil
+	}
+
+	return nil, errFeedTooLarge
+}
+
+// limitItems keeps the newest limit items, dropping the rest
+func limitItems(feed *gofeed.Feed, limit int) bool {
+	if limit <= 0 || len(feed.Items) <= limit {
+		return false
+	}
+
+	sort.SliceStable(feed.Items, func(i, j int) bool {
+		a, b := feed.Items[i].PublishedParsed, feed.Items[j].PublishedParsed
+		if a == nil || b == nil {
+			return a != nil
+		}
+		return a.After(*b)
+	})
+	feed.Items = feed.Items[:limit]
+	return true
+}
+
+// parseWithTimeout stops waiting on the parser after timeout
+// encoding/xml doesn't expand custom entities, but deeply nested documents can still keep it busy for a long time
+// The parser reads the body through a deadlineReader so an abandoned parse stops at its next read, and frees the body, rather than running on
+// It can't be interrupted between reads though, so a parse can outlive the timeout by however long one chunk of the body takes
+func parseWithTimeout(fp *gofeed.Parser, body []byte, timeout time.Duration) (*gofeed.Feed, error) {
+	type result struct {
+		feed *gofeed.Feed
+		err  error
+	}
+	done := make(chan result, 1)
+	reader := &deadlineReader{r: bytes.NewReader(body), deadline: time.Now().Add(timeout)}
+	go func() {
+		feed, err := fp.Parse(reader)
+		done <- result{feed, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.feed, r.err
+	case <-time.After(timeout):
+		return nil, errParseTimeout
+	}
+}
+
+// parseChunkBytes is the most a deadlineReader hands the parser in one read
+const parseChunkBytes = 4096
+
+// deadlineReader fails every read once its deadline has passed
+// It deliberately isn't an io.ByteReader, so encoding/xml buffers it and reads in chunks we can check the time between
+type deadlineReader struct {
+	r        io.Reader
+	deadline time.Time
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	if time.Now().After(d.deadline) {
+		return 0, errParseTimeout
+	}
+	if len(p) > parseChunkBytes {
+		p = p[:parseChunkBytes]
+	}
+	return d.r.Read(p)
+}
+
+// classifyFailure returns the failure classification for an error from fetching or parsing a feed
+func classifyFailure(err error) string {
+	if fe, ok := err.(*feedError); ok {
+		return fe.class
+	}
+	if err == errParseTimeout {
+		return FailureParseTimeout
+	}
+	return FailureParse
+}
+
+// recordFeedFailure stores why we couldn't injest a feed against its podcast
+func recordFeedFailure(ctx context.Context, url string, err error) {
+	writeErr := getStores().FetchState.SetFailure(ctx, url, classifyFailure(err), err.Error())
+	if writeErr != nil {
+		log.Error("recordFeedFailure: Could not write to DB")
+		log.Error(writeErr)
+	}
+}
+
+// clearFeedFailure removes any failure recorded against a podcast once it injests successfully
+func clearFeedFailure(ctx context.Context, url string) {
+	writeErr := getStores().FetchState.ClearFailure(ctx, url)
+	if writeErr != nil {
+		log.Error("clearFeedFailure: Could not write to DB")
+		log.Error(writeErr)
+	}
+}
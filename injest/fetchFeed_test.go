@@ -0,0 +1,101 @@
+package injest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+func response(body []byte, encoding string) *http.Response {
+	header := http.Header{}
+	if encoding != "" {
+		header.Set("Content-Encoding", encoding)
+	}
+	return &http.Response{StatusCode: 200, Header: header, Body: ioutil.NopCloser(bytes.NewReader(body))}
+}
+
+func TestReadLimited(t *testing.T) {
+	limits := feedLimits{ResponseBytes: 100, DecompressedBytes: 1000}
+
+	body, truncated, err := readLimited(response([]byte("<rss/>"), ""), limits)
+	if err != nil || truncated || string(body) != "<rss/>" {
+		t.Errorf("got %q, %v, %v", body, truncated, err)
+	}
+
+	body, truncated, err = readLimited(response(bytes.Repeat([]byte("a"), 150), ""), limits)
+	if err != nil || !truncated {
+		t.Errorf("over the response limit: got truncated %v, %v", truncated, err)
+	}
+
+	// Compresses well under ResponseBytes but decompresses well over DecompressedBytes
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(bytes.Repeat([]byte("a"), 5000))
+	gz.Close()
+	body, truncated, err = readLimited(response(compressed.Bytes(), "gzip"), limits)
+	if err != nil || !truncated || len(body) != 1000 {
+		t.Errorf("over the decompressed limit: got %d bytes, truncated %v, %v", len(body), truncated, err)
+	}
+}
+
+func TestTruncateFeed(t *testing.T) {
+	body, err := truncateFeed([]byte("<rss><channel><item>1</item><item>2</item><item>3"))
+	if err != nil || string(body) != "<rss><channel><item>1</item><item>2</item></channel></rss>" {
+		t.Errorf("got %q, %v", body, err)
+	}
+	body, err = truncateFeed([]byte("<feed><entry>1</entry><entry>2"))
+	if err != nil || string(body) != "<feed><entry>1</entry></feed>" {
+		t.Errorf("got %q, %v", body, err)
+	}
+	if _, err = truncateFeed([]byte("<rss><channel><title>")); err != errFeedTooLarge {
+		t.Errorf("got %v, want errFeedTooLarge", err)
+	}
+}
+
+func TestLimitItems(t *testing.T) {
+	feed := &gofeed.Feed{}
+	for i := 1; i <= 5; i++ {
+		published := time.Date(2020, 1, i, 0, 0, 0, 0, time.UTC)
+		feed.Items = append(feed.Items, &gofeed.Item{Title: fmt.Sprint(i), PublishedParsed: &published})
+	}
+	if !limitItems(feed, 2) {
+		t.Fatal("got no items dropped")
+	}
+	if len(feed.Items) != 2 || feed.Items[0].Title != "5" || feed.Items[1].Title != "4" {
+		t.Errorf("got %d items, want the newest 2", len(feed.Items))
+	}
+	if limitItems(feed, 0) {
+		t.Error("a limit of 0 dropped items")
+	}
+}
+
+func TestParseWithTimeout(t *testing.T) {
+	body := []byte(`<rss version="2.0"><channel><title>Hi</title></channel></rss>`)
+	feed, err := parseWithTimeout(gofeed.NewParser(), body, time.Second)
+	if err != nil || feed.Title != "Hi" {
+		t.Fatalf("got %v, %v", feed, err)
+	}
+	// Bigger than a chunk, so it's read in pieces
+	body = []byte(`<rss version="2.0"><channel><title>Hi</title>` + strings.Repeat("<item><title>An episode</title></item>", 1000) + `</channel></rss>`)
+	feed, err = parseWithTimeout(gofeed.NewParser(), body, time.Second)
+	if err != nil || len(feed.Items) != 1000 {
+		t.Fatalf("got %v, %v", feed, err)
+	}
+
+	// An abandoned parse stops at its next read rather than working through the rest of the body
+	reader := &deadlineReader{r: strings.NewReader(strings.Repeat("<a>", 10000)), deadline: time.Now().Add(-time.Second)}
+	if _, err := reader.Read(make([]byte, 10)); err != errParseTimeout {
+		t.Errorf("got %v reading after the deadline, want errParseTimeout", err)
+	}
+	reader.deadline = time.Now().Add(time.Minute)
+	if n, _ := reader.Read(make([]byte, 10*parseChunkBytes)); n > parseChunkBytes {
+		t.Errorf("read %d bytes at once, want at most %d", n, parseChunkBytes)
+	}
+}
@@ -1,46 +1,111 @@
 package injest
 
 import (
+	"context"
 	"regexp"
 
 	// Prelude for sql package
 	"bitbucket.org/jayflux/mypodcasts_injest/logger"
+	"bitbucket.org/jayflux/mypodcasts_injest/metrics"
+	"bitbucket.org/jayflux/mypodcasts_injest/tracing"
 	_ "github.com/lib/pq"
-	"github.com/mmcdole/gofeed"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // For performance, compile this once at the beginning
 var (
 	UUIDRegex = regexp.MustCompile("^[a-fA-F0-9]{8}-[a-fA-F0-9]{4}-4[a-fA-F0-9]{3}-[8|9|aA|bB][a-fA-F0-9]{3}-[a-fA-F0-9]{12}$")
-	url       string
 	log       = logger.Log
 )
 
-func Injest(url string) {
+// Injest fetches a feed and writes the podcast and its episodes to the database
+// The error is returned so callers can count failures, it has already been logged, and recorded against the podcast if the feed was at fault
+// Cancelling ctx stops the fetch, or stops between episodes once we're writing, without counting as a failure
+func Injest(ctx context.Context, feedURL string) (err error) {
+	ctx, span := tracing.Span(ctx, "injest", attribute.String("feed_url", feedURL))
+	defer func() { tracing.End(span, err) }()
+	ctx = logger.WithFields(ctx, logger.Fields{"feed_url": feedURL})
+	log := logger.From(ctx)
 	// checkPodcastUrl can fail if the url is down or 500s
 	// lookahead to get metadata, such as headers, redirects etc
-	url, NotModified, err := checkPodcastUrl(url)
+	url, response, NotModified, err := checkPodcastUrl(ctx, feedURL)
+	if cancelled(ctx, err) {
+		return ctx.Err()
+	}
 	if err != nil {
-		log.Printf("%s", err)
-		return
+		log.Error(err)
+		recordFeedFailure(ctx, feedURL, &feedError{FailureFetch, err})
+		return err
 	}
 
 	if NotModified {
 		log.Printf("Request 304 Not Modified for %s", url)
+		response.Body.Close()
 		// Even though we got a not modified response we should still record a fetch has happened
-		updateFetchForPodcastURL(url)
-		return
+		updateFetchForPodcastURL(ctx, url)
+		return nil
 	}
 
-	fp := gofeed.NewParser()
-	feed, err := fp.ParseURL(url)
+	// Re-use the body we already fetched, this used to be downloaded twice
+	fetched, err := readFeedBody(ctx, url, response)
+	if cancelled(ctx, err) {
+		return ctx.Err()
+	}
 	if err != nil {
-		log.Printf("Injest: Error parsing %s\n", url)
-		log.Println(err)
+		log.Errorf("Injest: Error reading %s", url)
+		log.Error(err)
+		recordFeedFailure(ctx, url, err)
+		return err
+	}
+
+	_, parseSpan := tracing.Span(ctx, "injest.parse", attribute.Int("bytes", len(fetched.Body)))
+	feed, repairs, err := parseFeed(fetched.Body, fetched.ContentType)
+	tracing.End(parseSpan, err)
+	if fetched.Truncated {
+		repairs = append([]string{RepairTruncated}, repairs...)
+	}
+	recordParseResult(url, repairs, err)
+	if err != nil {
+		log.Errorf("Injest: Error parsing %s", url)
+		log.Error(err)
+		recordFeedFailure(ctx, url, err)
 		// Early return instead of fatal erroring, hopefully this should keep the process running
-		return
+		return err
+	}
+	if len(repairs) > 0 {
+		log.Printf("Injest: %s parsed after repairs %v", url, repairs)
 	}
 
-	process(feed, url)
+	id, err := process(ctx, feed, url)
+	if ctx.Err() != nil {
+		log.Printf("Injest: Stopped part way through %s", url)
+		return ctx.Err()
+	}
+	if err != nil {
+		// Our database is at fault rather than the feed, so it isn't recorded against it
+		log.Errorf("Injest: Could not write %s to DB", url)
+		log.Error(err)
+		return err
+	}
+	clearFeedFailure(ctx, url)
+	archiveSnapshot(id, url, fetched)
+	rememberURL(ctx, id, feedURL)
+	return nil
+}
+
+// observeTx times a transaction for metrics.DBTransactionDuration and traces it, call the function it returns once it's done
+func observeTx(ctx context.Context, name string) (context.Context, func()) {
+	timer := prometheus.NewTimer(metrics.DBTransactionDuration.WithLabelValues(name))
+	ctx, span := tracing.Span(ctx, "db."+name)
+	return ctx, func() {
+		timer.ObserveDuration()
+		span.End()
+	}
+}
 
+// cancelled reports whether err is down to ctx being cancelled, which happens when we're shutting down
+// Those aren't worth dying over or recording against the feed, it will be injested again next time
+func cancelled(ctx context.Context, err error) bool {
+	return err != nil && ctx.Err() != nil
 }
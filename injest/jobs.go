@@ -0,0 +1,84 @@
+package injest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/queue"
+)
+
+// InjestFeedJob is the payload of a queue.TypeInjestFeed job
+type InjestFeedJob struct {
+	URL string `json:"url"`
+}
+
+// InjestFeedResult is what an injest-feed job stores when it's finished
+type InjestFeedResult struct {
+	PodcastID string `json:"podcastId,omitempty"`
+}
+
+// ProbeEnclosureJob is the payload of a queue.TypeProbeEnclosure job
+type ProbeEnclosureJob struct {
+	URL string `json:"url"`
+}
+
+// ProbeEnclosureResult is what the server said about an enclosure
+type ProbeEnclosureResult struct {
+	StatusCode    int    `json:"statusCode"`
+	ContentType   string `json:"contentType"`
+	ContentLength int64  `json:"contentLength"`
+	FinalURL      string `json:"finalUrl"`
+}
+
+// RegisterJobHandlers registers the queue handlers for work done by this package
+func RegisterJobHandlers() {
+	queue.Register(queue.TypeInjestFeed, injestFeedHandler)
+	queue.Register(queue.TypeProbeEnclosure, probeEnclosureHandler)
+}
+
+// EnqueueInjest queues a feed to be injested, if it's already queued that job's ID is returned
+func EnqueueInjest(url string, priority int) (string, error) {
+	return queue.Enqueue(queue.TypeInjestFeed, InjestFeedJob{URL: url}, queue.Options{Priority: priority, DedupeKey: url})
+}
+
+func injestFeedHandler(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var job InjestFeedJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return nil, err
+	}
+	err := Injest(ctx, job.URL)
+	// Sources and IDs may have been recorded when the job was queued, before there was a podcast to link them to
+	LinkDiscovered([]string{job.URL})
+	return InjestFeedResult{PodcastID: PodcastIDForURL(job.URL)}, err
+}
+
+// probeEnclosureHandler checks an enclosure can be downloaded, without downloading it
+func probeEnclosureHandler(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var job ProbeEnclosureJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, "HEAD", job.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := HTTPClient(30*time.Second, false).Do(request)
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+
+	result := ProbeEnclosureResult{
+		StatusCode:    response.StatusCode,
+		ContentType:   response.Header.Get("Content-Type"),
+		ContentLength: response.ContentLength,
+		FinalURL:      response.Request.URL.String(),
+	}
+	if response.StatusCode >= http.StatusBadRequest {
+		return result, fmt.Errorf("%s returned %s", job.URL, response.Status)
+	}
+	return result, nil
+}
@@ -0,0 +1,233 @@
+package injest
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"mime"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+)
+
+// Repairs we may apply to a feed before it will parse, these are stored against each parse so keep them stable
+const (
+	RepairTrimmedLeadingContent = "trimmed-leading-content"
+	RepairStrippedBOM           = "stripped-bom"
+	RepairTranscoded            = "transcoded"
+	RepairRewroteDeclaration    = "rewrote-declaration"
+	RepairStrippedIllegalChars  = "stripped-illegal-chars"
+	RepairEscapedAmpersands     = "escaped-ampersands"
+	RepairReplacedHTMLEntities  = "replaced-html-entities"
+)
+
+// xmlEntities are the only named entities XML knows about, anything else (&nbsp; etc) comes from HTML
+var xmlEntities = map[string]bool{"lt": true, "gt": true, "quot": true, "apos": true, "amp": true}
+
+var (
+	utf8BOM            = []byte{0xEF, 0xBB, 0xBF}
+	xmlDeclarationExpr = regexp.MustCompile(`^<\?xml[^>]*\?>`)
+	xmlEncodingExpr    = regexp.MustCompile(`encoding\s*=\s*["']([A-Za-z0-9._:-]+)["']`)
+)
+
+// normaliseFeed tries to turn a broken feed body into valid UTF-8 XML
+// It returns the repaired body along with the names of the repairs applied, in the order they were applied
+func normaliseFeed(body []byte, contentType string) ([]byte, []string) {
+	repairs := make([]string, 0)
+
+	// Some servers send whitespace or junk before the XML starts, which is a hard error
+	if start := bytes.IndexByte(body, '<'); start > 0 {
+		if !bytes.Equal(body[:start], utf8BOM) {
+			body = body[start:]
+			repairs = append(repairs, RepairTrimmedLeadingContent)
+		}
+	}
+
+	if bytes.HasPrefix(body, utf8BOM) {
+		body = body[len(utf8BOM):]
+		repairs = append(repairs, RepairStrippedBOM)
+	}
+
+	label := detectCharset(body, contentType)
+	if label != "utf-8" {
+		if enc, _ := charset.Lookup(label); enc != nil {
+			if transcoded, err := enc.NewDecoder().Bytes(body); err == nil {
+				body = transcoded
+				repairs = append(repairs, RepairTranscoded+":"+label)
+			}
+		}
+	}
+
+	// Once we're UTF-8 the declaration needs to say so, otherwise the parser will try to transcode again
+	if declaration := xmlDeclarationExpr.Find(body); declaration != nil {
+		if match := xmlEncodingExpr.FindSubmatch(declaration); match != nil && !isUTF8Label(string(match[1])) {
+			fixed := xmlEncodingExpr.ReplaceAll(declaration, []byte(`encoding="UTF-8"`))
+			body = append(fixed, body[len(declaration):]...)
+			repairs = append(repairs, RepairRewroteDeclaration)
+		}
+	}
+
+	if cleaned, changed := stripIllegalXMLChars(body); changed {
+		body = cleaned
+		repairs = append(repairs, RepairStrippedIllegalChars)
+	}
+
+	fixed, escaped, replaced := fixReferences(body)
+	body = fixed
+	if escaped {
+		repairs = append(repairs, RepairEscapedAmpersands)
+	}
+	if replaced {
+		repairs = append(repairs, RepairReplacedHTMLEntities)
+	}
+
+	return body, repairs
+}
+
+// detectCharset works out what the body is really encoded in
+// Declarations are often wrong, so if the bytes are valid UTF-8 we trust that over anything the publisher says.
+// Otherwise we go with the Content-Type header, then the XML declaration, and finally fall back to Windows-1252
+// which is what most mislabelled "ISO-8859-1" feeds actually are
+func detectCharset(body []byte, contentType string) string {
+	if utf8.Valid(body) {
+		return "utf-8"
+	}
+
+	if _, params, err := mime.ParseMediaType(contentType); err == nil {
+		if label := strings.ToLower(params["charset"]); label != "" && !isUTF8Label(label) {
+			if enc, name := charset.Lookup(label); enc != nil {
+				return name
+			}
+		}
+	}
+
+	if declaration := xmlDeclarationExpr.Find(body); declaration != nil {
+		if match := xmlEncodingExpr.FindSubmatch(declaration); match != nil && !isUTF8Label(string(match[1])) {
+			if enc, name := charset.Lookup(string(match[1])); enc != nil {
+				return name
+			}
+		}
+	}
+
+	return "windows-1252"
+}
+
+func isUTF8Label(label string) bool {
+	label = strings.ToLower(strings.TrimSpace(label))
+	return label == "utf-8" || label == "utf8"
+}
+
+// stripIllegalXMLChars removes anything not allowed by https://www.w3.org/TR/xml/#charsets
+// This includes invalid UTF-8 sequences, which we can't do anything sensible with at this point
+func stripIllegalXMLChars(body []byte) ([]byte, bool) {
+	changed := false
+	out := make([]byte, 0, len(body))
+	for len(body) > 0 {
+		r, size := utf8.DecodeRune(body)
+		if isLegalXMLChar(r) && !(r == utf8.RuneError && size == 1) {
+			out = append(out, body[:size]...)
+		} else {
+			changed = true
+		}
+		body = body[size:]
+	}
+	return out, changed
+}
+
+func isLegalXMLChar(r rune) bool {
+	return r == 0x09 || r == 0x0A || r == 0x0D ||
+		(r >= 0x20 && r <= 0xD7FF) ||
+		(r >= 0xE000 && r <= 0xFFFD) ||
+		(r >= 0x10000 && r <= 0x10FFFF)
+}
+
+// fixReferences replaces & with &amp; unless it already starts an entity or character reference,
+// and swaps HTML only entities such as &nbsp; for numeric references the XML parser understands.
+// CDATA sections are left alone as ampersands are allowed in there
+func fixReferences(body []byte) ([]byte, bool, bool) {
+	cdataStart := []byte("<![CDATA[")
+	cdataEnd := []byte("]]>")
+	escaped := false
+	replaced := false
+	out := make([]byte, 0, len(body))
+
+	for i := 0; i < len(body); i++ {
+		if body[i] == '<' && bytes.HasPrefix(body[i:], cdataStart) {
+			end := bytes.Index(body[i:], cdataEnd)
+			if end == -1 {
+				out = append(out, body[i:]...)
+				break
+			}
+			out = append(out, body[i:i+end+len(cdataEnd)]...)
+			i += end + len(cdataEnd) - 1
+			continue
+		}
+
+		if body[i] == '&' {
+			if !isReference(body[i+1:]) {
+				out = append(out, "&amp;"...)
+				escaped = true
+				continue
+			}
+			end := bytes.IndexByte(body[i:], ';')
+			name := string(body[i+1 : i+end])
+			if name[0] != '#' && !xmlEntities[name] {
+				reference := string(body[i : i+end+1])
+				if unescaped := html.UnescapeString(reference); unescaped != reference {
+					for _, r := range unescaped {
+						out = append(out, fmt.Sprintf("&#%d;", r)...)
+					}
+					replaced = true
+					i += end
+					continue
+				}
+				// Not an entity anyone knows about, treat it as text
+				out = append(out, "&amp;"...)
+				escaped = true
+				continue
+			}
+		}
+		out = append(out, body[i])
+	}
+
+	return out, escaped, replaced
+}
+
+// isReference reports whether b (the bytes after an &) is a named entity, or a decimal/hex character reference
+func isReference(b []byte) bool {
+	end := bytes.IndexByte(b, ';')
+	// Entity names this long aren't real, it's an unescaped & followed by text that happens to contain a ;
+	if end < 1 || end > 32 {
+		return false
+	}
+	ref := b[:end]
+	if ref[0] == '#' {
+		ref = ref[1:]
+		hex := len(ref) > 0 && (ref[0] == 'x' || ref[0] == 'X')
+		if hex {
+			ref = ref[1:]
+		}
+		if len(ref) == 0 {
+			return false
+		}
+		for _, c := range ref {
+			isDigit := c >= '0' && c <= '9'
+			isHex := (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+			if !isDigit && !(hex && isHex) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for i, c := range ref {
+		isLetter := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		isDigit := c >= '0' && c <= '9'
+		if !isLetter && !(i > 0 && (isDigit || c == '_' || c == '-' || c == '.')) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,87 @@
+package injest
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormaliseFeed(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		want        string
+		repairs     []string
+	}{
+		{
+			name:    "valid feed is left alone",
+			body:    `<?xml version="1.0" encoding="UTF-8"?><rss><title>Hi &amp; bye</title></rss>`,
+			want:    `<?xml version="1.0" encoding="UTF-8"?><rss><title>Hi &amp; bye</title></rss>`,
+			repairs: []string{},
+		},
+		{
+			name:    "leading junk and BOM",
+			body:    "\n\n\xEF\xBB\xBF<rss/>",
+			want:    "<rss/>",
+			repairs: []string{RepairTrimmedLeadingContent},
+		},
+		{
+			name:    "BOM",
+			body:    "\xEF\xBB\xBF<rss/>",
+			want:    "<rss/>",
+			repairs: []string{RepairStrippedBOM},
+		},
+		{
+			name:    "mislabelled Latin-1",
+			body:    "<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?><rss><title>Caf\xe9 \x93quoted\x94</title></rss>",
+			want:    `<?xml version="1.0" encoding="UTF-8"?><rss><title>Café “quoted”</title></rss>`,
+			repairs: []string{RepairTranscoded + ":windows-1252", RepairRewroteDeclaration},
+		},
+		{
+			name:        "charset from the Content-Type",
+			body:        "<rss><title>\xcf\xf0\xe8\xe2\xe5\xf2</title></rss>",
+			contentType: "application/rss+xml; charset=windows-1251",
+			want:        "<rss><title>Привет</title></rss>",
+			repairs:     []string{RepairTranscoded + ":windows-1251"},
+		},
+		{
+			name:    "illegal control characters",
+			body:    "<rss><title>a\x01b\x1fc</title></rss>",
+			want:    "<rss><title>abc</title></rss>",
+			repairs: []string{RepairStrippedIllegalChars},
+		},
+		{
+			name:    "bare ampersands and HTML entities",
+			body:    "<rss><title>Tom & Jerry&nbsp;&copy; &amp; &#169;</title></rss>",
+			want:    "<rss><title>Tom &amp; Jerry&#160;&#169; &amp; &#169;</title></rss>",
+			repairs: []string{RepairEscapedAmpersands, RepairReplacedHTMLEntities},
+		},
+	}
+	for _, test := range tests {
+		got, repairs := normaliseFeed([]byte(test.body), test.contentType)
+		if string(got) != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+		if !reflect.DeepEqual(repairs, test.repairs) {
+			t.Errorf("%s: got repairs %q, want %q", test.name, repairs, test.repairs)
+		}
+	}
+}
+
+func TestParseFeedRepairs(t *testing.T) {
+	body := "<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?>\n<rss version=\"2.0\"><channel><title>Caf\xe9 & Friends&nbsp;</title><item><title>One</title></item></channel></rss>"
+	feed, repairs, err := parseFeed([]byte(body), "text/xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if feed.Title != "Café & Friends " {
+		t.Errorf("got title %q", feed.Title)
+	}
+	if len(repairs) == 0 {
+		t.Error("got no repairs")
+	}
+
+	if _, _, err := parseFeed([]byte("not a feed"), ""); err == nil {
+		t.Error("got no error parsing something that isn't a feed")
+	}
+}
@@ -0,0 +1,153 @@
+package injest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/config"
+	"bitbucket.org/jayflux/mypodcasts_injest/metrics"
+	"github.com/mmcdole/gofeed"
+)
+
+// parseFeed parses a feed body, if it fails as-is we normalise it and try again in lenient mode.
+// The repairs needed to get it parsing are returned so they can be recorded against the feed
+// Parsing is abandoned after the configured parse timeout, and only the newest items up to the item limit are kept
+func parseFeed(body []byte, contentType string) (*gofeed.Feed, []string, error) {
+	limits := getFeedLimits()
+	fp := gofeed.NewParser()
+	feed, err := parseWithTimeout(fp, body, limits.ParseTimeout)
+	if err == nil {
+		return feed, limitFeed(feed, limits, []string{}), nil
+	}
+	if err == errParseTimeout {
+		return nil, []string{}, err
+	}
+
+	repaired, repairs := normaliseFeed(body, contentType)
+	if len(repairs) == 0 {
+		// Nothing we know how to fix, the original error is the most useful
+		return nil, repairs, err
+	}
+
+	feed, lenientErr := parseWithTimeout(fp, repaired, limits.ParseTimeout)
+	if lenientErr == errParseTimeout {
+		return nil, repairs, lenientErr
+	}
+	if lenientErr != nil {
+		return nil, repairs, fmt.Errorf("%s (after repairs: %s)", err, lenientErr)
+	}
+
+	return feed, limitFeed(feed, limits, repairs), nil
+}
+
+// limitFeed applies the item limit, recording it as a repair if any items were dropped
+func limitFeed(feed *gofeed.Feed, limits feedLimits, repairs []string) []string {
+	if limitItems(feed, limits.Items) {
+		repairs = append(repairs, fmt.Sprintf("%s:%d", RepairLimitedItems, limits.Items))
+	}
+	return repairs
+}
+
+// recordParseResult keeps a log of each parse, whether it succeeded and what we had to repair to get there
+func recordParseResult(url string, repairs []string, parseErr error) {
+	repairsJSON, err := json.Marshal(repairs)
+	if err != nil {
+		log.Error("recordParseResult: unable to Marshal repairs for " + url)
+	}
+
+	var errorMessage *string
+	if parseErr != nil {
+		metrics.FeedParseFailures.Inc()
+		message := parseErr.Error()
+		errorMessage = &message
+	}
+
+	_, writeErr := getDB().Exec("INSERT INTO feed_parse_log (feed_url, parsed_at, success, repairs, error) VALUES ($1, now(), $2, $3, $4)", url, parseErr == nil, repairsJSON, errorMessage)
+	if writeErr != nil {
+		log.Error("recordParseResult: Could not write to DB")
+		log.Error(writeErr)
+	}
+}
+
+// PruneParseLog deletes parse results older than parseLog.keepDays, returning how many went
+func PruneParseLog(ctx context.Context) (int, error) {
+	result, err := getDB().ExecContext(ctx, "DELETE FROM feed_parse_log WHERE parsed_at < now() - make_interval(days => $1)", config.Get().ParseLog.KeepDays)
+	if err != nil {
+		return 0, fmt.Errorf("PruneParseLog: %s", err)
+	}
+	deleted, _ := result.RowsAffected()
+	return int(deleted), nil
+}
+
+// ParseReport prints parse failure rates and the repairs we've been making over the last number of days
+func ParseReport(days int) {
+	var (
+		total    int
+		failures int
+		repaired int
+	)
+	since := time.Now().AddDate(0, 0, -days)
+
+	err := getDB().QueryRow("SELECT count(*), count(*) FILTER (WHERE NOT success), count(*) FILTER (WHERE success AND jsonb_array_length(repairs) > 0) FROM feed_parse_log WHERE parsed_at > $1", since).Scan(&total, &failures, &repaired)
+	if err != nil {
+		log.Error(err)
+		log.Fatal("ParseReport: error in query")
+	}
+
+	fmt.Printf("Parses in the last %d days: %d\n", days, total)
+	if total == 0 {
+		return
+	}
+	fmt.Printf("Failed: %d (%.2f%%)\n", failures, 100*float64(failures)/float64(total))
+	fmt.Printf("Parsed after repairs: %d (%.2f%%)\n", repaired, 100*float64(repaired)/float64(total))
+
+	rows, err := getDB().Query("SELECT repair, count(*) FROM feed_parse_log, jsonb_array_elements_text(repairs) AS repair WHERE parsed_at > $1 GROUP BY repair ORDER BY count(*) DESC", since)
+	if err != nil {
+		log.Error(err)
+		log.Fatal("ParseReport: error in query")
+	}
+	defer rows.Close()
+	fmt.Println("\nRepairs applied:")
+	for rows.Next() {
+		var (
+			repair string
+			count  int
+		)
+		rows.Scan(&repair, &count)
+		fmt.Printf("  %-40s %d\n", repair, count)
+	}
+
+	classes, err := getDB().Query("SELECT last_failure, count(*) FROM podcasts WHERE last_failure IS NOT NULL GROUP BY last_failure ORDER BY count(*) DESC")
+	if err != nil {
+		log.Error(err)
+		log.Fatal("ParseReport: error in query")
+	}
+	defer classes.Close()
+	fmt.Println("\nPodcasts currently failing:")
+	for classes.Next() {
+		var (
+			class string
+			count int
+		)
+		classes.Scan(&class, &count)
+		fmt.Printf("  %-40s %d\n", class, count)
+	}
+
+	failing, err := getDB().Query("SELECT feed_url, count(*) FROM feed_parse_log WHERE parsed_at > $1 AND NOT success GROUP BY feed_url ORDER BY count(*) DESC LIMIT 20", since)
+	if err != nil {
+		log.Error(err)
+		log.Fatal("ParseReport: error in query")
+	}
+	defer failing.Close()
+	fmt.Println("\nMost frequently failing feeds:")
+	for failing.Next() {
+		var (
+			feedURL string
+			count   int
+		)
+		failing.Scan(&feedURL, &count)
+		fmt.Printf("  %-80s %d\n", feedURL, count)
+	}
+}
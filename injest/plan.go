@@ -0,0 +1,330 @@
+package injest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/store"
+	"github.com/mmcdole/gofeed"
+)
+
+// What injesting a feed would do to the podcast
+const (
+	PlanCreate    = "create"
+	PlanUpdate    = "update"
+	PlanUnchanged = "unchanged"
+)
+
+// What injesting a feed would do to each episode
+const (
+	EpisodeAdd     = "add"
+	EpisodeUpdate  = "update"
+	EpisodeRemoved = "removed"
+)
+
+// podcastFields and episodeFields are the columns we compare, in the order we report them
+var (
+	podcastFields = []string{"title", "description", "link", "updated", "language", "copyright", "author", "image", "itunes_ext", "categories"}
+	episodeFields = []string{"title", "description", "published", "author", "image", "enclosures", "itunes_ext"}
+)
+
+// Plan describes what injesting a feed would change, without changing anything
+type Plan struct {
+	FeedURL   string          `json:"feedUrl"`
+	PodcastID string          `json:"podcastId,omitempty"`
+	Action    string          `json:"action"`
+	URLMoves  []URLMove       `json:"urlMoves"`
+	Changes   []FieldChange   `json:"changes"`
+	Episodes  []EpisodeChange `json:"episodes"`
+	Repairs   []string        `json:"repairs"`
+}
+
+// URLMove is a change of feed URL we would apply
+type URLMove struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Reason string `json:"reason"`
+}
+
+// FieldChange is a single field whose value would change
+type FieldChange = store.FieldChange
+
+// EpisodeChange is an episode that would be added, updated, or is no longer in the feed
+// Removed episodes are reported but not deleted, process never deletes episodes
+type EpisodeChange struct {
+	GUID    string        `json:"guid"`
+	Title   string        `json:"title"`
+	Action  string        `json:"action"`
+	Changes []FieldChange `json:"changes,omitempty"`
+}
+
+// DryRun fetches and parses a feed then works out what Injest would do with it, nothing is written to the database
+// Caching headers aren't sent so we always get the full feed to compare against
+func DryRun(ctx context.Context, feedURL string) (*Plan, error) {
+	plan := &Plan{FeedURL: feedURL, URLMoves: []URLMove{}, Changes: []FieldChange{}, Episodes: []EpisodeChange{}}
+
+	result, err := Fetch(ctx, feedURL)
+	if err != nil {
+		return nil, err
+	}
+	if result.ParseError != nil {
+		return nil, result.ParseError
+	}
+	plan.Repairs = result.Repairs
+
+	// Injest swaps the URL on a redirect if we already have the podcast
+	for _, redirect := range result.Redirects {
+		exists, err := urlExistsInDB(ctx, redirect.From)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			plan.URLMoves = append(plan.URLMoves, URLMove{From: redirect.From, To: redirect.To, Reason: "http-redirect"})
+		}
+	}
+
+	if err := planProcess(ctx, plan, result.Feed, result.URL); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// planProcess mirrors the decisions process makes, filling in plan instead of writing to the database
+func planProcess(ctx context.Context, plan *Plan, feed *gofeed.Feed, url string) error {
+	// The podcast is found by its URL before any moves are applied
+	lookupURL := url
+	if len(plan.URLMoves) > 0 {
+		lookupURL = plan.URLMoves[0].From
+	}
+
+	if feed.ITunesExt != nil && feed.ITunesExt.NewFeedURL != "" && feed.ITunesExt.NewFeedURL != url {
+		exists, err := urlExistsInDB(ctx, url)
+		if err != nil {
+			return err
+		}
+		if exists || lookupURL != url {
+			plan.URLMoves = append(plan.URLMoves, URLMove{From: url, To: feed.ITunesExt.NewFeedURL, Reason: "itunes-new-feed-url"})
+		}
+		url = feed.ITunesExt.NewFeedURL
+	}
+	plan.FeedURL = url
+	applyDirectoryMetadata(ctx, feed, url)
+
+	doesPodcastExist, id, digest, err := podcastExists(ctx, lookupURL)
+	if err == nil && !doesPodcastExist && lookupURL != url {
+		doesPodcastExist, id, digest, err = podcastExists(ctx, url)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !doesPodcastExist {
+		plan.Action = PlanCreate
+		for _, episode := range feed.Items {
+			plan.Episodes = append(plan.Episodes, EpisodeChange{GUID: episode.GUID, Title: episode.Title, Action: EpisodeAdd})
+		}
+		return nil
+	}
+
+	plan.PodcastID = id
+	if generateDigestFromPodcast(feed) == digest {
+		plan.Action = PlanUnchanged
+		return nil
+	}
+
+	plan.Action = PlanUpdate
+	plan.Changes = diffFields(getPodcastFields(ctx, id), podcastFieldsFromFeed(feed), podcastFields)
+
+	hashes := getEpisodesHashesFromPodcast(ctx, id)
+	inFeed := make(map[string]bool)
+	for _, episode := range feed.Items {
+		inFeed[episode.GUID] = true
+		if digestExists(episode, hashes) {
+			continue
+		}
+		exists, err := episodeGuidExists(ctx, episode)
+		if err != nil {
+			return err
+		}
+		if exists {
+			changes := diffFields(getEpisodeFields(ctx, episode.GUID), episodeFieldsFromItem(episode), episodeFields)
+			plan.Episodes = append(plan.Episodes, EpisodeChange{GUID: episode.GUID, Title: episode.Title, Action: EpisodeUpdate, Changes: changes})
+		} else {
+			plan.Episodes = append(plan.Episodes, EpisodeChange{GUID: episode.GUID, Title: episode.Title, Action: EpisodeAdd})
+		}
+	}
+
+	rows, err := getDB().Query("SELECT COALESCE(guid, ''), COALESCE(title, '') FROM podcast_episodes WHERE parent = $1 ORDER BY published_parsed DESC", id)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var guid, title string
+		if err := rows.Scan(&guid, &title); err != nil {
+			log.Error(err)
+			continue
+		}
+		if !inFeed[guid] {
+			plan.Episodes = append(plan.Episodes, EpisodeChange{GUID: guid, Title: title, Action: EpisodeRemoved})
+		}
+	}
+	return nil
+}
+
+// getPodcastFields returns the current values of podcastFields, JSON columns are normalised so they can be compared
+func getPodcastFields(ctx context.Context, id string) map[string]string {
+	values, err := getStores().Podcasts.PodcastFields(ctx, id)
+	if err != nil {
+		log.Error(err)
+	}
+	return fieldMap(podcastFields, values)
+}
+
+// getEpisodeFields returns the current values of episodeFields for the episode with this GUID
+func getEpisodeFields(ctx context.Context, guid string) map[string]string {
+	values, err := getStores().Episodes.EpisodeFields(ctx, guid)
+	if err != nil {
+		log.Error(err)
+	}
+	return fieldMap(episodeFields, values)
+}
+
+func podcastFieldsFromFeed(feed *gofeed.Feed) map[string]string {
+	return map[string]string{
+		"title":       feed.Title,
+		"description": feed.Description,
+		"link":        feed.Link,
+		"updated":     feed.Updated,
+		"language":    feed.Language,
+		"copyright":   feed.Copyright,
+		"author":      marshalField(feed.Author),
+		"image":       marshalField(feed.Image),
+		"itunes_ext":  marshalField(feed.ITunesExt),
+		"categories":  marshalField(feed.Categories),
+	}
+}
+
+func episodeFieldsFromItem(episode *gofeed.Item) map[string]string {
+	return map[string]string{
+		"title":       episode.Title,
+		"description": episode.Description,
+		"published":   episode.Published,
+		"author":      marshalField(episode.Author),
+		"image":       marshalField(episode.Image),
+		"enclosures":  marshalField(episode.Enclosures),
+		"itunes_ext":  marshalField(episode.ITunesExt),
+	}
+}
+
+func fieldMap(fields []string, values map[string]string) map[string]string {
+	m := make(map[string]string)
+	for _, field := range fields {
+		m[field] = values[field]
+		if strings.HasPrefix(values[field], "{") || strings.HasPrefix(values[field], "[") || values[field] == "null" {
+			m[field] = normaliseJSON(values[field])
+		}
+	}
+	return m
+}
+
+// diffFields compares before and after, returning the fields that differ
+// image is merged rather than replaced when written (image processing adds its own keys), so it's compared the same way
+func diffFields(before, after map[string]string, fields []string) []FieldChange {
+	changes := make([]FieldChange, 0)
+	for _, field := range fields {
+		a := after[field]
+		if field == "image" {
+			a = mergeJSON(before[field], a)
+		}
+		if before[field] != a {
+			changes = append(changes, FieldChange{Field: field, Before: before[field], After: a})
+		}
+	}
+	return changes
+}
+
+// marshalField encodes a value the same way we write it to the database, normalised for comparison
+func marshalField(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return normaliseJSON(string(b))
+}
+
+// normaliseJSON re-encodes JSON so Postgres' jsonb formatting and ours compare equal
+func normaliseJSON(s string) string {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return s
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// mergeJSON does what jsonb's || does to two objects, keys in b win
+func mergeJSON(a, b string) string {
+	var objA, objB map[string]interface{}
+	if json.Unmarshal([]byte(a), &objA) != nil || json.Unmarshal([]byte(b), &objB) != nil || objA == nil || objB == nil {
+		return b
+	}
+	for k, v := range objB {
+		objA[k] = v
+	}
+	merged, _ := json.Marshal(objA)
+	return string(merged)
+}
+
+// Print writes a human readable version of the plan
+func (p *Plan) Print(w io.Writer) {
+	fmt.Fprintf(w, "Feed: %s\n", p.FeedURL)
+	if p.PodcastID != "" {
+		fmt.Fprintf(w, "Podcast: %s\n", p.PodcastID)
+	}
+	fmt.Fprintf(w, "Action: %s\n", p.Action)
+	if len(p.Repairs) > 0 {
+		fmt.Fprintf(w, "Repairs: %s\n", strings.Join(p.Repairs, ", "))
+	}
+
+	if len(p.URLMoves) > 0 {
+		fmt.Fprintln(w, "\nURL moves:")
+		for _, move := range p.URLMoves {
+			fmt.Fprintf(w, "  %s -> %s (%s)\n", move.From, move.To, move.Reason)
+		}
+	}
+
+	if len(p.Changes) > 0 {
+		fmt.Fprintln(w, "\nMetadata changes:")
+		printFieldChanges(w, p.Changes, "  ")
+	}
+
+	counts := make(map[string]int)
+	for _, episode := range p.Episodes {
+		counts[episode.Action]++
+	}
+	fmt.Fprintf(w, "\nEpisodes: %d to add, %d to update, %d no longer in feed\n", counts[EpisodeAdd], counts[EpisodeUpdate], counts[EpisodeRemoved])
+	symbols := map[string]string{EpisodeAdd: "+", EpisodeUpdate: "~", EpisodeRemoved: "-"}
+	for _, episode := range p.Episodes {
+		fmt.Fprintf(w, "  %s %s  %s\n", symbols[episode.Action], episode.GUID, truncate(episode.Title, 60))
+		printFieldChanges(w, episode.Changes, "      ")
+	}
+}
+
+func printFieldChanges(w io.Writer, changes []FieldChange, indent string) {
+	for _, change := range changes {
+		fmt.Fprintf(w, "%s%s: %q -> %q\n", indent, change.Field, truncate(change.Before, 80), truncate(change.After, 80))
+	}
+}
+
+func truncate(s string, length int) string {
+	runes := []rune(s)
+	if len(runes) <= length {
+		return s
+	}
+	return string(runes[:length]) + "…"
+}
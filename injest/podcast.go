@@ -1,220 +1,255 @@
 package injest
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
-	"fmt"
-	"strings"
 	"time"
 
+	"bitbucket.org/jayflux/mypodcasts_injest/config"
+	"bitbucket.org/jayflux/mypodcasts_injest/logger"
+	"bitbucket.org/jayflux/mypodcasts_injest/metrics"
+	"bitbucket.org/jayflux/mypodcasts_injest/sanitise"
+	"bitbucket.org/jayflux/mypodcasts_injest/store"
+	"bitbucket.org/jayflux/mypodcasts_injest/tracing"
 	"github.com/cnf/structhash"
 	_ "github.com/lib/pq"
 	"github.com/mmcdole/gofeed"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/satori/go.uuid"
-	"github.com/spf13/viper"
-)
-
-var (
-	db      *sql.DB
-	connErr error
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func init() {
-	// Setup Viper Config
-	setupConfig()
-
-	// Connect to the database
-	connStr := fmt.Sprintf("user=%s dbname=%s password=%s", viper.Get("database.user"), viper.Get("database.database"), viper.Get("database.password"))
-	db, connErr = sql.Open("postgres", connStr)
-	if connErr != nil {
-		log.Fatal(connErr)
-	}
-}
-
-func setupConfig() {
-	// Setup Config
-	viper.SetConfigName("config") // name of config file (without extension)
-	viper.SetConfigType("json")   //
-	viper.AddConfigPath(".")
-	viper.BindEnv("database.user", "DB_USER")
-	viper.BindEnv("database.database", "DB_NAME")
-	viper.BindEnv("database.password", "DB_PASS")
-	err := viper.ReadInConfig() // Find and read the config file
-	if err != nil {             // Handle errors reading the config file
-		panic(fmt.Errorf("Fatal error config file: %s \n", err))
-	}
+	registerBacklogMetric()
 }
 
 // ProcessPodcast will take a feed object and start inserting the properties into the database
-// It will also need to generate an ID for each podcast aswell
-func process(feed *gofeed.Feed, url string) {
+// It will also need to generate an ID for each podcast aswell, which is returned
+// If ctx is cancelled it stops between episodes, each write is its own transaction so nothing is left half done
+// It stops at the first lookup that fails, rather than guessing and creating a duplicate
+func process(ctx context.Context, feed *gofeed.Feed, url string) (string, error) {
+	defer prometheus.NewTimer(metrics.FeedProcessDuration).ObserveDuration()
+	ctx, span := tracing.Span(ctx, "injest.process", attribute.Int("episodes", len(feed.Items)))
+	defer span.End()
 	// Does the podcast already exist?
 	var doesPodcastExist bool
 	var id string
 
 	// Is there a new-feed element? And is it set to the same URL? (BBC ones seem to point to the same URL)
 	if feed.ITunesExt != nil && feed.ITunesExt.NewFeedURL != "" && feed.ITunesExt.NewFeedURL != url {
-		log.Printf("new feed detected from itunes-new-feed-url: %s", feed.ITunesExt.NewFeedURL)
+		logger.From(ctx).Printf("new feed detected from itunes-new-feed-url: %s", feed.ITunesExt.NewFeedURL)
 
 		// If this is an existing podcast the old URL may exist, in which case we want to replace.
 		// But this may not always be the case, so we need to check
 		// If the old URL exists, then we need to make the change before we progress further...
 		// otherwise we will end up creating a new podcast
-		if urlExistsInDB(url) {
-			updatePodcastUrl(url, feed.ITunesExt.NewFeedURL)
+		exists, err := urlExistsInDB(ctx, url)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			updatePodcastUrl(ctx, url, feed.ITunesExt.NewFeedURL)
 		}
 
 		url = feed.ITunesExt.NewFeedURL
 	}
+	// Fill in anything the feed is missing from what directories told us about it
+	applyDirectoryMetadata(ctx, feed, url)
 	// if podcast exists we should get an ID back, we can use this for our further queries
-	doesPodcastExist, id, digest := podcastExists(url)
+	doesPodcastExist, id, digest, err := podcastExists(ctx, url)
+	if err != nil {
+		return "", err
+	}
 	if doesPodcastExist {
+		ctx = logger.WithFields(ctx, logger.Fields{"podcast_id": id})
 		// Podcast exists in the DB, has there been a change? Lets diff the hashed RSS feeds
 		// If they match up then there's no need to update anything
 		if generateDigestFromPodcast(feed) != digest {
-			// Podcast exists, but some data may need updating
-			updatePodcastMetadata(feed, url)
 			// This gets all the hashes of the episodes
-			episodeHashes := getEpisodesHashesFromPodcast(id)
-			processPodcastEpisodes(feed, id, episodeHashes)
+			episodeHashes := getEpisodesHashesFromPodcast(ctx, id)
+			if err := processPodcastEpisodes(ctx, feed, id, episodeHashes); err != nil {
+				return id, err
+			}
+			// The new digest goes in with the podcast's metadata, so only once every episode is written
+			// If we stopped part way the feed still looks changed and the rest are written next time
+			if ctx.Err() != nil {
+				return id, nil
+			}
+			// Podcast exists, but some data may need updating
+			updatePodcastMetadata(ctx, feed, url, id)
 		} else {
 			// Don't need to do anything but update fetch date
-			updateFetchForPodcastURL(url)
+			updateFetchForPodcastURL(ctx, url)
 		}
 	} else {
 		// Create a new podcast and return the ID so we can create its children
-		id := createNewPodcast(feed, url)
-		processPodcastEpisodes(feed, id, make([]string, 0))
+		id, err = createNewPodcast(ctx, feed, url)
+		if err != nil {
+			return "", err
+		}
+		if id != "" {
+			ctx = logger.WithFields(ctx, logger.Fields{"podcast_id": id})
+			if err := processPodcastEpisodes(ctx, feed, id, make([]string, 0)); err != nil {
+				return id, err
+			}
+			if ctx.Err() == nil {
+				setPodcastDigest(ctx, url, generateDigestFromPodcast(feed))
+			}
+		}
 	}
 
+	return id, nil
+}
+
+// setPodcastDigest records the digest of a new podcast's feed once all its episodes are written
+// It's created without one, so if we stop part way the next fetch looks like a change and writes the rest
+func setPodcastDigest(ctx context.Context, url, digest string) {
+	ctx, done := observeTx(ctx, "setPodcastDigest")
+	defer done()
+	err := getStores().FetchState.SetDigest(ctx, url, digest)
+	if cancelled(ctx, err) {
+		return
+	}
+	if err != nil {
+		logger.From(ctx).Error("setPodcastDigest: Could not write to DB")
+		logger.From(ctx).Error(err)
+	}
 }
 
 // processPodcastEpisodes will loop through each episode and add/update the database
-func processPodcastEpisodes(feed *gofeed.Feed, id string, hashes []string) {
+func processPodcastEpisodes(ctx context.Context, feed *gofeed.Feed, id string, hashes []string) error {
 	for _, episode := range feed.Items {
-		processPodcastEpisode(episode, id, hashes)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err := processPodcastEpisode(ctx, episode, id, hashes); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 // There are 3 states we need to work out...
 // Podcast may exist and we don't need to do anything
 // Podcast may exist but some metadata is outdated
 // Podcast does not exist
-func processPodcastEpisode(episode *gofeed.Item, parent string, hashes []string) {
+func processPodcastEpisode(ctx context.Context, episode *gofeed.Item, parent string, hashes []string) error {
+	log := logger.From(ctx)
 	if digestExists(episode, hashes) {
 		// no need to do anything, this episode is already in the DB and is up to date
-	} else if episodeGuidExists(episode) {
+		return nil
+	}
+	exists, err := episodeGuidExists(ctx, episode)
+	if cancelled(ctx, err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if exists {
 
-		log.Printf("guid exists but change detected on %s\n", episode.GUID)
+		log.Printf("guid exists but change detected on %s", episode.GUID)
 		log.Println("Reinjesting episode....")
 		// Episode exists but digest is out of date, add all fields back in
-		updateEpisodeInDatabase(episode, parent)
+		updateEpisodeInDatabase(ctx, episode, parent)
 	} else {
-		addEpisodeInDatabase(episode, parent)
+		addEpisodeInDatabase(ctx, episode, parent)
 	}
+	return nil
 }
 
-func prepareEpisodeForDB(episode *gofeed.Item) map[string][]byte {
+func prepareEpisodeForDB(episode *gofeed.Item, parent string) store.Episode {
 	var err error
 	m := make(map[string][]byte)
 
 	m["author"], err = json.Marshal(episode.Author)
 	if err != nil {
-		log.Println(err)
+		log.Error(err)
 		log.Fatal("could not parse author into JSON")
 	}
 
 	m["image"], err = json.Marshal(episode.Image)
 	if err != nil {
-		log.Println(err)
+		log.Error(err)
 		log.Fatal("could not parse image into JSON")
 	}
 
 	m["itunesExt"], err = json.Marshal(episode.ITunesExt)
 	if err != nil {
-		log.Println(err)
+		log.Error(err)
 	}
 
 	m["enclosures"], err = json.Marshal(episode.Enclosures)
 	if err != nil {
-		log.Println(err)
+		log.Error(err)
+	}
+
+	prepareTextForDB(m, episode.Title, episode.Description)
+
+	return store.Episode{
+		GUID:            episode.GUID,
+		PodcastID:       parent,
+		Title:           episode.Title,
+		Description:     episode.Description,
+		Published:       episode.Published,
+		PublishedParsed: episode.PublishedParsed,
+		Author:          m["author"],
+		Image:           m["image"],
+		Enclosures:      m["enclosures"],
+		ItunesExt:       m["itunesExt"],
+		Digest:          generateDigestFromEpisode(episode),
+		LastFetch:       time.Now(),
+		TitleText:       string(m["title_text"]),
+		DescriptionHTML: string(m["description_html"]),
+		DescriptionText: string(m["description_text"]),
+		Summary:         string(m["summary"]),
 	}
-
-	// Generate hash
-	hash := generateDigestFromEpisode(episode)
-	m["digest"] = []byte(hash)
-
-	// generate timestamp
-	t := time.Now()
-	m["last_fetch"] = []byte(t.Format(time.RFC3339))
-
-	return m
 }
 
-func addEpisodeInDatabase(episode *gofeed.Item, parent string) {
+func addEpisodeInDatabase(ctx context.Context, episode *gofeed.Item, parent string) {
+	log := logger.From(ctx)
 	// Generate data
-	id := generateIDForPodcast(episode.GUID)
-	m := prepareEpisodeForDB(episode)
+	e := prepareEpisodeForDB(episode, parent)
+	e.ID = generateIDForPodcast(episode.GUID)
 
-	tx, err := db.Begin()
-	if err != nil {
-		log.Fatal("Couldn't begin database transaction")
+	ctx, done := observeTx(ctx, "addEpisodeInDatabase")
+	defer done()
+	err := getStores().Episodes.AddEpisode(ctx, e)
+	if cancelled(ctx, err) {
+		return
 	}
-
-	_, writeErr := tx.Exec("INSERT INTO podcast_episodes (id, guid, title, description, published, published_parsed, author, image, enclosures, digest, itunes_ext, last_fetch, parent) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13);",
-		id, episode.GUID, episode.Title, episode.Description, episode.Published, episode.PublishedParsed, m["author"], m["image"], m["enclosures"], m["digest"], m["itunesExt"], m["last_fetch"], parent)
-	if writeErr != nil {
-		log.Printf("Could not write episode (GUID: %s) to DB\n", episode.GUID)
-		log.Println(writeErr)
-	} else {
-		commitErr := tx.Commit()
-		if commitErr != nil {
-			log.Println("Commit failed")
-			log.Fatal(commitErr)
-		}
+	if err != nil {
+		log.Errorf("Could not write episode (GUID: %s) to DB", episode.GUID)
+		log.Error(err)
+		return
 	}
-
+	metrics.Episodes.WithLabelValues("inserted").Inc()
 }
 
-func updateEpisodeInDatabase(episode *gofeed.Item, parent string) {
-	m := prepareEpisodeForDB(episode)
+func updateEpisodeInDatabase(ctx context.Context, episode *gofeed.Item, parent string) {
+	log := logger.From(ctx)
+	e := prepareEpisodeForDB(episode, parent)
+	// Work out what's changed before we overwrite it, enclosure swaps are a common ad-insertion trick so we want a record
+	changes := diffFields(getEpisodeFields(ctx, episode.GUID), episodeFieldsFromItem(episode), episodeFields)
 
-	tx, err := db.Begin()
-	if err != nil {
-		log.Fatal("updateEpisodeInDatabase: Couldn't begin database transaction")
+	ctx, done := observeTx(ctx, "updateEpisodeInDatabase")
+	defer done()
+	err := getStores().Episodes.UpdateEpisode(ctx, e, changes)
+	if cancelled(ctx, err) {
+		return
 	}
-	_, writeErr := tx.Exec("UPDATE podcast_episodes SET (guid, title, description, published, published_parsed, author, image, enclosures, digest, itunes_ext, last_fetch, parent) = ($1, $2, $3, $4, $5, $6, image || $7, $8, $9, $10, $11, $12) WHERE guid = $1;",
-		episode.GUID, episode.Title, episode.Description, episode.Published, episode.PublishedParsed, m["author"], m["image"], m["enclosures"], m["digest"], m["itunesExt"], m["last_fetch"], parent)
-
-	if writeErr != nil {
-		log.Printf("updateEpisodeInDatabase: Could not write episode (GUID: %s) to DB\n", episode.GUID)
-		log.Println(writeErr)
-	} else {
-		commitErr := tx.Commit()
-		if commitErr != nil {
-			log.Println("updateEpisodeInDatabase: Commit failed")
-			log.Fatal(commitErr)
-		}
+	if err != nil {
+		log.Errorf("updateEpisodeInDatabase: Could not write episode (GUID: %s) to DB", episode.GUID)
+		log.Error(err)
+		return
 	}
-
+	metrics.Episodes.WithLabelValues("updated").Inc()
 }
 
 // digestExists is mainly used by podcast episode objects
 // Its a faster way than checking every single property
-func episodeGuidExists(episode *gofeed.Item) bool {
-	// we don't actually use title here, but it Scan returns an error object which we want
-	var title string
-	err := db.QueryRow("SELECT title FROM podcast_episodes WHERE guid = $1;", episode.GUID).Scan(&title)
-	switch {
-	case err == sql.ErrNoRows:
-		return false
-	case err != nil:
-		log.Fatal(err)
-	default:
-		return true
-	}
-
-	return false
+func episodeGuidExists(ctx context.Context, episode *gofeed.Item) (bool, error) {
+	return getStores().Episodes.EpisodeExists(ctx, episode.GUID)
 }
 
 func generateDigestFromEpisode(episode *gofeed.Item) string {
@@ -243,70 +278,84 @@ func digestExists(episode *gofeed.Item, hashes []string) bool {
 	return contains(hashes, digest)
 }
 
-func preparePodcastForDB(feed *gofeed.Feed) map[string][]byte {
+func preparePodcastForDB(ctx context.Context, feed *gofeed.Feed, url string) store.Podcast {
 	var err error
 	m := make(map[string][]byte)
 	m["author"], err = json.Marshal(feed.Author)
 	if err != nil {
-		log.Println(err)
+		log.Error(err)
 		log.Fatal("could not parse author into JSON")
 	}
 
 	m["image"], err = json.Marshal(feed.Image)
 	if err != nil {
-		log.Println(err)
+		log.Error(err)
 		log.Fatal("could not parse image into JSON")
 	}
 
 	m["ItunesExt"], err = json.Marshal(feed.ITunesExt)
 	if err != nil {
-		log.Println(err)
+		log.Error(err)
 	}
 
 	m["categories"], err = json.Marshal(feed.Categories)
 	if err != nil {
-		log.Println(err)
+		log.Error(err)
 	}
 
+	prepareTextForDB(m, feed.Title, feed.Description)
+
 	// Generate hash
 	hash := generateDigestFromPodcast(feed)
-	m["digest"] = []byte(hash)
-
-	// generate timestamp
-	t := time.Now()
-	lastFetch := t.Format(time.RFC3339)
-	m["last_fetch"] = []byte(lastFetch)
 
-	// generate last change, if hashes are different, date should be now()
-	// if hashes are the same, date will match what's already in the DB
-	m["last_change"] = []byte(getLastChanged(hash, url))
+	return store.Podcast{
+		FeedURL:       url,
+		Title:         feed.Title,
+		Description:   feed.Description,
+		Link:          feed.Link,
+		Updated:       feed.Updated,
+		UpdatedParsed: feed.UpdatedParsed,
+		Author:        m["author"],
+		Language:      feed.Language,
+		Image:         m["image"],
+		ItunesExt:     m["ItunesExt"],
+		Categories:    m["categories"],
+		Copyright:     feed.Copyright,
+		LastFetch:     time.Now(),
+		// generate last change, if hashes are different, date should be now()
+		// if hashes are the same, date will match what's already in the DB
+		LastChange:      getLastChanged(ctx, hash, url),
+		Digest:          hash,
+		TitleText:       string(m["title_text"]),
+		DescriptionHTML: string(m["description_html"]),
+		DescriptionText: string(m["description_text"]),
+		Summary:         string(m["summary"]),
+	}
+}
 
-	return m
+// prepareTextForDB adds the sanitised HTML and plain text versions of a title and description to m
+// The originals are stored as-is, these are what the API and search should use
+func prepareTextForDB(m map[string][]byte, title, description string) {
+	policy := sanitise.Policy{ImageProxy: config.Get().Sanitise.ImageProxy}
+	m["title_text"] = []byte(sanitise.Text(title))
+	m["description_html"] = []byte(policy.HTML(description))
+	m["description_text"] = []byte(sanitise.Text(description))
+	m["summary"] = []byte(sanitise.Summary(description, config.Get().Sanitise.SummaryLength))
 }
 
 // updateFetchForPodcastURL updates the timestamp for a podcast (by URL)
-func updateFetchForPodcastURL(url string) {
-	// generate timestamp
-	t := time.Now()
-	lastFetch := t.Format(time.RFC3339)
-
-	// Start transcation
-	tx, err := db.Begin()
-	if err != nil {
-		log.Println(err)
+func updateFetchForPodcastURL(ctx context.Context, url string) {
+	log := logger.From(ctx)
+	ctx, done := observeTx(ctx, "updateFetchForPodcastURL")
+	defer done()
+	err := getStores().FetchState.SetFetched(ctx, url, time.Now())
+	if cancelled(ctx, err) {
+		return
 	}
-	query := `UPDATE podcasts SET last_fetch = $1 where feed_url = $2`
-	_, writeErr := tx.Exec(query, lastFetch, url)
-	if writeErr != nil {
-		log.Println("updateFetchForURL: Could not write to DB")
-		log.Println(writeErr)
-	}
-	commitErr := tx.Commit()
-	if commitErr != nil {
-		log.Println("updateFetchForURL: Commit failed")
-		log.Fatal(commitErr)
+	if err != nil {
+		log.Error("updateFetchForURL: Could not write to DB")
+		log.Error(err)
 	}
-
 }
 
 // Update POLL Frequency
@@ -318,27 +367,26 @@ func updateFetchForPodcastURL(url string) {
 	> 24 -- 8 hours
 	default -- 4 hours
 **/
-func updatePollFrequency(url string) int8 {
-	var (
-		lastChange sql.NullString
-	)
-
-	err := db.QueryRow("SELECT last_change FROM podcasts WHERE feed_url = $1;", url).Scan(&lastChange)
+func updatePollFrequency(ctx context.Context, url string) int8 {
+	state, _, err := getStores().FetchState.FetchState(ctx, url)
 	if err != nil {
-		log.Println(err)
+		log.Error(err)
 	}
 	// Setup time for comparison
 	t := time.Now()
 
-	// no last change date, set default time
-	if !lastChange.Valid {
+	// no last change date, go with what directories say or the default time
+	if state.LastChange == "" {
+		if freq, ok := declaredPollFrequency(ctx, url); ok {
+			return freq
+		}
 		return 4
 	}
 
 	// Parse lastChange into time
-	lastChangeTime, err := time.Parse(time.RFC3339, lastChange.String)
+	lastChangeTime, err := time.Parse(time.RFC3339, state.LastChange)
 	if err != nil {
-		log.Println(err)
+		log.Error(err)
 	}
 
 	// get the difference from now to lastChange
@@ -361,34 +409,29 @@ func updatePollFrequency(url string) int8 {
 // Then returns a time
 // If there is a digest, check if its the same, if so continue to use same last_change date
 // If no digest is set, last_change should be now
-func getLastChanged(hash, url string) string {
-	var (
-		digest sql.NullString
-		change sql.NullString
-	)
-	err := db.QueryRow("SELECT digest, last_change FROM podcasts WHERE feed_url = $1;", url).Scan(&digest, &change)
+func getLastChanged(ctx context.Context, hash, url string) string {
+	state, found, err := getStores().FetchState.FetchState(ctx, url)
 	if err != nil {
-		if err != sql.ErrNoRows {
-			log.Println(err)
-		}
-
+		log.Error(err)
+	}
+	if !found {
 		// This is a new podcast, there is no data, just generate current time
 		return time.Now().Format(time.RFC3339)
 	}
 
 	// If there's no digest, just send the current time
-	if !digest.Valid {
+	if state.Digest == "" {
 		return time.Now().Format(time.RFC3339)
 	}
 
 	// If there's no last_change send back current time
-	if !change.Valid {
+	if state.LastChange == "" {
 		return time.Now().Format(time.RFC3339)
 	}
 
 	// if these match, there has been no change
-	if hash == digest.String {
-		return change.String
+	if hash == state.Digest {
+		return state.LastChange
 	}
 
 	// If we reach here, then we have a hash and a last_change, but there's been a change
@@ -396,114 +439,74 @@ func getLastChanged(hash, url string) string {
 	return time.Now().Format(time.RFC3339)
 }
 
-func updatePodcastMetadata(feed *gofeed.Feed, url string) {
+func updatePodcastMetadata(ctx context.Context, feed *gofeed.Feed, url string, id string) {
+	log := logger.From(ctx)
 	// For all the JSON properties, create a new mapping
-	m := preparePodcastForDB(feed)
-	freq := updatePollFrequency(url)
-	tx, err := db.Begin()
-	if err != nil {
-		log.Println("updatePodcastMetadata: Couldn't begin database transaction")
-		log.Fatal(err)
+	podcast := preparePodcastForDB(ctx, feed, url)
+	podcast.ID = id
+	podcast.PollFrequency = updatePollFrequency(ctx, url)
+	// Work out what's changed before we overwrite it, so it can go in the change log
+	changes := diffFields(getPodcastFields(ctx, id), podcastFieldsFromFeed(feed), podcastFields)
+	ctx, done := observeTx(ctx, "updatePodcastMetadata")
+	defer done()
+	err := getStores().Podcasts.UpdatePodcast(ctx, podcast, changes)
+	if cancelled(ctx, err) {
+		return
 	}
-
-	query := `
-	UPDATE podcasts SET (last_fetch, title, description, link, updated, updated_parsed, author, language, image, itunes_ext, categories, copyright, poll_frequency, last_change, digest) =
-	($2, $3, $4, $5, $6, $7, $8, $9, image || $10, $11, $12, $13, $14, $15, $16) where feed_url = $1;
-	`
-	_, writeErr := tx.Exec(query, url, m["last_fetch"], feed.Title, feed.Description, feed.Link, feed.Updated, feed.UpdatedParsed, m["author"], feed.Language, m["image"], m["ItunesExt"], m["categories"], feed.Copyright, freq, m["last_change"], m["digest"])
-	if writeErr != nil {
-		log.Println("updatePodcastMetadata: Could not write to DB")
-		log.Println(writeErr)
-	}
-	commitErr := tx.Commit()
-	if commitErr != nil {
-		log.Println("Commit failed")
-		log.Fatal(commitErr)
+	if err != nil {
+		log.Error("updatePodcastMetadata: Could not write to DB")
+		log.Error(err)
 	}
-
 }
 
-func createNewPodcast(feed *gofeed.Feed, url string) string {
+// It returns an empty ID if ctx was cancelled before the podcast was written
+func createNewPodcast(ctx context.Context, feed *gofeed.Feed, url string) (string, error) {
+	log := logger.From(ctx)
 	// Generate data
-	id := generateNewID()
-	m := preparePodcastForDB(feed)
-
-	tx, err := db.Begin()
+	podcast := preparePodcastForDB(ctx, feed, url)
+	podcast.ID = generateNewID()
+	podcast.PollFrequency = seedPollFrequency(ctx, url)
+	// The digest is set once the episodes are written, see setPodcastDigest
+	podcast.Digest = ""
+
+	ctx, done := observeTx(ctx, "createNewPodcast")
+	defer done()
+	err := getStores().Podcasts.CreatePodcast(ctx, podcast)
+	if cancelled(ctx, err) {
+		return "", nil
+	}
 	if err != nil {
-		log.Println("createNewPodcast: Couldn't begin database transaction")
-		log.Fatal(err)
-	}
-	// _, writeErr := tx.Exec("INSERT INTO podcasts(id, title, description, link, updated, updated_parsed, author, language, image, itunes_ext, categories, copyright, last_fetch, feed_url, digest, poll_frequency) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16);",
-	// id, feed.Title, feed.Description, feed.Link, feed.Updated, feed.UpdatedParsed, m["author"], feed.Language, m["image"], m["ItunesExt"], m["categories"], feed.Copyright, m["last_fetch"], url, m["digest"], 8)
-	query := `
-	INSERT INTO podcasts (id, last_fetch, title, description, link, updated, updated_parsed, author, language, image, itunes_ext, categories, copyright, poll_frequency, last_change, digest, feed_url, date_added) VALUES
-	($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, now());
-	`
-	_, writeErr := tx.Exec(query, id, m["last_fetch"], feed.Title, feed.Description, feed.Link, feed.Updated, feed.UpdatedParsed, m["author"], feed.Language, m["image"], m["ItunesExt"], m["categories"], feed.Copyright, 8, m["last_change"], m["digest"], url)
-	if writeErr != nil {
-		log.Println("Could not write to DB")
-		log.Println(writeErr)
+		log.Error("Could not write to DB")
+		log.Error(err)
 
 		// check if the problem is duplicate ID, this is highly unlikely
-		if strings.HasPrefix(writeErr.Error(), "pq: duplicate key value violates unique constraint") {
-			log.Println("Duplicate ID generated, trying again....")
-			process(feed, url)
-			return id
-		}
-	} else {
-		commitErr := tx.Commit()
-		if commitErr != nil {
-			log.Println("Commit failed")
-			log.Fatal(commitErr)
+		if err == store.ErrDuplicate {
+			log.Warn("Duplicate ID generated, trying again....")
+			return process(ctx, feed, url)
 		}
+		return "", err
 	}
 
-	log.Println("New Podcast created, Feed: %s", url)
+	log.Printf("New Podcast created, Feed: %s", url)
 
-	return id
+	return podcast.ID, nil
 }
 
 // podcastExists checks the database to see if a particular podcast already exists.
 // We use the URL as a key to check, as at this point we won't know the GUID
-func podcastExists(url string) (bool, string, string) {
-	// we don't actually use title here, but it Scan returns an error object which we want
-	var id string
-	var digest sql.NullString
-	err := db.QueryRow("SELECT id, digest FROM podcasts WHERE feed_url = $1;", url).Scan(&id, &digest)
-	switch {
-	case err == sql.ErrNoRows:
-		return false, "", id
-	case err != nil:
-		log.Fatal(err)
-	default:
-		return true, id, digest.String
-	}
-
-	// we would never get here
-	return true, id, digest.String
+func podcastExists(ctx context.Context, url string) (bool, string, string, error) {
+	id, digest, found, err := getStores().Podcasts.FindPodcast(ctx, url)
+	return found, id, digest, err
 }
 
 // getEpisodesHashesFromPodcast gets all of the episode hashes from a single podcast
 // This should save us a lot of time (not connecting to the DB for each episode and checking it exists)
-func getEpisodesHashesFromPodcast(id string) []string {
-	rows, err := db.Query("SELECT digest FROM podcast_episodes WHERE parent = $1;", id)
+func getEpisodesHashesFromPodcast(ctx context.Context, id string) []string {
+	digests, err := getStores().Episodes.EpisodeDigests(ctx, id)
 	if err != nil {
-		log.Println(err)
-	}
-	defer rows.Close()
-	digests := make([]string, 0)
-	for rows.Next() {
-		var digest string
-		if err := rows.Scan(&digest); err != nil {
-			log.Println(err)
-		}
-		digests = append(digests, digest)
-	}
-	if err := rows.Err(); err != nil {
-		log.Fatal(err)
+		log.Error(err)
 	}
 	return digests
-
 }
 
 // GUID's of podcasts can vary a LOT
@@ -0,0 +1,248 @@
+package injest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/store"
+	"github.com/mmcdole/gofeed"
+	ext "github.com/mmcdole/gofeed/extensions"
+)
+
+// failingEpisodes is the memory store with episode lookups failing, like a database that's gone away
+type failingEpisodes struct {
+	store.EpisodeStore
+}
+
+var errLookup = errors.New("connection refused")
+
+func (failingEpisodes) EpisodeExists(ctx context.Context, guid string) (bool, error) {
+	return false, errLookup
+}
+
+func TestProcessReturnsLookupErrors(t *testing.T) {
+	memory := store.NewMemory()
+	stores := memory.Stores()
+	stores.Episodes = failingEpisodes{stores.Episodes}
+	SetStores(stores)
+	defer SetStores(store.NewMemory().Stores())
+
+	feed := &gofeed.Feed{Title: "Failing", Items: []*gofeed.Item{{GUID: "episode-1", Title: "One"}}}
+	id, err := process(context.Background(), feed, "https://example.com/failing.xml")
+	if err != errLookup {
+		t.Fatalf("got %v, want the lookup error", err)
+	}
+	// The podcast was written before its episodes were looked at
+	if _, _, found, _ := memory.FindPodcast(context.Background(), "https://example.com/failing.xml"); !found || id == "" {
+		t.Errorf("got id %q, podcast found %v", id, found)
+	}
+}
+
+func TestProcessStopsWhenCancelled(t *testing.T) {
+	memory := store.NewMemory()
+	stores := memory.Stores()
+	stores.Episodes = failingEpisodes{stores.Episodes}
+	SetStores(stores)
+	defer SetStores(store.NewMemory().Stores())
+
+	// A lookup failing because we're shutting down isn't an error
+	ctx, cancel := context.WithCancel(context.Background())
+	feed := &gofeed.Feed{Title: "Cancelled", Items: []*gofeed.Item{{GUID: "episode-1"}}}
+	cancel()
+	if _, err := process(ctx, feed, "https://example.com/cancelled.xml"); err != nil {
+		t.Errorf("got %v", err)
+	}
+}
+
+func testFeed(title string, episodes ...string) *gofeed.Feed {
+	published := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	feed := &gofeed.Feed{Title: title, Description: "<p>A podcast</p>"}
+	for i, episode := range episodes {
+		at := published.Add(time.Duration(i) * 24 * time.Hour)
+		feed.Items = append(feed.Items, &gofeed.Item{GUID: "guid-" + episode, Title: episode, PublishedParsed: &at})
+	}
+	return feed
+}
+
+func TestProcess(t *testing.T) {
+	memory := store.NewMemory()
+	SetStores(memory.Stores())
+	ctx := context.Background()
+	url := "https://example.com/feed.xml"
+
+	id, err := process(ctx, testFeed("Show", "One", "Two"), url)
+	if err != nil || id == "" {
+		t.Fatalf("creating got %q, %v", id, err)
+	}
+	if digests, _ := memory.EpisodeDigests(ctx, id); len(digests) != 2 {
+		t.Errorf("got %d episodes, want 2", len(digests))
+	}
+	fields, _ := memory.PodcastFields(ctx, id)
+	if fields["title"] != "Show" {
+		t.Errorf("got fields %v", fields)
+	}
+
+	// The same feed again is recognised by its URL and nothing changes
+	if again, err := process(ctx, testFeed("Show", "One", "Two"), url); err != nil || again != id {
+		t.Fatalf("reprocessing got %q, %v, want %q", again, err, id)
+	}
+	if changes := memory.Changes(id); len(changes) != 0 {
+		t.Errorf("got changes %v for an unchanged feed", changes)
+	}
+
+	// A new title and episode are written, and the title change is logged
+	if _, err := process(ctx, testFeed("Renamed", "One", "Two", "Three"), url); err != nil {
+		t.Fatal(err)
+	}
+	if digests, _ := memory.EpisodeDigests(ctx, id); len(digests) != 3 {
+		t.Errorf("got %d episodes, want 3", len(digests))
+	}
+	if fields, _ := memory.EpisodeFields(ctx, "guid-Three"); fields["title"] != "Three" {
+		t.Errorf("got episode fields %v", fields)
+	}
+	var renamed bool
+	for _, change := range memory.Changes(id) {
+		renamed = renamed || (change.Field == "title" && change.Before == "Show" && change.After == "Renamed")
+	}
+	if !renamed {
+		t.Errorf("got changes %v, want the title change", memory.Changes(id))
+	}
+}
+
+func TestProcessNewFeedURL(t *testing.T) {
+	memory := store.NewMemory()
+	SetStores(memory.Stores())
+	ctx := context.Background()
+	oldURL, newURL := "https://example.com/old.xml", "https://example.com/new.xml"
+
+	id, err := process(ctx, testFeed("Moving", "One"), oldURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The feed at the old URL says it has moved, the podcast goes with it rather than being created again
+	feed := testFeed("Moving", "One")
+	feed.ITunesExt = &ext.ITunesFeedExtension{NewFeedURL: newURL}
+	moved, err := process(ctx, feed, oldURL)
+	if err != nil || moved != id {
+		t.Fatalf("got %q, %v, want %q", moved, err, id)
+	}
+	if found, _ := urlExistsInDB(ctx, oldURL); found {
+		t.Error("the podcast is still at the old URL")
+	}
+	if found, _ := urlExistsInDB(ctx, newURL); !found {
+		t.Error("the podcast isn't at the new URL")
+	}
+}
+
+func TestGetLastChanged(t *testing.T) {
+	memory := store.NewMemory()
+	SetStores(memory.Stores())
+	ctx := context.Background()
+	url := "https://example.com/feed.xml"
+	lastChange := time.Now().Add(-72 * time.Hour).Format(time.RFC3339)
+	memory.CreatePodcast(ctx, store.Podcast{ID: "podcast", FeedURL: url, Digest: "digest", LastChange: lastChange})
+
+	if got := getLastChanged(ctx, "digest", url); got != lastChange {
+		t.Errorf("got %s for an unchanged digest, want %s", got, lastChange)
+	}
+	for _, test := range []struct{ hash, url string }{{"changed", url}, {"digest", "https://example.com/new.xml"}} {
+		got, err := time.Parse(time.RFC3339, getLastChanged(ctx, test.hash, test.url))
+		if err != nil || time.Since(got) > time.Minute {
+			t.Errorf("getLastChanged(%q, %q) = %s, %v, want now", test.hash, test.url, got, err)
+		}
+	}
+}
+
+func TestUpdatePollFrequency(t *testing.T) {
+	memory := store.NewMemory()
+	SetStores(memory.Stores())
+	ctx := context.Background()
+	tests := []struct {
+		changed time.Duration
+		want    int8
+	}{
+		{time.Hour, 4},
+		{30 * time.Hour, 8},
+		{72 * time.Hour, 16},
+		{14 * 24 * time.Hour, 24},
+		{60 * 24 * time.Hour, 48},
+	}
+	for i, test := range tests {
+		url := fmt.Sprintf("https://example.com/%d.xml", i)
+		memory.CreatePodcast(ctx, store.Podcast{ID: url, FeedURL: url, Digest: "digest", LastChange: time.Now().Add(-test.changed).Format(time.RFC3339)})
+		if got := updatePollFrequency(ctx, url); got != test.want {
+			t.Errorf("changed %s ago got %d, want %d", test.changed, got, test.want)
+		}
+	}
+
+	// Without a last change it's what a directory says, or every 4 hours
+	memory.AddDirectoryMetadata(store.DirectoryMetadata{Directory: "bbc", FeedURL: "https://example.com/weekly.xml", Frequency: "weekly"})
+	if got := updatePollFrequency(ctx, "https://example.com/weekly.xml"); got != 24 {
+		t.Errorf("got %d for a weekly podcast, want 24", got)
+	}
+	if got := updatePollFrequency(ctx, "https://example.com/unknown.xml"); got != 4 {
+		t.Errorf("got %d for a podcast nothing is known about, want 4", got)
+	}
+}
+
+// cancellingEpisodes cancels the injest after the first episode it adds, like a shutdown part way through a feed
+type cancellingEpisodes struct {
+	store.EpisodeStore
+	cancel context.CancelFunc
+}
+
+func (c cancellingEpisodes) AddEpisode(ctx context.Context, e store.Episode) error {
+	err := c.EpisodeStore.AddEpisode(ctx, e)
+	c.cancel()
+	return err
+}
+
+func TestProcessFinishesEpisodesAfterStopping(t *testing.T) {
+	memory := store.NewMemory()
+	url := "https://example.com/feed.xml"
+	countEpisodes := func(id string) int {
+		digests, _ := memory.EpisodeDigests(context.Background(), id)
+		return len(digests)
+	}
+	// processStopping runs process with the injest stopped after the first new episode
+	processStopping := func(feed *gofeed.Feed) string {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		stores := memory.Stores()
+		stores.Episodes = cancellingEpisodes{stores.Episodes, cancel}
+		SetStores(stores)
+		id, err := process(ctx, feed, url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		SetStores(memory.Stores())
+		return id
+	}
+
+	// A new podcast stopped part way has its other episodes written when it's next processed
+	id := processStopping(testFeed("Show", "One", "Two", "Three"))
+	if got := countEpisodes(id); got != 1 {
+		t.Fatalf("got %d episodes after stopping, want 1", got)
+	}
+	if _, err := process(context.Background(), testFeed("Show", "One", "Two", "Three"), url); err != nil {
+		t.Fatal(err)
+	}
+	if got := countEpisodes(id); got != 3 {
+		t.Errorf("got %d episodes after processing again, want 3", got)
+	}
+
+	// The same for an update
+	processStopping(testFeed("Show", "One", "Two", "Three", "Four", "Five"))
+	if got := countEpisodes(id); got != 4 {
+		t.Fatalf("got %d episodes after stopping, want 4", got)
+	}
+	if _, err := process(context.Background(), testFeed("Show", "One", "Two", "Three", "Four", "Five"), url); err != nil {
+		t.Fatal(err)
+	}
+	if got := countEpisodes(id); got != 5 {
+		t.Errorf("got %d episodes after processing again, want 5", got)
+	}
+}
@@ -0,0 +1,158 @@
+package injest
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/config"
+	"github.com/lib/pq"
+)
+
+// InjestAll injests a list of feeds, workers at a time, and returns the feeds which failed
+// If workers is 0 or less injest.workers from config is used
+// Once ctx is done no more feeds are started, the ones not reached aren't counted as failed
+func InjestAll(ctx context.Context, urls []string, workers int) map[string]error {
+	if workers <= 0 {
+		workers = config.Get().Injest.Workers
+	}
+	if workers <= 0 {
+		workers = 1
+	}
+
+	failed := make(map[string]error)
+	var mu sync.Mutex
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for feedURL := range queue {
+				if err := Injest(ctx, feedURL); err != nil && ctx.Err() == nil {
+					mu.Lock()
+					failed[feedURL] = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, feedURL := range urls {
+		if ctx.Err() != nil {
+			break
+		}
+		queue <- feedURL
+	}
+	close(queue)
+	wg.Wait()
+	return failed
+}
+
+// KnownFeedURL reports whether we already have a podcast at this URL, or one that used to be at it
+func KnownFeedURL(url string) bool {
+	url = strings.TrimSpace(url)
+	var found int
+	err := getDB().QueryRow("SELECT 1 FROM podcasts WHERE feed_url = $1 UNION ALL SELECT 1 FROM podcast_feed_aliases WHERE feed_url = $1 LIMIT 1", url).Scan(&found)
+	switch {
+	case err == sql.ErrNoRows:
+		return false
+	case err != nil:
+		log.Error(err)
+		return false
+	}
+	return true
+}
+
+// rememberURL keeps the URL we were asked to injest as an alias if the podcast ended up at another one (a redirect or itunes:new-feed-url)
+// so the next import of the old URL is recognised, and sources recorded against it can be linked
+// It's only a hint for later imports, so failing to write it is logged rather than failing the injest
+func rememberURL(ctx context.Context, podcastID, url string) {
+	if podcastID == "" {
+		return
+	}
+	exists, err := urlExistsInDB(ctx, url)
+	if cancelled(ctx, err) || exists {
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	tx, err := getDB().Begin()
+	if err != nil {
+		log.Error("rememberURL: Couldn't begin database transaction")
+		log.Error(err)
+		return
+	}
+	recordAlias(tx, podcastID, url)
+	commitErr := tx.Commit()
+	if commitErr != nil {
+		log.Error("rememberURL: Commit failed")
+		log.Error(commitErr)
+	}
+}
+
+// recordAlias remembers a URL a podcast used to live at, so imports don't add it again
+func recordAlias(tx *sql.Tx, podcastID, url string) {
+	_, writeErr := tx.Exec("INSERT INTO podcast_feed_aliases (feed_url, podcast_id, added_at) VALUES ($1, $2, now()) ON CONFLICT (feed_url) DO UPDATE SET podcast_id = EXCLUDED.podcast_id", url, podcastID)
+	if writeErr != nil {
+		log.Error("recordAlias: Could not write to DB")
+		log.Error(writeErr)
+	}
+}
+
+// GetDiscoveryCursor returns where a discovery source got up to last time it ran, empty if it never has
+func GetDiscoveryCursor(source string) string {
+	var cursor string
+	err := getDB().QueryRow("SELECT cursor FROM discovery_cursors WHERE source = $1", source).Scan(&cursor)
+	if err != nil && err != sql.ErrNoRows {
+		log.Error(err)
+	}
+	return cursor
+}
+
+// SetDiscoveryCursor saves where a discovery source got up to, so the next run only lists what's new
+func SetDiscoveryCursor(source, cursor string) error {
+	tx, err := getDB().Begin()
+	if err != nil {
+		log.Error("SetDiscoveryCursor: Couldn't begin database transaction")
+		return err
+	}
+	defer tx.Rollback()
+	_, writeErr := tx.Exec("INSERT INTO discovery_cursors (source, cursor, updated_at) VALUES ($1, $2, now()) ON CONFLICT (source) DO UPDATE SET cursor = EXCLUDED.cursor, updated_at = EXCLUDED.updated_at", source, cursor)
+	if writeErr != nil {
+		log.Error("SetDiscoveryCursor: Could not write to DB")
+		return writeErr
+	}
+	commitErr := tx.Commit()
+	if commitErr != nil {
+		log.Error("SetDiscoveryCursor: Commit failed")
+		return commitErr
+	}
+	return nil
+}
+
+// KnownFeedURLs is KnownFeedURL for a batch of URLs, in one query
+func KnownFeedURLs(urls []string) map[string]bool {
+	known := make(map[string]bool)
+	if len(urls) == 0 {
+		return known
+	}
+	rows, err := getDB().Query("SELECT feed_url FROM podcasts WHERE feed_url = ANY($1) UNION SELECT feed_url FROM podcast_feed_aliases WHERE feed_url = ANY($1)", pq.Array(urls))
+	if err != nil {
+		log.Error(err)
+		return known
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var feedURL string
+		if err := rows.Scan(&feedURL); err != nil {
+			log.Error(err)
+			continue
+		}
+		known[feedURL] = true
+	}
+	return known
+}
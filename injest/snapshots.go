@@ -0,0 +1,190 @@
+package injest
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/archive"
+	"bitbucket.org/jayflux/mypodcasts_injest/config"
+	"bitbucket.org/jayflux/mypodcasts_injest/logger"
+)
+
+var (
+	snapshotStore     archive.Store
+	snapshotStoreOnce sync.Once
+)
+
+// getSnapshotStore returns the configured archive, or nil if archiving is turned off
+func getSnapshotStore() archive.Store {
+	snapshotStoreOnce.Do(func() {
+		var err error
+		snapshotStore, err = archive.NewStoreFromConfig()
+		if err != nil {
+			log.Println("getSnapshotStore: archiving disabled")
+			log.Error(err)
+		}
+	})
+	return snapshotStore
+}
+
+// archiveSnapshot stores the feed body we just fetched, as long as it's different to the last one we kept for this podcast
+func archiveSnapshot(podcastID, url string, fetched *fetchedFeed) {
+	store := getSnapshotStore()
+	if store == nil || podcastID == "" {
+		return
+	}
+
+	sum := sha256.Sum256(fetched.Body)
+	hash := hex.EncodeToString(sum[:])
+
+	var lastHash sql.NullString
+	err := getDB().QueryRow("SELECT sha256 FROM feed_snapshots WHERE podcast_id = $1 ORDER BY fetched_at DESC LIMIT 1", podcastID).Scan(&lastHash)
+	if err != nil && err != sql.ErrNoRows {
+		log.Error(err)
+		return
+	}
+	if lastHash.Valid && lastHash.String == hash {
+		return
+	}
+
+	data, err := archive.Compress(fetched.Body)
+	if err != nil {
+		log.Error("archiveSnapshot: unable to compress body of " + url)
+		return
+	}
+
+	fetchedAt := time.Now()
+	key := archive.Key(podcastID, fetchedAt)
+	if err := store.Put(key, data); err != nil {
+		log.Errorf("archiveSnapshot: unable to store %s", key)
+		log.Error(err)
+		return
+	}
+
+	headers, err := json.Marshal(fetched.Header)
+	if err != nil {
+		log.Error("archiveSnapshot: unable to Marshal headers from " + url)
+	}
+
+	_, writeErr := getDB().Exec("INSERT INTO feed_snapshots (podcast_id, feed_url, fetched_at, storage_key, sha256, size, response_headers, truncated) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+		podcastID, url, fetchedAt, key, hash, len(fetched.Body), headers, fetched.Truncated)
+	if writeErr != nil {
+		log.Error("archiveSnapshot: Could not write to DB")
+		log.Error(writeErr)
+		return
+	}
+
+	pruneSnapshots(store, podcastID)
+}
+
+// pruneSnapshots applies the retention rules for a podcast, the latest snapshot is always kept
+func pruneSnapshots(store archive.Store, podcastID string) {
+	retention := config.Get().Archive.Retention
+	maxSnapshots := retention.MaxSnapshots
+	cutoff := time.Now().AddDate(0, 0, -retention.MaxAgeDays)
+
+	rows, err := getDB().Query("SELECT storage_key FROM (SELECT storage_key, fetched_at, row_number() OVER (ORDER BY fetched_at DESC) AS position FROM feed_snapshots WHERE podcast_id = $1) s WHERE position > 1 AND (position > $2 OR fetched_at < $3)", podcastID, maxSnapshots, cutoff)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	defer rows.Close()
+
+	keys := make([]string, 0)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			log.Error(err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	for _, key := range keys {
+		if err := store.Delete(key); err != nil {
+			log.Errorf("pruneSnapshots: unable to delete %s", key)
+			log.Error(err)
+			continue
+		}
+		if _, err := getDB().Exec("DELETE FROM feed_snapshots WHERE storage_key = $1", key); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// Reprocess re-runs process over the latest stored snapshot of a podcast, without touching the network
+// If podcastID is empty every podcast with a snapshot is reprocessed, stopping early if ctx is done
+func Reprocess(ctx context.Context, podcastID string) {
+	store := getSnapshotStore()
+	if store == nil {
+		log.Fatal("Reprocess: archiving is not enabled in config.json")
+	}
+
+	query := "SELECT DISTINCT ON (feed_snapshots.podcast_id) podcasts.feed_url, feed_snapshots.storage_key, feed_snapshots.response_headers FROM feed_snapshots INNER JOIN podcasts ON (feed_snapshots.podcast_id = podcasts.id) WHERE $1 = '' OR feed_snapshots.podcast_id::text = $1 ORDER BY feed_snapshots.podcast_id, feed_snapshots.fetched_at DESC"
+	rows, err := getDB().Query(query, podcastID)
+	if err != nil {
+		log.Error(err)
+		log.Fatal("Reprocess: error in query")
+	}
+	defer rows.Close()
+
+	for rows.Next() && ctx.Err() == nil {
+		var (
+			url     string
+			key     string
+			raw     []byte
+			headers http.Header
+		)
+		if err := rows.Scan(&url, &key, &raw); err != nil {
+			log.Error(err)
+			continue
+		}
+		// Snapshots without headers are parsed without a Content-Type, but corrupt headers mean a corrupt snapshot
+		if len(raw) > 0 {
+			if err := json.Unmarshal(raw, &headers); err != nil {
+				log.Errorf("Reprocess: unable to read the headers of snapshot %s, skipping it", key)
+				log.Error(err)
+				continue
+			}
+		}
+		reprocessSnapshot(ctx, store, url, key, headers.Get("Content-Type"))
+	}
+}
+
+func reprocessSnapshot(ctx context.Context, store archive.Store, url, key, contentType string) {
+	log := logger.From(ctx)
+	data, err := store.Get(key)
+	if err != nil {
+		log.Errorf("Reprocess: unable to fetch snapshot %s", key)
+		log.Error(err)
+		return
+	}
+	body, err := archive.Decompress(data)
+	if err != nil {
+		log.Errorf("Reprocess: unable to decompress snapshot %s", key)
+		log.Error(err)
+		return
+	}
+
+	feed, repairs, err := parseFeed(body, contentType)
+	if err != nil {
+		log.Errorf("Reprocess: Error parsing snapshot %s", key)
+		log.Error(err)
+		return
+	}
+	if len(repairs) > 0 {
+		log.Printf("Reprocess: %s parsed after repairs %v", key, repairs)
+	}
+
+	log.Printf("Reprocessing %s from %s", url, key)
+	if _, err := process(ctx, feed, url); err != nil && ctx.Err() == nil {
+		log.Errorf("Reprocess: Could not write %s to DB", url)
+		log.Error(err)
+	}
+}
@@ -0,0 +1,97 @@
+package injest
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// Sources we record against podcasts which don't come from discover
+const (
+	SourceManual     = "manual"
+	SourceRedirect   = "redirect"
+	SourceSubmission = "submission"
+)
+
+// SourceRecord is a sighting of a feed in a source, e.g the BBC directory or a dataset
+type SourceRecord struct {
+	FeedURL string
+	Source  string
+	// SourceID is what the source calls the feed, e.g its Podcast Index ID or the row of a dataset, it can be empty
+	SourceID string
+	// Metadata is anything else the source told us about the feed, kept as it was given
+	Metadata map[string]interface{}
+}
+
+// podcastIDForURL is SQL finding the podcast at a feed URL, or that used to be at it (following redirects we've seen)
+func podcastIDForURL(param string) string {
+	return fmt.Sprintf("COALESCE((SELECT id FROM podcasts WHERE feed_url = %[1]s LIMIT 1), (SELECT podcast_id FROM podcast_feed_aliases WHERE feed_url = %[1]s))", param)
+}
+
+// RecordSources notes that sources listed these feeds, keeping when each was first and last seen
+// A podcast can have many sources and a source many podcasts, the same feed in the same source is one row
+// Nothing is recorded if it fails
+func RecordSources(records []SourceRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	tx, err := getDB().Begin()
+	if err != nil {
+		log.Error("RecordSources: Couldn't begin database transaction")
+		return err
+	}
+	defer tx.Rollback()
+	for _, record := range records {
+		if writeErr := recordSource(tx, record); writeErr != nil {
+			log.Error("RecordSources: Could not write to DB")
+			return writeErr
+		}
+	}
+	commitErr := tx.Commit()
+	if commitErr != nil {
+		log.Error("RecordSources: Commit failed")
+		return commitErr
+	}
+	return nil
+}
+
+func recordSource(tx *sql.Tx, record SourceRecord) error {
+	var metadata []byte
+	if len(record.Metadata) > 0 {
+		var err error
+		if metadata, err = json.Marshal(record.Metadata); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec(`INSERT INTO podcast_sources (source, feed_url, source_id, podcast_id, first_seen, last_seen, metadata) VALUES ($1, $2, NULLIF($3, ''), `+podcastIDForURL("$2")+`, now(), now(), $4)
+		ON CONFLICT (source, feed_url) DO UPDATE SET source_id = COALESCE(EXCLUDED.source_id, podcast_sources.source_id), podcast_id = COALESCE(EXCLUDED.podcast_id, podcast_sources.podcast_id), last_seen = EXCLUDED.last_seen,
+		metadata = COALESCE(EXCLUDED.metadata, podcast_sources.metadata)`,
+		record.Source, record.FeedURL, record.SourceID, metadata)
+	return err
+}
+
+// LinkDiscovered points sources, external IDs and directory metadata recorded before their feeds were injested at the podcasts
+func LinkDiscovered(urls []string) {
+	if len(urls) == 0 {
+		return
+	}
+	for _, table := range []string{"podcast_sources", "podcast_external_ids", "podcast_directory_metadata"} {
+		_, err := getDB().Exec("UPDATE "+table+" t SET podcast_id = "+podcastIDForURL("t.feed_url")+" WHERE t.podcast_id IS NULL AND t.feed_url = ANY($1)", pq.Array(urls))
+		if err != nil {
+			log.Errorf("LinkDiscovered: Could not write %s to DB", table)
+			log.Error(err)
+		}
+	}
+}
+
+// PodcastIDForURL returns the podcast at a feed URL, or that used to be at it, empty if there isn't one
+func PodcastIDForURL(url string) string {
+	var id sql.NullString
+	err := getDB().QueryRow("SELECT "+podcastIDForURL("$1"), url).Scan(&id)
+	if err != nil && err != sql.ErrNoRows {
+		log.Error(err)
+	}
+	return id.String
+}
@@ -0,0 +1,39 @@
+package injest
+
+import (
+	"database/sql"
+	"sync"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/database"
+	"bitbucket.org/jayflux/mypodcasts_injest/store"
+)
+
+var (
+	stores   *store.Stores
+	storesMu sync.Mutex
+)
+
+// SetStores sets where podcasts, their episodes and fetch state are kept, call it before injesting anything
+// Without it they're kept in the database, tests can use store.NewMemory().Stores() to injest without one
+func SetStores(s store.Stores) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	stores = &s
+}
+
+// getStores returns the stores set with SetStores, or the database's
+func getStores() store.Stores {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	if stores == nil {
+		postgres := store.NewPostgres(getDB()).Stores()
+		stores = &postgres
+	}
+	return *stores
+}
+
+// getDB returns the shared pool for everything which isn't in a store yet, e.g sources and snapshots
+// It's opened the first time it's needed, not when injest is imported
+func getDB() *sql.DB {
+	return database.DB()
+}
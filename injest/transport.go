@@ -0,0 +1,160 @@
+package injest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"sync"
+	"syscall"
+	"time"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/config"
+)
+
+// carrierGradeNAT is 100.64.0.0/10, net.IP.IsPrivate doesn't include it
+var carrierGradeNAT = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// feedTransport is used for every request we make to a feed, it refuses to connect to internal addresses
+// The check happens when connecting, after DNS, so a hostname can't be pointed at an internal address after we've checked it
+// Through a proxy the connection is to the proxy, so the host each request is for is checked before it is sent instead
+// Set fetch.allowPrivateAddresses to fetch feeds from a local network, e.g in development
+// It's built from the fetch settings in config the first time it's used
+var (
+	feedTransport     http.RoundTripper
+	feedTransportOnce sync.Once
+)
+
+func getFeedTransport() http.RoundTripper {
+	feedTransportOnce.Do(func() {
+		settings := config.Get().Fetch
+		proxy := http.ProxyFromEnvironment
+		if settings.Proxy != "" {
+			// Validated when the config was loaded
+			proxyURL, _ := neturl.Parse(settings.Proxy)
+			proxy = http.ProxyURL(proxyURL)
+		}
+		transport := &http.Transport{
+			Proxy: proxy,
+			DialContext: (&net.Dialer{
+				Timeout:   time.Duration(settings.ConnectTimeoutSeconds) * time.Second,
+				KeepAlive: 30 * time.Second,
+				Control: func(network, address string, c syscall.RawConn) error {
+					if settings.AllowPrivateAddresses {
+						return nil
+					}
+					host, _, err := net.SplitHostPort(address)
+					if err != nil {
+						return err
+					}
+					return checkPublicIP(net.ParseIP(host))
+				},
+			}).DialContext,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   time.Duration(settings.TLSTimeoutSeconds) * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		}
+		feedTransport = userAgentTransport{next: transport, userAgent: settings.UserAgent}
+		if !settings.AllowPrivateAddresses {
+			feedTransport = proxyCheckTransport{next: feedTransport, proxy: proxy}
+		}
+	})
+	return feedTransport
+}
+
+// userAgentTransport sets fetch.userAgent on requests which don't already have a User-Agent
+type userAgentTransport struct {
+	next      http.RoundTripper
+	userAgent string
+}
+
+func (t userAgentTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.Header.Get("User-Agent") == "" {
+		request = request.Clone(request.Context())
+		request.Header.Set("User-Agent", t.userAgent)
+	}
+	return t.next.RoundTrip(request)
+}
+
+// proxyCheckTransport checks the host a request is for when it goes through a proxy
+// The check when connecting only sees the proxy's address then, so without this a feed could point us at anything the proxy can reach
+// Redirects come back through RoundTrip so every hop is checked
+type proxyCheckTransport struct {
+	next  http.RoundTripper
+	proxy func(*http.Request) (*neturl.URL, error)
+}
+
+func (t proxyCheckTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	proxyURL, err := t.proxy(request)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL != nil {
+		if err := checkPublicHost(request.Context(), request.URL.Hostname()); err != nil {
+			return nil, err
+		}
+	}
+	return t.next.RoundTrip(request)
+}
+
+// HTTPClient returns a client which uses feedTransport and doesn't follow redirects if noRedirects is set
+func HTTPClient(timeout time.Duration, noRedirects bool) *http.Client {
+	client := &http.Client{Transport: getFeedTransport(), Timeout: timeout}
+	if noRedirects {
+		client.CheckRedirect = redirectPolicyFunc
+	}
+	return client
+}
+
+// FetchTimeout is how long a feed has to respond, fetch.timeoutSeconds in config
+func FetchTimeout() time.Duration {
+	return time.Duration(config.Get().Fetch.TimeoutSeconds) * time.Second
+}
+
+func checkPublicIP(ip net.IP) error {
+	if ip == nil {
+		return fmt.Errorf("not an IP address")
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || carrierGradeNAT.Contains(ip) {
+		return fmt.Errorf("%s is an internal address", ip)
+	}
+	return nil
+}
+
+// CheckPublicURL checks a URL is http(s) and its host only resolves to public addresses
+// Fetches are checked again when connecting, or before each request through a proxy, this is so callers can reject a URL up front with a useful error
+func CheckPublicURL(url string) error {
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%s isn't an http or https URL", url)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("%s has no host", url)
+	}
+	if config.Get().Fetch.AllowPrivateAddresses {
+		return nil
+	}
+	return checkPublicHost(context.Background(), u.Hostname())
+}
+
+// checkPublicHost checks every address host resolves to is public
+func checkPublicHost(ctx context.Context, host string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, address := range addresses {
+		if err := checkPublicIP(address.IP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
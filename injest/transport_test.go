@@ -0,0 +1,52 @@
+package injest
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"testing"
+)
+
+func TestCheckPublicIP(t *testing.T) {
+	for _, address := range []string{"127.0.0.1", "10.1.2.3", "192.168.0.1", "169.254.169.254", "100.64.0.1", "::1", "fe80::1", "0.0.0.0"} {
+		if checkPublicIP(net.ParseIP(address)) == nil {
+			t.Errorf("%s was allowed", address)
+		}
+	}
+	for _, address := range []string{"93.184.216.34", "2606:2800:220:1::1"} {
+		if err := checkPublicIP(net.ParseIP(address)); err != nil {
+			t.Errorf("%s was refused: %v", address, err)
+		}
+	}
+}
+
+func TestProxyCheckTransport(t *testing.T) {
+	// The proxy answers for any host, redirecting one of them to an internal address
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://10.0.0.1/feed.xml", http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+	proxyURL, _ := neturl.Parse(proxy.URL)
+	client := &http.Client{Transport: proxyCheckTransport{
+		next:  &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		proxy: http.ProxyURL(proxyURL),
+	}}
+
+	response, err := client.Get("http://93.184.216.34/feed.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	for _, url := range []string{"http://127.0.0.1/feed.xml", "http://169.254.169.254/latest/meta-data/", "http://93.184.216.34/redirect"} {
+		if response, err := client.Get(url); err == nil {
+			response.Body.Close()
+			t.Errorf("%s was fetched through the proxy", url)
+		}
+	}
+}
@@ -10,86 +10,90 @@
 package injest
 
 import (
-	"database/sql"
-	"encoding/json"
+	"context"
 	"errors"
 	"net/http"
 	"regexp"
 	"time"
 
+	"bitbucket.org/jayflux/mypodcasts_injest/logger"
+	"bitbucket.org/jayflux/mypodcasts_injest/metrics"
+	"bitbucket.org/jayflux/mypodcasts_injest/store"
+	"bitbucket.org/jayflux/mypodcasts_injest/tracing"
 	_ "github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var redirectErr *regexp.Regexp = regexp.MustCompile(`Don't redirect`)
 
 // These are the request headers we plan to send
-type RequestHeaders struct {
-	Etag         string `json:"etag"`
-	LastModified string `json:"last-modified"`
-	CacheControl string `json:"cache-control"`
-}
+type RequestHeaders = store.Headers
 
 // checkPodcastUrl checks to see if there is a redirect in the response,
 // If there is a redirect it will return the new URL, otherwise it will return the same url passed in.
 // If we already have the podcast, it will also update the database with the new URL
 // This is to make sure the database eventually updates with the new URL should a podcast move
-func checkPodcastUrl(url string) (string, bool, error) {
-	isRedirect, newEndpoint, response, err := fetchConanicalUrl(url)
+// The response is returned so the body can be read, it will be nil after a redirect
+func checkPodcastUrl(ctx context.Context, url string) (string, *http.Response, bool, error) {
+	log := logger.From(ctx)
+	isRedirect, newEndpoint, response, err := fetchConanicalUrl(ctx, url)
 	if err != nil {
-		return "", false, err
+		return "", nil, false, err
 	}
 	if isRedirect {
-		log.Printf("There has been a redirect from %s to %s\n", url, newEndpoint)
-		if urlExistsInDB(url) {
+		if response != nil && response.Body != nil {
+			response.Body.Close()
+		}
+		log.Printf("There has been a redirect from %s to %s", url, newEndpoint)
+		exists, err := urlExistsInDB(ctx, url)
+		if err != nil {
+			return "", nil, false, err
+		}
+		if exists {
 			log.Println("Old URL exists, updating to new URL before further injest...")
-			updatePodcastUrl(url, newEndpoint)
+			updatePodcastUrl(ctx, url, newEndpoint)
 		}
 
-		return newEndpoint, false, nil
+		return newEndpoint, nil, false, nil
 	}
 
 	// We should check if there has been a Not Modified response, in which case we can signal we don't need to go any further
 	if response.StatusCode == 304 {
-		return url, true, nil
+		return url, response, true, nil
 	}
 
-	setHeadersInDB(url, response)
+	setHeadersInDB(ctx, url, response)
 
-	return url, false, nil
+	return url, response, false, nil
 }
 
-func updatePodcastUrl(oldUrl string, newUrl string) {
+// updatePodcastUrl moves the podcast at oldUrl to newUrl
+// A publisher can point their feed anywhere, so a move that can't be made is skipped rather than stopping the injest
+func updatePodcastUrl(ctx context.Context, oldUrl string, newUrl string) {
+	log := logger.From(ctx)
 	// The old URL is in the DB we need to perform a swap
-	tx, err := db.Begin()
-	if err != nil {
-		log.Println("updatePodcastUrl: Couldn't begin database transaction")
-		log.Fatal(err)
-	}
-	_, writeErr := tx.Exec("UPDATE podcasts SET feed_url = $1 WHERE feed_url = $2", newUrl, oldUrl)
-	if writeErr != nil {
-		log.Println("updatePodcastUrl: Could not write to DB")
-		log.Fatal(writeErr)
-	}
-	commitErr := tx.Commit()
-	if commitErr != nil {
-		log.Println("updatePodcastUrl: Commit failed")
-		log.Fatal(commitErr)
-	}
-}
-
-func urlExistsInDB(url string) bool {
-	var urlColumn string
-	err := db.QueryRow("SELECT feed_url FROM podcasts WHERE feed_url = $1", url).Scan(&urlColumn)
+	ctx, done := observeTx(ctx, "updatePodcastUrl")
+	defer done()
+	_, err := getStores().Podcasts.MovePodcast(ctx, oldUrl, newUrl)
 	switch {
-	case err == sql.ErrNoRows:
-		return false
+	case cancelled(ctx, err):
+	case err == store.ErrNotFound:
+		// It's been moved, or removed, since we looked
+	case err == store.ErrDuplicate:
+		// We already have the podcast it's moving to, that one is kept up to date and this one is left where it is
+		log.Warnf("updatePodcastUrl: not moving %s to %s, we already have a podcast there", oldUrl, newUrl)
 	case err != nil:
-		log.Fatal(err)
-	default:
-		return true
+		log.Error("updatePodcastUrl: Could not write to DB")
+		log.Error(err)
 	}
-	// should never get here
-	return false
+}
+
+// urlExistsInDB reports whether we have a podcast at url
+func urlExistsInDB(ctx context.Context, url string) (bool, error) {
+	_, _, found, err := getStores().Podcasts.FindPodcast(ctx, url)
+	return found, err
 }
 
 // We don't follow any redirects and check the response object to see if its a 301
@@ -100,91 +104,102 @@ func redirectPolicyFunc(req *http.Request, via []*http.Request) error {
 
 // Return false plus the original URL if there has been no redirect
 // Return true plus the new URL if there is a redirect
-func fetchConanicalUrl(feed string) (bool, string, *http.Response, error) {
-	client := &http.Client{
-		CheckRedirect: redirectPolicyFunc,
-		Timeout:       10 * time.Second,
-	}
-
+func fetchConanicalUrl(ctx context.Context, feed string) (bool, string, *http.Response, error) {
 	// Get response headers from previous request before requesting
-	requestHeaders := getHeadersFromDB(feed)
+	return fetchConanicalUrlWithHeaders(ctx, feed, getHeadersFromDB(ctx, feed))
+}
+
+// fetchConanicalUrlWithHeaders is fetchConanicalUrl but with the caching headers passed in,
+// pass an empty RequestHeaders to always get the full feed back
+func fetchConanicalUrlWithHeaders(ctx context.Context, feed string, requestHeaders RequestHeaders) (bool, string, *http.Response, error) {
+	ctx, span := tracing.Span(ctx, "injest.fetch", attribute.String("url", feed))
+	defer span.End()
+	log := logger.From(ctx)
+	client := HTTPClient(FetchTimeout(), true)
 
 	// Create request
-	request, _ := http.NewRequest("GET", feed, nil)
+	request, _ := http.NewRequestWithContext(tracing.WithHTTPEvents(ctx), "GET", feed, nil)
 	// Set headers to save bandwidth
 	request.Header.Add("if-modified-since", requestHeaders.LastModified)
 	request.Header.Add("if-none-match", requestHeaders.Etag)
+	request.Header.Set("Accept-Encoding", acceptEncoding)
 
+	start := time.Now()
 	resp, err := client.Do(request)
+	metrics.FeedFetchDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
 		log.Println("error fetching feed")
 		// It could be a redirect....
 		if redirectErr.MatchString(err.Error()) {
+			countFetch(span, metrics.OutcomeRedirect)
 			return true, resp.Header.Get("Location"), resp, nil
 		}
 		// Any other errors
-		log.Println(err)
+		log.Error(err)
+		countFetch(span, metrics.OutcomeError)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		return false, "", resp, err
 	}
 
 	location, err := resp.Location()
 	if err != nil {
+		countFetch(span, fetchOutcome(resp.StatusCode))
 		return false, feed, resp, nil
 	}
 
+	countFetch(span, metrics.OutcomeRedirect)
 	return true, location.String(), resp, nil
 
 }
 
-// setHeadersInDB grabs response headers and saves them into the database for each podcast
-// This allows us to use them when making subsequent requests
-func setHeadersInDB(url string, response *http.Response) {
-	headersToSet := make(map[string]string)
-	headersToSet["last-modified"] = response.Header.Get("last-modified")
-	headersToSet["etag"] = response.Header.Get("etag")
-	headersToSet["cache-control"] = response.Header.Get("cache-control")
-
-	// convert to JSON
-	jsonString, err := json.Marshal(headersToSet)
-	if err != nil {
-		log.Println("unable to Marshal headers from " + url)
+// countFetch records how a fetch went in metrics.FeedFetches and on its span
+func countFetch(span trace.Span, outcome string) {
+	metrics.FeedFetches.WithLabelValues(outcome).Inc()
+	span.SetAttributes(attribute.String("outcome", outcome))
+}
+
+// fetchOutcome is how a feed response is counted in metrics.FeedFetches
+func fetchOutcome(statusCode int) string {
+	switch statusCode {
+	case http.StatusOK:
+		return metrics.OutcomeOK
+	case http.StatusNotModified:
+		return metrics.OutcomeNotModified
+	default:
+		return metrics.OutcomeError
 	}
+}
 
-	// The old URL is in the DB we need to perform a swap
-	tx, err := db.Begin()
-	if err != nil {
-		log.Println("setHeadersInDB: Couldn't begin database transaction")
-		log.Fatal(err)
+// setHeadersInDB grabs response headers and saves them into the database for each podcast
+// This allows us to use them when making subsequent requests
+// Not saving them only costs a full download next time, so a failed write is logged rather than stopping the injest
+func setHeadersInDB(ctx context.Context, url string, response *http.Response) {
+	log := logger.From(ctx)
+	headers := RequestHeaders{
+		LastModified: response.Header.Get("last-modified"),
+		Etag:         response.Header.Get("etag"),
+		CacheControl: response.Header.Get("cache-control"),
 	}
 
-	_, writeErr := tx.Exec("UPDATE podcasts SET response_headers = $1 WHERE feed_url = $2", jsonString, url)
-	if writeErr != nil {
-		log.Println("setHeadersInDB: Could not write to DB")
-		log.Fatal(writeErr)
+	ctx, done := observeTx(ctx, "setHeadersInDB")
+	defer done()
+	err := getStores().FetchState.SetHeaders(ctx, url, headers)
+	if cancelled(ctx, err) {
+		return
 	}
-	commitErr := tx.Commit()
-	if commitErr != nil {
-		log.Println("setHeadersInDB: Commit failed")
-		log.Fatal(commitErr)
+	if err != nil {
+		log.Error("setHeadersInDB: Could not write to DB")
+		log.Error(err)
 	}
 }
 
 // getHeadersFromDB returns the response headers from the previous request to feed_url
-func getHeadersFromDB(url string) RequestHeaders {
-	var responseHeaders sql.NullString
-	err := db.QueryRow("SELECT response_headers FROM podcasts WHERE feed_url = $1", url).Scan(&responseHeaders)
-	if err != nil && err != sql.ErrNoRows {
-		log.Printf("%s", err)
-	}
-
-	var headers = RequestHeaders{}
-	if responseHeaders.Valid {
-		err = json.Unmarshal([]byte(responseHeaders.String), &headers)
-		if err != nil {
-			log.Println("error in getHeaders")
-			log.Printf("%s", err)
-		}
+func getHeadersFromDB(ctx context.Context, url string) RequestHeaders {
+	state, _, err := getStores().FetchState.FetchState(ctx, url)
+	if err != nil {
+		log.Error("error in getHeaders")
+		log.Error(err)
 	}
-
-	return headers
+	return state.Headers
 }
@@ -1,72 +1,139 @@
 package injest
 
+import (
+	"context"
+	"math"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/metrics"
+	"bitbucket.org/jayflux/mypodcasts_injest/queue"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// dueCondition matches podcasts which haven't been fetched for longer than their poll frequency
+const dueCondition = "extract('epoch' from age(now(), last_fetch))/3600 > poll_frequency"
+
+// registerBacklogMetric reports how many podcasts are due but haven't been polled yet, queued or not
+// It's counted when /metrics is scraped
+func registerBacklogMetric() {
+	metrics.Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "injest_due_podcasts",
+		Help: "Podcasts past their poll frequency which haven't been fetched yet.",
+	}, func() float64 {
+		var due int
+		if err := getDB().QueryRow("select count(*) from podcasts where " + dueCondition).Scan(&due); err != nil {
+			log.Error("registerBacklogMetric: error in query")
+			log.Error(err)
+			return math.NaN()
+		}
+		return float64(due)
+	}))
+}
+
 // UpdateNewPodcasts updates new podcasts
-func UpdateNewPodcasts() {
+// It returns how many it injested, feeds which fail are counted out but don't stop it
+func UpdateNewPodcasts(ctx context.Context) (int, error) {
 	// Fetch podcasts which haven't had their last_change set (new podcasts)
 	// This should be a one-off
 	var feedURL string
 
-	rows, err := db.Query("select feed_url from podcasts where last_change is NULL")
+	rows, err := getDB().QueryContext(ctx, "select feed_url from podcasts where last_change is NULL")
+	if cancelled(ctx, err) {
+		return 0, nil
+	}
 	if err != nil {
-		log.Println(err)
-		log.Fatal("UpdatePodcasts: error in query")
+		log.Error("UpdateNewPodcasts: error in query")
+		return 0, err
 	}
 	defer rows.Close()
-	for rows.Next() {
-		rows.Scan(&feedURL)
-		Injest(feedURL)
+	injested := 0
+	for rows.Next() && ctx.Err() == nil {
+		if err := rows.Scan(&feedURL); err != nil {
+			return injested, err
+		}
+		if Injest(ctx, feedURL) == nil {
+			injested++
+		}
 	}
+	if err := rows.Err(); !cancelled(ctx, err) {
+		return injested, err
+	}
+	return injested, nil
 }
 
-// UpdatePodcasts updates podcasts which need updating
-func UpdatePodcasts() {
-	log.Println("Performing update on podcasts..")
+// UpdatePodcasts queues the podcasts which need updating, workers do the injesting
+// It returns how many were queued, stopping early if ctx is done
+func UpdatePodcasts(ctx context.Context) (int, error) {
+	log.Println("Queueing update of podcasts..")
 	// Fetch podcasts which haven't had their last_change set (new podcasts)
 	// This should be a one-off
 	var feedURL string
 
-	rows, err := db.Query("select feed_url from podcasts where extract('epoch' from age(now(), last_fetch))/3600 > poll_frequency")
+	rows, err := getDB().QueryContext(ctx, "select feed_url from podcasts where "+dueCondition)
+	if cancelled(ctx, err) {
+		return 0, nil
+	}
 	if err != nil {
-		log.Println(err)
-		log.Fatal("UpdatePodcasts: error in query")
+		log.Error("UpdatePodcasts: error in query")
+		return 0, err
 	}
 	defer rows.Close()
-	for rows.Next() {
-		rows.Scan(&feedURL)
-		Injest(feedURL)
+	queued := 0
+	for rows.Next() && ctx.Err() == nil {
+		if err := rows.Scan(&feedURL); err != nil {
+			return queued, err
+		}
+		if _, err := EnqueueInjest(feedURL, queue.PriorityNormal); err != nil {
+			log.Errorf("UpdatePodcasts: Could not queue %s", feedURL)
+			log.Error(err)
+			continue
+		}
+		queued++
 	}
+	if err := rows.Err(); !cancelled(ctx, err) {
+		return queued, err
+	}
+	return queued, nil
 }
 
 // UpdatePollFrequencies will go through all podcasts and set the right polling frequency
-func UpdatePollFrequencies() {
+// It returns how many podcasts it went through, nothing is changed if it fails part way
+func UpdatePollFrequencies(ctx context.Context) (int, error) {
 	var feedURL string
 	// Fetch all podcasts and update their poll frequencies
-	rows, err := db.Query("select feed_url from podcasts")
+	rows, err := getDB().QueryContext(ctx, "select feed_url from podcasts")
 	if err != nil {
-		log.Println(err)
-		log.Fatal("UpdatePollFrequencies: error in query")
+		log.Error("UpdatePollFrequencies: error in query")
+		return 0, err
 	}
 	defer rows.Close()
-	tx, err := db.Begin()
+	tx, err := getDB().BeginTx(ctx, nil)
 	if err != nil {
-		log.Println("UpdatePollFrequencies: Couldn't begin database transaction")
-		log.Fatal(err)
+		log.Error("UpdatePollFrequencies: Couldn't begin database transaction")
+		return 0, err
 	}
+	defer tx.Rollback()
 
+	updated := 0
 	for rows.Next() {
-		rows.Scan(&feedURL)
-		freq := updatePollFrequency(feedURL)
-		_, writeErr := tx.Exec("UPDATE podcasts SET poll_frequency = $1 WHERE feed_url = $2", freq, feedURL)
+		if err := rows.Scan(&feedURL); err != nil {
+			return 0, err
+		}
+		updated++
+		freq := updatePollFrequency(ctx, feedURL)
+		_, writeErr := tx.ExecContext(ctx, "UPDATE podcasts SET poll_frequency = $1 WHERE feed_url = $2", freq, feedURL)
 		if writeErr != nil {
-			log.Println("UpdatePollFrequencies: Could not write to DB")
-			log.Fatal(writeErr)
+			log.Error("UpdatePollFrequencies: Could not write to DB")
+			return 0, writeErr
 		}
 	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
 
 	commitErr := tx.Commit()
 	if commitErr != nil {
-		log.Println("UpdatePollFrequencies: Commit failed")
-		log.Fatal(commitErr)
+		log.Error("UpdatePollFrequencies: Commit failed")
+		return 0, commitErr
 	}
-
+	return updated, nil
 }
@@ -1,27 +1,26 @@
 package injestFromDataset
 
 import (
-	"encoding/csv"
-	"log"
-	"os"
+	"context"
 
-	"bitbucket.org/jayflux/mypodcasts_injest/injest"
+	"bitbucket.org/jayflux/mypodcasts_injest/discover"
 )
 
-func CrawlDataset() {
-	file, _ := os.Open("/var/local/all-podcasts-dataset/a.tsv")
-	defer file.Close()
-
-	r := csv.NewReader(file)
-	r.Comma = '\t'
-
-	records, err := r.ReadAll()
-	if err != nil {
-		log.Fatal(err)
+// CrawlDataset imports the dataset source from config, streaming it through the injest worker pool
+// path overrides the file in config, it's checkpointed separately so it doesn't move the configured dataset's cursor
+func CrawlDataset(ctx context.Context, path string, options discover.Options) (discover.Stats, error) {
+	name := "dataset"
+	config := discover.LoadConfig(name)
+	if path != "" {
+		name = "dataset:" + path
+		config.Path = path
+		// A different file can be a different format, let its extension decide
+		config.Format = ""
 	}
 
-	for _, each := range records {
-		injest.Injest(each[3])
+	src, err := discover.NewDatasetSource(name, config)
+	if err != nil {
+		return discover.Stats{Source: name}, err
 	}
-
+	return discover.Run(ctx, src, options)
 }
@@ -0,0 +1,21 @@
+package injestFromOPML
+
+import (
+	"context"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/discover"
+	"bitbucket.org/jayflux/mypodcasts_injest/logger"
+)
+
+var log = logger.Log
+
+// ImportOPML reads an OPML file (a path or an http(s) URL) and injests any feeds we don't already have
+// Feeds are matched against current feed URLs and the URLs podcasts have moved away from
+func ImportOPML(ctx context.Context, source string, workers int) discover.Stats {
+	stats, err := discover.Run(ctx, discover.NewOPMLSource(source), discover.Options{Workers: workers, Full: true})
+	if err != nil && ctx.Err() == nil {
+		log.Errorf("ImportOPML: Unable to import %s", source)
+		log.Fatal(err)
+	}
+	return stats
+}
@@ -0,0 +1,207 @@
+// Package leader makes sure only one replica runs each scheduled job
+// Every instance campaigns for a lease row per job, the holder renews it every third of leader.leaseSeconds
+// If the holder dies its lease runs out and the next instance to campaign takes over
+package leader
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/config"
+	"bitbucket.org/jayflux/mypodcasts_injest/database"
+	"bitbucket.org/jayflux/mypodcasts_injest/logger"
+)
+
+var (
+	log = logger.Log
+
+	// leases are the ones this instance is campaigning for, keyed by name
+	leases   = make(map[string]*lease)
+	leasesMu sync.Mutex
+)
+
+// lease is this instance's view of a lease it's campaigning for
+type lease struct {
+	mu      sync.Mutex
+	leading bool
+	// resigned stops us campaigning again, we're on our way out
+	resigned bool
+	// until is when we stop trusting the lease if we can't renew it, measured before the renewal was sent
+	until time.Time
+}
+
+// Lease is who holds a lease, as stored in Postgres
+type Lease struct {
+	Name       string     `json:"name"`
+	Holder     string     `json:"holder"`
+	AcquiredAt time.Time  `json:"acquiredAt"`
+	RenewedAt  time.Time  `json:"renewedAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	LastRunAt  *time.Time `json:"lastRunAt,omitempty"`
+	Expired    bool       `json:"expired"`
+}
+
+// getDB returns the shared pool
+func getDB() *sql.DB {
+	return database.DB()
+}
+
+// Instance identifies this process as a lease holder
+func Instance() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+func leaseDuration() time.Duration {
+	return time.Duration(config.Get().Leader.LeaseSeconds) * time.Second
+}
+
+// Guard wraps a scheduled job so it only runs on the instance holding name's lease
+// It starts campaigning for the lease straight away, so leadership is settled before the first run
+func Guard(name string, fn func()) func() {
+	campaign(name)
+	return func() {
+		if !IsLeader(name) {
+			log.Printf("leader: skipping %s, another instance leads it", name)
+			return
+		}
+		if !markRun(name) {
+			log.Printf("leader: skipping %s, lost the lease", name)
+			return
+		}
+		fn()
+	}
+}
+
+// campaign starts trying for name's lease in the background, calling it again for the same name does nothing
+func campaign(name string) {
+	leasesMu.Lock()
+	defer leasesMu.Unlock()
+	if _, ok := leases[name]; ok {
+		return
+	}
+	l := &lease{}
+	leases[name] = l
+
+	go func() {
+		for !l.hasResigned() {
+			l.renew(name)
+			time.Sleep(leaseDuration() / 3)
+		}
+	}()
+}
+
+func (l *lease) hasResigned() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.resigned
+}
+
+// renew takes the lease if it's free or expired, or extends it if we already hold it
+func (l *lease) renew(name string) {
+	ttl := leaseDuration()
+	sent := time.Now()
+	var holder string
+	err := getDB().QueryRow(`INSERT INTO leader_leases (name, holder, acquired_at, renewed_at, expires_at)
+		VALUES ($1, $2, now(), now(), now() + make_interval(secs => $3))
+		ON CONFLICT (name) DO UPDATE SET
+			holder = EXCLUDED.holder,
+			acquired_at = CASE WHEN leader_leases.holder = EXCLUDED.holder THEN leader_leases.acquired_at ELSE now() END,
+			renewed_at = now(),
+			expires_at = EXCLUDED.expires_at
+		WHERE leader_leases.holder = EXCLUDED.holder OR leader_leases.expires_at < now()
+		RETURNING holder`, name, Instance(), ttl.Seconds()).Scan(&holder)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.resigned {
+		return
+	}
+	switch {
+	case err == sql.ErrNoRows:
+		if l.leading {
+			log.Warnf("leader: %s lost the %s lease", Instance(), name)
+		}
+		l.leading = false
+	case err != nil:
+		// Keep leading until the lease we had runs out, someone else can't take it before then either
+		log.Error("leader: Could not renew lease " + name)
+		log.Error(err)
+		if l.leading && time.Now().After(l.until) {
+			log.Warnf("leader: %s lost the %s lease", Instance(), name)
+			l.leading = false
+		}
+	default:
+		if !l.leading {
+			log.Printf("leader: %s now leads %s", Instance(), name)
+		}
+		l.leading = true
+		l.until = sent.Add(ttl)
+	}
+}
+
+// IsLeader reports whether this instance holds name's lease
+func IsLeader(name string) bool {
+	leasesMu.Lock()
+	l, ok := leases[name]
+	leasesMu.Unlock()
+	if !ok {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leading && time.Now().Before(l.until)
+}
+
+// markRun records a run against the lease, failing if the database says we don't hold it any more
+func markRun(name string) bool {
+	result, err := getDB().Exec("UPDATE leader_leases SET last_run_at = now() WHERE name = $1 AND holder = $2 AND expires_at > now()", name, Instance())
+	if err != nil {
+		log.Error("leader: Could not write to DB")
+		log.Error(err)
+		return false
+	}
+	rows, _ := result.RowsAffected()
+	return rows == 1
+}
+
+// Resign gives up every lease this instance holds so another can take over without waiting for them to expire
+// It's for shutting down, we stop campaigning afterwards
+func Resign() {
+	leasesMu.Lock()
+	defer leasesMu.Unlock()
+	for name, l := range leases {
+		l.mu.Lock()
+		l.resigned = true
+		if l.leading {
+			_, err := getDB().Exec("UPDATE leader_leases SET expires_at = now() WHERE name = $1 AND holder = $2", name, Instance())
+			if err != nil {
+				log.Error("leader: Could not resign lease " + name)
+				log.Error(err)
+			}
+			l.leading = false
+		}
+		l.mu.Unlock()
+	}
+}
+
+// Leases returns every lease and who holds it
+func Leases() ([]Lease, error) {
+	all := make([]Lease, 0)
+	rows, err := getDB().Query("SELECT name, holder, acquired_at, renewed_at, expires_at, last_run_at, expires_at < now() FROM leader_leases ORDER BY name")
+	if err != nil {
+		return all, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var l Lease
+		if err := rows.Scan(&l.Name, &l.Holder, &l.AcquiredAt, &l.RenewedAt, &l.ExpiresAt, &l.LastRunAt, &l.Expired); err != nil {
+			return all, err
+		}
+		all = append(all, l)
+	}
+	return all, rows.Err()
+}
@@ -1,26 +1,198 @@
+// Package logger is the application's leveled, structured logger
+// Lines go to each sink in logging.sinks at or above that sink's level, as JSON, or as text when NODE_ENV is development
+// Fields such as feed_url or job can be attached to a context, so everything logged for that piece of work carries them,
+// along with its trace_id when it's being traced
 package logger
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/config"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 // Log is the main logger of our application
-var Log *log.Logger
+var Log *logrus.Logger
+
+// Fields are added to log lines, e.g. logger.Fields{"feed_url": url}
+type Fields = logrus.Fields
+
+// Sink is somewhere log lines are written, Path is a file or stdout or stderr
+// Level is the least severe level written there, logging.level if it's empty
+type Sink struct {
+	Path  string `mapstructure:"path" json:"path"`
+	Level string `mapstructure:"level" json:"level"`
+}
+
+type contextKey struct{}
 
 // Init starts when the first package imports it
 func init() {
-	// Location of log file
-	logpath := "./combined.log"
-	f, err := os.OpenFile(logpath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	if err != nil {
-		log.Fatalf("error opening file: %v", err)
-	}
+	viper.SetDefault("logging.level", "info")
+	// json or text, empty picks text when NODE_ENV is development and json otherwise
+	viper.SetDefault("logging.format", "")
+	viper.SetDefault("logging.sinks", []map[string]interface{}{
+		{"path": "./combined.log"},
+		{"path": "/var/log/fancast/error.log", "level": "error"},
+	})
+	// Files are rotated once they reach maxSizeMB, and every rotateHours, 0 turns time based rotation off
+	viper.SetDefault("logging.maxSizeMB", 100)
+	viper.SetDefault("logging.maxBackups", 10)
+	viper.SetDefault("logging.maxAgeDays", 28)
+	viper.SetDefault("logging.rotateHours", 24)
+	viper.SetDefault("logging.compress", true)
+	config.Load()
 
-	Log = log.New(f, "", log.LstdFlags|log.Lshortfile)
-	Log.Println("LogFile : " + logpath)
-	if os.Getenv("NODE_ENV") == "development" {
+	Log = logrus.New()
+	Log.SetReportCaller(true)
+	// Everything is written by the sink hooks
+	Log.SetOutput(ioutil.Discard)
+	Log.SetFormatter(formatter())
+
+	var sinks []Sink
+	if err := viper.UnmarshalKey("logging.sinks", &sinks); err != nil {
 		Log.SetOutput(os.Stderr)
-		Log.SetOutput(os.Stdout)
+		Log.Fatalf("logger: logging.sinks is invalid: %s", err)
+	}
+	if os.Getenv("NODE_ENV") == "development" {
+		sinks = []Sink{{Path: "stdout"}}
+	}
+
+	files := make([]*lumberjack.Logger, 0)
+	lowest := logrus.PanicLevel
+	for _, sink := range sinks {
+		level, err := parseLevel(sink.Level)
+		if err != nil {
+			Log.SetOutput(os.Stderr)
+			Log.Fatalf("logger: %s has an invalid level: %s", sink.Path, err)
+		}
+		if level > lowest {
+			lowest = level
+		}
+		writer := openSink(sink.Path)
+		if file, ok := writer.(*lumberjack.Logger); ok {
+			files = append(files, file)
+		}
+		Log.AddHook(&sinkHook{writer: writer, levels: logrus.AllLevels[:level+1]})
+	}
+	Log.SetLevel(lowest)
+	rotateEvery(files, time.Duration(viper.GetInt("logging.rotateHours"))*time.Hour)
+
+	for _, sink := range sinks {
+		Log.Infof("LogFile : %s", sink.Path)
+	}
+}
+
+// WithFields returns a copy of ctx whose log lines carry fields, on top of any it already had
+func WithFields(ctx context.Context, fields Fields) context.Context {
+	merged := make(Fields)
+	for k, v := range fieldsFrom(ctx) {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, contextKey{}, merged)
+}
+
+// From returns a logger which adds the fields attached to ctx to each line, and the trace if ctx is being traced
+func From(ctx context.Context) *logrus.Entry {
+	entry := Log.WithFields(fieldsFrom(ctx))
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		entry = entry.WithFields(Fields{"trace_id": span.TraceID().String(), "span_id": span.SpanID().String()})
+	}
+	return entry
+}
+
+func fieldsFrom(ctx context.Context) Fields {
+	if fields, ok := ctx.Value(contextKey{}).(Fields); ok {
+		return fields
+	}
+	return Fields{}
+}
+
+func formatter() logrus.Formatter {
+	format := viper.GetString("logging.format")
+	if format == "" && os.Getenv("NODE_ENV") == "development" {
+		format = "text"
+	}
+	if format == "text" {
+		return &logrus.TextFormatter{FullTimestamp: true, CallerPrettyfier: shortCaller}
+	}
+	return &logrus.JSONFormatter{CallerPrettyfier: shortCaller}
+}
+
+// shortCaller reports the caller as file:line, like log.Lshortfile did
+func shortCaller(frame *runtime.Frame) (string, string) {
+	return "", fmt.Sprintf("%s:%d", filepath.Base(frame.File), frame.Line)
+}
+
+func parseLevel(level string) (logrus.Level, error) {
+	if level == "" {
+		level = viper.GetString("logging.level")
+	}
+	return logrus.ParseLevel(level)
+}
+
+// openSink returns a writer for path, files are rotated by lumberjack
+func openSink(path string) io.Writer {
+	switch strings.ToLower(path) {
+	case "stdout":
+		return os.Stdout
+	case "stderr":
+		return os.Stderr
+	}
+	return &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    viper.GetInt("logging.maxSizeMB"),
+		MaxBackups: viper.GetInt("logging.maxBackups"),
+		MaxAge:     viper.GetInt("logging.maxAgeDays"),
+		Compress:   viper.GetBool("logging.compress"),
+	}
+}
+
+// rotateEvery rotates files on a timer, lumberjack only rotates on size itself
+func rotateEvery(files []*lumberjack.Logger, every time.Duration) {
+	if every <= 0 || len(files) == 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(every) {
+			for _, file := range files {
+				if err := file.Rotate(); err != nil {
+					Log.Errorf("logger: Could not rotate %s: %s", file.Filename, err)
+				}
+			}
+		}
+	}()
+}
+
+// sinkHook writes entries at levels to writer, logrus runs hooks one at a time so writes don't interleave
+type sinkHook struct {
+	writer io.Writer
+	levels []logrus.Level
+}
+
+func (h *sinkHook) Levels() []logrus.Level {
+	return h.levels
+}
+
+func (h *sinkHook) Fire(entry *logrus.Entry) error {
+	line, err := entry.Logger.Formatter.Format(entry)
+	if err != nil {
+		return err
 	}
+	_, err = h.writer.Write(line)
+	return err
 }
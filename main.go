@@ -1,20 +1,35 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
 	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
-	"bitbucket.org/jayflux/mypodcasts_injest/api"
+	"bitbucket.org/jayflux/mypodcasts_injest/config"
+	"bitbucket.org/jayflux/mypodcasts_injest/discover"
 	"bitbucket.org/jayflux/mypodcasts_injest/models"
 
 	"bitbucket.org/jayflux/mypodcasts_injest/injest"
 	"bitbucket.org/jayflux/mypodcasts_injest/injestFromBBC"
+	"bitbucket.org/jayflux/mypodcasts_injest/injestFromDataset"
+	"bitbucket.org/jayflux/mypodcasts_injest/injestFromOPML"
+	"bitbucket.org/jayflux/mypodcasts_injest/leader"
 	"bitbucket.org/jayflux/mypodcasts_injest/logger"
-	"github.com/spf13/viper"
-	"gopkg.in/robfig/cron.v2"
+	"bitbucket.org/jayflux/mypodcasts_injest/migrate"
+	"bitbucket.org/jayflux/mypodcasts_injest/queue"
+	"bitbucket.org/jayflux/mypodcasts_injest/scheduler"
+	"bitbucket.org/jayflux/mypodcasts_injest/tracing"
+	"bitbucket.org/jayflux/mypodcasts_injest/validator"
 )
 
 var build = flag.String("build", "", "Specify type of build")
@@ -22,23 +37,74 @@ var dbFlag = flag.String("db", "", "update or backup")
 var updater = flag.Bool("cron", false, "Initiate application")
 var apiFlag = flag.Bool("api", false, "Start API")
 var cpuprofile = flag.Bool("cpuprofile", false, "write cpu profile to file")
+var dryRun = flag.Bool("dry-run", false, "Show what -build injest would change without writing anything")
+var format = flag.String("format", "text", "Output format for -dry-run, validate, history, discover, sources-report, queue-status and leaders, schedules, job-runs, migrate and config, text or json")
+var category = flag.String("category", "", "Only export podcasts in this category")
+var language = flag.String("language", "", "Only export podcasts in this language, en matches en-gb")
+var active = flag.Bool("active", false, "Only export podcasts which are active and injesting")
+var workers = flag.Int("workers", 0, "How many feeds to injest at once, defaults to injest.workers in config")
+var full = flag.Bool("full", false, "Make discover list everything instead of resuming from where it got to")
+var worker = flag.Bool("worker", false, "Run queue workers, -workers sets how many")
+var serveFlag = flag.Bool("serve", false, "Run the roles in serve.roles, with health checks and metrics on serve.healthAddr")
+var enqueue = flag.Bool("queue", false, "Make discover and import-dataset queue new feeds for the workers instead of injesting them")
+
+// config reads -config and -set from the command line itself, packages load it before flag.Parse runs
+// They're declared so flag accepts them and lists them in -help
+var _ = flag.String("config", "config.json", "Config file to read instead of config.json in the working directory")
+
+func init() {
+	flag.Var(new(settingsFlag), "set", "Override a config value, e.g -set database.host=db -set api.addr=:8080, can be repeated")
+}
+
 var log = logger.Log
 
 func main() {
 	// Setup Config
-	setupConfig()
+	config.Load()
 
-	// Setup logging
-	f, err := os.OpenFile("/var/log/fancast/error.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	if err != nil {
-		log.Fatalf("error opening file: %v", err)
-	}
-	defer f.Close()
+	// Logging is set up by the logger package, the sinks are in logging.sinks
 	log.Println("Application started")
 
 	// Parse commandline arguments
 	flag.Parse()
 
+	// Check config before doing anything with it, config print shows it even if it's invalid
+	if *build != "config" {
+		if err := config.Validate(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	registerSchedules()
+
+	// SIGINT or SIGTERM stops new work being started and lets what's running finish, a second one kills us as normal
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	// Setup tracing, spans are only exported if tracing.exporter is set
+	stopTracing, err := tracing.Start(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() {
+		// Flush what's left, the context above is already done if we're shutting down
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := stopTracing(flushCtx); err != nil {
+			log.Error(err)
+		}
+	}()
+
+	// Refuse to run against a schema older than the code, -build migrate is how it gets updated
+	if usesDatabase() {
+		if err := migrate.Check(ctx); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// Setup CPU Profiling
 	if *cpuprofile {
 		log.Println("profiling...")
@@ -53,66 +119,519 @@ func main() {
 	}
 	switch *build {
 	case "injest":
-		injest.Injest(flag.Arg(0))
+		if *dryRun {
+			printDryRun(ctx, flag.Arg(0))
+		} else {
+			if err := injest.RecordSources([]injest.SourceRecord{{FeedURL: flag.Arg(0), Source: injest.SourceManual}}); err != nil {
+				log.Fatal(err)
+			}
+			injest.Injest(ctx, flag.Arg(0))
+			injest.LinkDiscovered([]string{flag.Arg(0)})
+		}
 	case "bbc":
-		injestFromBBC.CrawlBBC()
+		if _, err := injestFromBBC.CrawlBBC(ctx); err != nil {
+			log.Fatal(err)
+		}
 
 	case "update":
-		injest.UpdatePodcasts()
+		if _, err := injest.UpdatePodcasts(ctx); err != nil {
+			log.Fatal(err)
+		}
 
 	case "update-frequencies":
-		injest.UpdatePollFrequencies()
+		if _, err := injest.UpdatePollFrequencies(ctx); err != nil {
+			log.Fatal(err)
+		}
+
+	case "backfill-text":
+		injest.BackfillText()
+
+	case "parse-report":
+		days, err := strconv.Atoi(flag.Arg(0))
+		if err != nil {
+			days = 7
+		}
+		injest.ParseReport(days)
+
+	case "reprocess":
+		injest.Reprocess(ctx, flag.Arg(0))
+
+	case "validate":
+		printValidation(ctx, flag.Arg(0))
+
+	case "history":
+		printHistory(ctx, flag.Arg(0))
+
+	case "import-opml":
+		stats := injestFromOPML.ImportOPML(ctx, flag.Arg(0), *workers)
+		stats.Print(os.Stdout)
+
+	case "discover":
+		runDiscover(ctx, flag.Arg(0))
+
+	case "import-dataset":
+		printDiscoverStats(injestFromDataset.CrawlDataset(ctx, flag.Arg(0), discover.Options{Workers: *workers, Full: *full, Progress: os.Stderr, Enqueue: *enqueue}))
+
+	case "leaders":
+		printLeaders()
+
+	case "schedules":
+		printSchedules()
+
+	case "job-runs":
+		printJobRuns(flag.Arg(0))
+
+	case "run-job":
+		run, err := scheduler.Trigger(ctx, flag.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		printJobRun(*run)
+		if run.Status != scheduler.StatusSucceeded {
+			os.Exit(1)
+		}
+
+	case "migrate":
+		runMigrate(ctx, flag.Arg(0), flag.Arg(1))
+
+	case "config":
+		if flag.Arg(0) != "print" {
+			fmt.Fprintln(os.Stderr, "usage: -build config print")
+			os.Exit(1)
+		}
+		printConfig()
+
+	case "queue-status":
+		printQueueStatus()
+
+	case "queue-retry":
+		retried, err := queue.Retry(flag.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Requeued %d jobs\n", retried)
+
+	case "sources-report":
+		printSourcesReport(ctx, flag.Arg(0))
+
+	case "export-opml":
+		exportOPML(ctx, flag.Arg(0))
 	}
 
 	switch *dbFlag {
 	case "update":
 		updateDatabase()
 	case "backup":
-		performBackup()
+		if err := performBackup(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *serveFlag {
+		if err := serve(ctx, config.Get().Serve.Roles, config.Get().Serve.HealthAddr); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
+	// -cron, -worker and -api are the roles -serve runs, picked by flag instead of config
+	// They serve health checks and /metrics on serve.healthAddr too, give each process its own if they share a host
+	legacyRoles := make([]string, 0)
 	// Set up cron job to do various tasks, including backing up database
 	if *updater {
-		// https://godoc.org/gopkg.in/robfig/cron.v2
-		c := cron.New()
-		c.AddFunc("@hourly", func() {
-			log.Println("Starting update of podcasts")
-			injest.UpdatePodcasts()
-		})
-		c.AddFunc("@hourly", func() {
-			log.Println("Calling imageProcessing/updateImages.js")
-			cmd := exec.Command("node", "imageProcessing/updateImages.js")
-			err := cmd.Run()
-			if err != nil {
-				log.Println(err)
-			}
-		})
-		c.AddFunc("@weekly", func() {
-			log.Println("Injesting from BBC")
-			injestFromBBC.CrawlBBC()
-		})
-		c.Start()
-		select {}
+		legacyRoles = append(legacyRoles, roleScheduler)
+	}
+	if *worker || (*updater && config.Get().Cron.RunWorkers) {
+		legacyRoles = append(legacyRoles, roleWorker, roleImageProcessor)
 	}
-
 	if *apiFlag {
-		models.InitDB()
-		api.API()
+		legacyRoles = append(legacyRoles, roleAPI)
+	}
+	if len(legacyRoles) > 0 {
+		if err := serve(ctx, legacyRoles, config.Get().Serve.HealthAddr); err != nil {
+			log.Fatal(err)
+		}
 	}
 
 }
 
-func setupConfig() {
-	// Setup Config
-	viper.SetConfigName("config") // name of config file (without extension)
-	viper.SetConfigType("json")   //
-	viper.AddConfigPath(".")
-	viper.BindEnv("database.user", "DB_USER")
-	viper.BindEnv("database.database", "DB_NAME")
-	viper.BindEnv("database.password", "DB_PASS")
-	err := viper.ReadInConfig() // Find and read the config file
-	if err != nil {             // Handle errors reading the config file
-		panic(fmt.Errorf("Fatal error config file: %s \n", err))
+// printDryRun prints what injesting a feed would do, in the format asked for by -format
+func printDryRun(ctx context.Context, url string) {
+	plan, err := injest.DryRun(ctx, url)
+	if err != nil {
+		log.Error(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(plan)
+		return
+	}
+	plan.Print(os.Stdout)
+}
+
+// printValidation prints the findings from validating a feed, in the format asked for by -format
+func printValidation(ctx context.Context, url string) {
+	report, err := validator.Validate(ctx, url)
+	if err != nil {
+		log.Error(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	} else {
+		report.Print(os.Stdout)
+	}
+
+	if report.Count(validator.SeverityError) > 0 {
+		os.Exit(2)
+	}
+}
+
+// printHistory prints the change log of a podcast, newest first
+func printHistory(ctx context.Context, id string) {
+	history := models.GetPodcastHistory(ctx, id, 500)
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(history)
+		return
 	}
 
+	for _, change := range history {
+		target := "podcast"
+		if change.Episode != "" {
+			target = "episode " + change.Episode
+		}
+		fmt.Printf("%s  %s  %s: %q -> %q\n", change.ChangedAt.Format(time.RFC3339), target, change.Field, change.Before, change.After)
+	}
+}
+
+// runDiscover runs a source from discover.sources in config, listing them if name is empty
+func runDiscover(ctx context.Context, name string) {
+	if name == "" {
+		fmt.Println(strings.Join(discover.Names(), "\n"))
+		return
+	}
+	src, err := discover.Get(name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	stats, err := discover.Run(ctx, src, discover.Options{Workers: *workers, Full: *full, Progress: os.Stderr, Enqueue: *enqueue})
+	printDiscoverStats(stats, err)
+}
+
+// printDiscoverStats prints how a discover run went, in the format asked for by -format
+func printDiscoverStats(stats discover.Stats, err error) {
+	if err != nil {
+		log.Error(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(stats)
+		return
+	}
+	stats.Print(os.Stdout)
+}
+
+// printSourcesReport prints how each source's podcasts are doing, and the feeds source never injested if it's given
+func printSourcesReport(ctx context.Context, source string) {
+	report := struct {
+		Sources    []models.SourceSummary `json:"sources"`
+		Uninjested []models.PodcastSource `json:"uninjested,omitempty"`
+	}{Sources: models.GetSourceSummaries(ctx)}
+	if source != "" {
+		report.Uninjested = models.GetUninjestedSources(ctx, source, 1000)
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+		return
+	}
+
+	fmt.Printf("%-30s %8s %8s %8s %8s %8s  %s\n", "Source", "Feeds", "Podcasts", "Live", "Failing", "Never", "Last seen")
+	for _, s := range report.Sources {
+		fmt.Printf("%-30s %8d %8d %8d %8d %8d  %s\n", s.Source, s.Feeds, s.Podcasts, s.Live, s.Failing, s.NeverInjested, s.LastSeen.Format("2006-01-02"))
+	}
+	if source != "" {
+		fmt.Printf("\nFeeds from %s never injested:\n", source)
+		for _, s := range report.Uninjested {
+			fmt.Printf("  %s  %s\n", s.LastSeen.Format("2006-01-02"), s.FeedURL)
+		}
+	}
+}
+
+// exportOPML writes the podcasts matching -category, -language and -active to a file, or stdout if there isn't one
+func exportOPML(ctx context.Context, path string) {
+	doc := models.GetPodcastsOPML(ctx, models.PodcastFilter{Category: *category, Language: *language, Active: *active})
+	out := os.Stdout
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		out = f
+	}
+	if err := doc.Write(out); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// registerJobHandlers tells the queue how to run each type of job
+func registerJobHandlers() {
+	injest.RegisterJobHandlers()
+	queue.Register(queue.TypeProcessImages, func(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+		log.Println("Calling imageProcessing/updateImages.js")
+		return nil, exec.CommandContext(ctx, "node", "imageProcessing/updateImages.js").Run()
+	})
+	queue.Register(queue.TypeBackup, func(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+		return nil, performBackup()
+	})
+}
+
+// printLeaders prints which instance holds each scheduled job's lease
+func printLeaders() {
+	leases, err := leader.Leases()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(leases)
+		return
+	}
+
+	fmt.Printf("%-20s %-30s %-25s %-25s %s\n", "Job", "Leader", "Since", "Expires", "Last run")
+	for _, l := range leases {
+		holder := l.Holder
+		if l.Expired {
+			holder += " (expired)"
+		}
+		lastRun := "never"
+		if l.LastRunAt != nil {
+			lastRun = l.LastRunAt.Format(time.RFC3339)
+		}
+		fmt.Printf("%-20s %-30s %-25s %-25s %s\n", l.Name, holder, l.AcquiredAt.Format(time.RFC3339), l.ExpiresAt.Format(time.RFC3339), lastRun)
+	}
+}
+
+// printSchedules prints each recurring job, how it's configured and when it last ran
+func printSchedules() {
+	schedules := scheduler.Schedules()
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(schedules)
+		return
+	}
+
+	fmt.Printf("%-25s %-15s %8s %-8s %s\n", "Job", "Spec", "Jitter", "Enabled", "Last run")
+	for _, s := range schedules {
+		lastRun := "never"
+		if runs, err := scheduler.Runs(s.Name, 1); err == nil && len(runs) > 0 {
+			lastRun = runs[0].StartedAt.Format(time.RFC3339) + " " + runs[0].Status
+		}
+		fmt.Printf("%-25s %-15s %7ds %-8t %s\n", s.Name, s.Spec, s.JitterSeconds, s.Enabled, lastRun)
+	}
+}
+
+// printJobRuns prints the latest runs of a recurring job, or of all of them if name is empty
+func printJobRuns(name string) {
+	runs, err := scheduler.Runs(name, 50)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(runs)
+		return
+	}
+	for _, run := range runs {
+		printJobRun(run)
+	}
+}
+
+func printJobRun(run scheduler.Run) {
+	counts := make([]string, 0, len(run.Counts))
+	for k, v := range run.Counts {
+		counts = append(counts, fmt.Sprintf("%s=%d", k, v))
+	}
+	sort.Strings(counts)
+	fmt.Printf("%s  %-25s %-9s %-9s %8s  %s  %s %s\n", run.StartedAt.Format(time.RFC3339), run.Name, run.Trigger, run.Status, run.Duration(), run.Instance, strings.Join(counts, " "), run.Error)
+}
+
+// printQueueStatus prints how many jobs are in each state and the latest dead lettered ones
+func printQueueStatus() {
+	counts, err := queue.Counts()
+	if err != nil {
+		log.Fatal(err)
+	}
+	dead, err := queue.Dead(20)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(struct {
+			Counts []queue.Count `json:"counts"`
+			Dead   []queue.Job   `json:"dead"`
+		}{counts, dead})
+		return
+	}
+
+	fmt.Printf("%-20s %-10s %8s\n", "Type", "Status", "Jobs")
+	for _, c := range counts {
+		fmt.Printf("%-20s %-10s %8d\n", c.Type, c.Status, c.Jobs)
+	}
+	if len(dead) > 0 {
+		fmt.Println("\nDead jobs:")
+		for _, job := range dead {
+			fmt.Printf("  %s  %s  %s  %s\n", job.UpdatedAt.Format(time.RFC3339), job.ID, job.Type, job.LastError)
+		}
+	}
+}
+
+// usesDatabase is whether what we've been asked to do reads or writes the database
+// -db update replaces it wholesale, so it's left out along with config, migrate and validate
+func usesDatabase() bool {
+	switch *build {
+	case "config", "migrate", "validate":
+		return false
+	case "":
+		return *serveFlag || *updater || *worker || *apiFlag
+	}
+	return true
+}
+
+// runMigrate runs -build migrate status, up, down or to <version>
+func runMigrate(ctx context.Context, command string, version string) {
+	var err error
+	switch command {
+	case "status", "":
+		printMigrations(ctx)
+		return
+	case "up":
+		err = migrate.Up(ctx)
+	case "down":
+		err = migrate.Down(ctx)
+	case "to":
+		target, convErr := strconv.Atoi(version)
+		if convErr != nil {
+			fmt.Fprintln(os.Stderr, "usage: -build migrate to <version>")
+			os.Exit(1)
+		}
+		err = migrate.To(ctx, target)
+	default:
+		fmt.Fprintln(os.Stderr, "usage: -build migrate status|up|down|to <version>")
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Error(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	printMigrations(ctx)
+}
+
+// printMigrations prints each migration and when it was applied, in the format asked for by -format
+func printMigrations(ctx context.Context) {
+	statuses, err := migrate.Statuses(ctx)
+	if err != nil {
+		log.Error(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(statuses)
+		return
+	}
+
+	fmt.Printf("%-8s %-35s %s\n", "Version", "Name", "Applied")
+	for _, status := range statuses {
+		applied := "pending"
+		if status.AppliedAt != nil {
+			applied = status.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Printf("%-8d %-35s %s\n", status.Version, status.Name, applied)
+	}
+}
+
+// printConfig prints the config in effect, after the environment and -set, with secrets redacted
+// It exits with the problems found if the config is invalid
+func printConfig() {
+	settings := config.Get().Redacted()
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(settings)
+	} else {
+		// Flattened to the keys config.json and -set use, e.g api.submissions.perHour
+		var values map[string]interface{}
+		settingsJSON, _ := json.Marshal(settings)
+		json.Unmarshal(settingsJSON, &values)
+		flattened := make(map[string]interface{})
+		flattenConfig("", values, flattened)
+		keys := make([]string, 0, len(flattened))
+		for key := range flattened {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			valueJSON, _ := json.Marshal(flattened[key])
+			fmt.Printf("%-35s %s\n", key, valueJSON)
+		}
+	}
+
+	if err := config.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func flattenConfig(prefix string, values map[string]interface{}, into map[string]interface{}) {
+	for key, value := range values {
+		if nested, ok := value.(map[string]interface{}); ok {
+			flattenConfig(prefix+key+".", nested, into)
+			continue
+		}
+		into[prefix+key] = value
+	}
+}
+
+// settingsFlag accepts -set more than once
+type settingsFlag []string
+
+func (s *settingsFlag) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *settingsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
 }
@@ -0,0 +1,111 @@
+// Package metrics holds the Prometheus metrics the injester reports, on one registry which is served at /metrics
+// Packages with their own gauges to collect, e.g. queue depth, register them on Registry themselves
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry is shared by every role in the process, it also has the Go runtime and process collectors on it
+var Registry = prometheus.NewRegistry()
+
+// Feed fetch outcomes
+const (
+	OutcomeOK          = "200"
+	OutcomeNotModified = "304"
+	OutcomeRedirect    = "redirect"
+	OutcomeError       = "error"
+)
+
+var (
+	// FeedFetches counts feed requests by outcome, anything other than a 200, 304 or redirect is an error
+	FeedFetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "injest_feed_fetches_total",
+		Help: "Feed requests by outcome (200, 304, redirect or error).",
+	}, []string{"outcome"})
+
+	// FeedFetchDuration is how long a feed takes to respond, up to its headers, the body is read as it's parsed
+	FeedFetchDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "injest_feed_fetch_duration_seconds",
+		Help:    "Time until a feed responded with its headers.",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	})
+
+	// FeedFetchBytes is the size of feed bodies after decompression
+	FeedFetchBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "injest_feed_fetch_bytes",
+		Help:    "Size of feed bodies after decompression.",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+	})
+
+	// FeedParseFailures counts feeds which couldn't be parsed, even after repairs
+	FeedParseFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "injest_feed_parse_failures_total",
+		Help: "Feeds which could not be parsed, even after repairs.",
+	})
+
+	// FeedProcessDuration is how long it takes to write a parsed feed and its episodes to the database
+	FeedProcessDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "injest_feed_process_duration_seconds",
+		Help:    "Time to write a parsed feed and its episodes to the database.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	// Episodes counts episode writes by action, inserted or updated
+	Episodes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "injest_episodes_total",
+		Help: "Episodes written to the database, by action (inserted or updated).",
+	}, []string{"action"})
+
+	// DBTransactionDuration is how long injest's transactions take, labelled with the function running them
+	DBTransactionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "injest_db_transaction_duration_seconds",
+		Help:    "Time taken by database transactions, by the function running them.",
+		Buckets: []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 5},
+	}, []string{"tx"})
+
+	// JobRuns counts scheduled job runs by how they ended, including the ones skipped because one was already running
+	JobRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "scheduler_job_runs_total",
+		Help: "Scheduled job runs, by job and status.",
+	}, []string{"job", "status"})
+
+	// JobRunDuration is how long scheduled jobs take, skipped runs aren't observed
+	JobRunDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "scheduler_job_run_duration_seconds",
+		Help:    "Time taken by scheduled job runs, by job and status.",
+		Buckets: []float64{1, 5, 15, 30, 60, 300, 900, 1800, 3600, 7200},
+	}, []string{"job", "status"})
+
+	// APIRequestDuration is how long API requests take, by route template so IDs don't blow up the cardinality
+	APIRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "api_request_duration_seconds",
+		Help:    "Time taken to serve API requests, by route, method and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+)
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		FeedFetches,
+		FeedFetchDuration,
+		FeedFetchBytes,
+		FeedParseFailures,
+		FeedProcessDuration,
+		Episodes,
+		DBTransactionDuration,
+		JobRuns,
+		JobRunDuration,
+		APIRequestDuration,
+	)
+}
+
+// Handler serves everything on Registry in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,311 @@
+// Package migrate keeps the database schema in step with the code, using versioned migrations embedded in the binary
+// Each migration is a pair of files in migrations, <version>_<name>.up.sql and <version>_<name>.down.sql
+// Applied versions are recorded in schema_migrations, and an advisory lock stops two instances migrating at once
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/database"
+	"bitbucket.org/jayflux/mypodcasts_injest/logger"
+)
+
+//go:embed migrations/*.sql
+var files embed.FS
+
+// lockID is the advisory lock held while migrating, any instance migrating waits for the one before it
+const lockID = 4823591
+
+var fileRegex = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is one version of the schema
+type Migration struct {
+	Version int    `json:"version"`
+	Name    string `json:"name"`
+	up      string
+	down    string
+}
+
+// Status is a migration and when it was applied, AppliedAt is nil if it hasn't been
+type Status struct {
+	Migration
+	AppliedAt *time.Time `json:"appliedAt,omitempty"`
+}
+
+// queryer is the pool or a connection from it
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// getDB returns the shared pool
+func getDB() *sql.DB {
+	return database.DB()
+}
+
+// Migrations returns every embedded migration, oldest first
+func Migrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(files, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := fileRegex.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migrate: %s isn't named <version>_<name>.up.sql or .down.sql", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		body, err := files.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migrate: version %d is used by %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.up = string(body)
+		} else {
+			m.down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" {
+			return nil, fmt.Errorf("migrate: %d_%s has no up migration", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Latest is the version the code needs the database to be at
+func Latest() int {
+	migrations, err := Migrations()
+	if err != nil || len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// Statuses returns every migration the code has or the database has applied, oldest first
+func Statuses(ctx context.Context) ([]Status, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedVersions(ctx, getDB())
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, 0, len(migrations))
+	for _, m := range migrations {
+		status := Status{Migration: m}
+		if at, ok := applied[m.Version]; ok {
+			status.AppliedAt = &at
+			delete(applied, m.Version)
+		}
+		statuses = append(statuses, status)
+	}
+	// Versions applied by a newer build than this one
+	for version, at := range applied {
+		at := at
+		statuses = append(statuses, Status{Migration: Migration{Version: version, Name: "unknown"}, AppliedAt: &at})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+	return statuses, nil
+}
+
+// Check returns an error if any of the code's migrations haven't been applied, so we don't run against an older schema
+// A database ahead of the code is allowed, so instances running the previous build keep going during a deploy
+func Check(ctx context.Context) error {
+	statuses, err := Statuses(ctx)
+	if err != nil {
+		return err
+	}
+	pending := make([]int, 0)
+	for _, status := range statuses {
+		if status.AppliedAt == nil {
+			pending = append(pending, status.Version)
+		}
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("migrate: the database schema is out of date, migrations %v haven't been applied, run -build migrate up", pending)
+	}
+	return nil
+}
+
+// Up applies every migration that hasn't been
+func Up(ctx context.Context) error {
+	return To(ctx, Latest())
+}
+
+// Down rolls back the latest migration applied
+func Down(ctx context.Context) error {
+	return withLock(ctx, func(conn *sql.Conn) error {
+		migrations, err := Migrations()
+		if err != nil {
+			return err
+		}
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(migrations) - 1; i >= 0; i-- {
+			if _, ok := applied[migrations[i].Version]; ok {
+				return revert(ctx, conn, migrations[i])
+			}
+		}
+		logger.From(ctx).Println("migrate: Nothing to roll back")
+		return nil
+	})
+}
+
+// To applies or rolls back migrations until the database is at version, 0 rolls back everything
+func To(ctx context.Context, version int) error {
+	return withLock(ctx, func(conn *sql.Conn) error {
+		migrations, err := Migrations()
+		if err != nil {
+			return err
+		}
+		if version != 0 && !hasVersion(migrations, version) {
+			return fmt.Errorf("migrate: there's no migration %d", version)
+		}
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; ok && m.Version > version {
+				if err := revert(ctx, conn, m); err != nil {
+					return err
+				}
+			}
+		}
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; !ok && m.Version <= version {
+				if err := apply(ctx, conn, m); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// withLock runs fn on a connection holding the migration lock, waiting for any other instance migrating to finish
+func withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := getDB().Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", lockID); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", lockID)
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer PRIMARY KEY,
+		name text not null,
+		applied_at timestamp not null
+	)`)
+	if err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+// apply runs m's up migration and records it, in one transaction so a failure leaves nothing half done
+func apply(ctx context.Context, conn *sql.Conn, m Migration) error {
+	log := logger.From(ctx)
+	log.Printf("migrate: Applying %d_%s", m.Version, m.Name)
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, m.up); err != nil {
+		return fmt.Errorf("migrate: %d_%s failed: %s", m.Version, m.Name, err)
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, now())", m.Version, m.Name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// revert runs m's down migration and forgets it was applied
+func revert(ctx context.Context, conn *sql.Conn, m Migration) error {
+	log := logger.From(ctx)
+	if m.down == "" {
+		return fmt.Errorf("migrate: %d_%s can't be rolled back, it has no down migration", m.Version, m.Name)
+	}
+	log.Printf("migrate: Rolling back %d_%s", m.Version, m.Name)
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, m.down); err != nil {
+		return fmt.Errorf("migrate: rolling back %d_%s failed: %s", m.Version, m.Name, err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = $1", m.Version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// appliedVersions returns when each applied version was, it's empty if nothing has been migrated yet
+func appliedVersions(ctx context.Context, db queryer) (map[int]time.Time, error) {
+	applied := make(map[int]time.Time)
+	var exists bool
+	if err := db.QueryRowContext(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists); err != nil || !exists {
+		return applied, err
+	}
+	rows, err := db.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+func hasVersion(migrations []Migration, version int) bool {
+	for _, m := range migrations {
+		if m.Version == version {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package migrate
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("got no migrations")
+	}
+	for i, m := range migrations {
+		// Versions are applied in order, a gap usually means a file was misnamed
+		if m.Version != i+1 {
+			t.Errorf("got version %d at position %d, want %d", m.Version, i, i+1)
+		}
+		if strings.TrimSpace(m.down) == "" {
+			t.Errorf("%d_%s has no down migration", m.Version, m.Name)
+		}
+	}
+	if Latest() != migrations[len(migrations)-1].Version {
+		t.Errorf("got Latest %d, want %d", Latest(), migrations[len(migrations)-1].Version)
+	}
+}
+
+func TestInitialSchemaIsTheBaseline(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A database made by build/create_tables.sql adopts 0001, so anything added since has to be in a later migration or it's never added
+	for _, column := range []string{"title_text", "description_html", "summary", "last_failure", "poll_frequency", "last_change"} {
+		if strings.Contains(migrations[0].up, column) {
+			t.Errorf("0001 has %s, it wasn't in build/create_tables.sql", column)
+		}
+	}
+}
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS podcast_episodes;
+DROP TABLE IF EXISTS podcasts;
@@ -0,0 +1,70 @@
+-- The schema as build/create_tables.sql made it before migrations, IF NOT EXISTS lets a database created from it adopt this version
+-- Everything added since is a migration of its own, so an adopted database is brought up to date by the ones after this
+CREATE TABLE IF NOT EXISTS podcasts (
+    id  uuid PRIMARY KEY,
+    title   text,
+    title_tsv tsvector,
+    description text,
+    description_tsv tsvector,
+    link    text,
+    updated text,
+    updated_parsed  timestamp,
+    author  jsonb,
+    language    text,
+    image jsonb,
+    itunes_ext jsonb,
+    categories jsonb,
+    feed_url text,
+    copyright text,
+    last_fetch timestamp,
+  active boolean
+);
+
+
+CREATE TABLE IF NOT EXISTS podcast_episodes (
+    id uuid PRIMARY KEY,
+    -- I need both ID and guid, ID will be the internal ID, guid is the field provided by the RSS Item
+    -- When updating a podcast episode i will need to do a lookup on the GUID, i will only expect a single row so this should be unique
+    guid text UNIQUE,
+    title text,
+    title_tsv tsvector,
+    description text,
+    description_tsv tsvector,
+    published text,
+    published_parsed timestamp,
+    author jsonb,
+    image jsonb,
+    enclosures jsonb,
+    digest text UNIQUE,
+    itunes_ext jsonb,
+    last_fetch timestamp,
+    parent uuid not null,
+  active boolean
+);
+
+-- Indexes for podcast episodes, named as Postgres named the unnamed ones in build/create_tables.sql
+CREATE INDEX IF NOT EXISTS podcast_episodes_published_parsed_idx ON podcast_episodes (published_parsed);
+CREATE INDEX IF NOT EXISTS podcast_episodes_description_tsv_idx ON podcast_episodes USING GIN (description_tsv);
+CREATE INDEX IF NOT EXISTS podcast_episodes_title_tsv_idx ON podcast_episodes USING GIN (title_tsv);
+
+-- Indexes for podcasts
+CREATE INDEX IF NOT EXISTS podcasts_updated_parsed_idx ON podcasts (updated_parsed);
+CREATE INDEX IF NOT EXISTS podcasts_description_tsv_idx ON podcasts USING GIN (description_tsv);
+CREATE INDEX IF NOT EXISTS podcasts_title_tsv_idx ON podcasts USING GIN (title_tsv);
+
+-- Keep the search vectors up to date, dropped first as CREATE TRIGGER has no IF NOT EXISTS
+DROP TRIGGER IF EXISTS tsvectorupdate_podcast_episodes_description ON podcast_episodes;
+CREATE TRIGGER tsvectorupdate_podcast_episodes_description BEFORE INSERT OR UPDATE ON podcast_episodes FOR EACH ROW EXECUTE PROCEDURE
+tsvector_update_trigger(description_tsv, 'pg_catalog.english', description);
+
+DROP TRIGGER IF EXISTS tsvectorupdate_podcast_episodes_title ON podcast_episodes;
+CREATE TRIGGER tsvectorupdate_podcast_episodes_title BEFORE INSERT OR UPDATE ON podcast_episodes FOR EACH ROW EXECUTE PROCEDURE
+tsvector_update_trigger(title_tsv, 'pg_catalog.english', title);
+
+DROP TRIGGER IF EXISTS tsvectorupdate_podcasts_description ON podcasts;
+CREATE TRIGGER tsvectorupdate_podcasts_description BEFORE INSERT OR UPDATE ON podcasts FOR EACH ROW EXECUTE PROCEDURE
+tsvector_update_trigger(description_tsv, 'pg_catalog.english', description);
+
+DROP TRIGGER IF EXISTS tsvectorupdate_podcasts_title ON podcasts;
+CREATE TRIGGER tsvectorupdate_podcasts_title BEFORE INSERT OR UPDATE ON podcasts FOR EACH ROW EXECUTE PROCEDURE
+tsvector_update_trigger(title_tsv, 'pg_catalog.english', title);
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS podcasts_date_added_idx;
+ALTER TABLE podcasts DROP COLUMN IF EXISTS date_added;
+ALTER TABLE podcasts DROP COLUMN IF EXISTS response_headers;
+ALTER TABLE podcasts DROP COLUMN IF EXISTS last_change;
+ALTER TABLE podcasts DROP COLUMN IF EXISTS poll_frequency;
+ALTER TABLE podcasts DROP COLUMN IF EXISTS digest;
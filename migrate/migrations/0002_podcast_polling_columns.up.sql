@@ -0,0 +1,12 @@
+-- Columns the injester has always written to podcasts but build/create_tables.sql never had
+-- Hash of the feed's metadata, a podcast is only rewritten when it changes
+ALTER TABLE podcasts ADD COLUMN IF NOT EXISTS digest text;
+-- Hours between polls, see updatePollFrequency
+ALTER TABLE podcasts ADD COLUMN IF NOT EXISTS poll_frequency integer;
+-- When the digest last changed, RFC3339
+ALTER TABLE podcasts ADD COLUMN IF NOT EXISTS last_change text;
+-- ETag, Last-Modified and Cache-Control from the last fetch, sent back so unchanged feeds aren't downloaded again
+ALTER TABLE podcasts ADD COLUMN IF NOT EXISTS response_headers jsonb;
+ALTER TABLE podcasts ADD COLUMN IF NOT EXISTS date_added timestamp;
+
+CREATE INDEX IF NOT EXISTS podcasts_date_added_idx ON podcasts (date_added);
@@ -0,0 +1,27 @@
+DROP TRIGGER IF EXISTS tsvectorupdate_podcasts_description ON podcasts;
+CREATE TRIGGER tsvectorupdate_podcasts_description BEFORE INSERT OR UPDATE ON podcasts FOR EACH ROW EXECUTE PROCEDURE
+tsvector_update_trigger(description_tsv, 'pg_catalog.english', description);
+
+DROP TRIGGER IF EXISTS tsvectorupdate_podcasts_title ON podcasts;
+CREATE TRIGGER tsvectorupdate_podcasts_title BEFORE INSERT OR UPDATE ON podcasts FOR EACH ROW EXECUTE PROCEDURE
+tsvector_update_trigger(title_tsv, 'pg_catalog.english', title);
+
+DROP TRIGGER IF EXISTS tsvectorupdate_podcast_episodes_description ON podcast_episodes;
+CREATE TRIGGER tsvectorupdate_podcast_episodes_description BEFORE INSERT OR UPDATE ON podcast_episodes FOR EACH ROW EXECUTE PROCEDURE
+tsvector_update_trigger(description_tsv, 'pg_catalog.english', description);
+
+DROP TRIGGER IF EXISTS tsvectorupdate_podcast_episodes_title ON podcast_episodes;
+CREATE TRIGGER tsvectorupdate_podcast_episodes_title BEFORE INSERT OR UPDATE ON podcast_episodes FOR EACH ROW EXECUTE PROCEDURE
+tsvector_update_trigger(title_tsv, 'pg_catalog.english', title);
+
+ALTER TABLE podcast_episodes
+    DROP COLUMN IF EXISTS title_text,
+    DROP COLUMN IF EXISTS description_html,
+    DROP COLUMN IF EXISTS description_text,
+    DROP COLUMN IF EXISTS summary;
+
+ALTER TABLE podcasts
+    DROP COLUMN IF EXISTS title_text,
+    DROP COLUMN IF EXISTS description_html,
+    DROP COLUMN IF EXISTS description_text,
+    DROP COLUMN IF EXISTS summary;
@@ -0,0 +1,29 @@
+-- Sanitised HTML and plain text versions of titles and descriptions, the originals are kept as the feed had them
+ALTER TABLE podcasts
+    ADD COLUMN IF NOT EXISTS title_text text,
+    ADD COLUMN IF NOT EXISTS description_html text,
+    ADD COLUMN IF NOT EXISTS description_text text,
+    ADD COLUMN IF NOT EXISTS summary text;
+
+ALTER TABLE podcast_episodes
+    ADD COLUMN IF NOT EXISTS title_text text,
+    ADD COLUMN IF NOT EXISTS description_html text,
+    ADD COLUMN IF NOT EXISTS description_text text,
+    ADD COLUMN IF NOT EXISTS summary text;
+
+-- Search the plain text rather than the raw HTML
+DROP TRIGGER IF EXISTS tsvectorupdate_podcasts_description ON podcasts;
+CREATE TRIGGER tsvectorupdate_podcasts_description BEFORE INSERT OR UPDATE ON podcasts FOR EACH ROW EXECUTE PROCEDURE
+tsvector_update_trigger(description_tsv, 'pg_catalog.english', description_text);
+
+DROP TRIGGER IF EXISTS tsvectorupdate_podcasts_title ON podcasts;
+CREATE TRIGGER tsvectorupdate_podcasts_title BEFORE INSERT OR UPDATE ON podcasts FOR EACH ROW EXECUTE PROCEDURE
+tsvector_update_trigger(title_tsv, 'pg_catalog.english', title_text);
+
+DROP TRIGGER IF EXISTS tsvectorupdate_podcast_episodes_description ON podcast_episodes;
+CREATE TRIGGER tsvectorupdate_podcast_episodes_description BEFORE INSERT OR UPDATE ON podcast_episodes FOR EACH ROW EXECUTE PROCEDURE
+tsvector_update_trigger(description_tsv, 'pg_catalog.english', description_text);
+
+DROP TRIGGER IF EXISTS tsvectorupdate_podcast_episodes_title ON podcast_episodes;
+CREATE TRIGGER tsvectorupdate_podcast_episodes_title BEFORE INSERT OR UPDATE ON podcast_episodes FOR EACH ROW EXECUTE PROCEDURE
+tsvector_update_trigger(title_tsv, 'pg_catalog.english', title_text);
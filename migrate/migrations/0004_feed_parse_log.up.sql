@@ -0,0 +1,10 @@
+-- Every parse of a feed, whether it worked and what we had to repair to make it parse
+CREATE TABLE IF NOT EXISTS feed_parse_log (
+    feed_url text not null,
+    parsed_at timestamp not null,
+    success boolean not null,
+    repairs jsonb,
+    error text
+);
+
+CREATE INDEX IF NOT EXISTS feed_parse_log_parsed_at_idx ON feed_parse_log (parsed_at);
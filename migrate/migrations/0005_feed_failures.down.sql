@@ -0,0 +1,4 @@
+ALTER TABLE podcasts
+    DROP COLUMN IF EXISTS last_failure,
+    DROP COLUMN IF EXISTS last_failure_message,
+    DROP COLUMN IF EXISTS last_failure_at;
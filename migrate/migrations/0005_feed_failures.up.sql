@@ -0,0 +1,5 @@
+-- Why we last failed to injest a feed, cleared on the next successful injest
+ALTER TABLE podcasts
+    ADD COLUMN IF NOT EXISTS last_failure text,
+    ADD COLUMN IF NOT EXISTS last_failure_message text,
+    ADD COLUMN IF NOT EXISTS last_failure_at timestamp;
@@ -0,0 +1,13 @@
+-- Raw feed bodies kept in the archive (filesystem or bucket), used to reprocess without refetching
+CREATE TABLE IF NOT EXISTS feed_snapshots (
+    podcast_id uuid not null,
+    feed_url text not null,
+    fetched_at timestamp not null,
+    storage_key text PRIMARY KEY,
+    sha256 text not null,
+    size integer,
+    response_headers jsonb,
+    truncated boolean
+);
+
+CREATE INDEX IF NOT EXISTS feed_snapshots_podcast_id_fetched_at_idx ON feed_snapshots (podcast_id, fetched_at);
@@ -0,0 +1,13 @@
+-- Append-only log of every field the injester changes on a podcast or episode
+CREATE TABLE IF NOT EXISTS podcast_changes (
+    id bigserial PRIMARY KEY,
+    podcast_id uuid not null,
+    episode_id uuid,
+    episode_guid text,
+    field text not null,
+    before text,
+    after text,
+    changed_at timestamp not null
+);
+
+CREATE INDEX IF NOT EXISTS podcast_changes_podcast_id_changed_at_idx ON podcast_changes (podcast_id, changed_at);
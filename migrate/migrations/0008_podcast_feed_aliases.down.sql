@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS podcasts_feed_url_idx;
+DROP TABLE IF EXISTS podcast_feed_aliases;
@@ -0,0 +1,9 @@
+-- URLs a podcast used to be at, kept when the feed moves so we recognise them in imports
+CREATE TABLE IF NOT EXISTS podcast_feed_aliases (
+    feed_url text PRIMARY KEY,
+    podcast_id uuid not null,
+    added_at timestamp not null
+);
+
+-- Imports look every feed up by URL
+CREATE INDEX IF NOT EXISTS podcasts_feed_url_idx ON podcasts (feed_url);
@@ -0,0 +1,6 @@
+-- How far each discovery source got, so the next run only lists new feeds
+CREATE TABLE IF NOT EXISTS discovery_cursors (
+    source text PRIMARY KEY,
+    cursor text not null,
+    updated_at timestamp not null
+);
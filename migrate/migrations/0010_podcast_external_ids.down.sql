@@ -0,0 +1 @@
+DROP TABLE IF EXISTS podcast_external_ids;
@@ -0,0 +1,13 @@
+-- IDs other directories give a feed, keyed by feed URL as they're usually recorded before we've injested it
+CREATE TABLE IF NOT EXISTS podcast_external_ids (
+    feed_url text not null,
+    -- podcastindex, itunes or podcastguid
+    source text not null,
+    external_id text not null,
+    podcast_id uuid,
+    added_at timestamp not null,
+    PRIMARY KEY (source, external_id)
+);
+
+CREATE INDEX IF NOT EXISTS podcast_external_ids_podcast_id_idx ON podcast_external_ids (podcast_id);
+CREATE INDEX IF NOT EXISTS podcast_external_ids_feed_url_idx ON podcast_external_ids (feed_url);
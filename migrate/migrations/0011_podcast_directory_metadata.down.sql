@@ -0,0 +1 @@
+DROP TABLE IF EXISTS podcast_directory_metadata;
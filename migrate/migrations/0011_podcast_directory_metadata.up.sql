@@ -0,0 +1,17 @@
+-- What directories (so far the BBC) say about a podcast, kept as they list it
+CREATE TABLE IF NOT EXISTS podcast_directory_metadata (
+    directory text not null,
+    feed_url text not null,
+    podcast_id uuid,
+    network text,
+    genres jsonb,
+    frequency text,
+    brand_ids jsonb,
+    homepage_url text,
+    launch_date text,
+    updated_at timestamp not null,
+    PRIMARY KEY (directory, feed_url)
+);
+
+CREATE INDEX IF NOT EXISTS podcast_directory_metadata_podcast_id_idx ON podcast_directory_metadata (podcast_id);
+CREATE INDEX IF NOT EXISTS podcast_directory_metadata_network_idx ON podcast_directory_metadata (network);
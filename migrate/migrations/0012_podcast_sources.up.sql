@@ -0,0 +1,14 @@
+-- Where each podcast came from, a podcast can be listed by many sources (bbc, dataset, manual, redirect...)
+CREATE TABLE IF NOT EXISTS podcast_sources (
+    source text not null,
+    feed_url text not null,
+    -- What the source calls the feed, e.g a Podcast Index ID or BBC brand PID
+    source_id text,
+    podcast_id uuid,
+    first_seen timestamp not null,
+    last_seen timestamp not null,
+    PRIMARY KEY (source, feed_url)
+);
+
+CREATE INDEX IF NOT EXISTS podcast_sources_podcast_id_idx ON podcast_sources (podcast_id);
+CREATE INDEX IF NOT EXISTS podcast_sources_feed_url_idx ON podcast_sources (feed_url);
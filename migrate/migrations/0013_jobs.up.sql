@@ -0,0 +1,23 @@
+-- Work for the queue package, claimed by workers with FOR UPDATE SKIP LOCKED
+CREATE TABLE IF NOT EXISTS jobs (
+    id uuid PRIMARY KEY,
+    -- injest-feed, probe-enclosure, process-images or backup
+    type text not null,
+    payload jsonb not null,
+    priority integer not null default 0,
+    -- queued, running, done or dead
+    status text not null,
+    attempts integer not null default 0,
+    max_attempts integer not null,
+    run_at timestamp not null,
+    locked_by text,
+    locked_until timestamp,
+    last_error text,
+    result jsonb,
+    dedupe_key text,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+CREATE INDEX IF NOT EXISTS jobs_priority_run_at_idx ON jobs (priority DESC, run_at) WHERE status IN ('queued', 'running');
+CREATE UNIQUE INDEX IF NOT EXISTS jobs_type_dedupe_key_idx ON jobs (type, dedupe_key) WHERE status IN ('queued', 'running');
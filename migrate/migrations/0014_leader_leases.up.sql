@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS leader_leases (
+    -- the scheduled job the lease is for, e.g. update-podcasts
+    name text PRIMARY KEY,
+    -- hostname-pid of the instance leading
+    holder text not null,
+    acquired_at timestamp not null,
+    renewed_at timestamp not null,
+    expires_at timestamp not null,
+    last_run_at timestamp
+);
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS job_runs (
+    id serial PRIMARY KEY,
+    -- the scheduled job, e.g. update-podcasts
+    name text not null,
+    instance text not null,
+    -- schedule or manual
+    trigger text not null,
+    -- running, succeeded, failed, skipped or abandoned
+    status text not null,
+    started_at timestamp not null,
+    heartbeat_at timestamp not null,
+    finished_at timestamp,
+    counts jsonb,
+    error text
+);
+
+CREATE INDEX IF NOT EXISTS job_runs_name_started_at_idx ON job_runs (name, started_at DESC);
+-- Only one run of a job can be going at a time
+CREATE UNIQUE INDEX IF NOT EXISTS job_runs_name_idx ON job_runs (name) WHERE status = 'running';
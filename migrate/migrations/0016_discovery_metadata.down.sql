@@ -0,0 +1,2 @@
+ALTER TABLE podcast_directory_metadata DROP COLUMN IF EXISTS language;
+ALTER TABLE podcast_sources DROP COLUMN IF EXISTS metadata;
@@ -0,0 +1,4 @@
+-- Whatever else a source told us about a feed, e.g a Podcast Index popularity score or the OPML folders it was filed in
+ALTER TABLE podcast_sources ADD COLUMN IF NOT EXISTS metadata jsonb;
+-- The language a directory says a podcast is in, used when the feed doesn't say
+ALTER TABLE podcast_directory_metadata ADD COLUMN IF NOT EXISTS language text;
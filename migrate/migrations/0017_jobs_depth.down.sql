@@ -0,0 +1 @@
+DROP INDEX IF EXISTS jobs_status_type_idx;
@@ -0,0 +1,2 @@
+-- The queue_jobs metric counts these on every scrape, done jobs are left out as they pile up until they're cleaned up
+CREATE INDEX IF NOT EXISTS jobs_status_type_idx ON jobs (status, type) WHERE status IN ('queued', 'running', 'dead');
@@ -1,28 +1,20 @@
 package models
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
-	"log"
 
-	"bitbucket.org/jayflux/mypodcasts_injest/logger"
-	// Needed for database/sql
-	_ "github.com/lib/pq"
-	"github.com/spf13/viper"
+	"bitbucket.org/jayflux/mypodcasts_injest/database"
 )
 
-var (
-	db      *sql.DB
-	connErr error
-)
+// Querier is what the podcast and episode reads run on, the pool or a transaction
+// Those reads are made through a store.PodcastStore or store.EpisodeStore, which passes its own
+type Querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
 
-// Initialises the database, was originlly init() but this ran too fast
-func InitDB() {
-	// Connect to the database
-	connStr := fmt.Sprintf("user=%s dbname=%s password=%s", viper.Get("database.user"), viper.Get("database.database"), viper.Get("database.password"))
-	db, connErr = sql.Open("postgres", connStr)
-	if connErr != nil {
-		log.Fatal(connErr)
-	}
-	logger.Log.Println("Connected to database")
+// getDB returns the pool shared with the rest of the application, for everything else models reads
+func getDB() *sql.DB {
+	return database.DB()
 }
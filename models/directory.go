@@ -0,0 +1,92 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/logger"
+	"bitbucket.org/jayflux/mypodcasts_injest/tracing"
+)
+
+// DirectoryMetadata is what a directory (e.g the BBC or Podcast Index) says about a podcast it lists
+type DirectoryMetadata struct {
+	Directory   string          `db:"directory" json:"directory"`
+	Network     string          `db:"network" json:"network,omitempty"`
+	Genres      json.RawMessage `db:"genres" json:"genres"`
+	Frequency   string          `db:"frequency" json:"frequency,omitempty"`
+	BrandIDs    json.RawMessage `db:"brand_ids" json:"brandIds"`
+	HomepageURL string          `db:"homepage_url" json:"homepageUrl,omitempty"`
+	LaunchDate  string          `db:"launch_date" json:"launchDate,omitempty"`
+	Language    string          `db:"language" json:"language,omitempty"`
+}
+
+// Network is a grouping of podcasts from a directory, e.g BBC Radio 4
+type Network struct {
+	ID        string `json:"id"`
+	Directory string `json:"directory"`
+	Podcasts  int    `json:"podcasts"`
+}
+
+// GetDirectoryMetadata returns what each directory says about a podcast
+func GetDirectoryMetadata(ctx context.Context, db Querier, id string) ([]DirectoryMetadata, error) {
+	ctx, span := tracing.Span(ctx, "models.GetDirectoryMetadata")
+	defer span.End()
+	metadata := make([]DirectoryMetadata, 0)
+	rows, err := db.QueryContext(ctx, "SELECT directory, COALESCE(network, ''), COALESCE(genres, '[]'), COALESCE(frequency, ''), COALESCE(brand_ids, '[]'), COALESCE(homepage_url, ''), COALESCE(launch_date, ''), COALESCE(language, '') FROM podcast_directory_metadata WHERE podcast_id = $1 ORDER BY directory", id)
+	if err != nil {
+		return metadata, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m DirectoryMetadata
+		if err := rows.Scan(&m.Directory, &m.Network, &m.Genres, &m.Frequency, &m.BrandIDs, &m.HomepageURL, &m.LaunchDate, &m.Language); err != nil {
+			return metadata, err
+		}
+		metadata = append(metadata, m)
+	}
+	return metadata, rows.Err()
+}
+
+// GetNetworks returns every network with podcasts we've injested, largest first
+func GetNetworks(ctx context.Context) []Network {
+	ctx, span := tracing.Span(ctx, "models.GetNetworks")
+	defer span.End()
+	networks := make([]Network, 0)
+	rows, err := getDB().QueryContext(ctx, "SELECT network, directory, count(DISTINCT podcast_id) FROM podcast_directory_metadata WHERE network IS NOT NULL AND podcast_id IS NOT NULL GROUP BY network, directory ORDER BY count(DISTINCT podcast_id) DESC, network")
+	if err != nil {
+		logger.Log.Error(err)
+		return networks
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var network Network
+		if err := rows.Scan(&network.ID, &network.Directory, &network.Podcasts); err != nil {
+			logger.Log.Error(err)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// GetNetworkPodcasts returns the podcasts in a network, ordered by title
+func GetNetworkPodcasts(ctx context.Context, network string) []Podcast {
+	ctx, span := tracing.Span(ctx, "models.GetNetworkPodcasts")
+	defer span.End()
+	podcasts := make([]Podcast, 0)
+	rows, err := getDB().QueryContext(ctx, "SELECT DISTINCT ON (lower(podcasts.title), podcasts.id) "+podcastColumns+" FROM podcasts INNER JOIN podcast_directory_metadata d ON (d.podcast_id = podcasts.id) WHERE d.network = $1 ORDER BY lower(podcasts.title), podcasts.id", network)
+	if err != nil {
+		logger.Log.Error(err)
+		return podcasts
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var podcast Podcast
+		if err := scanPodcast(rows, &podcast); err != nil {
+			logger.Log.Error(err)
+			continue
+		}
+		podcasts = append(podcasts, podcast)
+	}
+	return podcasts
+}
@@ -1,86 +1,112 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"time"
 
 	"bitbucket.org/jayflux/mypodcasts_injest/logger"
+	"bitbucket.org/jayflux/mypodcasts_injest/tracing"
 )
 
 // Podcast represents the structure of a podcast
+// Title and Description are as the publisher sent them, TitleText, DescriptionHTML and Summary are the sanitised versions
 type Podcast struct {
-	ID          string           `db:"id" json:"id"`
-	Title       string           `db:"title" json:"title"`
-	Description string           `db:"description" json:"description"`
-	Category    sql.NullString   `db:"category" json:"category"`
-	Image       json.RawMessage  `db:"image" json:"image"`
-	Episodes    []PodcastEpisode `db:"episodes" json:"episodes"`
+	ID              string           `db:"id" json:"id"`
+	Title           string           `db:"title" json:"title"`
+	Description     string           `db:"description" json:"description"`
+	TitleText       string           `db:"title_text" json:"titleText"`
+	DescriptionHTML string           `db:"description_html" json:"descriptionHtml"`
+	Summary         string           `db:"summary" json:"summary"`
+	Category        sql.NullString   `db:"category" json:"category"`
+	Image           json.RawMessage  `db:"image" json:"image"`
+	Episodes        []PodcastEpisode `db:"episodes" json:"episodes"`
+	// Directories is what directories like the BBC say about the podcast, only filled in by GetPodcast
+	Directories []DirectoryMetadata `json:"directories,omitempty"`
 }
 
-// GetPodcast returns a Podcast struct
-func GetPodcast(id string) Podcast {
+// podcastColumns are the columns scanned by scanPodcast, table must be aliased or named podcasts
+const podcastColumns = "podcasts.id, podcasts.title, podcasts.description, COALESCE(podcasts.title_text, ''), COALESCE(podcasts.description_html, ''), COALESCE(podcasts.summary, ''), podcasts.image, podcasts.categories->0 #>> '{}' as category"
+
+// scanPodcast scans a row selected with podcastColumns
+func scanPodcast(row interface{ Scan(...interface{}) error }, podcast *Podcast) error {
+	return row.Scan(&podcast.ID, &podcast.Title, &podcast.Description, &podcast.TitleText, &podcast.DescriptionHTML, &podcast.Summary, &podcast.Image, &podcast.Category)
+}
+
+// GetPodcast returns a Podcast struct, an empty one if there's no podcast with id
+func GetPodcast(ctx context.Context, db Querier, id string) (Podcast, error) {
+	ctx, span := tracing.Span(ctx, "models.GetPodcast")
+	defer span.End()
 	var podcast Podcast
-	row := db.QueryRow("SELECT id, title, description, image, categories->0 #>> '{}' as category FROM podcasts where id = $1", id)
-	err := row.Scan(&podcast.ID, &podcast.Title, &podcast.Description, &podcast.Image, &podcast.Category)
-	if err != nil {
-		logger.Log.Println(err)
+	row := db.QueryRowContext(ctx, "SELECT "+podcastColumns+" FROM podcasts where id = $1", id)
+	err := scanPodcast(row, &podcast)
+	if err != nil && err != sql.ErrNoRows {
+		return podcast, err
 	}
 
-	podcast.Episodes = podcast.GetEpisodes()
-	return podcast
+	if podcast.Episodes, err = podcast.GetEpisodes(ctx, db); err != nil {
+		return podcast, err
+	}
+	podcast.Directories, err = GetDirectoryMetadata(ctx, db, podcast.ID)
+	return podcast, err
 }
 
 // GetUpdatedPodcasts returns a list of podcasts ordered by last changed
-func GetUpdatedPodcasts() []Podcast {
+func GetUpdatedPodcasts(ctx context.Context, db Querier) ([]Podcast, error) {
+	ctx, span := tracing.Span(ctx, "models.GetUpdatedPodcasts")
+	defer span.End()
 	var podcasts []Podcast
 	// Select all podcast episodes ordered by published then return the brand
-	rows, err := db.Query("select podcasts.id, podcasts.title, podcasts.description, podcasts.image, categories->0 #>> '{}' as category from podcast_episodes inner join podcasts ON (podcast_episodes.parent = podcasts.id) order by published_parsed desc LIMIT 20")
+	rows, err := db.QueryContext(ctx, "select "+podcastColumns+" from podcast_episodes inner join podcasts ON (podcast_episodes.parent = podcasts.id) order by published_parsed desc LIMIT 20")
 	if err != nil {
-		logger.Log.Println(err)
+		return podcasts, err
 	}
 	defer rows.Close()
 	for rows.Next() {
 		var podcast Podcast
-		if err := rows.Scan(&podcast.ID, &podcast.Title, &podcast.Description, &podcast.Image, &podcast.Category); err != nil {
-			logger.Log.Fatal(err)
+		if err := scanPodcast(rows, &podcast); err != nil {
+			return podcasts, err
 		}
 
 		podcasts = append(podcasts, podcast)
 	}
 
-	return podcasts
+	return podcasts, rows.Err()
 }
 
 // GetNewPodcasts returns a list of recently added podcasts
-func GetNewPodcasts() []Podcast {
+func GetNewPodcasts(ctx context.Context, db Querier) ([]Podcast, error) {
+	ctx, span := tracing.Span(ctx, "models.GetNewPodcasts")
+	defer span.End()
 	var podcasts []Podcast
-	rows, err := db.Query("select id, title, description, image, categories->0 #>> '{}' as category from podcasts ORDER BY date_added desc LIMIT 20")
+	rows, err := db.QueryContext(ctx, "select "+podcastColumns+" from podcasts ORDER BY date_added desc LIMIT 20")
 	if err != nil {
-		logger.Log.Println(err)
+		return podcasts, err
 	}
 	defer rows.Close()
 	for rows.Next() {
 		var podcast Podcast
-		if err := rows.Scan(&podcast.ID, &podcast.Title, &podcast.Description, &podcast.Image, &podcast.Category); err != nil {
-			logger.Log.Fatal(err)
+		if err := scanPodcast(rows, &podcast); err != nil {
+			return podcasts, err
 		}
 
 		podcasts = append(podcasts, podcast)
 	}
 
-	return podcasts
+	return podcasts, rows.Err()
 }
 
 // GetEpisodes fetches the first 20 episodes related to this podcast
-func (p Podcast) GetEpisodes() []PodcastEpisode {
+func (p Podcast) GetEpisodes(ctx context.Context, db Querier) ([]PodcastEpisode, error) {
+	ctx, span := tracing.Span(ctx, "models.Podcast.GetEpisodes")
+	defer span.End()
 	// First lets get a date from the past
 	datetime, err := time.Parse(time.RFC3339, "1990-08-24T11:00:00Z")
 	if err != nil {
-		logger.Log.Println(err)
+		logger.Log.Error(err)
 	}
 
-	podcastEpisodes := GetPodcastEpisodes(p.ID, datetime)
-	return podcastEpisodes
+	return GetPodcastEpisodes(ctx, db, p.ID, datetime)
 
 }
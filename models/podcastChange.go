@@ -0,0 +1,47 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/logger"
+	"bitbucket.org/jayflux/mypodcasts_injest/tracing"
+)
+
+// PodcastChange is a single field level change the injester made to a podcast or one of its episodes
+type PodcastChange struct {
+	PodcastID   string         `db:"podcast_id" json:"podcastID"`
+	EpisodeID   sql.NullString `db:"episode_id" json:"-"`
+	EpisodeGUID sql.NullString `db:"episode_guid" json:"-"`
+	// Episode is the GUID of the episode that changed, empty if the change was to the podcast
+	Episode   string    `json:"episode,omitempty"`
+	Field     string    `db:"field" json:"field"`
+	Before    string    `db:"before" json:"before"`
+	After     string    `db:"after" json:"after"`
+	ChangedAt time.Time `db:"changed_at" json:"changedAt"`
+}
+
+// GetPodcastHistory returns the most recent changes to a podcast and its episodes, newest first
+func GetPodcastHistory(ctx context.Context, id string, limit int) []PodcastChange {
+	ctx, span := tracing.Span(ctx, "models.GetPodcastHistory")
+	defer span.End()
+	changes := make([]PodcastChange, 0)
+	rows, err := getDB().QueryContext(ctx, "SELECT podcast_id, episode_id, episode_guid, field, COALESCE(before, ''), COALESCE(after, ''), changed_at FROM podcast_changes WHERE podcast_id = $1 ORDER BY changed_at DESC, id DESC LIMIT $2", id, limit)
+	if err != nil {
+		logger.Log.Error(err)
+		return changes
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var change PodcastChange
+		if err := rows.Scan(&change.PodcastID, &change.EpisodeID, &change.EpisodeGUID, &change.Field, &change.Before, &change.After, &change.ChangedAt); err != nil {
+			logger.Log.Error(err)
+			continue
+		}
+		change.Episode = change.EpisodeGUID.String
+		changes = append(changes, change)
+	}
+
+	return changes
+}
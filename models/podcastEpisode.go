@@ -1,20 +1,27 @@
 package models
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
 	"time"
 
 	"bitbucket.org/jayflux/mypodcasts_injest/logger"
+	"bitbucket.org/jayflux/mypodcasts_injest/tracing"
 )
 
 // The format of the API output - using reference time
 var episodePublishedOutputFormat = "Jan 02, 2006"
 
 // PodcastEpisode represents the structure of a podcast
+// Title and Description are as the publisher sent them, TitleText, DescriptionHTML and Summary are the sanitised versions
 type PodcastEpisode struct {
 	ID              string          `db:"id" json:"id"`
 	Title           string          `db:"title" json:"title"`
 	Description     string          `db:"description" json:"description"`
+	TitleText       string          `db:"title_text" json:"titleText"`
+	DescriptionHTML string          `db:"description_html" json:"descriptionHtml"`
+	Summary         string          `db:"summary" json:"summary"`
 	Image           json.RawMessage `db:"image" json:"image"`
 	PublishedParsed string          `db:"published_parsed" json:"publishedParsed"`
 	Published       string          `db:"published" json:"published"`
@@ -25,53 +32,62 @@ type PodcastEpisode struct {
 	Length          string          `json:"length"`
 }
 
-// GetPodcastEpisode returns a Podcast struct
-func GetPodcastEpisode(id string) PodcastEpisode {
+// GetPodcastEpisode returns a Podcast struct, an empty one if there's no episode with id
+func GetPodcastEpisode(ctx context.Context, db Querier, id string) (PodcastEpisode, error) {
+	ctx, span := tracing.Span(ctx, "models.GetPodcastEpisode")
+	defer span.End()
 	var podcastEpisode PodcastEpisode
-	row := db.QueryRow("SELECT podcast_episodes.id, podcast_episodes.title, podcast_episodes.description, COALESCE(NULLIF(podcast_episodes.image, 'null'::jsonb), podcasts.image) AS image, podcast_episodes.published_parsed, podcast_episodes.published, podcast_episodes.parent, podcast_episodes.enclosures, podcasts.title AS parentTitle FROM podcast_episodes INNER JOIN podcasts ON (podcast_episodes.parent = podcasts.id) where podcast_episodes.id = $1", id)
-	row.Scan(&podcastEpisode.ID, &podcastEpisode.Title, &podcastEpisode.Description, &podcastEpisode.Image, &podcastEpisode.PublishedParsed, &podcastEpisode.Published, &podcastEpisode.ParentID, &podcastEpisode.Enclosures, &podcastEpisode.ParentTitle)
+	row := db.QueryRowContext(ctx, "SELECT podcast_episodes.id, podcast_episodes.title, podcast_episodes.description, COALESCE(podcast_episodes.title_text, ''), COALESCE(podcast_episodes.description_html, ''), COALESCE(podcast_episodes.summary, ''), COALESCE(NULLIF(podcast_episodes.image, 'null'::jsonb), podcasts.image) AS image, podcast_episodes.published_parsed, podcast_episodes.published, podcast_episodes.parent, podcast_episodes.enclosures, podcasts.title AS parentTitle FROM podcast_episodes INNER JOIN podcasts ON (podcast_episodes.parent = podcasts.id) where podcast_episodes.id = $1", id)
+	err := row.Scan(&podcastEpisode.ID, &podcastEpisode.Title, &podcastEpisode.Description, &podcastEpisode.TitleText, &podcastEpisode.DescriptionHTML, &podcastEpisode.Summary, &podcastEpisode.Image, &podcastEpisode.PublishedParsed, &podcastEpisode.Published, &podcastEpisode.ParentID, &podcastEpisode.Enclosures, &podcastEpisode.ParentTitle)
+	if err != nil && err != sql.ErrNoRows {
+		return podcastEpisode, err
+	}
 
 	// Set the proper formatting for published
-	podcastEpisode.formatPublished()
-	return podcastEpisode
+	podcastEpisode.FormatPublished()
+	return podcastEpisode, nil
 }
 
 // GetPodcastEpisodes returns multiple episodes based on a datetime
 // Example datetime from database - 2018-08-24T11:00:00Z
-func GetPodcastEpisodes(id string, datetime time.Time) []PodcastEpisode {
+func GetPodcastEpisodes(ctx context.Context, db Querier, id string, datetime time.Time) ([]PodcastEpisode, error) {
+	ctx, span := tracing.Span(ctx, "models.GetPodcastEpisodes")
+	defer span.End()
 	var podcastEpisodes []PodcastEpisode
-	rows, err := db.Query("SELECT podcast_episodes.id, podcast_episodes.title, podcast_episodes.description, COALESCE(NULLIF(podcast_episodes.image, 'null'::jsonb), podcasts.image) AS image, podcast_episodes.published_parsed, podcast_episodes.published, podcast_episodes.enclosures, podcast_episodes.itunes_ext FROM podcast_episodes INNER JOIN podcasts ON (podcast_episodes.parent = podcasts.id) where podcast_episodes.parent = $1 AND published_parsed > $2 ORDER BY published_parsed DESC LIMIT 20", id, datetime)
+	rows, err := db.QueryContext(ctx, "SELECT podcast_episodes.id, podcast_episodes.title, podcast_episodes.description, COALESCE(podcast_episodes.title_text, ''), COALESCE(podcast_episodes.description_html, ''), COALESCE(podcast_episodes.summary, ''), COALESCE(NULLIF(podcast_episodes.image, 'null'::jsonb), podcasts.image) AS image, podcast_episodes.published_parsed, podcast_episodes.published, podcast_episodes.enclosures, podcast_episodes.itunes_ext FROM podcast_episodes INNER JOIN podcasts ON (podcast_episodes.parent = podcasts.id) where podcast_episodes.parent = $1 AND published_parsed > $2 ORDER BY published_parsed DESC LIMIT 20", id, datetime)
 	if err != nil {
-		logger.Log.Println(err)
+		return podcastEpisodes, err
 	}
 	defer rows.Close()
 	for rows.Next() {
 		var podcastEpisode PodcastEpisode
-		if err := rows.Scan(&podcastEpisode.ID, &podcastEpisode.Title, &podcastEpisode.Description, &podcastEpisode.Image, &podcastEpisode.PublishedParsed, &podcastEpisode.Published, &podcastEpisode.Enclosures, &podcastEpisode.ItunesExt); err != nil {
-			logger.Log.Fatal(err)
+		if err := rows.Scan(&podcastEpisode.ID, &podcastEpisode.Title, &podcastEpisode.Description, &podcastEpisode.TitleText, &podcastEpisode.DescriptionHTML, &podcastEpisode.Summary, &podcastEpisode.Image, &podcastEpisode.PublishedParsed, &podcastEpisode.Published, &podcastEpisode.Enclosures, &podcastEpisode.ItunesExt); err != nil {
+			return podcastEpisodes, err
 		}
 		// Set the proper formatting for published
-		podcastEpisode.formatPublished()
-		podcastEpisode.getLength()
+		podcastEpisode.FormatPublished()
+		podcastEpisode.SetLength()
 		podcastEpisodes = append(podcastEpisodes, podcastEpisode)
 	}
 
-	return podcastEpisodes
+	return podcastEpisodes, rows.Err()
 }
 
-func (p *PodcastEpisode) formatPublished() {
+// FormatPublished sets Published from PublishedParsed, the way the API shows it
+func (p *PodcastEpisode) FormatPublished() {
 	timeStr, err := time.Parse(time.RFC3339, p.PublishedParsed)
 	if err != nil {
-		logger.Log.Println(err)
+		logger.Log.Error(err)
 	}
 	p.Published = timeStr.Format(episodePublishedOutputFormat)
 }
 
-func (p *PodcastEpisode) getLength() {
+// SetLength sets Length from the itunes duration in ItunesExt
+func (p *PodcastEpisode) SetLength() {
 	var itunes PodcastItunesExt
 	err := json.Unmarshal(p.ItunesExt, &itunes)
 	if err != nil {
-		logger.Log.Println(err)
+		logger.Log.Error(err)
 	}
 
 	p.Length = itunes.Duration
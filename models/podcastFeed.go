@@ -0,0 +1,49 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/logger"
+	"bitbucket.org/jayflux/mypodcasts_injest/opml"
+	"bitbucket.org/jayflux/mypodcasts_injest/tracing"
+)
+
+// PodcastFilter narrows down which podcasts are exported, empty fields match everything
+type PodcastFilter struct {
+	Category string
+	// Language matches by prefix, so en matches en-gb and en-us
+	Language string
+	// Active only includes podcasts which aren't disabled and didn't fail their last injest
+	Active bool
+}
+
+// GetPodcastsOPML returns the podcasts matching filter as an OPML document, ordered by title
+func GetPodcastsOPML(ctx context.Context, filter PodcastFilter) *opml.Document {
+	ctx, span := tracing.Span(ctx, "models.GetPodcastsOPML")
+	defer span.End()
+	doc := opml.New("Fancast podcasts")
+	rows, err := getDB().QueryContext(ctx, `SELECT COALESCE(title_text, title, ''), feed_url, COALESCE(link, ''), COALESCE(categories, '[]') FROM podcasts
+		WHERE feed_url IS NOT NULL
+		AND ($1 = '' OR EXISTS (SELECT 1 FROM jsonb_array_elements_text(CASE WHEN jsonb_typeof(categories) = 'array' THEN categories ELSE '[]' END) c WHERE lower(c) = lower($1)))
+		AND ($2 = '' OR lower(language) LIKE lower($2) || '%')
+		AND (NOT $3 OR (COALESCE(active, true) AND last_failure IS NULL))
+		ORDER BY lower(COALESCE(title_text, title))`, filter.Category, filter.Language, filter.Active)
+	if err != nil {
+		logger.Log.Error(err)
+		return doc
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var feed opml.Feed
+		var categories []byte
+		if err := rows.Scan(&feed.Title, &feed.URL, &feed.HTMLURL, &categories); err != nil {
+			logger.Log.Error(err)
+			continue
+		}
+		json.Unmarshal(categories, &feed.Categories)
+		doc.Add(feed)
+	}
+
+	return doc
+}
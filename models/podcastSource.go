@@ -0,0 +1,108 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/logger"
+	"bitbucket.org/jayflux/mypodcasts_injest/tracing"
+)
+
+// PodcastSource is a source that listed a podcast's feed, e.g the BBC directory or a dataset
+type PodcastSource struct {
+	Source    string         `db:"source" json:"source"`
+	SourceID  string         `db:"source_id" json:"sourceId,omitempty"`
+	FeedURL   string         `db:"feed_url" json:"feedUrl"`
+	PodcastID sql.NullString `db:"podcast_id" json:"-"`
+	// Podcast is empty if the feed was never injested
+	Podcast   string    `json:"podcast,omitempty"`
+	FirstSeen time.Time `db:"first_seen" json:"firstSeen"`
+	LastSeen  time.Time `db:"last_seen" json:"lastSeen"`
+	// Metadata is anything else the source told us about the feed
+	Metadata json.RawMessage `db:"metadata" json:"metadata,omitempty"`
+}
+
+// SourceSummary is how the feeds a source listed are doing
+type SourceSummary struct {
+	Source string `json:"source"`
+	Feeds  int    `json:"feeds"`
+	// Podcasts is how many of the feeds were injested
+	Podcasts int `json:"podcasts"`
+	// Live podcasts are active and injested fine last time, Failing ones didn't
+	Live          int       `json:"live"`
+	Failing       int       `json:"failing"`
+	NeverInjested int       `json:"neverInjested"`
+	FirstSeen     time.Time `json:"firstSeen"`
+	LastSeen      time.Time `json:"lastSeen"`
+}
+
+const podcastSourceColumns = "s.source, COALESCE(s.source_id, ''), s.feed_url, s.podcast_id, s.first_seen, s.last_seen, s.metadata"
+
+func scanPodcastSources(rows *sql.Rows) []PodcastSource {
+	sources := make([]PodcastSource, 0)
+	defer rows.Close()
+	for rows.Next() {
+		var source PodcastSource
+		if err := rows.Scan(&source.Source, &source.SourceID, &source.FeedURL, &source.PodcastID, &source.FirstSeen, &source.LastSeen, &source.Metadata); err != nil {
+			logger.Log.Error(err)
+			continue
+		}
+		source.Podcast = source.PodcastID.String
+		sources = append(sources, source)
+	}
+	return sources
+}
+
+// GetPodcastSources returns every source that has listed a podcast, earliest first
+func GetPodcastSources(ctx context.Context, id string) []PodcastSource {
+	ctx, span := tracing.Span(ctx, "models.GetPodcastSources")
+	defer span.End()
+	rows, err := getDB().QueryContext(ctx, "SELECT "+podcastSourceColumns+" FROM podcast_sources s WHERE s.podcast_id = $1 ORDER BY s.first_seen", id)
+	if err != nil {
+		logger.Log.Error(err)
+		return make([]PodcastSource, 0)
+	}
+	return scanPodcastSources(rows)
+}
+
+// GetUninjestedSources returns feeds a source listed which never became podcasts, most recently seen first
+func GetUninjestedSources(ctx context.Context, source string, limit int) []PodcastSource {
+	ctx, span := tracing.Span(ctx, "models.GetUninjestedSources")
+	defer span.End()
+	rows, err := getDB().QueryContext(ctx, "SELECT "+podcastSourceColumns+" FROM podcast_sources s WHERE s.source = $1 AND s.podcast_id IS NULL ORDER BY s.last_seen DESC LIMIT $2", source, limit)
+	if err != nil {
+		logger.Log.Error(err)
+		return make([]PodcastSource, 0)
+	}
+	return scanPodcastSources(rows)
+}
+
+// GetSourceSummaries returns a summary of every source, biggest first
+func GetSourceSummaries(ctx context.Context) []SourceSummary {
+	ctx, span := tracing.Span(ctx, "models.GetSourceSummaries")
+	defer span.End()
+	summaries := make([]SourceSummary, 0)
+	rows, err := getDB().QueryContext(ctx, `SELECT s.source, count(*), count(p.id),
+		count(p.id) FILTER (WHERE COALESCE(p.active, true) AND p.last_failure IS NULL),
+		count(p.id) FILTER (WHERE p.last_failure IS NOT NULL),
+		count(*) FILTER (WHERE s.podcast_id IS NULL),
+		min(s.first_seen), max(s.last_seen)
+		FROM podcast_sources s LEFT JOIN podcasts p ON (p.id = s.podcast_id)
+		GROUP BY s.source ORDER BY count(*) DESC, s.source`)
+	if err != nil {
+		logger.Log.Error(err)
+		return summaries
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s SourceSummary
+		if err := rows.Scan(&s.Source, &s.Feeds, &s.Podcasts, &s.Live, &s.Failing, &s.NeverInjested, &s.FirstSeen, &s.LastSeen); err != nil {
+			logger.Log.Error(err)
+			continue
+		}
+		summaries = append(summaries, s)
+	}
+	return summaries
+}
@@ -0,0 +1,145 @@
+// Package opml reads and writes OPML subscription lists
+// Supports OPML 1.0 and 2.0, including nested outlines which are treated as categories
+package opml
+
+import (
+	"encoding/xml"
+	"io"
+	"strings"
+	"time"
+)
+
+// Document is an OPML file
+type Document struct {
+	XMLName xml.Name `xml:"opml"`
+	Version string   `xml:"version,attr"`
+	Head    Head     `xml:"head"`
+	Body    Body     `xml:"body"`
+}
+
+// Body holds the outlines, it's its own element so an empty document still has one, OPML requires it
+type Body struct {
+	Outlines []Outline `xml:"outline"`
+}
+
+// Head is the OPML head element, we only care about a few of these
+type Head struct {
+	Title       string `xml:"title,omitempty"`
+	DateCreated string `xml:"dateCreated,omitempty"`
+	OwnerName   string `xml:"ownerName,omitempty"`
+}
+
+// Outline is a single entry, either a feed (has an xmlUrl) or a folder of other outlines
+type Outline struct {
+	Text     string    `xml:"text,attr"`
+	Title    string    `xml:"title,attr,omitempty"`
+	Type     string    `xml:"type,attr,omitempty"`
+	XMLURL   string    `xml:"xmlUrl,attr,omitempty"`
+	HTMLURL  string    `xml:"htmlUrl,attr,omitempty"`
+	Language string    `xml:"language,attr,omitempty"`
+	Category string    `xml:"category,attr,omitempty"`
+	Outlines []Outline `xml:"outline"`
+}
+
+// Feed is a feed found in an OPML file, with the categories it was filed under
+type Feed struct {
+	Title      string
+	URL        string
+	HTMLURL    string
+	Categories []string
+}
+
+// Parse reads an OPML document
+func Parse(r io.Reader) (*Document, error) {
+	var doc Document
+	decoder := xml.NewDecoder(r)
+	// OPML in the wild is often not quite valid XML
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// Feeds flattens the document into a list of feeds
+// Folders an outline is nested in become its categories, along with anything in its category attribute
+func (d *Document) Feeds() []Feed {
+	feeds := make([]Feed, 0)
+	var walk func(outlines []Outline, parents []string)
+	walk = func(outlines []Outline, parents []string) {
+		for _, o := range outlines {
+			if o.XMLURL != "" {
+				categories := append([]string{}, parents...)
+				categories = append(categories, splitCategories(o.Category)...)
+				title := o.Title
+				if title == "" {
+					title = o.Text
+				}
+				feeds = append(feeds, Feed{Title: title, URL: strings.TrimSpace(o.XMLURL), HTMLURL: o.HTMLURL, Categories: categories})
+			}
+			if len(o.Outlines) > 0 {
+				folder := o.Text
+				if folder == "" {
+					folder = o.Title
+				}
+				children := parents
+				if folder != "" && o.XMLURL == "" {
+					children = append(append([]string{}, parents...), folder)
+				}
+				walk(o.Outlines, children)
+			}
+		}
+	}
+	walk(d.Body.Outlines, []string{})
+	return feeds
+}
+
+// splitCategories splits an OPML 2.0 category attribute, a comma separated list of slash delimited paths
+func splitCategories(attr string) []string {
+	categories := make([]string, 0)
+	for _, path := range strings.Split(attr, ",") {
+		for _, category := range strings.Split(path, "/") {
+			if category = strings.TrimSpace(category); category != "" {
+				categories = append(categories, category)
+			}
+		}
+	}
+	return categories
+}
+
+// New creates an empty OPML 2.0 document
+func New(title string) *Document {
+	return &Document{
+		Version: "2.0",
+		Head:    Head{Title: title, DateCreated: time.Now().UTC().Format(time.RFC1123Z)},
+		Body:    Body{Outlines: []Outline{}},
+	}
+}
+
+// Add appends a feed to the document
+func (d *Document) Add(feed Feed) {
+	d.Body.Outlines = append(d.Body.Outlines, Outline{
+		Text:     feed.Title,
+		Title:    feed.Title,
+		Type:     "rss",
+		XMLURL:   feed.URL,
+		HTMLURL:  feed.HTMLURL,
+		Category: strings.Join(feed.Categories, ","),
+	})
+}
+
+// Write encodes the document as XML
+func (d *Document) Write(w io.Writer) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(d); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,75 @@
+package opml
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFeeds(t *testing.T) {
+	doc, err := Parse(strings.NewReader(`<?xml version="1.0"?>
+<opml version="2.0">
+  <head><title>Subscriptions</title></head>
+  <body>
+    <outline text="Top level" type="rss" xmlUrl=" https://example.com/top.xml " category="/News/Politics,Daily"/>
+    <outline text="Comedy">
+      <outline text="Panel shows">
+        <outline text="Nested" title="Nested show" type="rss" xmlUrl="https://example.com/nested.xml" htmlUrl="https://example.com"/>
+      </outline>
+    </outline>
+    <outline text="Not a feed"/>
+  </body>
+</opml>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Feed{
+		{Title: "Top level", URL: "https://example.com/top.xml", Categories: []string{"News", "Politics", "Daily"}},
+		{Title: "Nested show", URL: "https://example.com/nested.xml", HTMLURL: "https://example.com", Categories: []string{"Comedy", "Panel shows"}},
+	}
+	if got := doc.Feeds(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestParseLenient(t *testing.T) {
+	// OPML 1.0 exported by hand, with an HTML entity and an unclosed outline
+	doc, err := Parse(strings.NewReader(`<opml version="1.0"><body><outline text="Tom &amp; Jerry&nbsp;" xmlUrl="https://example.com/a.xml"></body></opml>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if feeds := doc.Feeds(); len(feeds) != 1 || feeds[0].URL != "https://example.com/a.xml" {
+		t.Errorf("got %+v", feeds)
+	}
+}
+
+func TestWriteRoundTrip(t *testing.T) {
+	doc := New("Catalog")
+	doc.Add(Feed{Title: "A show", URL: "https://example.com/a.xml", HTMLURL: "https://example.com", Categories: []string{"Comedy", "News"}})
+
+	var buf bytes.Buffer
+	if err := doc.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := Parse(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Feed{{Title: "A show", URL: "https://example.com/a.xml", HTMLURL: "https://example.com", Categories: []string{"Comedy", "News"}}}
+	if got := parsed.Feeds(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestWriteEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	if err := New("Empty").Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	// OPML requires a body, even when there's nothing in it
+	if !strings.Contains(buf.String(), "<body></body>") {
+		t.Errorf("got no body in %s", buf.String())
+	}
+}
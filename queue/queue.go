@@ -0,0 +1,239 @@
+// Package queue is a durable job queue kept in Postgres
+// Workers claim jobs with SELECT ... FOR UPDATE SKIP LOCKED, so any number of them can share the queue across machines
+// A claimed job is leased for queue.visibilityTimeoutSeconds, if the worker dies the job is picked up again once the lease runs out
+// Failed jobs are retried with exponential backoff, after queue.maxAttempts they're dead lettered for someone to look at
+package queue
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/config"
+	"bitbucket.org/jayflux/mypodcasts_injest/database"
+	"bitbucket.org/jayflux/mypodcasts_injest/logger"
+	"bitbucket.org/jayflux/mypodcasts_injest/metrics"
+	"github.com/lib/pq"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Job types
+const (
+	TypeInjestFeed     = "injest-feed"
+	TypeProbeEnclosure = "probe-enclosure"
+	TypeProcessImages  = "process-images"
+	TypeBackup         = "backup"
+)
+
+// Job statuses, a failed job goes back to queued until it runs out of attempts and is dead
+const (
+	StatusQueued  = "queued"
+	StatusRunning = "running"
+	StatusDone    = "done"
+	StatusDead    = "dead"
+)
+
+// Priorities, higher runs first
+const (
+	PriorityLow    = 0
+	PriorityNormal = 50
+	PriorityHigh   = 100
+)
+
+var (
+	log = logger.Log
+)
+
+// Job is a unit of work in the queue
+type Job struct {
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	Payload     json.RawMessage `json:"payload"`
+	Priority    int             `json:"priority"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"maxAttempts"`
+	RunAt       time.Time       `json:"runAt"`
+	LastError   string          `json:"lastError,omitempty"`
+	Result      json.RawMessage `json:"result,omitempty"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	UpdatedAt   time.Time       `json:"updatedAt"`
+}
+
+// Options change how a job is enqueued
+type Options struct {
+	Priority int
+	// DedupeKey stops the same work being queued twice, a job with the same type and key that's queued or running is returned instead
+	DedupeKey string
+	// RunAt delays the job, the zero value runs it as soon as possible
+	RunAt time.Time
+	// MaxAttempts overrides queue.maxAttempts
+	MaxAttempts int
+}
+
+func init() {
+	metrics.Registry.MustRegister(depthCollector{})
+}
+
+// getDB returns the shared pool
+func getDB() *sql.DB {
+	return database.DB()
+}
+
+// Enqueue adds a job, payload is marshalled to JSON
+func Enqueue(jobType string, payload interface{}, options Options) (string, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	if options.MaxAttempts <= 0 {
+		options.MaxAttempts = config.Get().Queue.MaxAttempts
+	}
+	if options.RunAt.IsZero() {
+		options.RunAt = time.Now()
+	}
+
+	id := uuid.NewV4().String()
+	// The unique index on (type, dedupe_key) only covers queued and running jobs, on a clash we return the existing job
+	err = getDB().QueryRow(`INSERT INTO jobs (id, type, payload, priority, status, attempts, max_attempts, run_at, dedupe_key, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, 'queued', 0, $5, $6, NULLIF($7, ''), now(), now())
+		ON CONFLICT (type, dedupe_key) WHERE status IN ('queued', 'running') DO UPDATE SET priority = GREATEST(jobs.priority, EXCLUDED.priority)
+		RETURNING id`, id, jobType, body, options.Priority, options.MaxAttempts, options.RunAt, options.DedupeKey).Scan(&id)
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Get returns a job by ID
+func Get(id string) (*Job, error) {
+	var job Job
+	var lastError sql.NullString
+	var result []byte
+	err := getDB().QueryRow(`SELECT id, type, payload, priority, status, attempts, max_attempts, run_at, last_error, result, created_at, updated_at FROM jobs WHERE id = $1`, id).
+		Scan(&job.ID, &job.Type, &job.Payload, &job.Priority, &job.Status, &job.Attempts, &job.MaxAttempts, &job.RunAt, &lastError, &result, &job.CreatedAt, &job.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	job.LastError = lastError.String
+	job.Result = result
+	return &job, nil
+}
+
+// claim leases the next job that's due, or one whose lease ran out, nil if there's nothing to do
+func claim(worker string, types []string) (*Job, error) {
+	var job Job
+	timeout := config.Get().Queue.VisibilityTimeoutSeconds
+	// A job whose lease ran out on its last attempt was lost with its worker, it's dead rather than claimed again
+	_, err := getDB().Exec(`UPDATE jobs SET status = 'dead', last_error = COALESCE(last_error, 'lease expired on the last attempt'), locked_by = NULL, locked_until = NULL, updated_at = now()
+		WHERE status = 'running' AND locked_until < now() AND attempts >= max_attempts AND type = ANY($1)`, pq.Array(types))
+	if err != nil {
+		return nil, err
+	}
+	err = getDB().QueryRow(`UPDATE jobs SET status = 'running', attempts = attempts + 1, locked_by = $1, locked_until = now() + make_interval(secs => $2), updated_at = now()
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE ((status = 'queued' AND run_at <= now()) OR (status = 'running' AND locked_until < now() AND attempts < max_attempts)) AND type = ANY($3)
+			ORDER BY priority DESC, run_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, type, payload, priority, status, attempts, max_attempts, run_at, created_at, updated_at`, worker, timeout, pq.Array(types)).
+		Scan(&job.ID, &job.Type, &job.Payload, &job.Priority, &job.Status, &job.Attempts, &job.MaxAttempts, &job.RunAt, &job.CreatedAt, &job.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// extend renews a job's lease while it's still being worked on
+func extend(job *Job, worker string) {
+	_, err := getDB().Exec("UPDATE jobs SET locked_until = now() + make_interval(secs => $1) WHERE id = $2 AND locked_by = $3 AND status = 'running'", config.Get().Queue.VisibilityTimeoutSeconds, job.ID, worker)
+	if err != nil {
+		log.Error("queue: Could not extend lease")
+		log.Error(err)
+	}
+}
+
+// complete marks a job done, keeping what it returned
+func complete(job *Job, worker string, result interface{}) {
+	body, _ := json.Marshal(result)
+	_, err := getDB().Exec("UPDATE jobs SET status = 'done', result = $1, last_error = NULL, locked_by = NULL, locked_until = NULL, updated_at = now() WHERE id = $2 AND locked_by = $3", body, job.ID, worker)
+	if err != nil {
+		log.Error("queue: Could not write to DB")
+		log.Error(err)
+	}
+}
+
+// fail puts a job back in the queue with backoff, or dead letters it once it's used all its attempts
+func fail(job *Job, worker string, jobErr error) {
+	status := StatusQueued
+	if job.Attempts >= job.MaxAttempts {
+		status = StatusDead
+	}
+	_, err := getDB().Exec("UPDATE jobs SET status = $1, run_at = now() + make_interval(secs => $2), last_error = $3, locked_by = NULL, locked_until = NULL, updated_at = now() WHERE id = $4 AND locked_by = $5",
+		status, backoff(job.Attempts).Seconds(), jobErr.Error(), job.ID, worker)
+	if err != nil {
+		log.Error("queue: Could not write to DB")
+		log.Error(err)
+	}
+}
+
+// release puts a job straight back in the queue without using up an attempt
+func release(job *Job, worker string) {
+	_, err := getDB().Exec("UPDATE jobs SET status = 'queued', attempts = attempts - 1, run_at = now(), locked_by = NULL, locked_until = NULL, updated_at = now() WHERE id = $1 AND locked_by = $2", job.ID, worker)
+	if err != nil {
+		log.Error("queue: Could not write to DB")
+		log.Error(err)
+	}
+}
+
+// backoff is how long to wait before the next attempt, doubling each time up to queue.maxBackoffSeconds
+func backoff(attempts int) time.Duration {
+	base := time.Duration(config.Get().Queue.BackoffSeconds) * time.Second
+	max := time.Duration(config.Get().Queue.MaxBackoffSeconds) * time.Second
+	wait := base
+	for i := 1; i < attempts && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+	return wait
+}
+
+// Retry puts a dead job back in the queue with a fresh set of attempts, id "all" retries every dead job
+// A dead job is left alone if the same work is already queued or running, and of several dead copies only the latest is retried
+func Retry(id string) (int64, error) {
+	result, err := getDB().Exec(`UPDATE jobs SET status = 'queued', attempts = 0, run_at = now(), updated_at = now()
+		WHERE id IN (
+			SELECT DISTINCT ON (type, COALESCE(dedupe_key, id::text)) id FROM jobs dead
+			WHERE status = 'dead' AND ($1 = 'all' OR id::text = $1)
+			AND NOT EXISTS (SELECT 1 FROM jobs live WHERE live.type = dead.type AND live.dedupe_key = dead.dedupe_key AND live.status IN ('queued', 'running'))
+			ORDER BY type, COALESCE(dedupe_key, id::text), updated_at DESC
+		)`, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// prune deletes finished jobs older than queue.keepDoneDays, dead jobs are kept until they're retried or removed by hand
+func prune() {
+	_, err := getDB().Exec("DELETE FROM jobs WHERE status = 'done' AND updated_at < now() - make_interval(days => $1)", config.Get().Queue.KeepDoneDays)
+	if err != nil {
+		log.Error("queue: Could not prune jobs")
+		log.Error(err)
+	}
+}
+
+// workerName identifies this process in locked_by
+func workerName() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
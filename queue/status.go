@@ -0,0 +1,76 @@
+package queue
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Count is how many jobs of a type are in a status
+type Count struct {
+	Type   string `json:"type"`
+	Status string `json:"status"`
+	Jobs   int    `json:"jobs"`
+}
+
+// Counts returns how many jobs there are of each type and status
+func Counts() ([]Count, error) {
+	return counts("SELECT type, status, count(*) FROM jobs GROUP BY type, status ORDER BY type, status")
+}
+
+// Depth returns Counts for jobs still to run, or dead, without counting the done jobs waiting to be cleaned up
+func Depth() ([]Count, error) {
+	return counts("SELECT type, status, count(*) FROM jobs WHERE status IN ('queued', 'running', 'dead') GROUP BY type, status ORDER BY type, status")
+}
+
+func counts(query string) ([]Count, error) {
+	counts := make([]Count, 0)
+	rows, err := getDB().Query(query)
+	if err != nil {
+		return counts, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c Count
+		if err := rows.Scan(&c.Type, &c.Status, &c.Jobs); err != nil {
+			return counts, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// Dead returns the most recent dead lettered jobs
+func Dead(limit int) ([]Job, error) {
+	jobs := make([]Job, 0)
+	rows, err := getDB().Query("SELECT id, type, payload, priority, status, attempts, max_attempts, run_at, COALESCE(last_error, ''), created_at, updated_at FROM jobs WHERE status = 'dead' ORDER BY updated_at DESC LIMIT $1", limit)
+	if err != nil {
+		return jobs, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var job Job
+		if err := rows.Scan(&job.ID, &job.Type, &job.Payload, &job.Priority, &job.Status, &job.Attempts, &job.MaxAttempts, &job.RunAt, &job.LastError, &job.CreatedAt, &job.UpdatedAt); err != nil {
+			return jobs, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// depthCollector reports Depth as a gauge each time /metrics is scraped
+type depthCollector struct{}
+
+var depthDesc = prometheus.NewDesc("queue_jobs", "Jobs queued, running or dead, by type and status.", []string{"type", "status"}, nil)
+
+func (depthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- depthDesc
+}
+
+func (depthCollector) Collect(ch chan<- prometheus.Metric) {
+	counts, err := Depth()
+	if err != nil {
+		log.Error("queue: Could not count jobs")
+		log.Error(err)
+		return
+	}
+	for _, c := range counts {
+		ch <- prometheus.MustNewConstMetric(depthDesc, prometheus.GaugeValue, float64(c.Jobs), c.Type, c.Status)
+	}
+}
@@ -0,0 +1,175 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/config"
+	"bitbucket.org/jayflux/mypodcasts_injest/logger"
+	"bitbucket.org/jayflux/mypodcasts_injest/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Handler does the work for a type of job, whatever it returns is stored as the job's result
+// Returning an error retries the job later, ctx is cancelled if the worker is shutting down and runs out of time
+type Handler func(ctx context.Context, payload json.RawMessage) (interface{}, error)
+
+var (
+	handlers   = make(map[string]Handler)
+	handlersMu sync.RWMutex
+)
+
+// Register sets the handler for a job type, workers only claim jobs they have a handler for
+func Register(jobType string, handler Handler) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	handlers[jobType] = handler
+}
+
+// Types returns every job type with a handler registered, sorted
+func Types() []string {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+	types := make([]string, 0, len(handlers))
+	for t := range handlers {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func handlerFor(jobType string) Handler {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+	return handlers[jobType]
+}
+
+// Work runs workers goroutines claiming and running jobs until ctx is done
+// After that no more jobs are claimed, running ones get queue.shutdownGraceSeconds to finish before their context is cancelled
+// If workers is 0 or less queue.workers from config is used, types limits which jobs are claimed, none means every registered type
+func Work(ctx context.Context, workers int, types ...string) {
+	if workers <= 0 {
+		workers = config.Get().Queue.Workers
+	}
+	if len(types) == 0 {
+		types = Types()
+	}
+	name := workerName()
+	log.Printf("queue: %s starting %d workers for %v", name, workers, types)
+
+	jobCtx, cancelJobs := context.WithCancel(context.Background())
+	defer cancelJobs()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-jobCtx.Done():
+			return
+		}
+		log.Printf("queue: %s stopping, waiting for running jobs", name)
+		select {
+		case <-time.After(time.Duration(config.Get().Queue.ShutdownGraceSeconds) * time.Second):
+			log.Printf("queue: %s cancelling jobs still running", name)
+			cancelJobs()
+		case <-jobCtx.Done():
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			work(ctx, jobCtx, fmt.Sprintf("%s-%d", name, n), types)
+		}(i)
+	}
+
+	// Tidy up finished jobs now and then
+	go func() {
+		for {
+			prune()
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Hour):
+			}
+		}
+	}()
+	wg.Wait()
+	log.Printf("queue: %s stopped", name)
+}
+
+// work is a single worker's loop, it sleeps for queue.pollIntervalSeconds whenever the queue is empty
+// It stops claiming once ctx is done, jobCtx is what the jobs themselves run with
+func work(ctx, jobCtx context.Context, worker string, types []string) {
+	poll := time.Duration(config.Get().Queue.PollIntervalSeconds) * time.Second
+	for ctx.Err() == nil {
+		job, err := claim(worker, types)
+		if err != nil {
+			log.Error("queue: Could not claim a job")
+			log.Error(err)
+		}
+		if job == nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(poll):
+			}
+			continue
+		}
+		run(jobCtx, job, worker)
+	}
+}
+
+// run runs a job's handler, renewing its lease until it finishes
+func run(ctx context.Context, job *Job, worker string) {
+	ctx, span := tracing.Span(ctx, "job "+job.Type, attribute.String("job_id", job.ID), attribute.Int("attempt", job.Attempts))
+	// Everything the handler logs through ctx says which job it was for
+	ctx = logger.WithFields(ctx, logger.Fields{"job": job.Type, "job_id": job.ID, "attempt": job.Attempts})
+	log := logger.From(ctx)
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Duration(config.Get().Queue.VisibilityTimeoutSeconds) * time.Second / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				extend(job, worker)
+			}
+		}
+	}()
+
+	result, err := runHandler(ctx, job)
+	close(done)
+	tracing.End(span, err)
+	if err != nil && ctx.Err() != nil {
+		// We're shutting down, it isn't the job's fault so don't count the attempt
+		log.Printf("queue: %s job %s interrupted by shutdown, putting it back", job.Type, job.ID)
+		release(job, worker)
+		return
+	}
+	if err != nil {
+		log.Errorf("queue: %s job %s failed (attempt %d of %d): %s", job.Type, job.ID, job.Attempts, job.MaxAttempts, err)
+		fail(job, worker, err)
+		return
+	}
+	complete(job, worker, result)
+}
+
+// runHandler turns a panicking handler into a failed job rather than a dead worker
+func runHandler(ctx context.Context, job *Job) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	handler := handlerFor(job.Type)
+	if handler == nil {
+		return nil, fmt.Errorf("no handler for %s jobs", job.Type)
+	}
+	return handler(ctx, job.Payload)
+}
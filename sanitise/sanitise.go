@@ -0,0 +1,324 @@
+// Package sanitise turns the raw HTML we get from feeds into something safe to serve.
+// Publishers put all sorts in their titles and descriptions (scripts, inline styles, tracking pixels, CDATA wrapped markup)
+// so we keep the original, but also generate a cleaned up HTML version and a plain-text summary.
+package sanitise
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// DefaultSummaryLength is how many characters we allow in a summary before truncating
+const DefaultSummaryLength = 300
+
+// allowedTags maps the tags we keep to the attributes we allow on them
+var allowedTags = map[atom.Atom][]string{
+	atom.A:          {"href", "title"},
+	atom.B:          nil,
+	atom.Blockquote: nil,
+	atom.Br:         nil,
+	atom.Code:       nil,
+	atom.Em:         nil,
+	atom.H1:         nil,
+	atom.H2:         nil,
+	atom.H3:         nil,
+	atom.H4:         nil,
+	atom.H5:         nil,
+	atom.H6:         nil,
+	atom.I:          nil,
+	atom.Img:        {"src", "alt", "title", "width", "height"},
+	atom.Li:         nil,
+	atom.Ol:         nil,
+	atom.P:          nil,
+	atom.Pre:        nil,
+	atom.Strong:     nil,
+	atom.U:          nil,
+	atom.Ul:         nil,
+}
+
+// droppedTags have their contents thrown away as well as the tag itself
+var droppedTags = map[atom.Atom]bool{
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Iframe:   true,
+	atom.Object:   true,
+	atom.Embed:    true,
+	atom.Noscript: true,
+	atom.Template: true,
+	atom.Head:     true,
+	atom.Title:    true,
+	atom.Svg:      true,
+	atom.Math:     true,
+}
+
+// blockTags force a line break when converting to plain text
+var blockTags = map[atom.Atom]bool{
+	atom.Blockquote: true,
+	atom.Br:         true,
+	atom.Div:        true,
+	atom.H1:         true,
+	atom.H2:         true,
+	atom.H3:         true,
+	atom.H4:         true,
+	atom.H5:         true,
+	atom.H6:         true,
+	atom.Li:         true,
+	atom.P:          true,
+	atom.Pre:        true,
+	atom.Tr:         true,
+}
+
+// Policy controls how HTML is sanitised
+type Policy struct {
+	// ImageProxy is a URL prefix remote images are rewritten through, e.g "https://images.fancast.uk/proxy?url="
+	// If this is empty remote images are removed entirely
+	ImageProxy string
+}
+
+// HTML returns a sanitised copy of s using a policy with no image proxy
+func HTML(s string) string {
+	return Policy{}.HTML(s)
+}
+
+// HTML returns a sanitised copy of s, only allowlisted tags and attributes survive.
+// Links are given rel="nofollow noopener" and images are either proxied or removed.
+func (p Policy) HTML(s string) string {
+	var buf bytes.Buffer
+	// How deep we are inside a tag whose contents we're dropping
+	skipDepth := 0
+	// Track which allowed tags are open so we don't emit stray closing tags
+	open := make(map[atom.Atom]int)
+
+	z := html.NewTokenizer(strings.NewReader(stripCDATA(s)))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			// Either EOF or the tokenizer can't go further, return what we have so far
+			break
+		}
+		token := z.Token()
+
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if droppedTags[token.DataAtom] {
+				if tt == html.StartTagToken {
+					skipDepth++
+				}
+				continue
+			}
+			if skipDepth > 0 {
+				continue
+			}
+			allowedAttrs, ok := allowedTags[token.DataAtom]
+			if !ok {
+				continue
+			}
+			attrs, keep := p.filterAttributes(token, allowedAttrs)
+			if !keep {
+				continue
+			}
+			token.Attr = attrs
+			if token.DataAtom == atom.Br || token.DataAtom == atom.Img {
+				token.Type = html.SelfClosingTagToken
+			} else if tt == html.StartTagToken {
+				open[token.DataAtom]++
+			}
+			buf.WriteString(token.String())
+
+		case html.EndTagToken:
+			if droppedTags[token.DataAtom] {
+				if skipDepth > 0 {
+					skipDepth--
+				}
+				continue
+			}
+			if skipDepth > 0 {
+				continue
+			}
+			if open[token.DataAtom] > 0 {
+				open[token.DataAtom]--
+				buf.WriteString(token.String())
+			}
+
+		case html.TextToken:
+			if skipDepth > 0 {
+				continue
+			}
+			buf.WriteString(html.EscapeString(token.Data))
+		}
+	}
+
+	// Close anything the publisher left open so it can't leak into our page
+	for _, a := range []atom.Atom{atom.A, atom.B, atom.Strong, atom.I, atom.Em, atom.U, atom.Code, atom.Pre, atom.Li, atom.Ul, atom.Ol, atom.Blockquote, atom.P, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6} {
+		for i := 0; i < open[a]; i++ {
+			buf.WriteString("</" + a.String() + ">")
+		}
+	}
+
+	return strings.TrimSpace(buf.String())
+}
+
+// filterAttributes strips everything but the allowed attributes, returns false if the tag should be dropped altogether
+func (p Policy) filterAttributes(token html.Token, allowed []string) ([]html.Attribute, bool) {
+	attrs := make([]html.Attribute, 0, len(token.Attr))
+	for _, attr := range token.Attr {
+		if !contains(allowed, attr.Key) {
+			continue
+		}
+		switch attr.Key {
+		case "href":
+			if !safeURL(attr.Val, "http", "https", "mailto") {
+				continue
+			}
+		case "src":
+			if !safeURL(attr.Val, "http", "https") {
+				return nil, false
+			}
+		case "width", "height":
+			// 1x1 images are tracking pixels
+			if strings.TrimSpace(attr.Val) == "0" || strings.TrimSpace(attr.Val) == "1" {
+				return nil, false
+			}
+		}
+		attrs = append(attrs, attr)
+	}
+
+	switch token.DataAtom {
+	case atom.A:
+		attrs = append(attrs, html.Attribute{Key: "rel", Val: "nofollow noopener"})
+	case atom.Img:
+		if p.ImageProxy == "" {
+			return nil, false
+		}
+		hasSrc := false
+		for i := range attrs {
+			if attrs[i].Key == "src" {
+				attrs[i].Val = p.ImageProxy + url.QueryEscape(attrs[i].Val)
+				hasSrc = true
+			}
+		}
+		if !hasSrc {
+			return nil, false
+		}
+	}
+
+	return attrs, true
+}
+
+// Text converts HTML into plain text, block elements become new lines and whitespace is collapsed
+func Text(s string) string {
+	var buf bytes.Buffer
+	skipDepth := 0
+
+	z := html.NewTokenizer(strings.NewReader(stripCDATA(s)))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		token := z.Token()
+
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if droppedTags[token.DataAtom] {
+				if tt == html.StartTagToken {
+					skipDepth++
+				}
+				continue
+			}
+			if blockTags[token.DataAtom] {
+				buf.WriteString("\n")
+			}
+		case html.EndTagToken:
+			if droppedTags[token.DataAtom] && skipDepth > 0 {
+				skipDepth--
+				continue
+			}
+			if blockTags[token.DataAtom] {
+				buf.WriteString("\n")
+			}
+		case html.TextToken:
+			if skipDepth > 0 {
+				continue
+			}
+			buf.WriteString(token.Data)
+		}
+	}
+
+	return collapseWhitespace(buf.String())
+}
+
+// Summary returns the plain text of s cut down to at most max characters.
+// We cut on a word boundary and add an ellipsis so we're not chopping words in half.
+// A max of 0 or less uses DefaultSummaryLength
+func Summary(s string, max int) string {
+	if max <= 0 {
+		max = DefaultSummaryLength
+	}
+	text := Text(s)
+	runes := []rune(text)
+	if len(runes) <= max {
+		return text
+	}
+
+	cut := runes[:max]
+	// Walk back to the last space so we don't end mid-word
+	for i := len(cut) - 1; i > 0; i-- {
+		if unicode.IsSpace(cut[i]) {
+			cut = cut[:i]
+			break
+		}
+	}
+
+	return strings.TrimRightFunc(string(cut), func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsPunct(r)
+	}) + "…"
+}
+
+// collapseWhitespace squashes runs of spaces into one, and runs of new lines into a paragraph break
+func collapseWhitespace(s string) string {
+	lines := strings.Split(s, "\n")
+	out := make([]string, 0, len(lines))
+	blank := false
+	for _, line := range lines {
+		line = strings.Join(strings.Fields(line), " ")
+		if line == "" {
+			blank = len(out) > 0
+			continue
+		}
+		if blank {
+			out = append(out, "")
+			blank = false
+		}
+		out = append(out, line)
+	}
+	return strings.Join(out, "\n")
+}
+
+// stripCDATA removes CDATA markers, some feeds double wrap their HTML so it reaches us with these still in
+func stripCDATA(s string) string {
+	s = strings.Replace(s, "<![CDATA[", "", -1)
+	return strings.Replace(s, "]]>", "", -1)
+}
+
+func safeURL(raw string, schemes ...string) bool {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return false
+	}
+	return contains(schemes, strings.ToLower(u.Scheme))
+}
+
+func contains(a []string, x string) bool {
+	for _, n := range a {
+		if x == n {
+			return true
+		}
+	}
+	return false
+}
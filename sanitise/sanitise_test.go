@@ -0,0 +1,62 @@
+package sanitise
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHTML(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"drops scripts and event handlers", `<p onclick="x()">Hi <script>alert(1)</script><b>there</b></p>`, `<p>Hi <b>there</b></p>`},
+		{"drops unsafe links", `<a href="javascript:alert(1)">x</a>`, `<a rel="nofollow noopener">x</a>`},
+		{"keeps safe links", `<a href="https://example.com">y</a>`, `<a href="https://example.com" rel="nofollow noopener">y</a>`},
+		{"removes images without a proxy", `<img src="https://example.com/a.png">`, ``},
+		{"unwraps CDATA", `<![CDATA[<p>Hello</p>]]>`, `<p>Hello</p>`},
+		{"drops stray closing tags", `<div style="color:red">a</div></b>`, `a`},
+	}
+	for _, test := range tests {
+		if got := HTML(test.in); got != test.want {
+			t.Errorf("%s: HTML(%q) = %q, want %q", test.name, test.in, got, test.want)
+		}
+	}
+}
+
+func TestPolicyImageProxy(t *testing.T) {
+	got := Policy{ImageProxy: "https://images.example.com/?url="}.HTML(`<img src="https://example.com/a.png">`)
+	want := `<img src="https://images.example.com/?url=https%3A%2F%2Fexample.com%2Fa.png"/>`
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestText(t *testing.T) {
+	if got := Text(`<p>Hi <script>alert(1)</script><b>there</b></p>`); got != "Hi there" {
+		t.Errorf("got %q, want %q", got, "Hi there")
+	}
+}
+
+func TestSummary(t *testing.T) {
+	tests := []struct {
+		in   string
+		max  int
+		want string
+	}{
+		{"one two three four", 9, "one two…"},
+		{"one two", 20, "one two"},
+		// 0 or less is DefaultSummaryLength, rather than panicking or returning just an ellipsis
+		{"one two", 0, "one two"},
+		{"one two", -3, "one two"},
+	}
+	for _, test := range tests {
+		if got := Summary(test.in, test.max); got != test.want {
+			t.Errorf("Summary(%q, %d) = %q, want %q", test.in, test.max, got, test.want)
+		}
+	}
+
+	long := strings.Repeat("word ", 100)
+	if got := []rune(Summary(long, -1)); len(got) > DefaultSummaryLength+1 {
+		t.Errorf("got %d characters, want at most %d", len(got), DefaultSummaryLength+1)
+	}
+}
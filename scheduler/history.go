@@ -0,0 +1,120 @@
+package scheduler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/config"
+	"bitbucket.org/jayflux/mypodcasts_injest/leader"
+)
+
+// Run statuses, abandoned runs stopped heartbeating without finishing, usually because their process died
+const (
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	StatusSkipped   = "skipped"
+	StatusAbandoned = "abandoned"
+)
+
+// Run is a single run of a job, as kept in job_runs
+type Run struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Instance   string     `json:"instance"`
+	Trigger    string     `json:"trigger"`
+	Status     string     `json:"status"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	Counts     Counts     `json:"counts,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// Duration is how long the run took, or has taken so far
+func (r *Run) Duration() time.Duration {
+	if r.FinishedAt != nil {
+		return r.FinishedAt.Sub(r.StartedAt).Round(time.Second)
+	}
+	return time.Since(r.StartedAt).Round(time.Second)
+}
+
+// start records a new run, or a skipped one if the job is already running
+// Only one running row per job is allowed by a unique index, so this holds across processes
+func start(name, trigger string) (*Run, error) {
+	_, err := getDB().Exec("UPDATE job_runs SET status = 'abandoned', finished_at = heartbeat_at WHERE name = $1 AND status = 'running' AND heartbeat_at < now() - make_interval(mins => $2)", name, config.Get().Scheduler.StaleRunMinutes)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Run{Name: name, Instance: leader.Instance(), Trigger: trigger, Status: StatusRunning}
+	err = getDB().QueryRow(`INSERT INTO job_runs (name, instance, trigger, status, started_at, heartbeat_at)
+		VALUES ($1, $2, $3, 'running', now(), now())
+		ON CONFLICT (name) WHERE status = 'running' DO NOTHING
+		RETURNING id, started_at`, name, r.Instance, trigger).Scan(&r.ID, &r.StartedAt)
+	if err == nil {
+		return r, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	r.Status = StatusSkipped
+	err = getDB().QueryRow(`INSERT INTO job_runs (name, instance, trigger, status, started_at, heartbeat_at, finished_at)
+		VALUES ($1, $2, $3, 'skipped', now(), now(), now())
+		RETURNING id, started_at, finished_at`, name, r.Instance, trigger).Scan(&r.ID, &r.StartedAt, &r.FinishedAt)
+	return r, err
+}
+
+// heartbeat shows the run is still going
+func heartbeat(r *Run) {
+	_, err := getDB().Exec("UPDATE job_runs SET heartbeat_at = now() WHERE id = $1", r.ID)
+	if err != nil {
+		log.Error("scheduler: Could not write to DB")
+		log.Error(err)
+	}
+}
+
+// finish records how a run ended
+func finish(r *Run, counts Counts, runErr error) {
+	r.Status = StatusSucceeded
+	r.Counts = counts
+	if runErr != nil {
+		r.Status = StatusFailed
+		r.Error = runErr.Error()
+	}
+	var body interface{}
+	if counts != nil {
+		encoded, _ := json.Marshal(counts)
+		body = string(encoded)
+	}
+	err := getDB().QueryRow("UPDATE job_runs SET status = $2, finished_at = now(), heartbeat_at = now(), counts = $3, error = NULLIF($4, '') WHERE id = $1 RETURNING finished_at",
+		r.ID, r.Status, body, r.Error).Scan(&r.FinishedAt)
+	if err != nil {
+		log.Error("scheduler: Could not write to DB")
+		log.Error(err)
+	}
+}
+
+// Runs returns the latest runs, of every job if name is empty
+func Runs(name string, limit int) ([]Run, error) {
+	runs := make([]Run, 0)
+	rows, err := getDB().Query(`SELECT id, name, instance, trigger, status, started_at, finished_at, counts, COALESCE(error, '')
+		FROM job_runs WHERE $1 = '' OR name = $1 ORDER BY started_at DESC LIMIT $2`, name, limit)
+	if err != nil {
+		return runs, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r Run
+		var counts []byte
+		if err := rows.Scan(&r.ID, &r.Name, &r.Instance, &r.Trigger, &r.Status, &r.StartedAt, &r.FinishedAt, &counts, &r.Error); err != nil {
+			return runs, err
+		}
+		if counts != nil {
+			json.Unmarshal(counts, &r.Counts)
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
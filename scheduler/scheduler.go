@@ -0,0 +1,237 @@
+// Package scheduler runs the recurring jobs cron used to hard-code
+// Each job's schedule comes from schedules.<name> in config, a run is skipped if the previous one is still going,
+// and every run is recorded in job_runs so we can see what happened and when
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/config"
+	"bitbucket.org/jayflux/mypodcasts_injest/database"
+	"bitbucket.org/jayflux/mypodcasts_injest/leader"
+	"bitbucket.org/jayflux/mypodcasts_injest/logger"
+	"bitbucket.org/jayflux/mypodcasts_injest/metrics"
+	"bitbucket.org/jayflux/mypodcasts_injest/tracing"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"gopkg.in/robfig/cron.v2"
+)
+
+// How a run was started
+const (
+	TriggerSchedule = "schedule"
+	TriggerManual   = "manual"
+)
+
+// Counts are whatever a job wants to report about a run, e.g. how many feeds it queued
+type Counts map[string]int
+
+// Task is the work a job does, ctx is cancelled if we're shutting down and it runs out of time
+type Task func(ctx context.Context) (Counts, error)
+
+// Job is a recurring task, Spec and Jitter are defaults which schedules.<name> in config overrides
+type Job struct {
+	Name string
+	// Spec is a robfig cron spec, e.g. @hourly or "0 30 4 * * *"
+	Spec string
+	// Jitter is the most a run is delayed by, so replicas and neighbouring jobs don't all hit the database at once
+	Jitter time.Duration
+	Task   Task
+}
+
+// Schedule is a job as configured
+type Schedule struct {
+	Name          string `json:"name"`
+	Spec          string `json:"spec"`
+	JitterSeconds int    `json:"jitterSeconds"`
+	Enabled       bool   `json:"enabled"`
+}
+
+var (
+	log = logger.Log
+
+	jobs   = make(map[string]Job)
+	jobsMu sync.RWMutex
+
+	// running is the scheduled runs in progress, so Wait can let them finish
+	running   sync.WaitGroup
+	runningMu sync.Mutex
+	stopped   bool
+)
+
+// getDB returns the shared pool
+func getDB() *sql.DB {
+	return database.DB()
+}
+
+// Register adds a job, its defaults go into config so schedules.<name> only needs what's different
+func Register(job Job) {
+	viper.SetDefault("schedules."+job.Name+".spec", job.Spec)
+	viper.SetDefault("schedules."+job.Name+".jitterSeconds", int(job.Jitter/time.Second))
+	viper.SetDefault("schedules."+job.Name+".enabled", true)
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	jobs[job.Name] = job
+}
+
+// Schedules returns every registered job as configured, sorted by name
+func Schedules() []Schedule {
+	jobsMu.RLock()
+	defer jobsMu.RUnlock()
+	schedules := make([]Schedule, 0, len(jobs))
+	for name := range jobs {
+		schedules = append(schedules, getSchedule(name))
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].Name < schedules[j].Name
+	})
+	return schedules
+}
+
+func getSchedule(name string) Schedule {
+	return Schedule{
+		Name:          name,
+		Spec:          viper.GetString("schedules." + name + ".spec"),
+		JitterSeconds: viper.GetInt("schedules." + name + ".jitterSeconds"),
+		Enabled:       viper.GetBool("schedules." + name + ".enabled"),
+	}
+}
+
+// Start adds every enabled job to c
+// Every replica can call this, each job only runs on the instance leading it
+// Once ctx is done no more runs start, ones in progress get scheduler.shutdownGraceSeconds before their context is cancelled
+func Start(ctx context.Context, c *cron.Cron) error {
+	runCtx, cancelRuns := context.WithCancel(context.Background())
+	go func() {
+		<-ctx.Done()
+		time.Sleep(time.Duration(config.Get().Scheduler.ShutdownGraceSeconds) * time.Second)
+		cancelRuns()
+	}()
+
+	for _, schedule := range Schedules() {
+		if !schedule.Enabled {
+			log.Printf("scheduler: %s is disabled", schedule.Name)
+			continue
+		}
+		name, jitter := schedule.Name, time.Duration(schedule.JitterSeconds)*time.Second
+		_, err := c.AddFunc(schedule.Spec, leader.Guard(name, func() {
+			runningMu.Lock()
+			if stopped {
+				runningMu.Unlock()
+				return
+			}
+			running.Add(1)
+			runningMu.Unlock()
+			defer running.Done()
+			if jitter > 0 {
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Duration(rand.Int63n(int64(jitter)))):
+				}
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			run(runCtx, name, TriggerSchedule)
+		}))
+		if err != nil {
+			return fmt.Errorf("scheduler: %s has a bad spec %q: %s", name, schedule.Spec, err)
+		}
+		log.Printf("scheduler: %s runs %s", name, schedule.Spec)
+	}
+	return nil
+}
+
+// Wait blocks until scheduled runs in progress have finished, none start after it's called
+func Wait() {
+	runningMu.Lock()
+	stopped = true
+	runningMu.Unlock()
+	running.Wait()
+}
+
+// Trigger runs a job now, in this process, and returns how it went
+// It still won't run if the job is already running somewhere
+func Trigger(ctx context.Context, name string) (*Run, error) {
+	jobsMu.RLock()
+	_, ok := jobs[name]
+	jobsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("scheduler: no job called %s", name)
+	}
+	return run(ctx, name, TriggerManual), nil
+}
+
+// run starts a run of name unless one is already going, records it and returns it
+func run(ctx context.Context, name, trigger string) *Run {
+	ctx, span := tracing.Span(ctx, "schedule "+name, attribute.String("trigger", trigger))
+	defer span.End()
+	ctx = logger.WithFields(ctx, logger.Fields{"job": name, "trigger": trigger})
+	log := logger.From(ctx)
+	jobsMu.RLock()
+	job := jobs[name]
+	jobsMu.RUnlock()
+
+	r, err := start(name, trigger)
+	if err != nil {
+		log.Error("scheduler: Could not write to DB")
+		log.Error(err)
+		return &Run{Name: name, Trigger: trigger, Status: StatusFailed, Error: err.Error()}
+	}
+	if r.Status == StatusSkipped {
+		log.Printf("scheduler: skipping %s, the last run is still going", name)
+		metrics.JobRuns.WithLabelValues(name, r.Status).Inc()
+		return r
+	}
+
+	log.Printf("scheduler: starting %s (%s)", name, trigger)
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				heartbeat(r)
+			}
+		}
+	}()
+
+	started := time.Now()
+	counts, err := runTask(ctx, job.Task)
+	close(done)
+	finish(r, counts, err)
+	span.SetAttributes(attribute.String("status", r.Status))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	metrics.JobRuns.WithLabelValues(name, r.Status).Inc()
+	metrics.JobRunDuration.WithLabelValues(name, r.Status).Observe(time.Since(started).Seconds())
+	if err != nil {
+		log.Errorf("scheduler: %s failed after %s: %s", name, r.Duration(), err)
+	} else {
+		log.Printf("scheduler: %s finished in %s", name, r.Duration())
+	}
+	return r
+}
+
+// runTask turns a panicking task into a failed run
+func runTask(ctx context.Context, task Task) (counts Counts, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return task(ctx)
+}
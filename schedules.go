@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/injest"
+	"bitbucket.org/jayflux/mypodcasts_injest/injestFromBBC"
+	"bitbucket.org/jayflux/mypodcasts_injest/queue"
+	"bitbucket.org/jayflux/mypodcasts_injest/scheduler"
+)
+
+// registerSchedules tells the scheduler about our recurring jobs
+// These are defaults, schedules.<name>.spec, jitterSeconds and enabled in config.json override them
+func registerSchedules() {
+	scheduler.Register(scheduler.Job{
+		Name:   "update-podcasts",
+		Spec:   "@hourly",
+		Jitter: time.Minute,
+		Task: func(ctx context.Context) (scheduler.Counts, error) {
+			queued, err := injest.UpdatePodcasts(ctx)
+			return scheduler.Counts{"queued": queued}, err
+		},
+	})
+	scheduler.Register(scheduler.Job{
+		Name:   "process-images",
+		Spec:   "@hourly",
+		Jitter: 5 * time.Minute,
+		Task: func(ctx context.Context) (scheduler.Counts, error) {
+			_, err := queue.Enqueue(queue.TypeProcessImages, nil, queue.Options{DedupeKey: queue.TypeProcessImages})
+			return nil, err
+		},
+	})
+	scheduler.Register(scheduler.Job{
+		Name:   "crawl-bbc",
+		Spec:   "@weekly",
+		Jitter: time.Hour,
+		Task: func(ctx context.Context) (scheduler.Counts, error) {
+			stats, err := injestFromBBC.CrawlBBC(ctx)
+			return scheduler.Counts{"candidates": stats.Candidates, "new": stats.New, "queued": stats.Queued, "failed": stats.Failed}, err
+		},
+	})
+	scheduler.Register(scheduler.Job{
+		Name:   "update-poll-frequencies",
+		Spec:   "0 30 3 * * *",
+		Jitter: 10 * time.Minute,
+		Task: func(ctx context.Context) (scheduler.Counts, error) {
+			updated, err := injest.UpdatePollFrequencies(ctx)
+			return scheduler.Counts{"podcasts": updated}, err
+		},
+	})
+	scheduler.Register(scheduler.Job{
+		Name:   "prune-parse-log",
+		Spec:   "0 0 5 * * *",
+		Jitter: 10 * time.Minute,
+		Task: func(ctx context.Context) (scheduler.Counts, error) {
+			deleted, err := injest.PruneParseLog(ctx)
+			return scheduler.Counts{"deleted": deleted}, err
+		},
+	})
+	scheduler.Register(scheduler.Job{
+		Name:   "backup",
+		Spec:   "0 0 4 * * *",
+		Jitter: 10 * time.Minute,
+		Task: func(ctx context.Context) (scheduler.Counts, error) {
+			return nil, performBackup()
+		},
+	})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/api"
+	"bitbucket.org/jayflux/mypodcasts_injest/config"
+	"bitbucket.org/jayflux/mypodcasts_injest/database"
+	"bitbucket.org/jayflux/mypodcasts_injest/health"
+	"bitbucket.org/jayflux/mypodcasts_injest/leader"
+	"bitbucket.org/jayflux/mypodcasts_injest/metrics"
+	"bitbucket.org/jayflux/mypodcasts_injest/queue"
+	"bitbucket.org/jayflux/mypodcasts_injest/scheduler"
+	"bitbucket.org/jayflux/mypodcasts_injest/store"
+	"gopkg.in/robfig/cron.v2"
+)
+
+// Roles a process can run, -serve runs the ones in serve.roles
+const (
+	roleAPI            = "api"
+	roleScheduler      = "scheduler"
+	roleWorker         = "worker"
+	roleImageProcessor = "image-processor"
+)
+
+// role runs until ctx is done, calling ready once it's able to take work
+type role func(ctx context.Context, ready func()) error
+
+var roles = map[string]role{
+	roleAPI:            serveAPI,
+	roleScheduler:      serveScheduler,
+	roleWorker:         serveWorker,
+	roleImageProcessor: serveImageProcessor,
+}
+
+// serve runs each of names until ctx is done, or until one of them fails, which stops the rest
+// If healthAddr isn't empty each role's status is served there for the container platform to probe, along with /metrics
+func serve(ctx context.Context, names []string, healthAddr string) error {
+	if len(names) == 0 {
+		return fmt.Errorf("serve: no roles to run")
+	}
+	registry := health.New()
+	for _, name := range names {
+		if _, ok := roles[name]; !ok {
+			return fmt.Errorf("serve: no role called %s", name)
+		}
+		registry.Set(name, health.StatusStarting, nil)
+	}
+	registry.AddCheck("database", func(ctx context.Context) error {
+		return database.DB().PingContext(ctx)
+	})
+
+	// The health server outlives the roles so the platform can see them stopping, /metrics is served alongside it
+	if healthAddr != "" {
+		handler := http.NewServeMux()
+		handler.Handle("/metrics", metrics.Handler())
+		handler.Handle("/", registry.Handler())
+		server := &http.Server{Addr: healthAddr, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				log.Error("serve: health server stopped")
+				log.Error(err)
+			}
+		}()
+		defer server.Close()
+		log.Printf("serve: health checks and metrics on %s", healthAddr)
+	}
+
+	if containsRole(names, roleWorker) || containsRole(names, roleImageProcessor) {
+		registerJobHandlers()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		for _, name := range names {
+			registry.Stopping(name)
+		}
+	}()
+
+	var (
+		wg       sync.WaitGroup
+		errMu    sync.Mutex
+		firstErr error
+	)
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			log.Printf("serve: starting %s", name)
+			err := runRole(ctx, roles[name], func() {
+				registry.Set(name, health.StatusReady, nil)
+				log.Printf("serve: %s is ready", name)
+			})
+			if err != nil {
+				log.Errorf("serve: %s failed: %s", name, err)
+				registry.Set(name, health.StatusFailed, err)
+				errMu.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("serve: %s failed: %s", name, err)
+				}
+				errMu.Unlock()
+				cancel()
+				return
+			}
+			registry.Set(name, health.StatusStopped, nil)
+			log.Printf("serve: %s stopped", name)
+		}(name)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// runRole turns a panicking role into a failed one
+func runRole(ctx context.Context, r role, ready func()) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return r(ctx, ready)
+}
+
+func containsRole(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func serveAPI(ctx context.Context, ready func()) error {
+	listener, err := net.Listen("tcp", config.Get().API.Addr)
+	if err != nil {
+		return err
+	}
+	ready()
+	return api.Serve(ctx, listener, store.NewPostgres(database.DB()).Stores())
+}
+
+// serveScheduler runs the recurring jobs this instance leads, letting runs in progress finish once ctx is done
+func serveScheduler(ctx context.Context, ready func()) error {
+	// https://godoc.org/gopkg.in/robfig/cron.v2
+	c := cron.New()
+	if err := scheduler.Start(ctx, c); err != nil {
+		return err
+	}
+	c.Start()
+	ready()
+	<-ctx.Done()
+	log.Println("Shutting down, waiting for scheduled jobs to finish")
+	c.Stop()
+	scheduler.Wait()
+	leader.Resign()
+	return nil
+}
+
+// serveWorker works every type of job except image processing, which has its own role
+func serveWorker(ctx context.Context, ready func()) error {
+	types := make([]string, 0)
+	for _, t := range queue.Types() {
+		if t != queue.TypeProcessImages {
+			types = append(types, t)
+		}
+	}
+	ready()
+	queue.Work(ctx, *workers, types...)
+	return nil
+}
+
+func serveImageProcessor(ctx context.Context, ready func()) error {
+	ready()
+	queue.Work(ctx, config.Get().Serve.ImageWorkers, queue.TypeProcessImages)
+	return nil
+}
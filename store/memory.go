@@ -0,0 +1,545 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/models"
+)
+
+// Memory keeps everything in memory, it's every store and behaves like Postgres does
+// It's for running the ingester and API without a database, e.g in tests, nothing is kept once the process exits
+type Memory struct {
+	mu       sync.Mutex
+	podcasts map[string]*memoryPodcast
+	episodes map[string]*Episode
+	// aliases are the URLs podcasts used to be at, to their ID
+	aliases     map[string]string
+	changes     []memoryChange
+	directories []DirectoryMetadata
+}
+
+type memoryPodcast struct {
+	Podcast
+	dateAdded      time.Time
+	headers        *Headers
+	failure        string
+	failureMessage string
+}
+
+type memoryChange struct {
+	podcastID   string
+	episodeGUID string
+	FieldChange
+}
+
+// NewMemory returns empty stores
+func NewMemory() *Memory {
+	return &Memory{
+		podcasts: make(map[string]*memoryPodcast),
+		episodes: make(map[string]*Episode),
+		aliases:  make(map[string]string),
+	}
+}
+
+// Stores returns m as each store
+func (m *Memory) Stores() Stores {
+	return Stores{Podcasts: m, Episodes: m, FetchState: m}
+}
+
+// AddDirectoryMetadata records what directories say about feeds, replacing what the same directory said about the same feed
+func (m *Memory) AddDirectoryMetadata(metadata ...DirectoryMetadata) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, added := range metadata {
+		replaced := false
+		for i, existing := range m.directories {
+			if existing.Directory == added.Directory && existing.FeedURL == added.FeedURL {
+				m.directories[i] = added
+				replaced = true
+			}
+		}
+		if !replaced {
+			m.directories = append(m.directories, added)
+		}
+	}
+}
+
+// Changes returns the change log of the podcast with podcastID and its episodes, oldest first
+func (m *Memory) Changes(podcastID string) []FieldChange {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	changes := make([]FieldChange, 0)
+	for _, change := range m.changes {
+		if change.podcastID == podcastID {
+			changes = append(changes, change.FieldChange)
+		}
+	}
+	return changes
+}
+
+// Failure returns why the feed at feedURL last failed, class is empty if it hasn't or it's been cleared since
+func (m *Memory) Failure(feedURL string) (class, message string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if podcast := m.podcastByURL(feedURL); podcast != nil {
+		return podcast.failure, podcast.failureMessage
+	}
+	return "", ""
+}
+
+// FindPodcast implements PodcastStore
+func (m *Memory) FindPodcast(ctx context.Context, feedURL string) (string, string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	podcast := m.podcastByURL(feedURL)
+	if podcast == nil {
+		return "", "", false, nil
+	}
+	return podcast.ID, podcast.Digest, true, nil
+}
+
+// CreatePodcast implements PodcastStore
+func (m *Memory) CreatePodcast(ctx context.Context, p Podcast) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.podcasts[p.ID]; ok {
+		return ErrDuplicate
+	}
+	m.podcasts[p.ID] = &memoryPodcast{Podcast: p, dateAdded: time.Now()}
+	return nil
+}
+
+// UpdatePodcast implements PodcastStore
+// Like Postgres every podcast at p.FeedURL is updated, there's usually one
+func (m *Memory) UpdatePodcast(ctx context.Context, p Podcast, changes []FieldChange) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, podcast := range m.podcasts {
+		if podcast.FeedURL != p.FeedURL {
+			continue
+		}
+		updated := p
+		updated.ID = podcast.ID
+		updated.Image = mergeJSON(podcast.Image, p.Image)
+		podcast.Podcast = updated
+	}
+	m.recordChanges(p.ID, "", changes)
+	return nil
+}
+
+// MovePodcast implements PodcastStore
+func (m *Memory) MovePodcast(ctx context.Context, oldURL, newURL string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	podcast := m.podcastByURL(oldURL)
+	if podcast == nil {
+		return "", ErrNotFound
+	}
+	for _, existing := range m.podcasts {
+		if existing.FeedURL == newURL {
+			return "", ErrDuplicate
+		}
+	}
+	podcast.FeedURL = newURL
+	m.recordChanges(podcast.ID, "", []FieldChange{{Field: "feed_url", Before: oldURL, After: newURL}})
+	m.aliases[oldURL] = podcast.ID
+	return podcast.ID, nil
+}
+
+// PodcastFields implements PodcastStore
+func (m *Memory) PodcastFields(ctx context.Context, id string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	podcast, ok := m.podcasts[id]
+	if !ok {
+		return map[string]string{}, nil
+	}
+	return map[string]string{
+		"title":       podcast.Title,
+		"description": podcast.Description,
+		"link":        podcast.Link,
+		"updated":     podcast.Updated,
+		"language":    podcast.Language,
+		"copyright":   podcast.Copyright,
+		"author":      string(jsonValue(podcast.Author)),
+		"image":       string(jsonValue(podcast.Image)),
+		"itunes_ext":  string(jsonValue(podcast.ItunesExt)),
+		"categories":  string(jsonValue(podcast.Categories)),
+	}, nil
+}
+
+// DirectoryMetadata implements PodcastStore
+func (m *Memory) DirectoryMetadata(ctx context.Context, feedURL string) ([]DirectoryMetadata, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	podcastID := ""
+	if podcast := m.podcastByURL(feedURL); podcast != nil {
+		podcastID = podcast.ID
+	}
+	metadata := make([]DirectoryMetadata, 0)
+	for _, d := range m.directories {
+		if d.FeedURL == feedURL || (podcastID != "" && m.podcastIDForURL(d.FeedURL) == podcastID) {
+			metadata = append(metadata, DirectoryMetadata{Directory: d.Directory, FeedURL: d.FeedURL, Network: d.Network, Genres: d.Genres, Frequency: d.Frequency, Language: d.Language})
+		}
+	}
+	sort.SliceStable(metadata, func(i, j int) bool {
+		return metadata[i].Directory < metadata[j].Directory
+	})
+	return metadata, nil
+}
+
+// Podcast implements PodcastStore
+func (m *Memory) Podcast(ctx context.Context, id string) (models.Podcast, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	podcast, ok := m.podcasts[id]
+	if !ok {
+		return models.Podcast{Directories: make([]models.DirectoryMetadata, 0)}, nil
+	}
+	shown := podcastModel(podcast)
+	shown.Episodes = m.episodeModels(id, time.Date(1990, 8, 24, 11, 0, 0, 0, time.UTC))
+	shown.Directories = make([]models.DirectoryMetadata, 0)
+	for _, d := range m.directories {
+		if m.podcastIDForURL(d.FeedURL) == id {
+			genres, _ := json.Marshal(d.Genres)
+			brandIDs, _ := json.Marshal(d.BrandIDs)
+			shown.Directories = append(shown.Directories, models.DirectoryMetadata{Directory: d.Directory, Network: d.Network, Genres: genres, Frequency: d.Frequency, BrandIDs: brandIDs, HomepageURL: d.HomepageURL, LaunchDate: d.LaunchDate, Language: d.Language})
+		}
+	}
+	sort.SliceStable(shown.Directories, func(i, j int) bool {
+		return shown.Directories[i].Directory < shown.Directories[j].Directory
+	})
+	return shown, nil
+}
+
+// NewPodcasts implements PodcastStore
+func (m *Memory) NewPodcasts(ctx context.Context) ([]models.Podcast, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	podcasts := make([]*memoryPodcast, 0, len(m.podcasts))
+	for _, podcast := range m.podcasts {
+		podcasts = append(podcasts, podcast)
+	}
+	sort.Slice(podcasts, func(i, j int) bool {
+		return podcasts[i].dateAdded.After(podcasts[j].dateAdded)
+	})
+	var shown []models.Podcast
+	for i := 0; i < len(podcasts) && i < 20; i++ {
+		shown = append(shown, podcastModel(podcasts[i]))
+	}
+	return shown, nil
+}
+
+// UpdatedPodcasts implements PodcastStore
+func (m *Memory) UpdatedPodcasts(ctx context.Context) ([]models.Podcast, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var shown []models.Podcast
+	for _, episode := range m.sortedEpisodes(func(e *Episode) bool { return true }) {
+		if len(shown) == 20 {
+			break
+		}
+		if podcast, ok := m.podcasts[episode.PodcastID]; ok {
+			shown = append(shown, podcastModel(podcast))
+		}
+	}
+	return shown, nil
+}
+
+// EpisodeDigests implements EpisodeStore
+func (m *Memory) EpisodeDigests(ctx context.Context, podcastID string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	digests := make([]string, 0)
+	for _, episode := range m.episodes {
+		if episode.PodcastID == podcastID {
+			digests = append(digests, episode.Digest)
+		}
+	}
+	return digests, nil
+}
+
+// EpisodeExists implements EpisodeStore
+func (m *Memory) EpisodeExists(ctx context.Context, guid string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.episodeByGUID(guid) != nil, nil
+}
+
+// AddEpisode implements EpisodeStore
+func (m *Memory) AddEpisode(ctx context.Context, e Episode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.episodes[e.ID]; ok || m.episodeByGUID(e.GUID) != nil {
+		return ErrDuplicate
+	}
+	for _, episode := range m.episodes {
+		if episode.Digest == e.Digest {
+			return ErrDuplicate
+		}
+	}
+	m.episodes[e.ID] = &e
+	return nil
+}
+
+// UpdateEpisode implements EpisodeStore
+func (m *Memory) UpdateEpisode(ctx context.Context, e Episode, changes []FieldChange) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	episode := m.episodeByGUID(e.GUID)
+	if episode == nil {
+		return nil
+	}
+	updated := e
+	updated.ID = episode.ID
+	updated.Image = mergeJSON(episode.Image, e.Image)
+	*episode = updated
+	m.recordChanges(e.PodcastID, e.GUID, changes)
+	return nil
+}
+
+// EpisodeFields implements EpisodeStore
+func (m *Memory) EpisodeFields(ctx context.Context, guid string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	episode := m.episodeByGUID(guid)
+	if episode == nil {
+		return map[string]string{}, nil
+	}
+	return map[string]string{
+		"title":       episode.Title,
+		"description": episode.Description,
+		"published":   episode.Published,
+		"author":      string(jsonValue(episode.Author)),
+		"image":       string(jsonValue(episode.Image)),
+		"enclosures":  string(jsonValue(episode.Enclosures)),
+		"itunes_ext":  string(jsonValue(episode.ItunesExt)),
+	}, nil
+}
+
+// Episode implements EpisodeStore
+func (m *Memory) Episode(ctx context.Context, id string) (models.PodcastEpisode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	episode, ok := m.episodes[id]
+	if !ok {
+		return models.PodcastEpisode{}, nil
+	}
+	podcast, ok := m.podcasts[episode.PodcastID]
+	if !ok {
+		return models.PodcastEpisode{}, nil
+	}
+	shown := episodeModel(episode, podcast)
+	shown.ParentID = podcast.ID
+	shown.ParentTitle = podcast.Title
+	shown.ItunesExt = nil
+	shown.FormatPublished()
+	return shown, nil
+}
+
+// Episodes implements EpisodeStore
+func (m *Memory) Episodes(ctx context.Context, podcastID string, since time.Time) ([]models.PodcastEpisode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.episodeModels(podcastID, since), nil
+}
+
+// FetchState implements FetchStateStore
+func (m *Memory) FetchState(ctx context.Context, feedURL string) (FetchState, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	podcast := m.podcastByURL(feedURL)
+	if podcast == nil {
+		return FetchState{}, false, nil
+	}
+	state := FetchState{Digest: podcast.Digest, LastChange: podcast.LastChange}
+	if podcast.headers != nil {
+		state.Headers = *podcast.headers
+	}
+	return state, true, nil
+}
+
+// SetFetched implements FetchStateStore
+func (m *Memory) SetFetched(ctx context.Context, feedURL string, at time.Time) error {
+	m.update(feedURL, func(podcast *memoryPodcast) {
+		podcast.LastFetch = at
+	})
+	return nil
+}
+
+// SetDigest implements FetchStateStore
+func (m *Memory) SetDigest(ctx context.Context, feedURL, digest string) error {
+	m.update(feedURL, func(podcast *memoryPodcast) {
+		podcast.Digest = digest
+	})
+	return nil
+}
+
+// SetHeaders implements FetchStateStore
+func (m *Memory) SetHeaders(ctx context.Context, feedURL string, headers Headers) error {
+	m.update(feedURL, func(podcast *memoryPodcast) {
+		podcast.headers = &headers
+	})
+	return nil
+}
+
+// SetFailure implements FetchStateStore
+func (m *Memory) SetFailure(ctx context.Context, feedURL, class, message string) error {
+	m.update(feedURL, func(podcast *memoryPodcast) {
+		podcast.failure = class
+		podcast.failureMessage = message
+	})
+	return nil
+}
+
+// ClearFailure implements FetchStateStore
+func (m *Memory) ClearFailure(ctx context.Context, feedURL string) error {
+	m.update(feedURL, func(podcast *memoryPodcast) {
+		podcast.failure = ""
+		podcast.failureMessage = ""
+	})
+	return nil
+}
+
+// update calls fn on every podcast at feedURL
+func (m *Memory) update(feedURL string, fn func(podcast *memoryPodcast)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, podcast := range m.podcasts {
+		if podcast.FeedURL == feedURL {
+			fn(podcast)
+		}
+	}
+}
+
+// podcastByURL returns the podcast at feedURL, or nil, m.mu must be held
+func (m *Memory) podcastByURL(feedURL string) *memoryPodcast {
+	for _, podcast := range m.podcasts {
+		if podcast.FeedURL == feedURL {
+			return podcast
+		}
+	}
+	return nil
+}
+
+// podcastIDForURL returns the podcast at feedURL, or that used to be at it, m.mu must be held
+func (m *Memory) podcastIDForURL(feedURL string) string {
+	if podcast := m.podcastByURL(feedURL); podcast != nil {
+		return podcast.ID
+	}
+	return m.aliases[feedURL]
+}
+
+// episodeByGUID returns the episode with guid, or nil, m.mu must be held
+func (m *Memory) episodeByGUID(guid string) *Episode {
+	for _, episode := range m.episodes {
+		if episode.GUID == guid {
+			return episode
+		}
+	}
+	return nil
+}
+
+// sortedEpisodes returns the episodes matching keep, latest first with unpublished ones before them like Postgres sorts NULLs
+func (m *Memory) sortedEpisodes(keep func(e *Episode) bool) []*Episode {
+	episodes := make([]*Episode, 0)
+	for _, episode := range m.episodes {
+		if keep(episode) {
+			episodes = append(episodes, episode)
+		}
+	}
+	sort.Slice(episodes, func(i, j int) bool {
+		a, b := episodes[i].PublishedParsed, episodes[j].PublishedParsed
+		if a == nil || b == nil {
+			return a == nil && b != nil
+		}
+		return a.After(*b)
+	})
+	return episodes
+}
+
+// episodeModels returns the 20 latest episodes of the podcast with podcastID published after since, m.mu must be held
+func (m *Memory) episodeModels(podcastID string, since time.Time) []models.PodcastEpisode {
+	var shown []models.PodcastEpisode
+	podcast, ok := m.podcasts[podcastID]
+	if !ok {
+		return shown
+	}
+	episodes := m.sortedEpisodes(func(e *Episode) bool {
+		return e.PodcastID == podcastID && e.PublishedParsed != nil && e.PublishedParsed.After(since)
+	})
+	for i := 0; i < len(episodes) && i < 20; i++ {
+		episode := episodeModel(episodes[i], podcast)
+		episode.FormatPublished()
+		episode.SetLength()
+		shown = append(shown, episode)
+	}
+	return shown
+}
+
+// recordChanges appends to the change log, m.mu must be held
+func (m *Memory) recordChanges(podcastID, episodeGUID string, changes []FieldChange) {
+	for _, change := range changes {
+		m.changes = append(m.changes, memoryChange{podcastID: podcastID, episodeGUID: episodeGUID, FieldChange: change})
+	}
+}
+
+// podcastModel is podcast as the API shows it, without its episodes or directories
+func podcastModel(podcast *memoryPodcast) models.Podcast {
+	shown := models.Podcast{
+		ID:              podcast.ID,
+		Title:           podcast.Title,
+		Description:     podcast.Description,
+		TitleText:       podcast.TitleText,
+		DescriptionHTML: podcast.DescriptionHTML,
+		Summary:         podcast.Summary,
+		Image:           jsonValue(podcast.Image),
+	}
+	var categories []string
+	if json.Unmarshal(podcast.Categories, &categories) == nil && len(categories) > 0 {
+		shown.Category = sql.NullString{String: categories[0], Valid: true}
+	}
+	return shown
+}
+
+// episodeModel is episode as the API shows it, the podcast's image is used if the episode doesn't have one
+func episodeModel(episode *Episode, podcast *memoryPodcast) models.PodcastEpisode {
+	shown := models.PodcastEpisode{
+		ID:              episode.ID,
+		Title:           episode.Title,
+		Description:     episode.Description,
+		TitleText:       episode.TitleText,
+		DescriptionHTML: episode.DescriptionHTML,
+		Summary:         episode.Summary,
+		Image:           jsonValue(episode.Image),
+		Published:       episode.Published,
+		Enclosures:      jsonValue(episode.Enclosures),
+		ItunesExt:       jsonValue(episode.ItunesExt),
+	}
+	if bytes.Equal(shown.Image, []byte("null")) {
+		shown.Image = jsonValue(podcast.Image)
+	}
+	if episode.PublishedParsed != nil {
+		shown.PublishedParsed = episode.PublishedParsed.UTC().Format(time.RFC3339Nano)
+	}
+	return shown
+}
+
+// mergeJSON does what jsonb's || does, keys in b win when both are objects, otherwise b replaces a
+func mergeJSON(a, b json.RawMessage) json.RawMessage {
+	var objA, objB map[string]json.RawMessage
+	if json.Unmarshal(a, &objA) != nil || json.Unmarshal(b, &objB) != nil || objA == nil || objB == nil {
+		return b
+	}
+	for k, v := range objB {
+		objA[k] = v
+	}
+	merged, _ := json.Marshal(objA)
+	return merged
+}
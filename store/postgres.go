@@ -0,0 +1,352 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/models"
+	"github.com/lib/pq"
+)
+
+// Postgres keeps everything in the database, it's every store
+type Postgres struct {
+	db *sql.DB
+}
+
+// NewPostgres returns stores using db, usually database.DB()
+func NewPostgres(db *sql.DB) *Postgres {
+	return &Postgres{db: db}
+}
+
+// Stores returns p as each store
+func (p *Postgres) Stores() Stores {
+	return Stores{Podcasts: p, Episodes: p, FetchState: p}
+}
+
+// FindPodcast implements PodcastStore
+func (p *Postgres) FindPodcast(ctx context.Context, feedURL string) (string, string, bool, error) {
+	var id string
+	var digest sql.NullString
+	err := p.db.QueryRowContext(ctx, "SELECT id, digest FROM podcasts WHERE feed_url = $1;", feedURL).Scan(&id, &digest)
+	switch {
+	case err == sql.ErrNoRows:
+		return "", "", false, nil
+	case err != nil:
+		return "", "", false, err
+	}
+	return id, digest.String, true, nil
+}
+
+// CreatePodcast implements PodcastStore
+func (p *Postgres) CreatePodcast(ctx context.Context, podcast Podcast) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	query := `
+	INSERT INTO podcasts (id, last_fetch, title, description, link, updated, updated_parsed, author, language, image, itunes_ext, categories, copyright, poll_frequency, last_change, digest, feed_url, date_added, title_text, description_html, description_text, summary) VALUES
+	($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, now(), $18, $19, $20, $21);
+	`
+	_, err = tx.ExecContext(ctx, query, podcast.ID, podcast.LastFetch, podcast.Title, podcast.Description, podcast.Link, podcast.Updated, podcast.UpdatedParsed, jsonValue(podcast.Author), podcast.Language, jsonValue(podcast.Image), jsonValue(podcast.ItunesExt), jsonValue(podcast.Categories), podcast.Copyright, podcast.PollFrequency, podcast.LastChange, podcast.Digest, podcast.FeedURL, podcast.TitleText, podcast.DescriptionHTML, podcast.DescriptionText, podcast.Summary)
+	if err != nil {
+		return duplicate(err)
+	}
+	return tx.Commit()
+}
+
+// UpdatePodcast implements PodcastStore
+func (p *Postgres) UpdatePodcast(ctx context.Context, podcast Podcast, changes []FieldChange) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	query := `
+	UPDATE podcasts SET (last_fetch, title, description, link, updated, updated_parsed, author, language, image, itunes_ext, categories, copyright, poll_frequency, last_change, digest, title_text, description_html, description_text, summary) =
+	($2, $3, $4, $5, $6, $7, $8, $9, image || $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20) where feed_url = $1;
+	`
+	_, err = tx.ExecContext(ctx, query, podcast.FeedURL, podcast.LastFetch, podcast.Title, podcast.Description, podcast.Link, podcast.Updated, podcast.UpdatedParsed, jsonValue(podcast.Author), podcast.Language, jsonValue(podcast.Image), jsonValue(podcast.ItunesExt), jsonValue(podcast.Categories), podcast.Copyright, podcast.PollFrequency, podcast.LastChange, podcast.Digest, podcast.TitleText, podcast.DescriptionHTML, podcast.DescriptionText, podcast.Summary)
+	if err != nil {
+		return err
+	}
+	if err := recordChanges(ctx, tx, podcast.ID, "", changes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MovePodcast implements PodcastStore
+func (p *Postgres) MovePodcast(ctx context.Context, oldURL, newURL string) (string, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	var taken bool
+	if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM podcasts WHERE feed_url = $1)", newURL).Scan(&taken); err != nil {
+		return "", err
+	}
+	if taken {
+		return "", ErrDuplicate
+	}
+	var id string
+	err = tx.QueryRowContext(ctx, "UPDATE podcasts SET feed_url = $1 WHERE feed_url = $2 RETURNING id", newURL, oldURL).Scan(&id)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := recordChanges(ctx, tx, id, "", []FieldChange{{Field: "feed_url", Before: oldURL, After: newURL}}); err != nil {
+		return "", err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO podcast_feed_aliases (feed_url, podcast_id, added_at) VALUES ($1, $2, now()) ON CONFLICT (feed_url) DO UPDATE SET podcast_id = EXCLUDED.podcast_id", oldURL, id)
+	if err != nil {
+		return "", err
+	}
+	// The podcast is now in the catalog at newURL because of the move
+	_, err = tx.ExecContext(ctx, `INSERT INTO podcast_sources (source, feed_url, source_id, podcast_id, first_seen, last_seen) VALUES ($1, $2, $3, $4, now(), now())
+		ON CONFLICT (source, feed_url) DO UPDATE SET source_id = EXCLUDED.source_id, podcast_id = EXCLUDED.podcast_id, last_seen = EXCLUDED.last_seen`,
+		sourceRedirect, newURL, oldURL, id)
+	if err != nil {
+		return "", err
+	}
+	return id, tx.Commit()
+}
+
+// PodcastFields implements PodcastStore
+func (p *Postgres) PodcastFields(ctx context.Context, id string) (map[string]string, error) {
+	var title, description, link, updated, language, copyright, author, image, itunesExt, categories string
+	err := p.db.QueryRowContext(ctx, "SELECT COALESCE(title, ''), COALESCE(description, ''), COALESCE(link, ''), COALESCE(updated, ''), COALESCE(language, ''), COALESCE(copyright, ''), COALESCE(author::text, 'null'), COALESCE(image::text, 'null'), COALESCE(itunes_ext::text, 'null'), COALESCE(categories::text, 'null') FROM podcasts WHERE id = $1", id).
+		Scan(&title, &description, &link, &updated, &language, &copyright, &author, &image, &itunesExt, &categories)
+	if err == sql.ErrNoRows {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"title":       title,
+		"description": description,
+		"link":        link,
+		"updated":     updated,
+		"language":    language,
+		"copyright":   copyright,
+		"author":      author,
+		"image":       image,
+		"itunes_ext":  itunesExt,
+		"categories":  categories,
+	}, nil
+}
+
+// DirectoryMetadata implements PodcastStore
+// The podcast may have moved since the directory listed it, so it's matched on the podcast as well as the URL
+func (p *Postgres) DirectoryMetadata(ctx context.Context, feedURL string) ([]DirectoryMetadata, error) {
+	metadata := make([]DirectoryMetadata, 0)
+	rows, err := p.db.QueryContext(ctx, `SELECT directory, feed_url, COALESCE(network, ''), COALESCE(genres, '[]'), COALESCE(frequency, ''), COALESCE(language, '') FROM podcast_directory_metadata
+		WHERE feed_url = $1 OR podcast_id = (SELECT id FROM podcasts WHERE feed_url = $1 LIMIT 1) ORDER BY directory`, feedURL)
+	if err != nil {
+		return metadata, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m DirectoryMetadata
+		var genres []byte
+		if err := rows.Scan(&m.Directory, &m.FeedURL, &m.Network, &genres, &m.Frequency, &m.Language); err != nil {
+			return metadata, err
+		}
+		json.Unmarshal(genres, &m.Genres)
+		metadata = append(metadata, m)
+	}
+	return metadata, rows.Err()
+}
+
+// Podcast implements PodcastStore
+func (p *Postgres) Podcast(ctx context.Context, id string) (models.Podcast, error) {
+	return models.GetPodcast(ctx, p.db, id)
+}
+
+// NewPodcasts implements PodcastStore
+func (p *Postgres) NewPodcasts(ctx context.Context) ([]models.Podcast, error) {
+	return models.GetNewPodcasts(ctx, p.db)
+}
+
+// UpdatedPodcasts implements PodcastStore
+func (p *Postgres) UpdatedPodcasts(ctx context.Context) ([]models.Podcast, error) {
+	return models.GetUpdatedPodcasts(ctx, p.db)
+}
+
+// EpisodeDigests implements EpisodeStore
+func (p *Postgres) EpisodeDigests(ctx context.Context, podcastID string) ([]string, error) {
+	digests := make([]string, 0)
+	rows, err := p.db.QueryContext(ctx, "SELECT digest FROM podcast_episodes WHERE parent = $1;", podcastID)
+	if err != nil {
+		return digests, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var digest string
+		if err := rows.Scan(&digest); err != nil {
+			return digests, err
+		}
+		digests = append(digests, digest)
+	}
+	return digests, rows.Err()
+}
+
+// EpisodeExists implements EpisodeStore
+func (p *Postgres) EpisodeExists(ctx context.Context, guid string) (bool, error) {
+	var found int
+	err := p.db.QueryRowContext(ctx, "SELECT 1 FROM podcast_episodes WHERE guid = $1;", guid).Scan(&found)
+	switch {
+	case err == sql.ErrNoRows:
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return true, nil
+}
+
+// AddEpisode implements EpisodeStore
+func (p *Postgres) AddEpisode(ctx context.Context, e Episode) error {
+	_, err := p.db.ExecContext(ctx, "INSERT INTO podcast_episodes (id, guid, title, description, published, published_parsed, author, image, enclosures, digest, itunes_ext, last_fetch, parent, title_text, description_html, description_text, summary) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17);",
+		e.ID, e.GUID, e.Title, e.Description, e.Published, e.PublishedParsed, jsonValue(e.Author), jsonValue(e.Image), jsonValue(e.Enclosures), e.Digest, jsonValue(e.ItunesExt), e.LastFetch, e.PodcastID, e.TitleText, e.DescriptionHTML, e.DescriptionText, e.Summary)
+	return duplicate(err)
+}
+
+// UpdateEpisode implements EpisodeStore
+func (p *Postgres) UpdateEpisode(ctx context.Context, e Episode, changes []FieldChange) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, "UPDATE podcast_episodes SET (guid, title, description, published, published_parsed, author, image, enclosures, digest, itunes_ext, last_fetch, parent, title_text, description_html, description_text, summary) = ($1, $2, $3, $4, $5, $6, image || $7, $8, $9, $10, $11, $12, $13, $14, $15, $16) WHERE guid = $1;",
+		e.GUID, e.Title, e.Description, e.Published, e.PublishedParsed, jsonValue(e.Author), jsonValue(e.Image), jsonValue(e.Enclosures), e.Digest, jsonValue(e.ItunesExt), e.LastFetch, e.PodcastID, e.TitleText, e.DescriptionHTML, e.DescriptionText, e.Summary)
+	if err != nil {
+		return err
+	}
+	if err := recordChanges(ctx, tx, e.PodcastID, e.GUID, changes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// EpisodeFields implements EpisodeStore
+func (p *Postgres) EpisodeFields(ctx context.Context, guid string) (map[string]string, error) {
+	var title, description, published, author, image, enclosures, itunesExt string
+	err := p.db.QueryRowContext(ctx, "SELECT COALESCE(title, ''), COALESCE(description, ''), COALESCE(published, ''), COALESCE(author::text, 'null'), COALESCE(image::text, 'null'), COALESCE(enclosures::text, 'null'), COALESCE(itunes_ext::text, 'null') FROM podcast_episodes WHERE guid = $1", guid).
+		Scan(&title, &description, &published, &author, &image, &enclosures, &itunesExt)
+	if err == sql.ErrNoRows {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"title":       title,
+		"description": description,
+		"published":   published,
+		"author":      author,
+		"image":       image,
+		"enclosures":  enclosures,
+		"itunes_ext":  itunesExt,
+	}, nil
+}
+
+// Episode implements EpisodeStore
+func (p *Postgres) Episode(ctx context.Context, id string) (models.PodcastEpisode, error) {
+	return models.GetPodcastEpisode(ctx, p.db, id)
+}
+
+// Episodes implements EpisodeStore
+func (p *Postgres) Episodes(ctx context.Context, podcastID string, since time.Time) ([]models.PodcastEpisode, error) {
+	return models.GetPodcastEpisodes(ctx, p.db, podcastID, since)
+}
+
+// FetchState implements FetchStateStore
+func (p *Postgres) FetchState(ctx context.Context, feedURL string) (FetchState, bool, error) {
+	var state FetchState
+	var digest, lastChange, headers sql.NullString
+	err := p.db.QueryRowContext(ctx, "SELECT digest, last_change, response_headers FROM podcasts WHERE feed_url = $1;", feedURL).Scan(&digest, &lastChange, &headers)
+	switch {
+	case err == sql.ErrNoRows:
+		return state, false, nil
+	case err != nil:
+		return state, false, err
+	}
+	state.Digest = digest.String
+	state.LastChange = lastChange.String
+	if headers.Valid {
+		if err := json.Unmarshal([]byte(headers.String), &state.Headers); err != nil {
+			return state, true, err
+		}
+	}
+	return state, true, nil
+}
+
+// SetFetched implements FetchStateStore
+func (p *Postgres) SetFetched(ctx context.Context, feedURL string, at time.Time) error {
+	_, err := p.db.ExecContext(ctx, `UPDATE podcasts SET last_fetch = $1 where feed_url = $2`, at, feedURL)
+	return err
+}
+
+// SetDigest implements FetchStateStore
+func (p *Postgres) SetDigest(ctx context.Context, feedURL, digest string) error {
+	_, err := p.db.ExecContext(ctx, "UPDATE podcasts SET digest = $1 WHERE feed_url = $2", digest, feedURL)
+	return err
+}
+
+// SetHeaders implements FetchStateStore
+func (p *Postgres) SetHeaders(ctx context.Context, feedURL string, headers Headers) error {
+	headersJSON, err := json.Marshal(headers)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.ExecContext(ctx, "UPDATE podcasts SET response_headers = $1 WHERE feed_url = $2", headersJSON, feedURL)
+	return err
+}
+
+// SetFailure implements FetchStateStore
+func (p *Postgres) SetFailure(ctx context.Context, feedURL, class, message string) error {
+	_, err := p.db.ExecContext(ctx, "UPDATE podcasts SET (last_failure, last_failure_message, last_failure_at) = ($2, $3, now()) WHERE feed_url = $1", feedURL, class, message)
+	return err
+}
+
+// ClearFailure implements FetchStateStore
+func (p *Postgres) ClearFailure(ctx context.Context, feedURL string) error {
+	_, err := p.db.ExecContext(ctx, "UPDATE podcasts SET (last_failure, last_failure_message, last_failure_at) = (NULL, NULL, NULL) WHERE feed_url = $1 AND last_failure IS NOT NULL", feedURL)
+	return err
+}
+
+// recordChanges appends field level changes to the change log, inside the transaction making the change
+// episodeGUID is empty for changes to the podcast itself
+func recordChanges(ctx context.Context, tx *sql.Tx, podcastID, episodeGUID string, changes []FieldChange) error {
+	for _, change := range changes {
+		_, err := tx.ExecContext(ctx, "INSERT INTO podcast_changes (podcast_id, episode_id, episode_guid, field, before, after, changed_at) VALUES ($1, (SELECT id FROM podcast_episodes WHERE guid = NULLIF($2, '')), NULLIF($2, ''), $3, $4, $5, now())",
+			podcastID, episodeGUID, change.Field, change.Before, change.After)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jsonValue is a JSON field as it's written to a jsonb column, nil is written as null like json.Marshal(nil)
+func jsonValue(raw json.RawMessage) []byte {
+	if len(raw) == 0 {
+		return []byte("null")
+	}
+	return raw
+}
+
+// duplicate turns a unique constraint violation into ErrDuplicate
+func duplicate(err error) error {
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		return ErrDuplicate
+	}
+	return err
+}
@@ -0,0 +1,177 @@
+// Package store is where podcasts, their episodes and how their feeds were last fetched are kept
+// The ingester and the API are given Stores rather than talking to the database themselves,
+// NewPostgres keeps them in the database and NewMemory keeps them in memory, e.g to run the ingester without a database
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/models"
+)
+
+// ErrDuplicate is returned when a podcast or episode being created has an ID, GUID or digest that's already taken
+var ErrDuplicate = errors.New("store: already exists")
+
+// ErrNotFound is returned when the podcast being changed isn't there
+var ErrNotFound = errors.New("store: not found")
+
+// Stores are the stores the ingester and API use, usually all backed by the same database
+type Stores struct {
+	Podcasts   PodcastStore
+	Episodes   EpisodeStore
+	FetchState FetchStateStore
+}
+
+// PodcastStore keeps podcasts, keyed by ID and by the feed URL they're at now
+type PodcastStore interface {
+	// FindPodcast returns the ID and digest of the podcast at feedURL, found is false if there isn't one
+	FindPodcast(ctx context.Context, feedURL string) (id, digest string, found bool, err error)
+	// CreatePodcast adds p, returning ErrDuplicate if its ID is taken
+	CreatePodcast(ctx context.Context, p Podcast) error
+	// UpdatePodcast overwrites the podcast at p.FeedURL with p and records changes in its change log
+	// Image is merged into what's there rather than replacing it, image processing adds its own keys
+	UpdatePodcast(ctx context.Context, p Podcast, changes []FieldChange) error
+	// MovePodcast changes the feed URL of the podcast at oldURL, returning its ID
+	// It returns ErrNotFound if there's no podcast at oldURL and ErrDuplicate if there's already one at newURL
+	// The move is recorded in the change log, oldURL is kept as an alias and newURL is sourced from the redirect
+	MovePodcast(ctx context.Context, oldURL, newURL string) (id string, err error)
+	// PodcastFields returns the podcast's fields as text, JSON fields as JSON, for diffing against a feed
+	// A podcast that isn't there has no fields
+	PodcastFields(ctx context.Context, id string) (map[string]string, error)
+	// DirectoryMetadata returns what directories say about the podcast at feedURL, or that was listed at it
+	DirectoryMetadata(ctx context.Context, feedURL string) ([]DirectoryMetadata, error)
+
+	// Podcast returns the podcast with id and its latest episodes, as the API shows it
+	Podcast(ctx context.Context, id string) (models.Podcast, error)
+	// NewPodcasts returns the 20 podcasts added most recently
+	NewPodcasts(ctx context.Context) ([]models.Podcast, error)
+	// UpdatedPodcasts returns the podcasts of the 20 episodes published most recently
+	UpdatedPodcasts(ctx context.Context) ([]models.Podcast, error)
+}
+
+// EpisodeStore keeps podcast episodes, keyed by ID and by the GUID their feed gives them
+type EpisodeStore interface {
+	// EpisodeDigests returns the digest of every episode of the podcast with podcastID
+	EpisodeDigests(ctx context.Context, podcastID string) ([]string, error)
+	// EpisodeExists reports whether there's an episode with guid
+	EpisodeExists(ctx context.Context, guid string) (bool, error)
+	// AddEpisode adds e, returning ErrDuplicate if its ID, GUID or digest is taken
+	AddEpisode(ctx context.Context, e Episode) error
+	// UpdateEpisode overwrites the episode with e.GUID and records changes in its podcast's change log, merging image like UpdatePodcast
+	UpdateEpisode(ctx context.Context, e Episode, changes []FieldChange) error
+	// EpisodeFields returns the episode's fields as text, like PodcastFields
+	EpisodeFields(ctx context.Context, guid string) (map[string]string, error)
+
+	// Episode returns the episode with id as the API shows it, with its podcast's title and image if it has none
+	Episode(ctx context.Context, id string) (models.PodcastEpisode, error)
+	// Episodes returns the 20 latest episodes of the podcast with podcastID published after since
+	Episodes(ctx context.Context, podcastID string, since time.Time) ([]models.PodcastEpisode, error)
+}
+
+// FetchStateStore keeps how each feed was last fetched, keyed by feed URL
+// Feeds we don't have a podcast for have no fetch state and writes to them do nothing
+type FetchStateStore interface {
+	// FetchState returns the state of the feed at feedURL, found is false if we don't have it
+	FetchState(ctx context.Context, feedURL string) (state FetchState, found bool, err error)
+	// SetFetched records the feed was fetched at, even if it hadn't changed
+	SetFetched(ctx context.Context, feedURL string, at time.Time) error
+	// SetDigest records the digest of the feed once everything in it has been written
+	SetDigest(ctx context.Context, feedURL, digest string) error
+	// SetHeaders keeps the caching headers of the last response, to be sent with the next request
+	SetHeaders(ctx context.Context, feedURL string, headers Headers) error
+	// SetFailure records why the feed couldn't be injested, class is one of injest's Failure constants
+	SetFailure(ctx context.Context, feedURL, class, message string) error
+	// ClearFailure forgets the last failure once the feed is injested
+	ClearFailure(ctx context.Context, feedURL string) error
+}
+
+// Podcast is a podcast as the ingester writes it, JSON fields are the feed's values encoded as JSON
+type Podcast struct {
+	ID            string
+	FeedURL       string
+	Title         string
+	Description   string
+	Link          string
+	Updated       string
+	UpdatedParsed *time.Time
+	Author        json.RawMessage
+	Language      string
+	Image         json.RawMessage
+	ItunesExt     json.RawMessage
+	Categories    json.RawMessage
+	Copyright     string
+	// PollFrequency is the hours between polls
+	PollFrequency int8
+	LastFetch     time.Time
+	// LastChange is when Digest last changed, RFC3339
+	LastChange string
+	Digest     string
+	// The sanitised versions of Title and Description
+	TitleText       string
+	DescriptionHTML string
+	DescriptionText string
+	Summary         string
+}
+
+// Episode is an episode as the ingester writes it, JSON fields are the feed's values encoded as JSON
+type Episode struct {
+	ID              string
+	GUID            string
+	PodcastID       string
+	Title           string
+	Description     string
+	Published       string
+	PublishedParsed *time.Time
+	Author          json.RawMessage
+	Image           json.RawMessage
+	Enclosures      json.RawMessage
+	ItunesExt       json.RawMessage
+	Digest          string
+	LastFetch       time.Time
+	// The sanitised versions of Title and Description
+	TitleText       string
+	DescriptionHTML string
+	DescriptionText string
+	Summary         string
+}
+
+// FieldChange is a single field whose value changed
+type FieldChange struct {
+	Field  string `json:"field"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// FetchState is what we remember about the last fetch of a feed
+// Digest and LastChange are empty if the podcast has never been written by the ingester
+type FetchState struct {
+	Digest     string
+	LastChange string
+	Headers    Headers
+}
+
+// Headers are the caching headers from a feed's last response
+type Headers struct {
+	Etag         string `json:"etag"`
+	LastModified string `json:"last-modified"`
+	CacheControl string `json:"cache-control"`
+}
+
+// DirectoryMetadata is what a directory (e.g the BBC or Podcast Index) says about a podcast it lists
+type DirectoryMetadata struct {
+	Directory   string
+	FeedURL     string
+	Network     string
+	Genres      []string
+	Frequency   string
+	BrandIDs    []string
+	HomepageURL string
+	LaunchDate  string
+	Language    string
+}
+
+// sourceRedirect is the source MovePodcast records the new URL under, it's injest.SourceRedirect
+const sourceRedirect = "redirect"
@@ -0,0 +1,145 @@
+// Package tracing sends OpenTelemetry spans for fetches, parses, database writes, jobs and API requests
+// tracing.exporter picks where they go: otlp sends them to a collector, file appends them to tracing.file as JSON
+// for offline analysis, and none, the default, turns tracing off
+package tracing
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http/httptrace"
+	"os"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/config"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Exporters tracing.exporter can be set to
+const (
+	ExporterNone = "none"
+	ExporterOTLP = "otlp"
+	ExporterFile = "file"
+)
+
+// tracer comes from the global provider, spans are only sent once Start has set one up
+var tracer = otel.Tracer("bitbucket.org/jayflux/mypodcasts_injest")
+
+func init() {
+	viper.SetDefault("tracing.exporter", ExporterNone)
+	// host:port of an OTLP/HTTP collector
+	viper.SetDefault("tracing.endpoint", "localhost:4318")
+	viper.SetDefault("tracing.insecure", true)
+	viper.SetDefault("tracing.file", "./traces.json")
+	// Fraction of traces kept, a trace started by a sampled parent, e.g. an API request, is always kept
+	viper.SetDefault("tracing.sampleRate", 0.1)
+	viper.SetDefault("tracing.serviceName", "mypodcasts_injest")
+}
+
+// Start sets up the exporter from config, the function it returns flushes spans that haven't been sent and stops it
+func Start(ctx context.Context) (func(context.Context) error, error) {
+	config.Load()
+	var exporter sdktrace.SpanExporter
+	var closeFile func() error
+	switch viper.GetString("tracing.exporter") {
+	case ExporterNone, "":
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(viper.GetString("tracing.endpoint"))}
+		if viper.GetBool("tracing.insecure") {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		otlp, err := otlptracehttp.New(ctx, options...)
+		if err != nil {
+			return nil, err
+		}
+		exporter = otlp
+	case ExporterFile:
+		f, err := os.OpenFile(viper.GetString("tracing.file"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		file, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		exporter, closeFile = file, f.Close
+	default:
+		return nil, fmt.Errorf("tracing: unknown exporter %q, it can be none, otlp or file", viper.GetString("tracing.exporter"))
+	}
+
+	host, _ := os.Hostname()
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(viper.GetFloat64("tracing.sampleRate")))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", viper.GetString("tracing.serviceName")),
+			attribute.String("host.name", host),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closeFile != nil {
+			closeFile()
+		}
+		return err
+	}, nil
+}
+
+// Span starts a span called name, as a child of the span in ctx if there is one
+func Span(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends span, marking it as failed if err isn't nil
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// WithHTTPEvents records DNS, connecting, TLS and the first byte as events on the span in ctx,
+// for requests made with the context it returns, so a slow fetch shows which part was slow
+func WithHTTPEvents(ctx context.Context) context.Context {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return ctx
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			span.AddEvent("dns start", trace.WithAttributes(attribute.String("host", info.Host)))
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			span.AddEvent("dns done")
+		},
+		ConnectStart: func(network, addr string) {
+			span.AddEvent("connect start", trace.WithAttributes(attribute.String("addr", addr)))
+		},
+		ConnectDone: func(network, addr string, err error) {
+			span.AddEvent("connect done")
+		},
+		TLSHandshakeStart: func() {
+			span.AddEvent("tls start")
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			span.AddEvent("tls done")
+		},
+		GotFirstResponseByte: func() {
+			span.AddEvent("first byte")
+		},
+	})
+}
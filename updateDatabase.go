@@ -7,12 +7,15 @@ import (
 	"os/exec"
 	"time"
 
+	"bitbucket.org/jayflux/mypodcasts_injest/config"
 	"github.com/minio/minio-go"
 )
 
-var accessKey string = os.Getenv("SPACES_KEY")
-var secKey string = os.Getenv("SPACES_SECRET_KEY")
-var ssl bool = true
+// spacesClient connects to the object storage under "spaces" in config
+func spacesClient() (*minio.Client, error) {
+	spaces := config.Get().Spaces
+	return minio.New(spaces.Endpoint, spaces.Key, spaces.SecretKey, spaces.UseSSL)
+}
 
 func updateDatabase() {
 	log.Println("[Restore] - Starting restore")
@@ -21,10 +24,11 @@ func updateDatabase() {
 	var latestObject minio.ObjectInfo
 
 	// Initiate a client using DigitalOcean Spaces.
-	client, err := minio.New("ams3.digitaloceanspaces.com", accessKey, secKey, ssl)
+	client, err := spacesClient()
 	if err != nil {
 		log.Fatal(err)
 	}
+	bucket := config.Get().Spaces.Bucket
 
 	// https://docs.minio.io/docs/golang-client-api-reference#ListObjects
 	// Loop through objests and get latest one
@@ -36,7 +40,7 @@ func updateDatabase() {
 
 	isRecursive := true
 	// There isn't an easy way to get the latest object, so we need to loop through to find the latest one
-	objectCh := client.ListObjectsV2("fancast", "database-backups/", isRecursive, doneCh)
+	objectCh := client.ListObjectsV2(bucket, config.Get().Spaces.BackupPrefix, isRecursive, doneCh)
 	for object := range objectCh {
 		if object.Err != nil {
 			fmt.Println(object.Err)
@@ -50,7 +54,7 @@ func updateDatabase() {
 	}
 
 	log.Println("Downloading latest database backup...")
-	err = client.FGetObject("fancast", latestObject.Key, "./fancast.backup", minio.GetObjectOptions{})
+	err = client.FGetObject(bucket, latestObject.Key, "./fancast.backup", minio.GetObjectOptions{})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -67,10 +71,11 @@ func updateDatabase() {
 	cmd.Stderr = os.Stderr
 
 	cmd.Run()
-	log.Printf("%s", err)
+	log.Error(err)
 }
 
-func performBackup() {
+// performBackup dumps the database and uploads it to spaces, the error says which step failed
+func performBackup() error {
 	// We should add a time to the DB backup
 	// TODO Not local time
 	// https://stackoverflow.com/questions/20234104/how-to-format-current-time-using-a-yyyymmddhhmmss-format
@@ -84,26 +89,30 @@ func performBackup() {
 
 	// Perform DB Backup
 	cmd := exec.Command("sudo", "-u", "fancast", "pg_dump", "-f", fileName, "-Fc", "fancast")
-	cmd.Run()
+	if err := cmd.Run(); err != nil {
+		log.Error("[backup] pg_dump failed")
+		return err
+	}
+	// Delete the file once we're done with it, a failed upload is tried again from a fresh dump
+	defer os.Remove(fileName)
 
 	log.Println("[backup] Writing of " + fileName + "  complete")
 
 	// Initiate a client using DigitalOcean Spaces.
-	client, err := minio.New("ams3.digitaloceanspaces.com", accessKey, secKey, ssl)
+	client, err := spacesClient()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	bucket := config.Get().Spaces.Bucket
 
 	// https://docs.minio.io/docs/golang-client-api-reference#FPutObject
-	n, err := client.FPutObject("fancast", "database-backups/"+fileName, "./"+fileName, minio.PutObjectOptions{})
+	n, err := client.FPutObject(bucket, config.Get().Spaces.BackupPrefix+fileName, "./"+fileName, minio.PutObjectOptions{})
 	if err != nil {
-		fmt.Println(err)
-		return
+		log.Error("[backup] Upload of " + fileName + " failed")
+		return err
 	}
 
 	log.Println("[backup] Upload of " + fileName + " complete")
 	log.Println("Successfully uploaded bytes: ", n)
-	// Delete file once uploaded
-	os.Remove(fileName)
-
+	return nil
 }
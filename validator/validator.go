@@ -0,0 +1,251 @@
+// Package validator checks a feed for the problems that make a podcast look wrong in Fancast (and other directories)
+// Each finding has a stable code so help pages can link to an explanation of how to fix it
+package validator
+
+import (
+	"context"
+	"fmt"
+	"image"
+	// Register decoders so we can read artwork dimensions
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"regexp"
+	"strings"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/injest"
+	"github.com/mmcdole/gofeed"
+)
+
+// Severities, errors stop a podcast or episode being injested properly, warnings degrade it
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+	SeverityInfo    = "info"
+)
+
+// MinArtworkSize is the smallest artwork (width and height) Apple accepts, we use the same
+const MinArtworkSize = 1400
+
+// Check describes a single thing we look for, the code must never change once published
+type Check struct {
+	Code     string `json:"code"`
+	Name     string `json:"name"`
+	Severity string `json:"severity"`
+}
+
+// The checks we run, codes are linked to from help pages so don't reuse or renumber them
+var (
+	CheckParseError         = Check{"FV001", "parse-error", SeverityError}
+	CheckRepaired           = Check{"FV002", "malformed-xml", SeverityWarning}
+	CheckTruncated          = Check{"FV003", "feed-too-large", SeverityWarning}
+	CheckRedirect           = Check{"FV004", "redirect", SeverityInfo}
+	CheckNoCachingHeaders   = Check{"FV005", "missing-caching-headers", SeverityWarning}
+	CheckMissingLanguage    = Check{"FV006", "missing-language", SeverityWarning}
+	CheckMissingArtwork     = Check{"FV007", "missing-artwork", SeverityError}
+	CheckArtworkTooSmall    = Check{"FV008", "artwork-too-small", SeverityWarning}
+	CheckInvalidCategory    = Check{"FV009", "invalid-itunes-category", SeverityWarning}
+	CheckMissingGUID        = Check{"FV010", "missing-guid", SeverityWarning}
+	CheckDuplicateGUID      = Check{"FV011", "duplicate-guid", SeverityError}
+	CheckMissingEnclosure   = Check{"FV012", "missing-enclosure", SeverityError}
+	CheckNonHTTPSEnclosure  = Check{"FV013", "non-https-enclosure", SeverityWarning}
+	CheckBadDate            = Check{"FV014", "bad-date", SeverityWarning}
+	CheckUnparsableDuration = Check{"FV015", "unparseable-duration", SeverityWarning}
+	CheckArtworkUnreadable  = Check{"FV016", "artwork-unreadable", SeverityWarning}
+)
+
+// durationExpr matches the formats itunes:duration may be in, seconds, MM:SS or HH:MM:SS
+var durationExpr = regexp.MustCompile(`^(\d+|\d{1,2}:\d{1,2}|\d+:\d{1,2}:\d{1,2})$`)
+
+// Finding is a single problem found in a feed
+type Finding struct {
+	Check
+	Message string `json:"message"`
+	// GUID is set when the finding is about a particular episode
+	GUID string `json:"guid,omitempty"`
+}
+
+// Report is the result of validating a feed
+type Report struct {
+	URL       string            `json:"url"`
+	FinalURL  string            `json:"finalUrl"`
+	Redirects []injest.Redirect `json:"redirects"`
+	Episodes  int               `json:"episodes"`
+	Findings  []Finding         `json:"findings"`
+}
+
+// Validate fetches a feed through the normal injest path and checks it
+func Validate(ctx context.Context, url string) (*Report, error) {
+	result, err := injest.Fetch(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{URL: url, FinalURL: result.URL, Redirects: result.Redirects, Findings: []Finding{}}
+	checkFetch(report, result)
+	if result.Feed != nil {
+		report.Episodes = len(result.Feed.Items)
+		checkFeed(ctx, report, result.Feed)
+		checkItems(report, result.Feed.Items)
+	}
+
+	return report, nil
+}
+
+func (r *Report) add(check Check, guid string, format string, args ...interface{}) {
+	r.Findings = append(r.Findings, Finding{Check: check, GUID: guid, Message: fmt.Sprintf(format, args...)})
+}
+
+// Count returns how many findings there are of a severity
+func (r *Report) Count(severity string) int {
+	count := 0
+	for _, finding := range r.Findings {
+		if finding.Severity == severity {
+			count++
+		}
+	}
+	return count
+}
+
+// checkFetch looks at how the feed was served
+func checkFetch(r *Report, result *injest.FetchResult) {
+	for _, redirect := range result.Redirects {
+		r.add(CheckRedirect, "", "%s redirected (%d) to %s, update links to point at the new URL", redirect.From, redirect.StatusCode, redirect.To)
+	}
+
+	if result.ParseError != nil {
+		r.add(CheckParseError, "", "The feed could not be parsed: %s", result.ParseError)
+	}
+
+	if result.Truncated {
+		r.add(CheckTruncated, "", "The feed is over our size limit, only the newest episodes will be injested")
+	}
+
+	for _, repair := range result.Repairs {
+		if repair == injest.RepairTruncated || strings.HasPrefix(repair, injest.RepairLimitedItems) {
+			continue
+		}
+		r.add(CheckRepaired, "", "The feed only parsed after we repaired it (%s)", repair)
+	}
+
+	if result.Header.Get("ETag") == "" && result.Header.Get("Last-Modified") == "" {
+		r.add(CheckNoCachingHeaders, "", "The server sends neither ETag nor Last-Modified, so the whole feed is downloaded on every poll")
+	}
+}
+
+// checkFeed looks at the podcast level metadata
+func checkFeed(ctx context.Context, r *Report, feed *gofeed.Feed) {
+	if strings.TrimSpace(feed.Language) == "" {
+		r.add(CheckMissingLanguage, "", "The feed has no <language>")
+	}
+
+	artwork := ""
+	if feed.ITunesExt != nil && feed.ITunesExt.Image != "" {
+		artwork = feed.ITunesExt.Image
+	} else if feed.Image != nil {
+		artwork = feed.Image.URL
+	}
+	if artwork == "" {
+		r.add(CheckMissingArtwork, "", "The feed has no <itunes:image> or <image>")
+	} else {
+		checkArtwork(ctx, r, artwork)
+	}
+
+	if feed.ITunesExt != nil {
+		for _, category := range feed.ITunesExt.Categories {
+			if category == nil {
+				continue
+			}
+			subcategory := ""
+			if category.Subcategory != nil {
+				subcategory = category.Subcategory.Text
+			}
+			if !validCategory(category.Text, subcategory) {
+				name := category.Text
+				if subcategory != "" {
+					name += " > " + subcategory
+				}
+				r.add(CheckInvalidCategory, "", "%q is not an Apple Podcasts category", name)
+			}
+		}
+	}
+}
+
+// checkArtwork downloads the artwork header and checks its dimensions
+func checkArtwork(ctx context.Context, r *Report, url string) {
+	client := injest.HTTPClient(injest.FetchTimeout(), false)
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		r.add(CheckArtworkUnreadable, "", "Artwork %s could not be fetched: %s", url, err)
+		return
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		r.add(CheckArtworkUnreadable, "", "Artwork %s could not be fetched: %s", url, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		r.add(CheckArtworkUnreadable, "", "Artwork %s returned %s", url, resp.Status)
+		return
+	}
+
+	// DecodeConfig only needs the header, don't download more than we have to
+	config, _, err := image.DecodeConfig(io.LimitReader(resp.Body, 10*1024*1024))
+	if err != nil {
+		r.add(CheckArtworkUnreadable, "", "Artwork %s isn't a JPEG or PNG we can read", url)
+		return
+	}
+	if config.Width < MinArtworkSize || config.Height < MinArtworkSize {
+		r.add(CheckArtworkTooSmall, "", "Artwork is %dx%d, it should be at least %dx%d", config.Width, config.Height, MinArtworkSize, MinArtworkSize)
+	}
+}
+
+// checkItems looks at each episode
+func checkItems(r *Report, items []*gofeed.Item) {
+	seen := make(map[string]bool)
+	for _, item := range items {
+		guid := item.GUID
+		if guid == "" {
+			r.add(CheckMissingGUID, "", "%q has no <guid>, we can't tell if it changes or moves", item.Title)
+		} else if seen[guid] {
+			r.add(CheckDuplicateGUID, guid, "%q has the same <guid> as another episode", item.Title)
+		}
+		seen[guid] = true
+
+		if len(item.Enclosures) == 0 {
+			r.add(CheckMissingEnclosure, guid, "%q has no <enclosure>", item.Title)
+		}
+		for _, enclosure := range item.Enclosures {
+			u, err := neturl.Parse(enclosure.URL)
+			if err != nil || u.Scheme != "https" {
+				r.add(CheckNonHTTPSEnclosure, guid, "%q enclosure %s isn't served over HTTPS", item.Title, enclosure.URL)
+			}
+		}
+
+		if item.Published == "" {
+			r.add(CheckBadDate, guid, "%q has no <pubDate>", item.Title)
+		} else if item.PublishedParsed == nil {
+			r.add(CheckBadDate, guid, "%q has a <pubDate> we can't parse: %q", item.Title, item.Published)
+		}
+
+		if item.ITunesExt != nil && item.ITunesExt.Duration != "" && !durationExpr.MatchString(strings.TrimSpace(item.ITunesExt.Duration)) {
+			r.add(CheckUnparsableDuration, guid, "%q has an <itunes:duration> we can't parse: %q", item.Title, item.ITunesExt.Duration)
+		}
+	}
+}
+
+// Print writes a human readable version of the report
+func (r *Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "Feed: %s\n", r.URL)
+	if r.FinalURL != r.URL {
+		fmt.Fprintf(w, "Fetched from: %s\n", r.FinalURL)
+	}
+	fmt.Fprintf(w, "Episodes: %d\n", r.Episodes)
+	fmt.Fprintf(w, "%d errors, %d warnings, %d info\n\n", r.Count(SeverityError), r.Count(SeverityWarning), r.Count(SeverityInfo))
+	for _, finding := range r.Findings {
+		fmt.Fprintf(w, "[%s] %-7s %-24s %s\n", finding.Code, finding.Severity, finding.Name, finding.Message)
+	}
+}
@@ -0,0 +1,123 @@
+package validator
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"bitbucket.org/jayflux/mypodcasts_injest/injest"
+	"github.com/mmcdole/gofeed"
+	ext "github.com/mmcdole/gofeed/extensions"
+)
+
+// codes lists the codes of a report's findings in order
+func codes(r *Report) []string {
+	found := make([]string, len(r.Findings))
+	for i, finding := range r.Findings {
+		found[i] = finding.Code
+	}
+	return found
+}
+
+func TestValidCategory(t *testing.T) {
+	tests := []struct {
+		category, subcategory string
+		want                  bool
+	}{
+		{"Comedy", "", true},
+		{"Comedy", "Stand-Up", true},
+		{"News", "Daily News", true},
+		{"Comedy", "Daily News", false},
+		{"comedy", "", false},
+		{"Podcasts", "", false},
+	}
+	for _, test := range tests {
+		if got := validCategory(test.category, test.subcategory); got != test.want {
+			t.Errorf("validCategory(%q, %q) = %v, want %v", test.category, test.subcategory, got, test.want)
+		}
+	}
+}
+
+func TestCheckFetch(t *testing.T) {
+	r := &Report{}
+	checkFetch(r, &injest.FetchResult{
+		Redirects: []injest.Redirect{{From: "http://example.com/feed", To: "https://example.com/feed", StatusCode: 301}},
+		Header:    http.Header{},
+		Repairs:   []string{injest.RepairTruncated, injest.RepairLimitedItems + ":500", injest.RepairStrippedBOM},
+		Truncated: true,
+	})
+	// Truncating and limiting items are reported as FV003, not as repairs
+	want := []string{CheckRedirect.Code, CheckTruncated.Code, CheckRepaired.Code, CheckNoCachingHeaders.Code}
+	if got := codes(r); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	r = &Report{}
+	checkFetch(r, &injest.FetchResult{Header: http.Header{"Etag": {`"abc"`}}})
+	if len(r.Findings) != 0 {
+		t.Errorf("got %v for a clean fetch", r.Findings)
+	}
+}
+
+func TestCheckFeed(t *testing.T) {
+	r := &Report{}
+	checkFeed(context.Background(), r, &gofeed.Feed{ITunesExt: &ext.ITunesFeedExtension{Categories: []*ext.ITunesCategory{
+		{Text: "Comedy", Subcategory: &ext.ITunesCategory{Text: "Stand-Up"}},
+		{Text: "Comedy", Subcategory: &ext.ITunesCategory{Text: "Politics"}},
+		nil,
+	}}})
+	want := []string{CheckMissingLanguage.Code, CheckMissingArtwork.Code, CheckInvalidCategory.Code}
+	if got := codes(r); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if r.Findings[2].Message != `"Comedy > Politics" is not an Apple Podcasts category` {
+		t.Errorf("got message %q", r.Findings[2].Message)
+	}
+}
+
+func TestCheckItems(t *testing.T) {
+	published := time.Now()
+	good := func(guid string) *gofeed.Item {
+		return &gofeed.Item{GUID: guid, Title: guid, Published: published.Format(time.RFC1123Z), PublishedParsed: &published,
+			Enclosures: []*gofeed.Enclosure{{URL: "https://example.com/" + guid + ".mp3"}},
+			ITunesExt:  &ext.ITunesItemExtension{Duration: "1:02:03"}}
+	}
+	noGUID := good("")
+	duplicate := good("one")
+	noEnclosure := good("two")
+	noEnclosure.Enclosures = nil
+	insecure := good("three")
+	insecure.Enclosures[0].URL = "http://example.com/three.mp3"
+	badDate := good("four")
+	badDate.Published, badDate.PublishedParsed = "yesterday", nil
+	badDuration := good("five")
+	badDuration.ITunesExt.Duration = "1 hour"
+
+	r := &Report{}
+	checkItems(r, []*gofeed.Item{good("one"), noGUID, duplicate, noEnclosure, insecure, badDate, badDuration})
+	want := []string{CheckMissingGUID.Code, CheckDuplicateGUID.Code, CheckMissingEnclosure.Code, CheckNonHTTPSEnclosure.Code, CheckBadDate.Code, CheckUnparsableDuration.Code}
+	if got := codes(r); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if r.Findings[1].GUID != "one" {
+		t.Errorf("got GUID %q on the duplicate finding", r.Findings[1].GUID)
+	}
+	if r.Count(SeverityError) != 2 || r.Count(SeverityWarning) != 4 {
+		t.Errorf("got %d errors and %d warnings", r.Count(SeverityError), r.Count(SeverityWarning))
+	}
+}
+
+func TestDurationExpr(t *testing.T) {
+	for _, duration := range []string{"3600", "59:59", "1:02:03", "100:00:00"} {
+		if !durationExpr.MatchString(duration) {
+			t.Errorf("%q didn't match", duration)
+		}
+	}
+	for _, duration := range []string{"1 hour", "1:2:3:4", "12.5", ""} {
+		if durationExpr.MatchString(duration) {
+			t.Errorf("%q matched", duration)
+		}
+	}
+}